@@ -0,0 +1,343 @@
+// Package accounts deletes accounts after a grace period, moves them to a
+// new email and exports what the service keeps about a user.
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hyperpage/chatfiles"
+	"hyperpage/chatgroups"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/payouts"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// DefaultGraceDays is used when ACCOUNT_DELETION_GRACE_DAYS is not set.
+const DefaultGraceDays = 14
+
+// GhostEmail identifies the placeholder account that keeps the anonymized
+// chat messages of deleted users.
+const GhostEmail = "deleted-account@localhost"
+
+var (
+	ErrAlreadyRequested = errors.New("account deletion is already requested")
+	ErrInvalidCancel    = errors.New("cancel link is invalid or the account is already deleted")
+	ErrPayoutInProgress = errors.New("an approved withdrawal is not paid out yet")
+)
+
+// GracePeriod returns how long a deleted account can still be restored.
+func GracePeriod(config *initializers.Config) time.Duration {
+	days := config.AccountDeletionGraceDays
+	if days <= 0 {
+		days = DefaultGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Request schedules the deletion of an account and returns the request and
+// the token that cancels it.
+func Request(db *gorm.DB, config *initializers.Config, userID uuid.UUID, now time.Time) (*models.AccountDeletion, string, error) {
+	if _, pending, err := Pending(db, userID); err != nil {
+		return nil, "", err
+	} else if pending {
+		return nil, "", ErrAlreadyRequested
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(b)
+
+	deletion := &models.AccountDeletion{
+		UserID:       userID,
+		RequestedAt:  now,
+		ScheduledFor: now.Add(GracePeriod(config)),
+		CancelHash:   hashToken(token),
+	}
+	if err := db.Create(deletion).Error; err != nil {
+		return nil, "", err
+	}
+	return deletion, token, nil
+}
+
+// Pending returns the deletion request of a user, if there is one.
+func Pending(db *gorm.DB, userID uuid.UUID) (*models.AccountDeletion, bool, error) {
+	var deletion models.AccountDeletion
+	err := db.First(&deletion, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &deletion, true, nil
+}
+
+// Cancel drops the deletion request of a cancel token and returns its user.
+func Cancel(db *gorm.DB, token string) (uuid.UUID, error) {
+	if token == "" {
+		return uuid.Nil, ErrInvalidCancel
+	}
+	var deletion models.AccountDeletion
+	err := db.First(&deletion, "cancel_hash = ?", hashToken(token)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return uuid.Nil, ErrInvalidCancel
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if err := db.Delete(&deletion).Error; err != nil {
+		return uuid.Nil, err
+	}
+	return deletion.UserID, nil
+}
+
+// PurgeDue deletes every account whose grace period is over. It is safe to
+// run often; a failed account is logged and tried again on the next run.
+func PurgeDue(db *gorm.DB, config *initializers.Config, now time.Time) {
+	var due []models.AccountDeletion
+	if err := db.Where("scheduled_for <= ?", now).Find(&due).Error; err != nil {
+		log.Println("Failed to load due account deletions:", err)
+		return
+	}
+
+	for _, deletion := range due {
+		if err := Purge(db, config, deletion.UserID, now); err != nil {
+			log.Printf("Failed to delete account %s: %v", deletion.UserID, err)
+			continue
+		}
+		log.Printf("Account %s deleted", deletion.UserID)
+	}
+}
+
+// Ghost returns the placeholder account that anonymized chat messages are
+// moved to, creating it on first use. It cannot sign in.
+func Ghost(db *gorm.DB) (*models.User, error) {
+	var ghost models.User
+	err := db.First(&ghost, "email = ?", GhostEmail).Error
+	if err == nil {
+		return &ghost, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// Nobody knows this password, and the account is banned and unverified
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	password, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(b)), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	ghost = models.User{
+		Name:     "Deleted account",
+		Email:    GhostEmail,
+		Password: string(password),
+		Provider: "system",
+		Banned:   true,
+	}
+	if err := db.Create(&ghost).Error; err != nil {
+		return nil, err
+	}
+	return &ghost, nil
+}
+
+// userTables hold rows that belong to the user and go with the account.
+var userTables = []string{
+	"billings",
+	"online_storages",
+	"transactions",
+	"promotion_bids",
+	"user_relation",
+	"votes",
+	"favorites",
+	"codes",
+	"code_redemptions",
+	"statement_schedules",
+	"subscriptions",
+	"two_factors",
+	"recovery_codes",
+	"user_identities",
+	"api_keys",
+	"chat_room_members",
+	"chat_attachments",
+	"chat_reactions",
+	"security_events",
+	"notifications",
+	"domains",
+	"payments",
+	"account_deletions",
+}
+
+// profileTables hold rows that belong to the profile of the user.
+var profileTables = []string{
+	"profiles_guilds",
+	"profiles_city",
+	"profiles_hashtags",
+	"profile_photos",
+}
+
+// blogTables hold rows that belong to the blogs of the user, whoever wrote
+// them.
+var blogTables = []string{
+	"blog_photos",
+	"blog_city",
+	"blog_guilds",
+	"blog_hashtags",
+	"votes",
+	"favorites",
+}
+
+// Purge deletes an account for good: its files, blogs and everything else
+// it owns. Chat messages stay in their rooms, so conversations keep their
+// shape, but lose their content and are moved to the Ghost account.
+// Withdrawals are kept for accounting, see settleWithdrawals.
+func Purge(db *gorm.DB, config *initializers.Config, userID uuid.UUID, now time.Time) error {
+	var user models.User
+	if err := db.First(&user, "id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Deleted some other way, only the request is left
+			return db.Delete(&models.AccountDeletion{}, "user_id = ?", userID).Error
+		}
+		return err
+	}
+
+	ghost, err := Ghost(db)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := settleWithdrawals(tx, user.ID, ghost.ID, now); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.ChatMessage{}).Where("user_id = ?", user.ID).Updates(map[string]interface{}{
+			"user_id":    ghost.ID,
+			"content":    "",
+			"json_data":  nil,
+			"is_deleted": true,
+			"deleted_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		// Forwards and pins of others keep pointing to somebody
+		if err := tx.Model(&models.ChatMessage{}).Where("forwarded_from_user_id = ?", user.ID).Update("forwarded_from_user_id", ghost.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.ChatMessage{}).Where("pinned_by = ?", user.ID).Update("pinned_by", ghost.ID).Error; err != nil {
+			return err
+		}
+
+		blogs := tx.Model(&models.Blog{}).Select("id").Where("user_id = ?", user.ID)
+		for _, table := range blogTables {
+			if err := tx.Exec("DELETE FROM "+table+" WHERE blog_id IN (?)", blogs).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM blogs WHERE user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+
+		profiles := tx.Model(&models.Profile{}).Select("id").Where("user_id = ?", user.ID)
+		for _, table := range profileTables {
+			if err := tx.Exec("DELETE FROM "+table+" WHERE profile_id IN (?)", profiles).Error; err != nil {
+				return err
+			}
+		}
+
+		// Groups the user owns go to another member
+		var owned []uint64
+		if err := tx.Model(&models.ChatRoom{}).Where("owner_id = ?", user.ID).Pluck("id", &owned).Error; err != nil {
+			return err
+		}
+		for _, roomID := range owned {
+			if _, err := chatgroups.Leave(tx, roomID, user.ID); err != nil && !errors.Is(err, chatgroups.ErrNotMember) {
+				return err
+			}
+		}
+
+		for _, table := range userTables {
+			if err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", user.ID).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM user_relation WHERE following_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Profile{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files go last, a failed transaction must not leave a user without them
+	if user.Storage != "" {
+		if err := os.RemoveAll(filepath.Join(config.IMGStorePath, user.Storage)); err != nil {
+			log.Printf("Failed to remove files of deleted account %s: %v", user.ID, err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(chatfiles.Root(config), user.ID.String())); err != nil {
+		log.Printf("Failed to remove chat attachments of deleted account %s: %v", user.ID, err)
+	}
+	return nil
+}
+
+// settleWithdrawals cancels the requests nobody has processed yet, which
+// gives their amounts back from the payout hold, and moves all withdrawals
+// to the Ghost account without their destinations. The rows stay because
+// the ledger postings of the hold and the payouts point to them. An
+// approved withdrawal may be on its way to the user, so the account is
+// not purged before it is paid or failed.
+func settleWithdrawals(tx *gorm.DB, userID, ghostID uuid.UUID, now time.Time) error {
+	var approved int64
+	if err := tx.Model(&models.Withdrawal{}).
+		Where("user_id = ? AND status = ?", userID, models.WithdrawalApproved).
+		Count(&approved).Error; err != nil {
+		return err
+	}
+	if approved > 0 {
+		return ErrPayoutInProgress
+	}
+
+	var requested []uint64
+	if err := tx.Model(&models.Withdrawal{}).
+		Where("user_id = ? AND status = ?", userID, models.WithdrawalRequested).
+		Pluck("id", &requested).Error; err != nil {
+		return err
+	}
+	for _, id := range requested {
+		if _, err := payouts.Cancel(tx, id, userID, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&models.Withdrawal{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+		"user_id":     ghostID,
+		"destination": "",
+		"comment":     "",
+	}).Error
+}
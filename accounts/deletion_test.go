@@ -0,0 +1,115 @@
+package accounts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/payouts"
+	"hyperpage/testdb"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+func openPayoutsDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t,
+		&models.Withdrawal{},
+		&models.Notification{},
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+}
+
+// earn credits a user with money that can be withdrawn.
+func earn(t *testing.T, db *gorm.DB, userID uuid.UUID, amount float64) {
+	t.Helper()
+	if _, err := ledger.Credit(db, userID, ledger.AccountRevenue, amount, ledger.Posting{Module: payouts.EarningModules[0]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func held(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var sum int64
+	if err := db.Model(&models.LedgerEntry{}).Where("account = ?", ledger.AccountPayoutHold).
+		Select("COALESCE(SUM(amount), 0)").Scan(&sum).Error; err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestSettleWithdrawalsReleasesRequests(t *testing.T) {
+	db := openPayoutsDB(t)
+	userID, ghostID := uuid.NewV4(), uuid.NewV4()
+	settings := payouts.Settings{MinAmount: 1}
+	earn(t, db, userID, 1000)
+
+	requested, err := payouts.Request(db, settings, userID, 300, "card 4242 4242 4242 4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid, err := payouts.Request(db, settings, userID, 200, "card 4242 4242 4242 4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := payouts.Approve(db, paid.ID, ghostID, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := payouts.MarkPaid(db, paid.ID, ghostID, "ref-1", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := settleWithdrawals(db, userID, ghostID, now); err != nil {
+		t.Fatalf("settle: %v", err)
+	}
+	if got := held(t, db); got != 0 {
+		t.Fatalf("payout hold = %d, want 0", got)
+	}
+	if balance, err := ledger.Balance(db, userID); err != nil || balance != 800 {
+		t.Fatalf("balance = %v, %v, want 800", balance, err)
+	}
+
+	var withdrawals []models.Withdrawal
+	db.Order("id").Find(&withdrawals)
+	if len(withdrawals) != 2 {
+		t.Fatalf("%d withdrawals kept, want 2", len(withdrawals))
+	}
+	if withdrawals[0].ID != requested.ID || withdrawals[0].Status != models.WithdrawalCanceled {
+		t.Fatalf("requested withdrawal = %+v", withdrawals[0])
+	}
+	for _, w := range withdrawals {
+		if w.UserID != ghostID || w.Destination != "" {
+			t.Fatalf("withdrawal %d kept user %s destination %q", w.ID, w.UserID, w.Destination)
+		}
+	}
+}
+
+func TestSettleWithdrawalsWaitsForApprovedPayout(t *testing.T) {
+	db := openPayoutsDB(t)
+	userID := uuid.NewV4()
+	earn(t, db, userID, 1000)
+
+	w, err := payouts.Request(db, payouts.Settings{MinAmount: 1}, userID, 300, "card 4242 4242 4242 4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := payouts.Approve(db, w.ID, uuid.NewV4(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := settleWithdrawals(db, userID, uuid.NewV4(), time.Now()); !errors.Is(err, ErrPayoutInProgress) {
+		t.Fatalf("err = %v, want ErrPayoutInProgress", err)
+	}
+	var kept models.Withdrawal
+	db.First(&kept, w.ID)
+	if kept.UserID != userID || kept.Destination == "" || kept.Status != models.WithdrawalApproved {
+		t.Fatalf("approved withdrawal changed: %+v", kept)
+	}
+}
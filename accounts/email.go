@@ -0,0 +1,165 @@
+package accounts
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// EmailChangeTTL is how long the confirmation link of a new email works.
+const EmailChangeTTL = 24 * time.Hour
+
+var (
+	ErrEmailTaken         = errors.New("email is already used by another account")
+	ErrInvalidEmailChange = errors.New("confirmation link is invalid or expired")
+)
+
+// EmailChange is an email change waiting for the new address to be
+// confirmed. The old email stays in use until then.
+type EmailChange struct {
+	UserID   string
+	NewEmail string
+}
+
+// Pending changes are found by the hash of their token. A user has at most
+// one; a new request replaces it.
+func emailChangeKey(hash string) string       { return "email_change:" + hash }
+func userEmailChangeKey(userID string) string { return "email_change_user:" + userID }
+
+// EmailTaken reports whether another account uses the email.
+func EmailTaken(db *gorm.DB, email string, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := db.Model(&models.User{}).Where("email = ? AND id <> ?", email, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// RequestEmailChange stores a pending change to newEmail and returns the
+// token that confirms it.
+func RequestEmailChange(ctx context.Context, db *gorm.DB, userID uuid.UUID, newEmail string) (string, error) {
+	taken, err := EmailTaken(db, newEmail, userID)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrEmailTaken
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	hash := hashToken(token)
+
+	rdb := initializers.RedisClient
+	previous, err := rdb.Get(ctx, userEmailChangeKey(userID.String())).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if previous != "" {
+			pipe.Del(ctx, emailChangeKey(previous))
+		}
+		pipe.HSet(ctx, emailChangeKey(hash), "user_id", userID.String(), "new_email", newEmail)
+		pipe.Expire(ctx, emailChangeKey(hash), EmailChangeTTL)
+		pipe.Set(ctx, userEmailChangeKey(userID.String()), hash, EmailChangeTTL)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// PendingEmailChange returns the address a user asked to change to, if any.
+func PendingEmailChange(ctx context.Context, userID uuid.UUID) (string, error) {
+	rdb := initializers.RedisClient
+	hash, err := rdb.Get(ctx, userEmailChangeKey(userID.String())).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	email, err := rdb.HGet(ctx, emailChangeKey(hash), "new_email").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return email, err
+}
+
+// CancelEmailChange drops the pending change of a user.
+func CancelEmailChange(ctx context.Context, userID uuid.UUID) error {
+	rdb := initializers.RedisClient
+	hash, err := rdb.GetDel(ctx, userEmailChangeKey(userID.String())).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rdb.Del(ctx, emailChangeKey(hash)).Err()
+}
+
+// ConfirmEmailChange spends a confirmation token and moves the user to the
+// new email, which counts as verified. It returns the user before the
+// change.
+func ConfirmEmailChange(ctx context.Context, db *gorm.DB, token string) (*models.User, *EmailChange, error) {
+	if token == "" {
+		return nil, nil, ErrInvalidEmailChange
+	}
+	key := emailChangeKey(hashToken(token))
+	rdb := initializers.RedisClient
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fields["user_id"] == "" {
+		return nil, nil, ErrInvalidEmailChange
+	}
+	if n, err := rdb.Del(ctx, key).Result(); err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		// Confirmed by a parallel request
+		return nil, nil, ErrInvalidEmailChange
+	}
+	rdb.Del(ctx, userEmailChangeKey(fields["user_id"]))
+
+	change := &EmailChange{UserID: fields["user_id"], NewEmail: fields["new_email"]}
+
+	var user models.User
+	if err := db.First(&user, "id = ?", change.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidEmailChange
+		}
+		return nil, nil, err
+	}
+
+	// The address may have been taken while the link waited
+	taken, err := EmailTaken(db, change.NewEmail, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if taken {
+		return nil, nil, ErrEmailTaken
+	}
+
+	err = db.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"email":    change.NewEmail,
+		"verified": true,
+	}).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, change, nil
+}
@@ -0,0 +1,165 @@
+package accounts
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+type exportBlog struct {
+	ID        uint64             `json:"id"`
+	Title     string             `json:"title"`
+	Descr     string             `json:"descr"`
+	Content   string             `json:"content"`
+	Slug      string             `json:"slug"`
+	Status    string             `json:"status"`
+	Lang      string             `json:"lang"`
+	Views     int                `json:"views"`
+	Total     float64            `json:"total"`
+	Currency  string             `json:"currency"`
+	Photos    []models.BlogPhoto `json:"photos"`
+	CreatedAt time.Time          `json:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt"`
+	ExpiredAt *time.Time         `json:"expiredAt"`
+}
+
+type exportMessage struct {
+	ID              uint64     `json:"id"`
+	RoomID          uint64     `json:"roomId"`
+	Content         string     `json:"content"`
+	MsgType         uint8      `json:"msgType"`
+	JsonData        *string    `json:"jsonData"`
+	ParentMessageID *uint64    `json:"parentMessageId"`
+	IsEdited        bool       `json:"isEdited"`
+	IsDeleted       bool       `json:"isDeleted"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	DeletedAt       *time.Time `json:"deletedAt"`
+}
+
+// Export writes a ZIP of what is kept about a user: profile.json,
+// blogs.json, chat_messages.json, transactions.json and the uploaded files
+// under files/.
+func Export(db *gorm.DB, config *initializers.Config, userID uuid.UUID, language string, w io.Writer) error {
+	var user models.User
+	err := db.Preload("Followings").
+		Preload("Followers").
+		Preload("Profile.City.Translations", "language = ?", language).
+		Preload("Profile.Guilds.Translations", "language = ?", language).
+		Preload("Profile.Hashtags").
+		Preload("Profile.Photos").
+		First(&user, "id = ?", userID).Error
+	if err != nil {
+		return err
+	}
+
+	var blogs []models.Blog
+	if err := db.Preload("Photos").Where("user_id = ?", userID).Order("id").Find(&blogs).Error; err != nil {
+		return err
+	}
+	exportBlogs := make([]exportBlog, 0, len(blogs))
+	for _, blog := range blogs {
+		exportBlogs = append(exportBlogs, exportBlog{
+			ID:        blog.ID,
+			Title:     blog.Title,
+			Descr:     blog.Descr,
+			Content:   blog.Content,
+			Slug:      blog.Slug,
+			Status:    blog.Status,
+			Lang:      blog.Lang,
+			Views:     blog.Views,
+			Total:     blog.Total,
+			Currency:  blog.Currency,
+			Photos:    blog.Photos,
+			CreatedAt: blog.CreatedAt,
+			UpdatedAt: blog.UpdatedAt,
+			ExpiredAt: blog.ExpiredAt,
+		})
+	}
+
+	messages := []exportMessage{}
+	if err := db.Model(&models.ChatMessage{}).Where("user_id = ?", userID).Order("id").Find(&messages).Error; err != nil {
+		return err
+	}
+
+	transactions := []models.Transaction{}
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&transactions).Error; err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	for _, doc := range []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", models.FilterUserRecord(&user, language)},
+		{"blogs.json", exportBlogs},
+		{"chat_messages.json", messages},
+		{"transactions.json", transactions},
+	} {
+		f, err := archive.Create(doc.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(doc.data); err != nil {
+			return err
+		}
+	}
+
+	if user.Storage != "" {
+		if err := addFiles(archive, filepath.Join(config.IMGStorePath, user.Storage)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// addFiles copies the storage directory of a user into files/.
+func addFiles(archive *zip.Writer, dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = "files/" + filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		dst, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(dst, src)
+		return err
+	})
+	if os.IsNotExist(err) {
+		// Nothing was ever uploaded
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,226 @@
+// Package apikeys issues and checks the keys bots and integrations send in
+// the X-API-Key header. A key is "hp_<prefix>_<secret>"; the prefix finds
+// it and the SHA-256 of the whole key proves it.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+)
+
+// Header carries the key.
+const Header = "X-API-Key"
+
+// Scopes of the machine routes.
+const (
+	ScopeBots       = "bots"        // register bots and fill their profiles
+	ScopeBotsDelete = "bots.delete" // delete every bot user, system keys only
+	ScopeStreaming  = "streaming"   // open and close streams
+)
+
+// Known lists the scopes with what they allow.
+var Known = map[string]string{
+	ScopeBots:       "Register bot users and update their profiles",
+	ScopeBotsDelete: "Delete all bot users",
+	ScopeStreaming:  "Start and stop profile streams",
+}
+
+const (
+	DefaultRateLimit = 60
+	// RotationGrace keeps the previous key working after a rotation so
+	// integrations can be redeployed.
+	RotationGrace = 24 * time.Hour
+	// touchInterval limits last use writes to one per key and minute.
+	touchInterval = time.Minute
+)
+
+var (
+	ErrInvalidKey   = errors.New("invalid API key")
+	ErrKeyNotFound  = errors.New("API key not found")
+	ErrUnknownScope = errors.New("unknown scope")
+	ErrSystemScope  = errors.New("scope is for system keys only")
+)
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create issues a key and returns it with the only copy of its secret.
+func Create(db *gorm.DB, name string, userID *uuid.UUID, scopes []string, rateLimit int, expiresAt *time.Time, createdBy uuid.UUID) (*models.APIKey, string, error) {
+	if err := validateScopes(scopes, userID); err != nil {
+		return nil, "", err
+	}
+	if rateLimit <= 0 {
+		rateLimit = DefaultRateLimit
+	}
+
+	prefix, err := randomHex(4)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := "hp_" + prefix + "_" + secret
+
+	key := &models.APIKey{
+		Name:      name,
+		UserID:    userID,
+		Prefix:    prefix,
+		Hash:      hash(raw),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+		ExpiresAt: expiresAt,
+		CreatedBy: createdBy,
+	}
+	if err := db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, raw, nil
+}
+
+// Rotate gives a key a new secret. The old one keeps working for
+// RotationGrace.
+func Rotate(db *gorm.DB, id uint64, now time.Time) (*models.APIKey, string, error) {
+	var key models.APIKey
+	if err := db.First(&key, "id = ? AND revoked_at IS NULL", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrKeyNotFound
+		}
+		return nil, "", err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := "hp_" + key.Prefix + "_" + secret
+
+	grace := now.Add(RotationGrace)
+	key.PreviousHash = key.Hash
+	key.PreviousExpiresAt = &grace
+	key.Hash = hash(raw)
+	key.RotatedAt = &now
+	if err := db.Save(&key).Error; err != nil {
+		return nil, "", err
+	}
+	return &key, raw, nil
+}
+
+// Revoke disables a key at once, the previous key of a rotation too.
+func Revoke(db *gorm.DB, id uint64, now time.Time) error {
+	result := db.Model(&models.APIKey{}).Where("id = ? AND revoked_at IS NULL", id).
+		Updates(map[string]interface{}{"revoked_at": now, "previous_hash": ""})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the live key a raw key belongs to.
+func Authenticate(db *gorm.DB, raw string, now time.Time) (*models.APIKey, error) {
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != "hp" {
+		return nil, ErrInvalidKey
+	}
+
+	var key models.APIKey
+	if err := db.First(&key, "prefix = ?", parts[1]).Error; err != nil {
+		return nil, ErrInvalidKey
+	}
+	if key.RevokedAt != nil || key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, ErrInvalidKey
+	}
+
+	h := hash(raw)
+	if subtle.ConstantTimeCompare([]byte(h), []byte(key.Hash)) == 1 {
+		return &key, nil
+	}
+	if key.PreviousHash != "" && key.PreviousExpiresAt != nil && now.Before(*key.PreviousExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(h), []byte(key.PreviousHash)) == 1 {
+		return &key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// HasScope reports whether a key was given a scope.
+func HasScope(key *models.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow counts a request of a key in the current minute and tells how long
+// to wait once it is over its limit.
+func Allow(ctx context.Context, key *models.APIKey, now time.Time) (bool, int, time.Duration, error) {
+	minute := now.Truncate(time.Minute)
+	counter := "apikey_rate:" + strconv.FormatUint(key.ID, 10) + ":" + strconv.FormatInt(minute.Unix(), 10)
+
+	rdb := initializers.RedisClient
+	count, err := rdb.Incr(ctx, counter).Result()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if count == 1 {
+		rdb.Expire(ctx, counter, 2*time.Minute)
+	}
+
+	remaining := key.RateLimit - int(count)
+	if remaining < 0 {
+		return false, 0, minute.Add(time.Minute).Sub(now), nil
+	}
+	return true, remaining, 0, nil
+}
+
+// Touch records the last use of a key, at most once a minute.
+func Touch(ctx context.Context, db *gorm.DB, key *models.APIKey, ip string, now time.Time) {
+	first, err := initializers.RedisClient.SetNX(ctx, "apikey_seen:"+strconv.FormatUint(key.ID, 10), 1, touchInterval).Result()
+	if err != nil || !first {
+		return
+	}
+	db.Model(key).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": ip})
+}
+
+func validateScopes(scopes []string, userID *uuid.UUID) error {
+	if len(scopes) == 0 {
+		return ErrUnknownScope
+	}
+	for _, s := range scopes {
+		if _, ok := Known[s]; !ok {
+			return ErrUnknownScope
+		}
+		if s == ScopeBotsDelete && userID != nil {
+			return ErrSystemScope
+		}
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+// Package chatfiles stores the files, images and voice notes attached to
+// chat messages. They live outside IMG_STORE_PATH, which the web server
+// hands out to anybody, and only reach members of their room through the
+// API. They count against the storage limit of the uploader together with
+// the files in their storage directory.
+package chatfiles
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/disintegration/imaging"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Attachment kinds.
+const (
+	KindImage = "image"
+	KindVoice = "voice"
+	KindFile  = "file"
+)
+
+const (
+	// DefaultPath is used when CHAT_ATTACHMENTS_PATH is not set.
+	DefaultPath = "../chat-attachments"
+	// DefaultMaxSize is used when CHAT_ATTACHMENT_MAX_MB is not set, in MB.
+	DefaultMaxSize = 20
+	// MaxVoiceDuration bounds the duration a client reports, in seconds.
+	MaxVoiceDuration = 60 * 60
+	// UnattachedTTL is how long an upload waits for its message.
+	UnattachedTTL = 24 * time.Hour
+
+	thumbnailSize = 320
+)
+
+var (
+	ErrTooLarge        = errors.New("file is too large")
+	ErrQuota           = errors.New("storage limit exceeded")
+	ErrNotAudio        = errors.New("voice notes must be audio")
+	ErrInvalidDuration = errors.New("voice notes need a duration up to an hour")
+	ErrNotFound        = errors.New("attachment not found")
+	ErrNotAttachable   = errors.New("attachment is sent already or belongs to another room")
+)
+
+// images have a decoder, so they get dimensions and a thumbnail.
+var images = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/bmp":  true,
+}
+
+// Root returns the directory of the attachments.
+func Root(config *initializers.Config) string {
+	if config.ChatAttachmentsPath == "" {
+		return DefaultPath
+	}
+	return config.ChatAttachmentsPath
+}
+
+// MaxSize returns the largest attachment in bytes.
+func MaxSize(config *initializers.Config) int64 {
+	mb := config.ChatAttachmentMaxSize
+	if mb <= 0 {
+		mb = DefaultMaxSize
+	}
+	return int64(mb) << 20
+}
+
+// Path returns where the file of an attachment is.
+func Path(config *initializers.Config, attachment *models.ChatAttachment) string {
+	return filepath.Join(Root(config), attachment.Path)
+}
+
+// ThumbnailPath returns where the thumbnail of an image is, or "".
+func ThumbnailPath(config *initializers.Config, attachment *models.ChatAttachment) string {
+	if attachment.Thumbnail == "" {
+		return ""
+	}
+	return filepath.Join(Root(config), attachment.Thumbnail)
+}
+
+func directorySize(dirname string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Used returns the bytes a user keeps: the files in their storage directory
+// and their chat attachments.
+func Used(db *gorm.DB, config *initializers.Config, userID uuid.UUID, storage string) (int64, error) {
+	var size int64
+	if storage != "" {
+		var err error
+		if size, err = directorySize(filepath.Join(config.IMGStorePath, storage)); err != nil {
+			return 0, err
+		}
+	}
+	var attachments int64
+	err := db.Model(&models.ChatAttachment{}).Where("user_id = ?", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&attachments).Error
+	return size + attachments, err
+}
+
+// extension keeps short alphanumeric extensions of uploaded names.
+func extension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if len(ext) < 2 || len(ext) > 10 {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// detect sniffs the type of a file, trusting the extension only when the
+// content says nothing.
+func detect(head []byte, name string) string {
+	detected := http.DetectContentType(head)
+	if detected == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(extension(name)); byExt != "" {
+			detected = byExt
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(detected); err == nil {
+		return mediaType
+	}
+	return "application/octet-stream"
+}
+
+func isAudio(mimeType string) bool {
+	// Browsers record voice in Ogg or WebM containers
+	return strings.HasPrefix(mimeType, "audio/") || mimeType == "application/ogg" || mimeType == "video/webm"
+}
+
+// Store saves an upload to a room for the user, before its message is sent.
+// Voice notes carry the duration the client measured.
+func Store(db *gorm.DB, config *initializers.Config, user models.UserResponse, roomID uint64, file *multipart.FileHeader, voice bool, duration float64) (*models.ChatAttachment, error) {
+	if file.Size > MaxSize(config) {
+		return nil, ErrTooLarge
+	}
+	used, err := Used(db, config, user.ID, user.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if used+file.Size > int64(user.LimitStorage)<<20 {
+		return nil, ErrQuota
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	attachment := &models.ChatAttachment{
+		RoomID:   roomID,
+		UserID:   user.ID,
+		Kind:     KindFile,
+		Name:     filepath.Base(file.Filename),
+		MimeType: detect(head[:n], file.Filename),
+		Size:     file.Size,
+	}
+	switch {
+	case voice:
+		if !isAudio(attachment.MimeType) {
+			return nil, ErrNotAudio
+		}
+		if duration <= 0 || duration > MaxVoiceDuration {
+			return nil, ErrInvalidDuration
+		}
+		attachment.Kind = KindVoice
+		attachment.Duration = duration
+	case images[attachment.MimeType]:
+		attachment.Kind = KindImage
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	name := hex.EncodeToString(b)
+	dir := filepath.Join(Root(config), user.ID.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	attachment.Path = filepath.Join(user.ID.String(), name+extension(file.Filename))
+
+	dst, err := os.Create(Path(config, attachment))
+	if err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(Path(config, attachment))
+		return nil, err
+	}
+	attachment.Size = written
+
+	if attachment.Kind == KindImage {
+		if err := thumbnail(config, attachment, name); err != nil {
+			// Still a file, just not shown inline
+			log.Printf("Failed to read image attachment %s: %v", attachment.Path, err)
+			attachment.Kind = KindFile
+		}
+	}
+
+	if err := db.Create(attachment).Error; err != nil {
+		remove(config, attachment)
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// thumbnail reads the dimensions of an image and writes its thumbnail.
+func thumbnail(config *initializers.Config, attachment *models.ChatAttachment, name string) error {
+	f, err := os.Open(Path(config, attachment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	attachment.Width = img.Bounds().Dx()
+	attachment.Height = img.Bounds().Dy()
+
+	attachment.Thumbnail = filepath.Join(attachment.UserID.String(), name+"_thumb.jpg")
+	thumb := imaging.Fit(img, thumbnailSize, thumbnailSize, imaging.Lanczos)
+	if err := imaging.Save(thumb, ThumbnailPath(config, attachment)); err != nil {
+		attachment.Thumbnail = ""
+		return err
+	}
+	return nil
+}
+
+// Attach hands uploads of the user in a room to the message that carries
+// them. Run it in the transaction that creates the message.
+func Attach(tx *gorm.DB, userID uuid.UUID, roomID, messageID uint64, ids []uint64) ([]models.ChatAttachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var attachments []models.ChatAttachment
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ? AND user_id = ? AND room_id = ? AND message_id IS NULL", ids, userID, roomID).
+		Order("id").
+		Find(&attachments).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) != len(ids) {
+		return nil, ErrNotAttachable
+	}
+	if err := tx.Model(&models.ChatAttachment{}).Where("id IN ?", ids).Update("message_id", messageID).Error; err != nil {
+		return nil, err
+	}
+	for i := range attachments {
+		attachments[i].MessageID = &messageID
+	}
+	return attachments, nil
+}
+
+// Copy gives a forwarded message copies of the attachments of the original,
+// owned by the user who forwards it, so deleting either leaves the other
+// alone. The copies count against the storage of that user. Run it in the
+// transaction that creates the message and call Delete on the copies if
+// that transaction fails.
+func Copy(tx *gorm.DB, config *initializers.Config, user models.UserResponse, roomID, messageID uint64, originals []models.ChatAttachment) ([]models.ChatAttachment, error) {
+	if len(originals) == 0 {
+		return nil, nil
+	}
+	var size int64
+	for _, original := range originals {
+		size += original.Size
+	}
+	used, err := Used(tx, config, user.ID, user.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if used+size > int64(user.LimitStorage)<<20 {
+		return nil, ErrQuota
+	}
+	if err := os.MkdirAll(filepath.Join(Root(config), user.ID.String()), 0755); err != nil {
+		return nil, err
+	}
+
+	var copies []models.ChatAttachment
+	fail := func(err error) ([]models.ChatAttachment, error) {
+		for i := range copies {
+			remove(config, &copies[i])
+		}
+		return nil, err
+	}
+	for _, original := range originals {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return fail(err)
+		}
+		name := hex.EncodeToString(b)
+		attachment := original
+		attachment.ID = 0
+		attachment.RoomID = roomID
+		attachment.UserID = user.ID
+		attachment.MessageID = &messageID
+		attachment.CreatedAt = time.Time{}
+		attachment.Path = filepath.Join(user.ID.String(), name+extension(original.Path))
+		attachment.Thumbnail = ""
+		if original.Thumbnail != "" {
+			attachment.Thumbnail = filepath.Join(user.ID.String(), name+"_thumb.jpg")
+		}
+		copies = append(copies, attachment)
+
+		if err := copyFile(Path(config, &original), Path(config, &attachment)); err != nil {
+			return fail(err)
+		}
+		if attachment.Thumbnail != "" {
+			if err := copyFile(ThumbnailPath(config, &original), ThumbnailPath(config, &attachment)); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := tx.Create(&copies).Error; err != nil {
+		return fail(err)
+	}
+	return copies, nil
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Find returns an attachment for a user, who must be a member of its room.
+func Find(db *gorm.DB, id uint64, userID uuid.UUID) (*models.ChatAttachment, error) {
+	var attachment models.ChatAttachment
+	err := db.Where("id = ? AND room_id IN (SELECT room_id FROM chat_room_members WHERE user_id = ?)", id, userID).
+		First(&attachment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func remove(config *initializers.Config, attachment *models.ChatAttachment) {
+	for _, path := range []string{Path(config, attachment), ThumbnailPath(config, attachment)} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove chat attachment %s: %v", path, err)
+		}
+	}
+}
+
+// Delete drops attachments and their files, which frees their storage.
+func Delete(db *gorm.DB, config *initializers.Config, attachments []models.ChatAttachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(attachments))
+	for _, attachment := range attachments {
+		ids = append(ids, attachment.ID)
+	}
+	if err := db.Delete(&models.ChatAttachment{}, ids).Error; err != nil {
+		return err
+	}
+	for i := range attachments {
+		remove(config, &attachments[i])
+	}
+	return nil
+}
+
+// DeleteForMessage drops the attachments of a deleted message.
+func DeleteForMessage(db *gorm.DB, config *initializers.Config, messageID uint64) error {
+	var attachments []models.ChatAttachment
+	if err := db.Where("message_id = ?", messageID).Find(&attachments).Error; err != nil {
+		return err
+	}
+	return Delete(db, config, attachments)
+}
+
+// PruneUnattached drops uploads no message took before a time.
+func PruneUnattached(db *gorm.DB, config *initializers.Config, before time.Time) {
+	var attachments []models.ChatAttachment
+	if err := db.Where("message_id IS NULL AND created_at < ?", before).Find(&attachments).Error; err != nil {
+		log.Println("Failed to load unattached chat attachments:", err)
+		return
+	}
+	if err := Delete(db, config, attachments); err != nil {
+		log.Println("Failed to prune unattached chat attachments:", err)
+	}
+}
@@ -0,0 +1,376 @@
+// Package chatgroups manages group chat rooms: their settings, members and
+// roles. A group has one owner, admins who invite and kick members, and a
+// member limit. Invited users join like the acceptor of a direct room: the
+// room shows up as new until they subscribe to it.
+package chatgroups
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultMaxMembers is used when CHAT_GROUP_MAX_MEMBERS is not set.
+const DefaultMaxMembers = 200
+
+// MaxTitleLength matches the title column.
+const MaxTitleLength = 128
+
+var (
+	ErrNotFound     = errors.New("group not found")
+	ErrNotMember    = errors.New("user is not a member of the group")
+	ErrForbidden    = errors.New("the role of the user does not allow this")
+	ErrFull         = errors.New("group is full")
+	ErrUnknownUser  = errors.New("user not found")
+	ErrUnknownRole  = errors.New("role must be owner, admin or member")
+	ErrInvalidTitle = errors.New("title is empty or too long")
+	ErrInvalidLimit = errors.New("member limit is below the member count or above the maximum")
+)
+
+// MaxMembers returns the largest group the config allows.
+func MaxMembers(config *initializers.Config) int {
+	if config.ChatGroupMaxMembers <= 0 {
+		return DefaultMaxMembers
+	}
+	return config.ChatGroupMaxMembers
+}
+
+// Limit returns how many members a group can have.
+func Limit(room *models.ChatRoom, config *initializers.Config) int {
+	max := MaxMembers(config)
+	if room.MaxMembers > 0 && room.MaxMembers < max {
+		return room.MaxMembers
+	}
+	return max
+}
+
+// rank orders the roles, lower outranks higher.
+func rank(role string) int {
+	switch role {
+	case models.ChatRoleOwner:
+		return 0
+	case models.ChatRoleAdmin:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func checkTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" || utf8.RuneCountInString(title) > MaxTitleLength {
+		return "", ErrInvalidTitle
+	}
+	return title, nil
+}
+
+// distinct drops duplicates and the IDs in skip.
+func distinct(ids []uuid.UUID, skip map[uuid.UUID]bool) []uuid.UUID {
+	seen := map[uuid.UUID]bool{}
+	var out []uuid.UUID
+	for _, id := range ids {
+		if id == uuid.Nil || seen[id] || skip[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	return out
+}
+
+func checkUsers(db *gorm.DB, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var count int64
+	if err := db.Model(&models.User{}).Where("id IN ?", ids).Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(ids) {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// lock loads a group for update, so changes of its members run one after
+// the other, and the member of userID in it.
+func lock(tx *gorm.DB, roomID uint64, userID uuid.UUID) (*models.ChatRoom, *models.ChatRoomMember, error) {
+	var room models.ChatRoom
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&room, "id = ? AND is_group = ?", roomID, true).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var member models.ChatRoomMember
+	err = tx.First(&member, "room_id = ? AND user_id = ?", roomID, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &room, &member, nil
+}
+
+func memberCount(tx *gorm.DB, roomID uint64) (int, error) {
+	var count int64
+	err := tx.Model(&models.ChatRoomMember{}).Where("room_id = ?", roomID).Count(&count).Error
+	return int(count), err
+}
+
+// Create makes a group owned by ownerID and invites memberIDs to it.
+func Create(db *gorm.DB, config *initializers.Config, ownerID uuid.UUID, title, avatar string, memberIDs []uuid.UUID) (*models.ChatRoom, error) {
+	title, err := checkTitle(title)
+	if err != nil {
+		return nil, err
+	}
+	memberIDs = distinct(memberIDs, map[uuid.UUID]bool{ownerID: true})
+	if 1+len(memberIDs) > MaxMembers(config) {
+		return nil, ErrFull
+	}
+	if err := checkUsers(db, memberIDs); err != nil {
+		return nil, err
+	}
+
+	room := &models.ChatRoom{
+		// Names are unique and only mean something for direct rooms
+		Name:    "group:" + uuid.NewV4().String(),
+		IsGroup: true,
+		Title:   title,
+		Avatar:  avatar,
+		OwnerID: &ownerID,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			return err
+		}
+		members := []models.ChatRoomMember{
+			{RoomID: room.ID, UserID: ownerID, IsSubscribed: true, Role: models.ChatRoleOwner},
+		}
+		for _, id := range memberIDs {
+			members = append(members, models.ChatRoomMember{RoomID: room.ID, UserID: id, IsNew: true, Role: models.ChatRoleMember})
+		}
+		if err := tx.Create(&members).Error; err != nil {
+			return err
+		}
+		room.Members = members
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// Settings are the changes of a group update; nil fields stay as they are.
+type Settings struct {
+	Title      *string
+	Avatar     *string
+	MaxMembers *int
+}
+
+// Update changes the settings of a group. Admins change the title and
+// avatar, the limit is up to the owner.
+func Update(db *gorm.DB, config *initializers.Config, roomID uint64, actorID uuid.UUID, settings Settings) (*models.ChatRoom, error) {
+	var room *models.ChatRoom
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var actor *models.ChatRoomMember
+		var err error
+		room, actor, err = lock(tx, roomID, actorID)
+		if err != nil {
+			return err
+		}
+		if rank(actor.Role) > rank(models.ChatRoleAdmin) {
+			return ErrForbidden
+		}
+
+		if settings.Title != nil {
+			if room.Title, err = checkTitle(*settings.Title); err != nil {
+				return err
+			}
+		}
+		if settings.Avatar != nil {
+			room.Avatar = *settings.Avatar
+		}
+		if settings.MaxMembers != nil {
+			if actor.Role != models.ChatRoleOwner {
+				return ErrForbidden
+			}
+			count, err := memberCount(tx, roomID)
+			if err != nil {
+				return err
+			}
+			// 0 goes back to the limit of the config
+			limit := *settings.MaxMembers
+			if limit < 0 || limit > MaxMembers(config) || (limit > 0 && limit < count) {
+				return ErrInvalidLimit
+			}
+			room.MaxMembers = limit
+		}
+		return tx.Model(room).Updates(map[string]interface{}{
+			"title":       room.Title,
+			"avatar":      room.Avatar,
+			"max_members": room.MaxMembers,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// Invite adds users to a group as new members and returns the group and the
+// users that were not members yet. Admins and the owner invite.
+func Invite(db *gorm.DB, config *initializers.Config, roomID uint64, actorID uuid.UUID, userIDs []uuid.UUID) (*models.ChatRoom, []uuid.UUID, error) {
+	var room *models.ChatRoom
+	var added []uuid.UUID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var actor *models.ChatRoomMember
+		var err error
+		room, actor, err = lock(tx, roomID, actorID)
+		if err != nil {
+			return err
+		}
+		if rank(actor.Role) > rank(models.ChatRoleAdmin) {
+			return ErrForbidden
+		}
+
+		var existing []uuid.UUID
+		if err := tx.Model(&models.ChatRoomMember{}).Where("room_id = ?", roomID).Pluck("user_id", &existing).Error; err != nil {
+			return err
+		}
+		skip := map[uuid.UUID]bool{}
+		for _, id := range existing {
+			skip[id] = true
+		}
+		added = distinct(userIDs, skip)
+		if len(added) == 0 {
+			return nil
+		}
+		if len(existing)+len(added) > Limit(room, config) {
+			return ErrFull
+		}
+		if err := checkUsers(tx, added); err != nil {
+			return err
+		}
+
+		var members []models.ChatRoomMember
+		for _, id := range added {
+			members = append(members, models.ChatRoomMember{RoomID: roomID, UserID: id, IsNew: true, Role: models.ChatRoleMember})
+		}
+		return tx.Create(&members).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return room, added, nil
+}
+
+// Kick removes a member. Admins kick members, the owner kicks anybody.
+func Kick(db *gorm.DB, roomID uint64, actorID, userID uuid.UUID) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		_, actor, err := lock(tx, roomID, actorID)
+		if err != nil {
+			return err
+		}
+		var target models.ChatRoomMember
+		err = tx.First(&target, "room_id = ? AND user_id = ?", roomID, userID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotMember
+		}
+		if err != nil {
+			return err
+		}
+		if actorID == userID || rank(actor.Role) > rank(models.ChatRoleAdmin) || rank(actor.Role) >= rank(target.Role) {
+			return ErrForbidden
+		}
+		return tx.Delete(&target).Error
+	})
+}
+
+// Leave removes a member from a group. When the owner leaves, the admin who
+// joined first becomes the owner, or the member who joined first if there
+// is no admin. It returns the new owner, if there is one.
+func Leave(db *gorm.DB, roomID uint64, userID uuid.UUID) (*uuid.UUID, error) {
+	var owner *uuid.UUID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		room, member, err := lock(tx, roomID, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(member).Error; err != nil {
+			return err
+		}
+		if member.Role != models.ChatRoleOwner {
+			return nil
+		}
+
+		var successor models.ChatRoomMember
+		err = tx.Where("room_id = ?", roomID).
+			Order(clause.Expr{SQL: "CASE role WHEN ? THEN 0 ELSE 1 END, joined_at, id", Vars: []interface{}{models.ChatRoleAdmin}}).
+			First(&successor).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The last member left, the messages stay
+			return tx.Model(room).Update("owner_id", nil).Error
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&successor).Update("role", models.ChatRoleOwner).Error; err != nil {
+			return err
+		}
+		owner = &successor.UserID
+		return tx.Model(room).Update("owner_id", successor.UserID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// SetRole changes the role of a member; only the owner does. Making
+// somebody the owner hands the group over and the owner becomes an admin.
+func SetRole(db *gorm.DB, roomID uint64, actorID, userID uuid.UUID, role string) error {
+	if role != models.ChatRoleOwner && role != models.ChatRoleAdmin && role != models.ChatRoleMember {
+		return ErrUnknownRole
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		room, actor, err := lock(tx, roomID, actorID)
+		if err != nil {
+			return err
+		}
+		if actor.Role != models.ChatRoleOwner || actorID == userID {
+			return ErrForbidden
+		}
+		var target models.ChatRoomMember
+		err = tx.First(&target, "room_id = ? AND user_id = ?", roomID, userID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotMember
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&target).Update("role", role).Error; err != nil {
+			return err
+		}
+		if role != models.ChatRoleOwner {
+			return nil
+		}
+		if err := tx.Model(actor).Update("role", models.ChatRoleAdmin).Error; err != nil {
+			return err
+		}
+		return tx.Model(room).Update("owner_id", userID).Error
+	})
+}
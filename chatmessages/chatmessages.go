@@ -0,0 +1,246 @@
+// Package chatmessages reacts to, pins and forwards chat messages. The
+// functions take the transaction the caller broadcasts the change in.
+package chatmessages
+
+import (
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"hyperpage/chatfiles"
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxEmojiBytes matches the emoji column; sequences with skin tones and
+	// joiners fit.
+	MaxEmojiBytes = 32
+	// MaxPins bounds the pinned messages of a room.
+	MaxPins = 50
+)
+
+var (
+	ErrNotFound     = errors.New("message not found")
+	ErrNotMember    = errors.New("user is not a member of the room")
+	ErrNotSendable  = errors.New("user cannot send messages to the room")
+	ErrForbidden    = errors.New("only admins pin messages in groups")
+	ErrInvalidEmoji = errors.New("reaction must be an emoji")
+	ErrTooManyPins  = errors.New("the room has too many pinned messages")
+)
+
+// Reaction counts the users who reacted to a message with an emoji.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	// Mine is set in reads for a user, when the user is one of them.
+	Mine bool `json:"mine,omitempty"`
+}
+
+// checkEmoji accepts short strings without letters, spaces or control
+// characters; clients pick the emoji, this only keeps out text.
+func checkEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > MaxEmojiBytes || !utf8.ValidString(emoji) {
+		return ErrInvalidEmoji
+	}
+	for _, r := range emoji {
+		if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return ErrInvalidEmoji
+		}
+	}
+	return nil
+}
+
+func member(tx *gorm.DB, roomID uint64, userID uuid.UUID) (*models.ChatRoomMember, error) {
+	var m models.ChatRoomMember
+	err := tx.First(&m, "room_id = ? AND user_id = ?", roomID, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// visible loads a message that is not deleted, for a member of its room.
+func visible(tx *gorm.DB, messageID uint64, userID uuid.UUID) (*models.ChatMessage, *models.ChatRoomMember, error) {
+	var message models.ChatMessage
+	err := tx.First(&message, "id = ? AND is_deleted = ?", messageID, false).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := member(tx, message.RoomID, userID)
+	if errors.Is(err, ErrNotMember) {
+		// Other rooms do not exist for the user
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &message, m, nil
+}
+
+// Reactions returns the reactions of messages, in the order they were
+// first used. Mine is set for userID, unless it is nil.
+func Reactions(db *gorm.DB, messageIDs []uint64, userID uuid.UUID) (map[uint64][]Reaction, error) {
+	reactions := map[uint64][]Reaction{}
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	var rows []struct {
+		MessageID uint64
+		Emoji     string
+		Count     int
+		Mine      bool
+	}
+	err := db.Model(&models.ChatReaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS mine", userID).
+		Where("message_id IN ?", messageIDs).
+		Group("message_id, emoji").
+		Order("message_id, MIN(id)").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		reactions[row.MessageID] = append(reactions[row.MessageID], Reaction{Emoji: row.Emoji, Count: row.Count, Mine: row.Mine})
+	}
+	return reactions, nil
+}
+
+// React adds or removes the reaction of a user to a message and returns the
+// message and its reactions after the change. Adding twice is no change.
+func React(tx *gorm.DB, userID uuid.UUID, messageID uint64, emoji string, add bool) (*models.ChatMessage, []Reaction, error) {
+	if err := checkEmoji(emoji); err != nil {
+		return nil, nil, err
+	}
+	message, _, err := visible(tx, messageID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if add {
+		err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ChatReaction{
+			MessageID: messageID,
+			UserID:    userID,
+			Emoji:     emoji,
+		}).Error
+	} else {
+		err = tx.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).
+			Delete(&models.ChatReaction{}).Error
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Counts go to every member, nothing is mine
+	reactions, err := Reactions(tx, []uint64{messageID}, uuid.Nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, reactions[messageID], nil
+}
+
+// Pin pins or unpins a message. Any member pins in a direct room, admins
+// and the owner in a group.
+func Pin(tx *gorm.DB, userID uuid.UUID, messageID uint64, pin bool) (*models.ChatMessage, error) {
+	message, m, err := visible(tx, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var room models.ChatRoom
+	if err := tx.First(&room, message.RoomID).Error; err != nil {
+		return nil, err
+	}
+	if room.IsGroup && m.Role != models.ChatRoleOwner && m.Role != models.ChatRoleAdmin {
+		return nil, ErrForbidden
+	}
+	if pin == (message.PinnedAt != nil) {
+		return message, nil
+	}
+
+	if pin {
+		var count int64
+		if err := tx.Model(&models.ChatMessage{}).
+			Where("room_id = ? AND pinned_at IS NOT NULL AND is_deleted = ?", message.RoomID, false).
+			Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count >= MaxPins {
+			return nil, ErrTooManyPins
+		}
+		now := time.Now()
+		message.PinnedAt = &now
+		message.PinnedBy = &userID
+	} else {
+		message.PinnedAt = nil
+		message.PinnedBy = nil
+	}
+	err = tx.Model(message).Updates(map[string]interface{}{
+		"pinned_at": message.PinnedAt,
+		"pinned_by": message.PinnedBy,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Forward copies a message into another room the user sends to. The copy
+// keeps a reference to the original message and its author, also when the
+// original was a forward itself, and gets copies of its attachments. On
+// error, the caller deletes the attachments returned with the message from
+// disk, see chatfiles.Copy.
+func Forward(tx *gorm.DB, config *initializers.Config, user models.UserResponse, messageID, roomID uint64) (*models.ChatMessage, error) {
+	original, _, err := visible(tx, messageID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := member(tx, roomID, user.ID)
+	if errors.Is(err, ErrNotMember) {
+		return nil, ErrNotSendable
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !target.IsSubscribed {
+		return nil, ErrNotSendable
+	}
+	var attachments []models.ChatAttachment
+	if err := tx.Where("message_id = ?", original.ID).Order("id").Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+
+	message := &models.ChatMessage{
+		Content:             original.Content,
+		UserID:              user.ID,
+		RoomID:              roomID,
+		MsgType:             original.MsgType,
+		JsonData:            original.JsonData,
+		ForwardedFromID:     &original.ID,
+		ForwardedFromUserID: &original.UserID,
+	}
+	if original.ForwardedFromID != nil {
+		message.ForwardedFromID = original.ForwardedFromID
+		message.ForwardedFromUserID = original.ForwardedFromUserID
+	}
+	if err := tx.Create(message).Error; err != nil {
+		return nil, err
+	}
+	if message.Attachments, err = chatfiles.Copy(tx, config, user, roomID, message.ID, attachments); err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.ChatRoom{}).Where("id = ?", roomID).Update("last_message_id", message.ID).Error; err != nil {
+		return message, err
+	}
+	return message, nil
+}
@@ -0,0 +1,357 @@
+// Package chatsync reads chat history page by page and tells reconnecting
+// clients what changed while they were away.
+//
+// Every insert or update of a room or a message stores the ID of its
+// transaction in the version column; a change of a member stores it in the
+// room and a reaction in its message (see the triggers in migrate). A sync
+// cursor is the oldest transaction still running when the changes were
+// read: everything older was visible to the read, everything newer is read
+// again next time. So no change is lost, whatever order transactions commit
+// in, and a change can come twice; clients replace what they have by ID.
+package chatsync
+
+import (
+	"errors"
+	"time"
+
+	"hyperpage/chatmessages"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageSize = 30
+	MaxPageSize     = 100
+	// MaxChanges bounds the messages of a sync. A client that missed more
+	// starts over from the rooms and their latest page.
+	MaxChanges = 500
+)
+
+var ErrNotMember = errors.New("user is not a member of the room or room does not exist")
+
+// Message is a chat message without the profile of its sender, which is
+// sent once per page in Users.
+type Message struct {
+	ID              uint64                  `json:"id"`
+	RoomID          uint64                  `json:"roomId"`
+	UserID          uuid.UUID               `json:"userId"`
+	Content         string                  `json:"content"`
+	MsgType         uint8                   `json:"msgType"`
+	JsonData        *string                 `json:"jsonData,omitempty"`
+	ParentMessageID *uint64                 `json:"parentMessageId,omitempty"`
+	IsEdited        bool                    `json:"isEdited"`
+	IsDeleted       bool                    `json:"isDeleted"`
+	CreatedAt       time.Time               `json:"createdAt"`
+	Attachments     []models.ChatAttachment `json:"attachments,omitempty"`
+	Reactions       []chatmessages.Reaction `json:"reactions,omitempty"`
+	PinnedAt        *time.Time              `json:"pinnedAt,omitempty"`
+	PinnedBy        *uuid.UUID              `json:"pinnedBy,omitempty"`
+	// Forwards point to the original message and its author
+	ForwardedFromID     *uint64    `json:"forwardedFromId,omitempty"`
+	ForwardedFromUserID *uuid.UUID `json:"forwardedFromUserId,omitempty"`
+	Version             uint64     `json:"version"`
+}
+
+// User is what a chat shows about a sender or a member.
+type User struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Photo string    `json:"photo"`
+}
+
+// Member is a member of a room with its read pointer.
+type Member struct {
+	UserID            uuid.UUID `json:"userId"`
+	Role              string    `json:"role"`
+	IsSubscribed      bool      `json:"isSubscribed"`
+	IsNew             bool      `json:"isNew"`
+	IsUnread          bool      `json:"isUnread"`
+	LastReadMessageID *uint64   `json:"lastReadMessageId"`
+	JoinedAt          time.Time `json:"joinedAt"`
+}
+
+// Room is a chat room with its members.
+type Room struct {
+	ID            uint64     `json:"id"`
+	Name          string     `json:"name"`
+	IsGroup       bool       `json:"isGroup"`
+	Title         string     `json:"title,omitempty"`
+	Avatar        string     `json:"avatar,omitempty"`
+	OwnerID       *uuid.UUID `json:"ownerId,omitempty"`
+	MaxMembers    int        `json:"maxMembers,omitempty"`
+	LastMessageID *uint64    `json:"lastMessageId"`
+	BumpedAt      time.Time  `json:"bumpedAt"`
+	Members       []Member   `json:"members"`
+	Version       uint64     `json:"version"`
+}
+
+// Page is a page of the history of a room, oldest message first.
+type Page struct {
+	Messages []Message `json:"messages"`
+	Users    []User    `json:"users"`
+	// HasMore tells whether there are messages beyond the page in the
+	// direction it was read.
+	HasMore bool `json:"hasMore"`
+}
+
+// Changes is what changed in the rooms of a user since a version.
+type Changes struct {
+	// Version is the cursor of the next sync.
+	Version uint64 `json:"version"`
+	// Reset is set when too much changed; Rooms has every room then and
+	// Messages is empty, so the client reloads the latest pages.
+	Reset bool `json:"reset"`
+	// RoomIDs has every room of the user, the client drops the others.
+	RoomIDs  []uint64  `json:"roomIds"`
+	Rooms    []Room    `json:"rooms"`
+	Messages []Message `json:"messages"`
+	Users    []User    `json:"users"`
+}
+
+func toMessage(message models.ChatMessage, reactions []chatmessages.Reaction) Message {
+	m := Message{
+		ID:              message.ID,
+		RoomID:          message.RoomID,
+		UserID:          message.UserID,
+		Content:         message.Content,
+		MsgType:         message.MsgType,
+		JsonData:        message.JsonData,
+		ParentMessageID: message.ParentMessageID,
+		IsEdited:        message.IsEdited,
+		IsDeleted:       message.IsDeleted,
+		CreatedAt:       message.CreatedAt,
+		Attachments:     message.Attachments,
+		Reactions:       reactions,
+		PinnedAt:        message.PinnedAt,
+		PinnedBy:        message.PinnedBy,
+		Version:         message.Version,
+
+		ForwardedFromID:     message.ForwardedFromID,
+		ForwardedFromUserID: message.ForwardedFromUserID,
+	}
+	if m.IsDeleted {
+		m.Content = ""
+		m.JsonData = nil
+		m.Attachments = nil
+		m.Reactions = nil
+		m.PinnedAt = nil
+		m.PinnedBy = nil
+	}
+	return m
+}
+
+// toMessages converts messages for a user and adds their senders and the
+// authors of forwards to people.
+func toMessages(db *gorm.DB, userID uuid.UUID, messages []models.ChatMessage, people map[uuid.UUID]bool) ([]Message, error) {
+	ids := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	reactions, err := chatmessages.Reactions(db, ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		list = append(list, toMessage(message, reactions[message.ID]))
+		people[message.UserID] = true
+		if message.ForwardedFromUserID != nil {
+			people[*message.ForwardedFromUserID] = true
+		}
+	}
+	return list, nil
+}
+
+func toRoom(room models.ChatRoom) Room {
+	r := Room{
+		ID:            room.ID,
+		Name:          room.Name,
+		IsGroup:       room.IsGroup,
+		Title:         room.Title,
+		Avatar:        room.Avatar,
+		OwnerID:       room.OwnerID,
+		MaxMembers:    room.MaxMembers,
+		LastMessageID: room.LastMessageID,
+		BumpedAt:      room.BumpedAt,
+		Members:       make([]Member, 0, len(room.Members)),
+		Version:       room.Version,
+	}
+	for _, member := range room.Members {
+		r.Members = append(r.Members, Member{
+			UserID:            member.UserID,
+			Role:              member.Role,
+			IsSubscribed:      member.IsSubscribed,
+			IsNew:             member.IsNew,
+			IsUnread:          member.IsUnread,
+			LastReadMessageID: member.LastReadMessageID,
+			JoinedAt:          member.JoinedAt,
+		})
+	}
+	return r
+}
+
+func users(db *gorm.DB, ids map[uuid.UUID]bool) ([]User, error) {
+	list := []User{}
+	if len(ids) == 0 {
+		return list, nil
+	}
+	keys := make([]uuid.UUID, 0, len(ids))
+	for id := range ids {
+		keys = append(keys, id)
+	}
+	err := db.Model(&models.User{}).Select("id, name, photo").Where("id IN ?", keys).Find(&list).Error
+	return list, err
+}
+
+// IsMember reports whether a user is a member of a room.
+func IsMember(db *gorm.DB, roomID uint64, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := db.Model(&models.ChatRoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// History returns a page of a room for one of its members: the messages
+// before a message ID, after one, or the latest without either.
+func History(db *gorm.DB, userID uuid.UUID, roomID, before, after uint64, limit int) (*Page, error) {
+	if member, err := IsMember(db, roomID, userID); err != nil {
+		return nil, err
+	} else if !member {
+		return nil, ErrNotMember
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	query := db.Model(&models.ChatMessage{}).Where("room_id = ?", roomID).Preload("Attachments").Limit(limit + 1)
+	if after > 0 {
+		query = query.Where("id > ?", after).Order("id")
+	} else {
+		if before > 0 {
+			query = query.Where("id < ?", before)
+		}
+		query = query.Order("id DESC")
+	}
+	var messages []models.ChatMessage
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	page := &Page{HasMore: len(messages) > limit}
+	if page.HasMore {
+		messages = messages[:limit]
+	}
+	if after == 0 {
+		// Read newest first, shown oldest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	people := map[uuid.UUID]bool{}
+	var err error
+	if page.Messages, err = toMessages(db, userID, messages, people); err != nil {
+		return nil, err
+	}
+	if page.Users, err = users(db, people); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Pinned returns the pinned messages of a room for one of its members, the
+// latest pin first.
+func Pinned(db *gorm.DB, userID uuid.UUID, roomID uint64) (*Page, error) {
+	if member, err := IsMember(db, roomID, userID); err != nil {
+		return nil, err
+	} else if !member {
+		return nil, ErrNotMember
+	}
+
+	var messages []models.ChatMessage
+	err := db.Where("room_id = ? AND pinned_at IS NOT NULL AND is_deleted = ?", roomID, false).
+		Preload("Attachments").
+		Order("pinned_at DESC").
+		Limit(chatmessages.MaxPins).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	people := map[uuid.UUID]bool{}
+	if page.Messages, err = toMessages(db, userID, messages, people); err != nil {
+		return nil, err
+	}
+	if page.Users, err = users(db, people); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Since returns what changed in the rooms of a user since a version. The
+// first sync, from version 0, returns the rooms only; their history comes
+// page by page.
+func Since(db *gorm.DB, userID uuid.UUID, version uint64) (*Changes, error) {
+	changes := &Changes{Rooms: []Room{}, Messages: []Message{}}
+
+	// Read the cursor before the changes, see the package comment
+	if err := db.Raw("SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint").Scan(&changes.Version).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(&models.ChatRoomMember{}).Where("user_id = ?", userID).Order("room_id").Pluck("room_id", &changes.RoomIDs).Error; err != nil {
+		return nil, err
+	}
+	if changes.RoomIDs == nil {
+		changes.RoomIDs = []uint64{}
+	}
+	if len(changes.RoomIDs) == 0 {
+		changes.Users = []User{}
+		return changes, nil
+	}
+
+	var messages []models.ChatMessage
+	if version > 0 {
+		err := db.Where("room_id IN ? AND version >= ?", changes.RoomIDs, version).
+			Preload("Attachments").
+			Order("id").
+			Limit(MaxChanges + 1).
+			Find(&messages).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	changes.Reset = version == 0 || len(messages) > MaxChanges
+
+	rooms := db.Where("id IN ?", changes.RoomIDs).Preload("Members")
+	if !changes.Reset {
+		rooms = rooms.Where("version >= ?", version)
+	}
+	var changed []models.ChatRoom
+	if err := rooms.Order("id").Find(&changed).Error; err != nil {
+		return nil, err
+	}
+
+	people := map[uuid.UUID]bool{}
+	for _, room := range changed {
+		changes.Rooms = append(changes.Rooms, toRoom(room))
+		for _, member := range room.Members {
+			people[member.UserID] = true
+		}
+	}
+	var err error
+	if !changes.Reset {
+		if changes.Messages, err = toMessages(db, userID, messages, people); err != nil {
+			return nil, err
+		}
+	}
+	if changes.Users, err = users(db, people); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
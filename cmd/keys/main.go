@@ -0,0 +1,120 @@
+// Command keys rotates the RSA keys that sign access and refresh tokens,
+// without signing anybody out. It reads app.env like the server.
+//
+//	go run ./cmd/keys list
+//	go run ./cmd/keys import
+//	go run ./cmd/keys generate -use access
+//	go run ./cmd/keys activate <kid>
+//	go run ./cmd/keys retire <kid>
+//
+// A rotation of the access key:
+//
+//  1. Once, import copies ACCESS_TOKEN_PRIVATE_KEY and
+//     REFRESH_TOKEN_PRIVATE_KEY into the signing_keys table. Until then they
+//     sign as before.
+//  2. generate -use access adds a next key. It is published at
+//     /.well-known/jwks.json right away but signs nothing yet.
+//  3. Wait until every service refreshed its copy of the JWKS: a few
+//     minutes for the API instances and the max-age of the endpoint, longer
+//     if a service caches it longer.
+//  4. activate <kid> makes the new key sign. The old one becomes retiring
+//     and keeps verifying the tokens it signed.
+//  5. After ACCESS_TOKEN_EXPIRED_IN, retire <old kid>. Its private key is
+//     wiped and its tokens are rejected from now on.
+//
+// Refresh keys rotate the same way with -use refresh; their old key retires
+// after REFRESH_TOKEN_EXPIRED_IN, or earlier if signing the remaining
+// sessions out is fine. Once the keys of the environment are imported or
+// retired, the variables can be removed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/signing"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keys list | import | generate -use access|refresh | activate <kid> | retire <kid>")
+	os.Exit(2)
+}
+
+func describe(key models.SigningKey) string {
+	line := fmt.Sprintf("%-43s %-8s %-9s created %s", key.KID, key.Use, key.Status, key.CreatedAt.Format(time.RFC3339))
+	if key.ActivatedAt != nil {
+		line += " activated " + key.ActivatedAt.Format(time.RFC3339)
+	}
+	if key.RetiredAt != nil {
+		line += " retired " + key.RetiredAt.Format(time.RFC3339)
+	}
+	return line
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	config, err := initializers.LoadConfig(".")
+	if err != nil {
+		log.Fatal("Could not load environment variables: ", err)
+	}
+	initializers.ConnectDB(&config)
+	if err := signing.Configure(&config); err != nil {
+		log.Fatal(err)
+	}
+	db := initializers.DB
+
+	args := os.Args[2:]
+	var key *models.SigningKey
+	switch os.Args[1] {
+	case "list":
+		keys, err := signing.List(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range keys {
+			fmt.Println(describe(key))
+		}
+		return
+	case "import":
+		keys, err := signing.Import(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(keys) == 0 {
+			fmt.Println("Nothing to import")
+		}
+		for _, key := range keys {
+			fmt.Println("Imported", describe(key))
+		}
+		return
+	case "generate":
+		flags := flag.NewFlagSet("generate", flag.ExitOnError)
+		use := flags.String("use", signing.Access, "access or refresh")
+		flags.Parse(args)
+		key, err = signing.Generate(db, *use)
+	case "activate":
+		if len(args) != 1 {
+			usage()
+		}
+		key, err = signing.Activate(db, args[0])
+	case "retire":
+		if len(args) != 1 {
+			usage()
+		}
+		key, err = signing.Retire(db, args[0])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(describe(*key))
+}
@@ -26,12 +26,21 @@ import (
 	"hyperpage/routes/api"
 	routes_paxcall "hyperpage/routes/paxcall"
 
+	"hyperpage/accounts"
+	"hyperpage/chatfiles"
 	"hyperpage/controllers"
+	"hyperpage/currency"
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/oidc"
+	"hyperpage/permissions"
+	"hyperpage/promotions"
 
 	// "hyperpage/meta/network"
 	"hyperpage/routes"
+	"hyperpage/signing"
+	"hyperpage/statements"
+	"hyperpage/subscriptions"
 	"hyperpage/utils"
 
 	"github.com/pion/webrtc/v3"
@@ -92,6 +101,22 @@ func init() {
 	initializers.ConnectDB(&config)
 	initializers.ConnectRedis(&config)
 	initializers.ConnectTelegram(&config)
+
+	if config.ExchangeRatesFile != "" {
+		if err := currency.LoadFile(initializers.DB, config.ExchangeRatesFile); err != nil {
+			log.Println("Failed to load exchange rates:", err)
+		}
+	}
+
+	oidc.FromConfig(&config)
+
+	if err := signing.Configure(&config); err != nil {
+		log.Println("Failed to load token signing keys:", err)
+	}
+
+	if err := permissions.Seed(initializers.DB); err != nil {
+		log.Println("Failed to seed roles:", err)
+	}
 }
 
 // @title Paxintrade core api
@@ -197,6 +222,12 @@ func main() {
 		ServerHeader: "paxintrade",
 		Views:        engine,
 		BodyLimit:    20 * 1024 * 1024, // 20 MB
+		// c.IP() is the client nginx passes in X-Real-IP, the header is
+		// ignored on requests that do not come from a trusted proxy
+		ProxyHeader:             "X-Real-IP",
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          config.TrustedProxies,
+		EnableIPValidation:      true,
 	})
 
 	micro_paxcall := fiber.New(fiber.Config{
@@ -213,7 +244,8 @@ func main() {
 
 	//VIEWS
 	routes.SwaggerRoute(app) // Register a route for API Docs (Swagger).
-	routes.MainView(app)     // Main page
+	routes.WellKnownRoute(app)
+	routes.MainView(app) // Main page
 
 	//API'S
 	api.Register(micro)
@@ -294,17 +326,7 @@ func main() {
 			}
 
 			if messageData.MessageType == "getADS" {
-				var blogs []models.Blog
-				err := initializers.DB.
-					Preload("Photos").
-					Preload("City.Translations", "language = ?", language).
-					Preload("Catygory.Translations", "language = ?", language).
-					Preload("User").
-					Preload("Hashtags").
-					Order("RANDOM()").
-					Limit(2).
-					Find(&blogs).
-					Error
+				blogs, err := liveAds(language, 2)
 				if err != nil {
 					fmt.Println("error fetching random blogs:", err)
 					// bufferPool.ReleaseBuffer(buffer)
@@ -374,23 +396,13 @@ func main() {
 				ClientsLock.Unlock()
 
 				if hasActiveClients {
-					var blog models.Blog
-					err := initializers.DB.
-						Preload("Photos").
-						Preload("City.Translations", "language = ?", lang).
-						Preload("Catygory.Translations", "language = ?", lang).
-						Preload("User").
-						Preload("Hashtags").
-						Order("RANDOM()").
-						Limit(1).
-						First(&blog).
-						Error
-					if err != nil {
+					blogs, err := liveAds(lang, 1)
+					if err != nil || len(blogs) == 0 {
 						fmt.Println("error fetching random blog:", err)
 						continue
 					}
 
-					blogJSON, err := json.Marshal(blog)
+					blogJSON, err := json.Marshal(blogs[0])
 					if err != nil {
 						fmt.Println("error encoding blog to JSON:", err)
 						continue
@@ -480,9 +492,7 @@ func main() {
 
 		if authToken != "" {
 
-			xconfig, _ := initializers.LoadConfig(".")
-
-			tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
+			tokenClaims, err := utils.ValidateToken(authToken, signing.Access)
 			if err != nil {
 				fmt.Println("TOKEN DIE")
 
@@ -628,9 +638,7 @@ func main() {
 
 			if authToken != "" {
 
-				xconfig, _ := initializers.LoadConfig(".")
-
-				tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
+				tokenClaims, err := utils.ValidateToken(authToken, signing.Access)
 				if err != nil {
 					// handle error
 					_ = err
@@ -803,9 +811,7 @@ func main() {
 						continue
 					}
 
-					xconfig, _ := initializers.LoadConfig(".")
-
-					tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
+					tokenClaims, err := utils.ValidateToken(authToken, signing.Access)
 					if err != nil {
 						log.Printf("Error validating token: %s", err)
 						continue
@@ -1139,13 +1145,35 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Settle promotion auctions shortly before their windows start
+	auctionTicker := time.NewTicker(15 * time.Minute)
+	defer auctionTicker.Stop()
+	go func() {
+		for range auctionTicker.C {
+			promotions.RunAuctions(initializers.DB, time.Now())
+		}
+	}()
+
+	// Purge accounts whose deletion grace period is over, and chat uploads
+	// no message took
+	deletionTicker := time.NewTicker(time.Hour)
+	defer deletionTicker.Stop()
+	go func() {
+		for range deletionTicker.C {
+			accounts.PurgeDue(initializers.DB, &config2, time.Now())
+			chatfiles.PruneUnattached(initializers.DB, &config2, time.Now().Add(-chatfiles.UnattachedTTL))
+		}
+	}()
+
 	// Get a channel that continuously receives updates from the chat.
 	defer ticker.Stop()
 	go func() {
 		for range ticker.C {
 			// utils.CheckExpiration(bot)
 			utils.MoveToArch(bot)
-			utils.CheckPlan(bot)
+			subscriptions.ProcessRenewals(initializers.DB, time.Now())
+			statements.SendScheduled(initializers.DB, &config2, time.Now())
+			controllers.PruneChatCDC(time.Now().Add(-24 * time.Hour))
 			utils.CheckSite(bot)
 			utils.CheckSiteTime(bot)
 		}
@@ -1494,6 +1522,46 @@ func main() {
 
 }
 
+// liveAds returns blogs for the live ad feed. Blogs holding a promotion slot
+// of the main feed go first, random blogs fill the rest.
+func liveAds(language string, limit int) ([]models.Blog, error) {
+	preload := func() *gorm.DB {
+		return initializers.DB.
+			Preload("Photos").
+			Preload("City.Translations", "language = ?", language).
+			Preload("Catygory.Translations", "language = ?", language).
+			Preload("User").
+			Preload("Hashtags")
+	}
+
+	ids, err := promotions.Promoted(initializers.DB, models.PromotionScopeAll, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var blogs []models.Blog
+	if len(ids) > 0 {
+		err := preload().Where("id IN ?", ids).Order("RANDOM()").Limit(limit).Find(&blogs).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(blogs) < limit {
+		var rest []models.Blog
+		query := preload().Order("RANDOM()").Limit(limit - len(blogs))
+		if len(ids) > 0 {
+			query = query.Where("id NOT IN ?", ids)
+		}
+		if err := query.Find(&rest).Error; err != nil {
+			return nil, err
+		}
+		blogs = append(blogs, rest...)
+	}
+
+	return blogs, nil
+}
+
 // currentTime := time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC) // Set the desired date and time for testing
 // if currentDay == time.Date(currentYear, currentMonth, time.Date(currentYear, currentMonth+1, 0, 0, 0, 0, 0, time.UTC).Day(), 23, 59, 0, 0, time.UTC).Day() {
 // WORKING RESET TIMER FIRST EXP
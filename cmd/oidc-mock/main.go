@@ -0,0 +1,28 @@
+// Command oidc-mock serves a local OpenID provider for trying social sign in
+// without real Google, Yandex or Apple credentials. Point OIDC_MOCK_ISSUER at
+// it and pass the email to sign in as in the login_hint of the authorization
+// URL.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"hyperpage/oidc"
+)
+
+func main() {
+	addr := flag.String("addr", ":9096", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9096", "issuer URL as seen by the API")
+	clientID := flag.String("client-id", oidc.MockClientID, "expected client ID")
+	flag.Parse()
+
+	mock, err := oidc.NewMockIssuer(*issuer, *clientID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock OpenID provider %s listening on %s", mock.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mock))
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"hyperpage/accounts"
+	"hyperpage/initializers"
+	"hyperpage/loginguard"
+	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RequestAccountDeletion locks the account of the current user and deletes
+// it once the grace period is over. Every session ends, and the cancel link
+// is sent by email.
+func RequestAccountDeletion(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+	config, _ := initializers.LoadConfig(".")
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userResp.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "User not found"})
+	}
+
+	deletion, token, err := accounts.Request(initializers.DB, &config, user.ID, time.Now())
+	if errors.Is(err, accounts.ErrAlreadyRequested) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to request account deletion"})
+	}
+
+	if err := sessions.RevokeAll(c.Context(), user.ID.String(), ""); err != nil {
+		log.Printf("Failed to end sessions of %s after deletion request: %v", user.ID, err)
+	}
+	initializers.DB.Model(&user).Update("online", false)
+
+	language, _ := c.Locals("language").(string)
+	sendDeletionEmail(&user, token, language)
+
+	return c.JSON(fiber.Map{"status": "success", "data": fiber.Map{"deletion": deletion}})
+}
+
+func sendDeletionEmail(user *models.User, token, language string) {
+	config, _ := initializers.LoadConfig(".")
+
+	firstName := user.Name
+	if strings.Contains(firstName, " ") {
+		firstName = strings.Split(firstName, " ")[1]
+	}
+
+	emailData := utils.EmailData{
+		URL:       "https://www." + config.ClientOrigin + "/auth/deletion/cancel/" + token,
+		FirstName: firstName,
+	}
+
+	switch language {
+	case "ru":
+		emailData.Subject = "Ваш аккаунт будет удалён"
+	default:
+		language = "en"
+		emailData.Subject = "Your account is scheduled for deletion"
+	}
+
+	utils.SendEmail(user, &emailData, "accountDeletion", language)
+}
+
+// CancelAccountDeletion keeps an account with the token from the deletion
+// email. The user signs in again afterwards.
+func CancelAccountDeletion(c *fiber.Ctx) error {
+	userID, err := accounts.Cancel(initializers.DB, c.Params("cancelToken"))
+	if errors.Is(err, accounts.ErrInvalidCancel) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The cancel link is invalid or the account is already deleted"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to cancel account deletion"})
+	}
+
+	log.Printf("Deletion of account %s cancelled", userID)
+
+	return c.JSON(fiber.Map{"status": "success", "message": "Account deletion cancelled, you can sign in again"})
+}
+
+// deletionPending refuses to sign in an account that waits for deletion.
+func deletionPending(c *fiber.Ctx, user *models.User) (bool, error) {
+	deletion, pending, err := accounts.Pending(initializers.DB, user.ID)
+	if err != nil {
+		return true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+	if !pending {
+		return false, nil
+	}
+	return true, c.Status(fiber.StatusLocked).JSON(fiber.Map{
+		"status":       "fail",
+		"message":      "deletion_pending",
+		"scheduledFor": deletion.ScheduledFor,
+	})
+}
+
+// ExportMyData downloads a ZIP with the profile, blogs, chat history,
+// transactions and uploaded files of the current user.
+func ExportMyData(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+	config, _ := initializers.LoadConfig(".")
+
+	language, ok := c.Locals("language").(string)
+	if !ok {
+		language = "en"
+	}
+
+	var buf bytes.Buffer
+	if err := accounts.Export(initializers.DB, &config, userResp.ID, language, &buf); err != nil {
+		log.Printf("Failed to export data of %s: %v", userResp.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to export your data"})
+	}
+
+	c.Attachment("myru-data-" + time.Now().Format("2006-01-02") + ".zip")
+	return c.Send(buf.Bytes())
+}
+
+// RequestEmailChange sends a confirmation link to a new email and a notice
+// to the current one, which stays in use until the link is followed.
+// Accounts with a password confirm it.
+func RequestEmailChange(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+	config, _ := initializers.LoadConfig(".")
+	language := c.Query("language")
+
+	var payload struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	email := loginguard.NormalizeEmail(payload.Email)
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid email"})
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userResp.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "User not found"})
+	}
+	if email == user.Email {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "This is already your email"})
+	}
+	if user.Provider == "local" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Invalid password"})
+		}
+	}
+
+	token, err := accounts.RequestEmailChange(c.Context(), initializers.DB, user.ID, email)
+	if errors.Is(err, accounts.ErrEmailTaken) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to request email change"})
+	}
+
+	firstName := user.Name
+	if strings.Contains(firstName, " ") {
+		firstName = strings.Split(firstName, " ")[1]
+	}
+	confirm := utils.EmailData{
+		URL:       "https://www." + config.ClientOrigin + "/auth/change-email/" + token,
+		FirstName: firstName,
+	}
+	notice := utils.EmailData{
+		FirstName: firstName,
+		Email:     email,
+	}
+	switch language {
+	case "ru":
+		confirm.Subject = "Подтвердите новый адрес электронной почты"
+		notice.Subject = "Запрошена смена адреса электронной почты"
+	default:
+		language = "en"
+		confirm.Subject = "Confirm your new email"
+		notice.Subject = "A change of your email was requested"
+	}
+
+	// The link goes to the new address, the notice to the one in use
+	recipient := user
+	recipient.Email = email
+	go utils.SendEmail(&recipient, &confirm, "changeEmail", language)
+	go utils.SendEmail(&user, &notice, "emailChangeNotice", language)
+
+	return c.JSON(fiber.Map{"status": "success", "message": "A confirmation link was sent to the new email"})
+}
+
+// GetEmailChange returns the email the current user is changing to, or an
+// empty string.
+func GetEmailChange(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+
+	email, err := accounts.PendingEmailChange(c.Context(), userResp.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to load email change"})
+	}
+	return c.JSON(fiber.Map{"status": "success", "data": fiber.Map{"email": email}})
+}
+
+// CancelEmailChange drops the pending email change of the current user.
+func CancelEmailChange(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+
+	if err := accounts.CancelEmailChange(c.Context(), userResp.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to cancel email change"})
+	}
+	return c.JSON(fiber.Map{"status": "success", "message": "Email change cancelled"})
+}
+
+// ConfirmEmailChange moves the account to the new email with the token from
+// the confirmation link and ends every session, so devices sign in again
+// with the new address.
+func ConfirmEmailChange(c *fiber.Ctx) error {
+	user, change, err := accounts.ConfirmEmailChange(c.Context(), initializers.DB, c.Params("changeToken"))
+	if errors.Is(err, accounts.ErrInvalidEmailChange) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The confirmation link is invalid or has expired"})
+	}
+	if errors.Is(err, accounts.ErrEmailTaken) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to change email"})
+	}
+
+	if err := sessions.RevokeAll(c.Context(), user.ID.String(), ""); err != nil {
+		log.Printf("Failed to end sessions of %s after email change: %v", user.ID, err)
+	}
+	loginguard.Record(initializers.DB, loginguard.EventEmailChanged, change.NewEmail, c.IP(), "from "+user.Email)
+
+	return c.JSON(fiber.Map{"status": "success", "message": "Email changed, please sign in again"})
+}
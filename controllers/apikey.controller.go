@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+
+	"hyperpage/apikeys"
+	"hyperpage/initializers"
+	"hyperpage/models"
+)
+
+// apiKeyActsFor reports whether the API key of the request may act for a
+// user: system keys act for anyone, user keys for their owner only.
+func apiKeyActsFor(c *fiber.Ctx, userID string) bool {
+	key, ok := c.Locals("api_key").(*models.APIKey)
+	if !ok {
+		return false
+	}
+	return key.UserID == nil || key.UserID.String() == userID
+}
+
+// isBotUser keeps bot keys away from the profiles of people.
+func isBotUser(userID string) bool {
+	var count int64
+	initializers.DB.Model(&models.User{}).Where("id = ? AND is_bot = ?", userID, true).Count(&count)
+	return count > 0
+}
+
+func GetAPIKeys(c *fiber.Ctx) error {
+	query := initializers.DB.Order("created_at DESC")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if c.Query("revoked") != "true" {
+		query = query.Where("revoked_at IS NULL")
+	}
+
+	var keys []models.APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch API keys",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   keys,
+		"meta":   fiber.Map{"scopes": apikeys.Known},
+	})
+}
+
+// CreateAPIKey issues a key for a user, or for the system when user_id is
+// empty. The key is shown only in this response.
+func CreateAPIKey(c *fiber.Ctx) error {
+	admin := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Name      string     `json:"name"`
+		UserID    string     `json:"user_id"`
+		Scopes    []string   `json:"scopes"`
+		RateLimit int        `json:"rate_limit"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	var owner *uuid.UUID
+	if payload.UserID != "" {
+		id, err := uuid.FromString(payload.UserID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid user ID",
+			})
+		}
+		var count int64
+		initializers.DB.Model(&models.User{}).Where("id = ?", id).Count(&count)
+		if count == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "User not found",
+			})
+		}
+		owner = &id
+	}
+
+	key, raw, err := apikeys.Create(initializers.DB, payload.Name, owner, payload.Scopes, payload.RateLimit, payload.ExpiresAt, admin.ID)
+	if err != nil {
+		return apiKeyError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   key,
+		"key":    raw,
+	})
+}
+
+// RotateAPIKey replaces the secret of a key. The old secret keeps working
+// for a day.
+func RotateAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid API key ID",
+		})
+	}
+
+	key, raw, err := apikeys.Rotate(initializers.DB, id, time.Now())
+	if err != nil {
+		return apiKeyError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   key,
+		"key":    raw,
+	})
+}
+
+func RevokeAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid API key ID",
+		})
+	}
+
+	if err := apikeys.Revoke(initializers.DB, id, time.Now()); err != nil {
+		return apiKeyError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func apiKeyError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, apikeys.ErrKeyNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "API key not found",
+		})
+	case errors.Is(err, apikeys.ErrUnknownScope):
+		message = "Unknown or missing scope"
+	case errors.Is(err, apikeys.ErrSystemScope):
+		message = "This scope is for system keys only"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update API key",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
@@ -15,7 +15,11 @@ import (
 	uuid "github.com/satori/go.uuid"
 
 	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/loginguard"
 	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/signing"
 	"hyperpage/utils"
 
 	"io"
@@ -24,6 +28,22 @@ import (
 	"gorm.io/gorm"
 )
 
+// createWithBonus inserts a user together with the registration bonus, so
+// a wallet never exists without the ledger entry of its opening balance.
+func createWithBonus(user *models.User) error {
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		_, err := ledger.Credit(tx, user.ID, ledger.AccountBonus, 100, ledger.Posting{
+			Module:      `Registration`,
+			Description: `Бонус за регистрацию`,
+			Status:      `CLOSED_1`,
+		})
+		return err
+	})
+}
+
 func SignUpUser(c *fiber.Ctx) error {
 	config, _ := initializers.LoadConfig(".")
 
@@ -78,12 +98,11 @@ func SignUpUser(c *fiber.Ctx) error {
 		Photo:         dirName + "/default.jpg",
 	}
 
-	result := initializers.DB.Create(&newUser)
-
-	if result.Error != nil && strings.Contains(result.Error.Error(), "duplicate key value violates unique") {
+	if err := createWithBonus(&newUser); err != nil && strings.Contains(err.Error(), "duplicate key value violates unique") {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": "User with that email already exists"})
-	} else if result.Error != nil {
-		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "error", "message": "Something bad happened"})
+	} else if err != nil {
+		log.Println("Failed to create user:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to create user"})
 	}
 
 	code := make([]byte, 20)
@@ -126,21 +145,6 @@ func SignUpUser(c *fiber.Ctx) error {
 		emailData.Subject = "MYRUONLINE account activation"
 	}
 
-	billing := models.Billing{
-		UserID: newUser.ID,
-		Amount: 100,
-	}
-
-	transaction := models.Transaction{
-		UserID:      newUser.ID,
-		Total:       `0`,
-		Amount:      100,
-		Description: `Бонус за регистрацию`,
-		Module:      `Registration`,
-		Type:        `profit`,
-		Status:      `CLOSED_1`,
-	}
-
 	// Create and save the OnlineStorage object to the database
 	onlineStorage := models.OnlineStorage{
 		UserID: newUser.ID,
@@ -149,8 +153,6 @@ func SignUpUser(c *fiber.Ctx) error {
 	}
 
 	initializers.DB.Create(&onlineStorage)
-	initializers.DB.Create(&transaction)
-	initializers.DB.Create(&billing)
 
 	utils.SendEmail(&newUser, &emailData, "verificationCode", language)
 
@@ -213,12 +215,11 @@ func SignUpBot(c *fiber.Ctx) error {
 		Verified:      true,
 	}
 
-	result := initializers.DB.Create(&newUser)
-
-	if result.Error != nil && strings.Contains(result.Error.Error(), "duplicate key value violates unique") {
+	if err := createWithBonus(&newUser); err != nil && strings.Contains(err.Error(), "duplicate key value violates unique") {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": "User with that email already exists"})
-	} else if result.Error != nil {
-		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "error", "message": "Something bad happened"})
+	} else if err != nil {
+		log.Println("Failed to create user:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to create user"})
 	}
 
 	code := make([]byte, 20)
@@ -234,21 +235,6 @@ func SignUpBot(c *fiber.Ctx) error {
 	newUser.TelegramToken = TokenCode
 	initializers.DB.Save(newUser)
 
-	billing := models.Billing{
-		UserID: newUser.ID,
-		Amount: 100,
-	}
-
-	transaction := models.Transaction{
-		UserID:      newUser.ID,
-		Total:       `0`,
-		Amount:      100,
-		Description: `Бонус за регистрацию`,
-		Module:      `Registration`,
-		Type:        `profit`,
-		Status:      `CLOSED_1`,
-	}
-
 	// Create and save the OnlineStorage object to the database
 	onlineStorage := models.OnlineStorage{
 		UserID: newUser.ID,
@@ -261,8 +247,6 @@ func SignUpBot(c *fiber.Ctx) error {
 	}
 
 	initializers.DB.Create(&onlineStorage)
-	initializers.DB.Create(&transaction)
-	initializers.DB.Create(&billing)
 	initializers.DB.Create(&profile)
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"status": "success", "data": fiber.Map{"user": models.FilterUserRecord(&newUser, language), "profile": profile}})
@@ -310,11 +294,18 @@ func SignInUser(c *fiber.Ctx) error {
 
 	message := "Invalid email or password"
 
+	// Locked accounts and addresses with too many failures wait
+	email := loginguard.NormalizeEmail(payload.Email)
+	if wait, err := guardSignIn(c, email); err != nil {
+		return throttled(c, wait, err)
+	}
+
 	// Find the user by email
 	var user models.User
 	err := initializers.DB.Where("email = ?", strings.ToLower(payload.Email)).First(&user).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
+			signInFailed(c, email, nil)
 			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": message})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
@@ -328,61 +319,72 @@ func SignInUser(c *fiber.Ctx) error {
 	// Compare passwords
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password))
 	if err != nil {
+		signInFailed(c, email, &user)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": message})
 	}
+	if err := loginguard.Succeed(c.Context(), email); err != nil {
+		log.Println("Login guard failed to reset failures:", err)
+	}
 
 	// Load configuration
 	config, _ := initializers.LoadConfig(".")
 
-	// Create access and refresh tokens
-	accessTokenDetails, err := utils.CreateToken(user.ID.String(), config.AccessTokenExpiresIn, config.AccessTokenPrivateKey)
+	// Accounts with two-factor authentication, and every admin, give a
+	// second factor before any token is issued
+	required, err := twoFactorRequired(&user)
 	if err != nil {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": "Failed to create access token"})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+	if required {
+		return beginTwoFactor(c, &user, payload.Session)
+	}
+
+	return completeSignIn(c, &config, &user, payload.Session, nil)
+}
+
+// completeSignIn starts the device session of a user whose credentials were
+// accepted and responds with the tokens and any extra fields.
+func completeSignIn(c *fiber.Ctx, config *initializers.Config, user *models.User, session string, extra fiber.Map) error {
+	if pending, err := deletionPending(c, user); pending {
+		return err
 	}
 
-	refreshTokenDetails, err := utils.CreateToken(user.ID.String(), config.RefreshTokenExpiresIn, config.RefreshTokenPrivateKey)
+	// Create access and refresh tokens for a new device session
+	accessTokenDetails, refreshTokenDetails, err := startSession(c, config, user)
 	if err != nil {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": "Failed to create refresh token"})
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": "Failed to create session"})
 	}
 
 	// Update user session and status
-	user.Session = payload.Session
+	user.Session = session
 	user.Online = true
 
 	// Save updated user information to the database
-	if err := initializers.DB.Save(&user).Error; err != nil {
+	if err := initializers.DB.Save(user).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to update user session"})
 	}
 
 	// Set user data in the context
-	c.Locals("user", &user)
+	c.Locals("user", user)
 
 	userID := user.ID.String()
 	var addintinal = ""
 	utils.UserActivity("userOnline", userID, addintinal)
 	// Send a personal message to the client
-	if err := utils.SendPersonalMessageToClient(payload.Session, "Hello Client"); err != nil {
+	if err := utils.SendPersonalMessageToClient(session, "Hello Client"); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to send message to client"})
 	}
 
-	// Set access token cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    *accessTokenDetails.Token,
-		Path:     "/",
-		SameSite: "Lax",
-		MaxAge:   config.AccessTokenMaxAge * 60,
-		Secure:   true,  // Consider setting this to true in production
-		HTTPOnly: false, // Consider making this true for better security
-		Domain:   config.ClientOrigin,
-	})
-
 	// Respond with success and tokens
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+	response := fiber.Map{
 		"status":        "success",
 		"access_token":  accessTokenDetails.Token,
 		"refresh_token": refreshTokenDetails,
-	})
+	}
+	for k, v := range extra {
+		response[k] = v
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
 }
 
 func CheckTokenExp(c *fiber.Ctx) error {
@@ -393,13 +395,15 @@ func CheckTokenExp(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": message})
 	}
 
-	config, _ := initializers.LoadConfig(".")
-
-	tokenClaims, err := utils.ValidateToken(token, config.AccessTokenPublicKey)
+	tokenClaims, err := utils.ValidateToken(token, signing.Access)
 	if err != nil {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
 
+	if _, err := sessions.Check(c.Context(), tokenClaims.TokenUuid); err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "session has been revoked"})
+	}
+
 	var user models.User
 	err = initializers.DB.First(&user, "id = ?", tokenClaims.UserID).Error
 
@@ -414,10 +418,24 @@ func CheckTokenExp(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "message": "access token is valid"})
 }
 
+// RefreshAccessToken exchanges a refresh token, sent in the body or the
+// refresh_token cookie, for a new token pair. Each refresh token works once.
 func RefreshAccessToken(c *fiber.Ctx) error {
 	message := "could not refresh access token"
 
-	refresh_token := c.Params("refreshToken")
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+		}
+	}
+
+	refresh_token := payload.RefreshToken
+	if refresh_token == "" {
+		refresh_token = c.Cookies("refresh_token")
+	}
 
 	if refresh_token == "" {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": message})
@@ -425,7 +443,7 @@ func RefreshAccessToken(c *fiber.Ctx) error {
 
 	config, _ := initializers.LoadConfig(".")
 
-	tokenClaims, err := utils.ValidateToken(refresh_token, config.RefreshTokenPublicKey)
+	tokenClaims, err := utils.ValidateToken(refresh_token, signing.Refresh)
 	if err != nil {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
@@ -441,23 +459,36 @@ func RefreshAccessToken(c *fiber.Ctx) error {
 		}
 	}
 
-	accessTokenDetails, err := utils.CreateToken(user.ID.String(), config.AccessTokenExpiresIn, config.AccessTokenPrivateKey)
+	accessTokenDetails, err := utils.CreateToken(user.ID.String(), config.AccessTokenExpiresIn, signing.Access)
 	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    *accessTokenDetails.Token,
-		Path:     "/",
-		SameSite: "Lax",
-		MaxAge:   config.AccessTokenMaxAge * 60,
-		Secure:   true,
-		HTTPOnly: false,
-		Domain:   config.ClientOrigin,
-	})
+	refreshTokenDetails, err := utils.CreateToken(user.ID.String(), config.RefreshTokenExpiresIn, signing.Refresh)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "access_token": accessTokenDetails.Token})
+	_, err = sessions.Rotate(c.Context(), tokenClaims.TokenUuid, accessTokenDetails, refreshTokenDetails)
+	if errors.Is(err, sessions.ErrReused) {
+		clearTokenCookies(c, &config)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "refresh token was already used, the session has been signed out"})
+	}
+	if errors.Is(err, sessions.ErrRevoked) {
+		clearTokenCookies(c, &config)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "session has been revoked"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": message})
+	}
+
+	setTokenCookies(c, &config, accessTokenDetails, refreshTokenDetails)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":        "success",
+		"access_token":  accessTokenDetails.Token,
+		"refresh_token": refreshTokenDetails,
+	})
 }
 
 func ForgotPassword(c *fiber.Ctx) error {
@@ -480,6 +511,10 @@ func ForgotPassword(c *fiber.Ctx) error {
 		})
 	}
 
+	if wait, err := guardAttempt(c, loginguard.Forgot, loginguard.NormalizeEmail(reqBody.Email)); err != nil {
+		return throttled(c, wait, err)
+	}
+
 	// TODO: Check if the email exists in the database
 	user := new(models.User)
 	result := initializers.DB.Where("email = ?", reqBody.Email).First(user)
@@ -546,6 +581,10 @@ func ResetPassword(c *fiber.Ctx) error {
 	// Get the reset token from the request params
 	resetToken := c.Params("resetToken")
 
+	if wait, err := guardAttempt(c, loginguard.Reset, ""); err != nil {
+		return throttled(c, wait, err)
+	}
+
 	// Get the password from the request body
 	type RequestBody struct {
 		Password        string `json:"password"`
@@ -615,8 +654,12 @@ func ResetPassword(c *fiber.Ctx) error {
 		_ = strings.Split(firstName, " ")[1]
 	}
 
-	// Clear the user's authentication token
+	// Clear the user's authentication token and sign out every device
 	c.ClearCookie("token")
+	if err := sessions.RevokeAll(c.Context(), user.ID.String(), ""); err != nil {
+		log.Println("Failed to revoke sessions after password reset:", err)
+	}
+	clearSignInLock(c.Context(), user.Email)
 
 	// Return success response
 	return c.Status(http.StatusOK).JSON(fiber.Map{
@@ -626,30 +669,6 @@ func ResetPassword(c *fiber.Ctx) error {
 }
 
 func LogoutUser(c *fiber.Ctx) error {
-	// message := "Token is invalid or session has expired"
-
-	// refresh_token := c.Get("refresh_token")
-
-	// if refresh_token == "" {
-	// 	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": message})
-	// }
-
-	// config, _ := initializers.LoadConfig(".")
-	// ctx := context.TODO()
-
-	// tokenClaims, err := utils.ValidateToken(refresh_token, config.RefreshTokenPublicKey)
-	// if err != nil {
-	// 	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
-	// }
-
-	// access_token_uuid := c.Locals("access_token_uuid").(string)
-	// _, err = initializers.RedisClient.Del(ctx, tokenClaims.TokenUuid, access_token_uuid).Result()
-	// if err != nil {
-	// 	return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": err.Error()})
-	// }
-	// Set user data in the context
-
-	config, _ := initializers.LoadConfig(".")
 	user := c.Locals("user")
 	if user == nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "User not found"})
@@ -671,6 +690,12 @@ func LogoutUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "User not found in the database"})
 	}
 
+	// Revoke the session so its access and refresh tokens stop working
+	sessionID, _ := c.Locals("session_id").(string)
+	if err := sessions.Revoke(c.Context(), userModel.ID.String(), sessionID); err != nil && !errors.Is(err, sessions.ErrNotFound) {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+
 	userRecord.Session = ""
 
 	// Сохраните изменения и проверьте запрос
@@ -679,31 +704,8 @@ func LogoutUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    "",
-		Path:     "/",
-		Secure:   true,
-		HTTPOnly: true,
-		Domain:   config.ClientOrigin,
-	})
+	clearTokenCookies(c, &config)
 
-	c.ClearCookie("access_token")
-
-	// c.Cookie(&fiber.Cookie{
-	// 	Name:     "refresh_token",
-	// 	Value:    "",
-	// 	Path:     "/",
-	// 	Secure:   true,
-	// 	HTTPOnly: true,
-	// 	Domain:   config.ClientOrigin,
-	// })
-
-	// c.Cookie(&fiber.Cookie{
-	// 	Name:    "logged_in",
-	// 	Value:   "",
-	// 	Expires: expired,
-	// })
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success"})
 }
 
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"testing"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/testdb"
+)
+
+func TestCreateWithBonus(t *testing.T) {
+	db := testdb.Open(t,
+		&models.User{},
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+	testdb.Use(t, db)
+
+	user := models.User{Name: "newcomer", Email: "newcomer@example.com", Password: "-"}
+	if err := createWithBonus(&user); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := ledger.Balance(db, user.ID); err != nil || balance != 100 {
+		t.Fatalf("balance = %v, %v, want 100", balance, err)
+	}
+	report, err := ledger.Reconcile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Discrepancies) != 0 {
+		t.Fatalf("wallets disagree with the ledger: %+v", report.Discrepancies)
+	}
+}
+
+func TestCreateWithBonusRollsBackUser(t *testing.T) {
+	// No ledger tables, the bonus cannot be credited
+	db := testdb.Open(t, &models.User{})
+	testdb.Use(t, db)
+
+	user := models.User{Name: "newcomer", Email: "newcomer@example.com", Password: "-"}
+	if err := createWithBonus(&user); err == nil {
+		t.Fatal("a user was created without the registration bonus")
+	}
+	var users int64
+	db.Model(&models.User{}).Count(&users)
+	if users != 0 {
+		t.Fatalf("%d users after a failed bonus, want 0", users)
+	}
+}
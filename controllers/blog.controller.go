@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,8 +24,12 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"hyperpage/currency"
 	"hyperpage/initializers"
+	"hyperpage/ledger"
 	"hyperpage/models"
+	"hyperpage/permissions"
+	"hyperpage/promotions"
 	"hyperpage/utils"
 
 	gt "github.com/bas24/googletranslatefree"
@@ -116,6 +121,8 @@ type blogResponse struct {
 	MultilangDescr   models.MultilangTitle `json:"multilangdescr"`
 	MultilangContent models.MultilangTitle `json:"multilangcontent"`
 	Total            float64               `json:"total"`
+	Price            int64                 `json:"price"` // minor units of Currency
+	Currency         string                `json:"currency"`
 	Content          string                `json:"content"`
 	Lang             string                `json:"lang"`
 	Views            int                   `json:"views"`
@@ -126,6 +133,7 @@ type blogResponse struct {
 	User             userResponse          `json:"user"`
 	City             []CityJSON            `json:"city"`
 	Pined            bool                  `json:"pined"`
+	Promoted         bool                  `json:"promoted"`
 	Catygory         []CategoryJSON        `json:"catygory"`
 	UniqId           string                `json:"uniqId"`
 	Sticker          string                `json:"sticker"`
@@ -344,8 +352,8 @@ func SendToArchive(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if user is the owner of the blog post or has admin rights
-	if userObj.Role != "admin" && blog.UserID != userObj.ID {
+	// Owners and moderators may change a blog
+	if !permissions.OwnerOr(initializers.DB, userObj.Role, userObj.ID, blog.UserID, permissions.BlogModerate) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Unauthorized",
@@ -426,6 +434,17 @@ func CreateBlog(c *fiber.Ctx) error {
 	// replace special characters in blog.Slug
 	blog.Slug = replaceSpecialChars(blog.Slug)
 
+	// Prices are in rubles unless the author picked another currency
+	if code, err := currency.Normalize(blog.Currency); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unsupported currency",
+		})
+	} else {
+		blog.Currency = code
+	}
+	blog.Price = ledger.ToMinor(blog.Total)
+
 	// Fetch languages from the database
 	var langs []models.Langs
 	err := initializers.DB.Raw("SELECT * FROM langs").Scan(&langs).Error
@@ -587,9 +606,13 @@ func CreateBlog(c *fiber.Ctx) error {
 	amount := commission
 	module := "blog"
 	if err := utils.DeductAmountFromUserBalance(userObj.ID, amount, total, module, elementId); err != nil {
+		message := "Insufficient balance"
+		if errors.Is(err, ledger.ErrAccountInDebt) {
+			message = "Account has an outstanding debt"
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Insufficient balance",
+			"message": message,
 		})
 	}
 
@@ -743,7 +766,7 @@ func CreateBlog(c *fiber.Ctx) error {
 
 			user.TotalBlogs += 1
 
-			if blog.Total == 0 {
+			if blog.Price == 0 {
 				blog.NotAds = true
 			} else {
 				blog.NotAds = false
@@ -784,7 +807,7 @@ func CreateBlog(c *fiber.Ctx) error {
 
 	user.TotalBlogs += 1
 
-	if blog.Total == 0 {
+	if blog.Price == 0 {
 		blog.NotAds = true
 	} else {
 		blog.NotAds = false
@@ -832,6 +855,7 @@ func SendBotCallRequest(c *fiber.Ctx) error {
 		Slug     string `json:"slug"`
 		Category string `json:"category"`
 		Price    int    `json:"price"`
+		Currency string `json:"currency"`
 	}
 
 	// Parse the POST request body into the struct
@@ -862,8 +886,8 @@ func SendBotCallRequest(c *fiber.Ctx) error {
 		chatID := int64(messageData.Tid)
 
 		// Create the message text
-		msgText := fmt.Sprintf("Здравствуйте, для вас новый запрос!\nИмя: %s\nТелефон: %s\nСсылка: %s\nКатегория: %s\nЦена: %s ₽",
-			messageData.Name, messageData.Phone, URL, messageData.Category, formattedPrice)
+		msgText := fmt.Sprintf("Здравствуйте, для вас новый запрос!\nИмя: %s\nТелефон: %s\nСсылка: %s\nКатегория: %s\nЦена: %s %s",
+			messageData.Name, messageData.Phone, URL, messageData.Category, formattedPrice, currency.Symbol(strings.ToUpper(messageData.Currency)))
 
 		msg := tgbotapi.NewMessage(chatID, msgText)
 
@@ -990,8 +1014,8 @@ func AddBlogTime(c *fiber.Ctx) error {
 		Role: userResp.Role,
 	}
 
-	// Check if user is the owner of the blog post or has admin rights
-	if userObj.Role != "admin" && blog.UserID != userObj.ID {
+	// Owners and moderators may change a blog
+	if !permissions.OwnerOr(initializers.DB, userObj.Role, userObj.ID, blog.UserID, permissions.BlogModerate) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Unauthorized",
@@ -1007,51 +1031,34 @@ func AddBlogTime(c *fiber.Ctx) error {
 		})
 	}
 
-	// Fetch the current balance
-	var billing models.Billing
-	err = initializers.DB.Where("user_id = ?", userObj.ID).First(&billing).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	// Charge the balance and log the transaction in one posting
+	_, err = ledger.Debit(initializers.DB, userObj.ID, ledger.AccountRevenue, priceFloat, ledger.Posting{
+		Module:      "addTimeBlog",
+		Description: "Оплата за продление размещения",
+		Status:      "CLOSED_1",
+	})
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to fetch balance",
+			"message": "Insufficient balance",
 		})
 	}
-
-	// Check if the balance is sufficient
-	if billing.Amount < priceFloat {
+	if errors.Is(err, ledger.ErrAccountInDebt) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Insufficient balance",
+			"message": "Account has an outstanding debt",
 		})
 	}
-	// Update the amount field in the balance table
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", userObj.ID).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount - ?", priceFloat),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	if errors.Is(err, ledger.ErrInvalidAmount) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to update balance",
+			"message": "Invalid price value",
 		})
 	}
-
-	transaction := models.Transaction{
-		UserID:      userObj.ID,
-		Total:       "0", // Update with the appropriate value
-		Amount:      priceFloat,
-		Description: "Оплата за продление размещения",
-		Module:      "addTimeBlog",
-		Type:        "deduction",
-		Status:      "CLOSED_1",
-	}
-
-	err = initializers.DB.Create(&transaction).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to create transaction",
+			"message": "Failed to update balance",
 		})
 	}
 
@@ -1263,6 +1270,7 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 				Username string   `json:"name"`
 				City     string   `json:"city"`
 				Total    float64  `json:"total"`
+				Currency string   `json:"currency"`
 				Hashtags []string `json:"hashtags"`
 			}
 
@@ -1270,7 +1278,8 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 				// City:     blog.City,
 				// Cat:      blog.Catygory,
 				Name:     blog.Title,
-				Total:    blog.Total,
+				Total:    ledger.FromMinor(blog.Price),
+				Currency: blog.Currency,
 				Hashtags: hashtags,
 				Url:      "https://" + user.Name + ".myru.online/" + blog.UniqId + "/" + blog.Slug,
 				// Username: user.Name,
@@ -1280,10 +1289,10 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 			utils.UserActivity("newblog", forbot.Username, addintinal)
 
 			var msgText string
-			if blog.Total == 0 {
+			if blog.Price == 0 {
 				msgText = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nURL: %s\nАвтор: @%s", forbot.City, forbot.Cat, forbot.Name, forbot.Url, forbot.Username)
 			} else {
-				msgText = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nЦена: %.2f ₽ \nURL: %s\nАвтор: @%s", forbot.City, forbot.Cat, forbot.Name, forbot.Total, forbot.Url, forbot.Username)
+				msgText = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nЦена: %.2f %s \nURL: %s\nАвтор: @%s", forbot.City, forbot.Cat, forbot.Name, forbot.Total, currency.Symbol(forbot.Currency), forbot.Url, forbot.Username)
 			}
 
 			if len(forbot.Hashtags) > 0 {
@@ -1503,6 +1512,8 @@ func GetBlogById(c *fiber.Ctx) error {
 			Slug:       b.Slug,
 			Status:     b.Status,
 			Total:      b.Total,
+			Price:      b.Price,
+			Currency:   b.Currency,
 			Content:    b.Content,
 			City:       cities,
 			Views:      b.Views,
@@ -1561,8 +1572,8 @@ func DeleteBlog(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if user is the owner of the blog post or has admin rights
-	if userObj.Role != "admin" && blog.UserID != userObj.ID {
+	// Owners and moderators may change a blog
+	if !permissions.OwnerOr(initializers.DB, userObj.Role, userObj.ID, blog.UserID, permissions.BlogModerate) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Unauthorized",
@@ -1649,6 +1660,14 @@ func DeleteBlog(c *fiber.Ctx) error {
 		}
 	}
 
+	// Give back held promotion bids before the blog goes away
+	if err := promotions.RemoveBlog(initializers.DB, blog.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete element",
+		})
+	}
+
 	// Proceed with deleting the blog entry
 	err = initializers.DB.Delete(&blog).Error
 	if err != nil {
@@ -1700,6 +1719,9 @@ func GetAll(c *fiber.Ctx) error {
 	hashtags := c.Query("hashtag")
 	category := c.Query("category")
 
+	// The feed whose promotion slots are shown, the most specific filter wins
+	scope, scopeID := models.PromotionScopeAll, uint64(0)
+
 	if hashtags != "" && hashtags != "all" {
 		// Split the hashtags into separate values
 		hashtagValues := strings.Split(hashtags, ",")
@@ -1729,6 +1751,7 @@ func GetAll(c *fiber.Ctx) error {
 
 			// Добавим условие, чтобы ваш основной запрос включал только записи с blog_id из подзапроса
 			query = query.Where("blogs.id IN (?)", subQuery) // Specify the table alias for "blogs.id"
+			scope, scopeID = models.PromotionScopeCity, uint64(cityTranslation.CityID)
 		}
 	}
 
@@ -1743,6 +1766,7 @@ func GetAll(c *fiber.Ctx) error {
 
 			// Добавим условие, чтобы ваш основной запрос включил только записи с blog_id из подзапроса
 			query = query.Where("blogs.id IN (?)", subQuery)
+			scope, scopeID = models.PromotionScopeGuild, uint64(guildTranslation.GuildID)
 		}
 	}
 
@@ -1776,6 +1800,26 @@ func GetAll(c *fiber.Ctx) error {
 		}
 	}
 
+	// Blogs holding a promotion slot of this feed open the first page and are
+	// left out of the regular listing
+	var promoted []models.Blog
+	promotedIDs, err := promotions.Promoted(initializers.DB, scope, scopeID, time.Now())
+	if err != nil {
+		log.Println("Could not load promoted blogs:", err)
+	}
+	if len(promotedIDs) > 0 {
+		if skip == "" || skip == "0" {
+			err := query.Session(&gorm.Session{}).Where("blogs.id IN ?", promotedIDs).Find(&promoted).Error
+			if err != nil {
+				log.Println("Could not load promoted blogs:", err)
+			}
+			sort.SliceStable(promoted, func(i, j int) bool {
+				return promotedIndex(promotedIDs, promoted[i].ID) < promotedIndex(promotedIDs, promoted[j].ID)
+			})
+		}
+		query = query.Where("blogs.id NOT IN ?", promotedIDs)
+	}
+
 	var count int64
 	if err := query.Model(&models.Blog{}).Count(&count).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -1815,9 +1859,10 @@ func GetAll(c *fiber.Ctx) error {
 			"message": "Could not retrieve data",
 		})
 	}
+	blogs = append(promoted, blogs...)
 
 	var res []*blogResponse
-	for _, b := range blogs {
+	for i, b := range blogs {
 		// b.Views++
 		// // Save the changes
 		// if err := initializers.DB.Save(&b).Error; err != nil {
@@ -1881,6 +1926,8 @@ func GetAll(c *fiber.Ctx) error {
 			Slug:           b.Slug,
 			Status:         b.Status,
 			Total:          b.Total,
+			Price:          b.Price,
+			Currency:       b.Currency,
 			Content:        b.Content,
 			City:           cities,
 			UserAvatar:     b.UserAvatar,
@@ -1889,6 +1936,7 @@ func GetAll(c *fiber.Ctx) error {
 			CreatedAt:      b.CreatedAt,
 			UpdatedAt:      b.UpdatedAt,
 			Pined:          b.Pined,
+			Promoted:       i < len(promoted),
 			Catygory:       categories,
 			UniqId:         b.UniqId,
 			Sticker:        b.Sticker,
@@ -1986,8 +2034,8 @@ func EditBlogGetId(c *fiber.Ctx) error {
 	// Access the first blog in the slice
 	blogPost := blog[0]
 
-	// Check if user is the owner of the blog post or has admin rights
-	if userObj.Role != "admin" && blogPost.UserID != userObj.ID {
+	// Owners and moderators may change a blog
+	if !permissions.OwnerOr(initializers.DB, userObj.Role, userObj.ID, blogPost.UserID, permissions.BlogModerate) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Unauthorized",
@@ -2045,6 +2093,8 @@ func EditBlogGetId(c *fiber.Ctx) error {
 			Slug:       b.Slug,
 			Status:     b.Status,
 			Total:      b.Total,
+			Price:      b.Price,
+			Currency:   b.Currency,
 			Content:    b.Content,
 			City:       cities,
 			UserAvatar: b.UserAvatar,
@@ -2113,8 +2163,8 @@ func UpdateBlog(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if the user is the owner of the blog post or has admin rights
-	if userObj.Role != "admin" && blog.UserID != userObj.ID {
+	// Owners and moderators may change a blog
+	if !permissions.OwnerOr(initializers.DB, userObj.Role, userObj.ID, blog.UserID, permissions.BlogModerate) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Unauthorized",
@@ -2129,6 +2179,7 @@ func UpdateBlog(c *fiber.Ctx) error {
 			ID uint64 `json:"id"`
 		} `json:"city"`
 		Total    float64  `json:"total"`
+		Currency string   `json:"currency"`
 		Content  string   `json:"content"`
 		Pined    bool     `json:"Pined"`
 		Hashtags []string `json:"hashtags"`
@@ -2283,6 +2334,17 @@ func UpdateBlog(c *fiber.Ctx) error {
 	blog.Descr = requestBody.Descr
 	blog.City = updatedCities
 	blog.Total = requestBody.Total
+	blog.Price = ledger.ToMinor(requestBody.Total)
+	if requestBody.Currency != "" {
+		code, err := currency.Normalize(requestBody.Currency)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Unsupported currency",
+			})
+		}
+		blog.Currency = code
+	}
 	blog.Pined = requestBody.Pined
 	blog.Content = requestBody.Content
 
@@ -2456,3 +2518,12 @@ func replaceSpecialChars(title string) string {
 	trimmedHyphen := strings.Trim(singleHyphen, "-")
 	return trimmedHyphen
 }
+
+func promotedIndex(ids []uint64, id uint64) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return len(ids)
+}
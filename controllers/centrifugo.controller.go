@@ -8,10 +8,13 @@ import (
 	"hyperpage/models"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 func GetCentrifugoConnectionToken(c *fiber.Ctx) error {
@@ -59,8 +62,14 @@ func GetCentrifugoSubscriptionToken(c *fiber.Ctx) error {
 }
 
 func GetRoomMemberChannels(roomID uint64) ([]string, error) {
+	return roomMemberChannels(initializers.DB, roomID)
+}
+
+// roomMemberChannels reads the members with db, so a transaction sees the
+// members it changed itself.
+func roomMemberChannels(db *gorm.DB, roomID uint64) ([]string, error) {
 	var members []models.ChatRoomMember
-	if err := initializers.DB.Where("room_id = ?", roomID).Find(&members).Error; err != nil {
+	if err := db.Where("room_id = ?", roomID).Find(&members).Error; err != nil {
 		return nil, err
 	}
 
@@ -119,15 +128,108 @@ func CentrifugoBroadcastViaAPI(apiEndpoint string, apiKey string, payload Centri
 	return "Broadcast sent successfully to Centrifugo", nil
 }
 
-func CentrifugoBroadcastRoom(roomID string, broadcastPayload CentrifugoBroadcastPayload) (string, error) {
+// Broadcast modes of CENTRIFUGO_BROADCAST_MODE.
+const (
+	BroadcastAPI    = "api"
+	BroadcastOutbox = "outbox"
+	BroadcastCDC    = "cdc"
+	BroadcastAPICDC = "api_cdc"
+)
+
+// centrifugoBroadcastMethod is the Centrifugo API method of outbox and CDC
+// rows.
+const centrifugoBroadcastMethod = "broadcast"
+
+// CentrifugoBroadcastViaOutbox writes a broadcast to the outbox table that
+// the Centrifugo PostgreSQL consumer reads. Events of a room share a
+// partition, so they keep their order.
+func CentrifugoBroadcastViaOutbox(tx *gorm.DB, partitions int, roomID uint64, payload CentrifugoBroadcastPayload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if partitions < 1 {
+		partitions = 1
+	}
+	return tx.Create(&models.ChatOutbox{
+		Method:    centrifugoBroadcastMethod,
+		Payload:   datatypes.JSON(payloadBytes),
+		Partition: int64(roomID % uint64(partitions)),
+	}).Error
+}
+
+// CentrifugoBroadcastViaCDC writes a broadcast to the table Debezium reads
+// from the WAL. The room is the Kafka message key, so events of a room land
+// in one Kafka partition in order.
+func CentrifugoBroadcastViaCDC(tx *gorm.DB, roomID uint64, payload CentrifugoBroadcastPayload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.ChatCDC{
+		Method:    centrifugoBroadcastMethod,
+		Payload:   datatypes.JSON(payloadBytes),
+		Partition: int64(roomID),
+	}).Error
+}
+
+// CentrifugoBroadcastRoomTx records a broadcast to a room in tx, for the
+// modes that publish through the database. The event is published if and
+// only if tx commits. Call CentrifugoBroadcastRoomCommitted after the
+// commit for the modes that also use the API.
+func CentrifugoBroadcastRoomTx(tx *gorm.DB, roomID uint64, broadcastPayload CentrifugoBroadcastPayload) error {
+	configPath := "./app.env"
+	config, _ := initializers.LoadConfig(configPath)
+
+	return centrifugoBroadcastRoomTx(tx, &config, roomID, broadcastPayload)
+}
+
+// centrifugoBroadcastRoomTx records a broadcast in the mode of config.
+func centrifugoBroadcastRoomTx(tx *gorm.DB, config *initializers.Config, roomID uint64, broadcastPayload CentrifugoBroadcastPayload) error {
+	switch config.CentrifugoBroadcastMode {
+	case BroadcastAPI:
+		return nil
+	case BroadcastOutbox:
+		return CentrifugoBroadcastViaOutbox(tx, config.CentrifugoOutboxPartitions, roomID, broadcastPayload)
+	case BroadcastCDC, BroadcastAPICDC:
+		return CentrifugoBroadcastViaCDC(tx, roomID, broadcastPayload)
+	default:
+		log.Printf("Broadcast mode '%s' is not implemented", config.CentrifugoBroadcastMode)
+		return fmt.Errorf("broadcast mode '%s' is not implemented", config.CentrifugoBroadcastMode)
+	}
+}
+
+// CentrifugoBroadcastRoomCommitted sends a broadcast recorded with
+// CentrifugoBroadcastRoomTx over the HTTP API, in the modes that use it.
+// Duplicates of api_cdc are dropped by Centrifugo with the idempotency key.
+func CentrifugoBroadcastRoomCommitted(roomID uint64, broadcastPayload CentrifugoBroadcastPayload) (string, error) {
 	configPath := "./app.env"
 	config, _ := initializers.LoadConfig(configPath)
 
 	switch config.CentrifugoBroadcastMode {
-	case "api":
+	case BroadcastAPI, BroadcastAPICDC:
 		return CentrifugoBroadcastViaAPI(config.CentrifugoHttpApiEndpoint, config.CentrifugoHttpApiKey, broadcastPayload)
 	default:
-		log.Printf("Broadcast mode '%s' is not implemented", config.CentrifugoBroadcastMode)
-		return "", fmt.Errorf("broadcast mode '%s' is not implemented", config.CentrifugoBroadcastMode)
+		return "", nil
+	}
+}
+
+// CentrifugoBroadcastRoom broadcasts to a room outside of a transaction.
+func CentrifugoBroadcastRoom(roomID string, broadcastPayload CentrifugoBroadcastPayload) (string, error) {
+	roomIDParsed, err := strconv.ParseUint(roomID, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid room ID %q: %w", roomID, err)
+	}
+	if err := CentrifugoBroadcastRoomTx(initializers.DB, roomIDParsed, broadcastPayload); err != nil {
+		return "", err
+	}
+	return CentrifugoBroadcastRoomCommitted(roomIDParsed, broadcastPayload)
+}
+
+// PruneChatCDC deletes CDC rows older than before. Debezium reads them from
+// the WAL right after the commit, the table only has to keep them briefly.
+func PruneChatCDC(before time.Time) {
+	if err := initializers.DB.Where("created_at < ?", before).Delete(&models.ChatCDC{}).Error; err != nil {
+		log.Println("Failed to prune chat CDC rows:", err)
 	}
 }
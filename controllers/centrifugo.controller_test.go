@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	"gorm.io/gorm"
+)
+
+var errRollback = errors.New("rollback")
+
+// chatWrite is the transaction body of a chat handler.
+type chatWrite struct {
+	name string
+	run  func(tx *gorm.DB, config *initializers.Config) (CentrifugoBroadcastPayload, error)
+}
+
+// chatWrites are the handlers that broadcast, in an order that can run
+// one after the other on the same message.
+func chatWrites(sender models.User, member *models.ChatRoomMember, message *models.ChatMessage) []chatWrite {
+	return []chatWrite{
+		{"send", func(tx *gorm.DB, config *initializers.Config) (CentrifugoBroadcastPayload, error) {
+			*message = models.ChatMessage{Content: "hello", UserID: sender.ID, RoomID: member.RoomID}
+			return sendMessageTx(tx, config, message, nil)
+		}},
+		{"edit", func(tx *gorm.DB, config *initializers.Config) (CentrifugoBroadcastPayload, error) {
+			message.Content = "hello again"
+			message.IsEdited = true
+			return editMessageTx(tx, config, message)
+		}},
+		{"read", func(tx *gorm.DB, config *initializers.Config) (CentrifugoBroadcastPayload, error) {
+			member.LastReadMessageID = &message.ID
+			return markReadTx(tx, config, member, *message)
+		}},
+		{"delete", func(tx *gorm.DB, config *initializers.Config) (CentrifugoBroadcastPayload, error) {
+			return deleteMessageTx(tx, config, message, time.Now())
+		}},
+	}
+}
+
+// inTx runs a chat write in a transaction that ends with the error of fail.
+func inTx(db *gorm.DB, config *initializers.Config, write chatWrite, fail error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := write.run(tx, config); err != nil {
+			return err
+		}
+		return fail
+	})
+}
+
+func countRows(t *testing.T, db *gorm.DB, model interface{}) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(model).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBroadcastCommitsWithMessage(t *testing.T) {
+	db := testdb.Open(t,
+		&models.User{},
+		&models.ChatRoom{},
+		&models.ChatRoomMember{},
+		&models.ChatMessage{},
+		&models.ChatAttachment{},
+		&models.ChatOutbox{},
+		&models.ChatCDC{},
+	)
+	sender := models.User{Name: "sender", Email: "sender@example.com", Password: "-"}
+	if err := db.Create(&sender).Error; err != nil {
+		t.Fatal(err)
+	}
+	room := models.ChatRoom{Name: "room"}
+	if err := db.Create(&room).Error; err != nil {
+		t.Fatal(err)
+	}
+	member := models.ChatRoomMember{RoomID: room.ID, UserID: sender.ID, IsSubscribed: true}
+	if err := db.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []struct {
+		name        string
+		outbox, cdc int64
+		config      initializers.Config
+	}{
+		{BroadcastAPI, 0, 0, initializers.Config{CentrifugoBroadcastMode: BroadcastAPI}},
+		{BroadcastOutbox, 1, 0, initializers.Config{CentrifugoBroadcastMode: BroadcastOutbox, CentrifugoOutboxPartitions: 4}},
+		{BroadcastCDC, 0, 1, initializers.Config{CentrifugoBroadcastMode: BroadcastCDC}},
+		{BroadcastAPICDC, 0, 1, initializers.Config{CentrifugoBroadcastMode: BroadcastAPICDC}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				db.Exec("DELETE FROM chat_outboxes")
+				db.Exec("DELETE FROM chat_cdcs")
+				db.Exec("DELETE FROM chat_messages")
+			})
+
+			var message models.ChatMessage
+			for i, write := range chatWrites(sender, &member, &message) {
+				outbox, cdc := countRows(t, db, &models.ChatOutbox{}), countRows(t, db, &models.ChatCDC{})
+
+				// A write that fails after its broadcast was written leaves nothing
+				if err := inTx(db, &mode.config, write, errRollback); !errors.Is(err, errRollback) {
+					t.Fatalf("%s: err = %v, want the rollback", write.name, err)
+				}
+				if got := countRows(t, db, &models.ChatOutbox{}); got != outbox {
+					t.Fatalf("%s: %d outbox rows after the rollback, want %d", write.name, got, outbox)
+				}
+				if got := countRows(t, db, &models.ChatCDC{}); got != cdc {
+					t.Fatalf("%s: %d CDC rows after the rollback, want %d", write.name, got, cdc)
+				}
+				if write.name == "send" && countRows(t, db, &models.ChatMessage{}) != 0 {
+					t.Fatal("send: the message was kept after the rollback")
+				}
+
+				if err := inTx(db, &mode.config, write, nil); err != nil {
+					t.Fatalf("%s: %v", write.name, err)
+				}
+				if got, want := countRows(t, db, &models.ChatOutbox{}), mode.outbox*int64(i+1); got != want {
+					t.Fatalf("%s: %d outbox rows after the commit, want %d", write.name, got, want)
+				}
+				if got, want := countRows(t, db, &models.ChatCDC{}), mode.cdc*int64(i+1); got != want {
+					t.Fatalf("%s: %d CDC rows after the commit, want %d", write.name, got, want)
+				}
+			}
+
+			var stored models.ChatMessage
+			if err := db.First(&stored, message.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !stored.IsEdited || !stored.IsDeleted {
+				t.Fatalf("message edited %v deleted %v, want both", stored.IsEdited, stored.IsDeleted)
+			}
+		})
+	}
+}
+
+func TestBroadcastUnknownModeFailsSend(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.ChatRoom{}, &models.ChatMessage{}, &models.ChatAttachment{}, &models.ChatRoomMember{})
+	sender := models.User{Name: "sender", Email: "sender@example.com", Password: "-"}
+	if err := db.Create(&sender).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	send := chatWrites(sender, &models.ChatRoomMember{RoomID: 1, UserID: sender.ID}, &models.ChatMessage{})[0]
+	if err := inTx(db, &initializers.Config{CentrifugoBroadcastMode: "kafka"}, send, nil); err == nil {
+		t.Fatal("a send in an unknown broadcast mode committed")
+	}
+	if got := countRows(t, db, &models.ChatMessage{}); got != 0 {
+		t.Fatalf("%d messages, want 0", got)
+	}
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"hyperpage/chatfiles"
+	"hyperpage/chatsync"
 	"hyperpage/initializers"
 	"hyperpage/models"
 	"hyperpage/utils"
@@ -21,10 +23,11 @@ type CreateRoomRequest struct {
 }
 
 type SendMessageRequest struct {
-	Content         string `json:"content"`
-	ParentMessageID string `json:"parentMessageId,omitempty"` // Use omitempty for an optional field
-	MsgType         string `json:"msgType,omitempty"`
-	JsonData        string `json:"jsonData,omitempty"` // this is msg field for system, backend only validates this as json
+	Content         string   `json:"content"`
+	ParentMessageID string   `json:"parentMessageId,omitempty"` // Use omitempty for an optional field
+	MsgType         string   `json:"msgType,omitempty"`
+	JsonData        string   `json:"jsonData,omitempty"`      // this is msg field for system, backend only validates this as json
+	AttachmentIDs   []string `json:"attachmentIds,omitempty"` // uploaded to the room before
 }
 
 type EditMessageRequest struct {
@@ -70,6 +73,7 @@ func CreateChatRoomForDM(c *fiber.Ctx) error {
 		Joins("JOIN chat_room_members as rm1 ON rm1.room_id = chat_rooms.id AND rm1.user_id = ?", requestorUser.ID).
 		Joins("JOIN chat_room_members as rm2 ON rm2.room_id = chat_rooms.id AND rm2.user_id = ?", acceptorUser.ID).
 		Where("chat_rooms.id IN (SELECT room_id FROM chat_room_members GROUP BY room_id HAVING COUNT(DISTINCT user_id) >= 2)").
+		Where("chat_rooms.is_group = ?", false).
 		Preload("Members", func(db *gorm.DB) *gorm.DB {
 			return db.Joins("User")
 		}).
@@ -551,6 +555,11 @@ func SendMessageForDM(c *fiber.Ctx) error {
 		})
 	}
 
+	var room models.ChatRoom
+	if err := initializers.DB.First(&room, u64).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Room not found"})
+	}
+
 	// Check if the user is a subscribed member of the room
 	var member models.ChatRoomMember
 	result := initializers.DB.Model(&models.ChatRoomMember{}).
@@ -560,31 +569,12 @@ func SendMessageForDM(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "error", "message": "User is not subscribed to the room"})
 	}
 
-	// Check if there's another subscribed member in this room
-	var recipient models.ChatRoomMember
-	initializers.DB.Model(&models.ChatRoomMember{}).
-		Where("room_id = ? AND user_id != ? AND is_subscribed = ?", u64, user.ID, true).
-		First(&recipient)
-	if recipient.UserID == uuid.Nil {
-		// This means the other member is not subscribed or does not exist
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "The other member is not subscribed or does not exist"})
-	}
-
-	// Check if the user is a member of the room and if the other member is subscribed.
-	var count int64
-	initializers.DB.Model(&models.ChatRoomMember{}).
-		Where("room_id = ? AND user_id = ?", u64, user.ID).
-		Count(&count)
-	// Check if the user is indeed a member of the room
-	if count == 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "error", "message": "User is not a member of the room"})
+	// The subscribed members who get a notification
+	recipients, err := messageRecipients(initializers.DB, u64, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to load room members"})
 	}
-
-	// check if there's another subscribed member in this room
-	initializers.DB.Model(&models.ChatRoomMember{}).
-		Where("room_id = ? AND user_id != ? AND is_subscribed = ?", u64, user.ID, true).
-		Count(&count)
-	if count == 0 {
+	if !room.IsGroup && len(recipients) == 0 {
 		// This means the other member is not subscribed or does not exist
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "The other member is not subscribed or does not exist"})
 	}
@@ -635,46 +625,84 @@ func SendMessageForDM(c *fiber.Ctx) error {
 		fmt.Println("Creating new message with content, default msgType is 0...")
 	}
 
-	if err := initializers.DB.Create(&message).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to send message"})
+	attachmentIDs := make([]uint64, 0, len(payload.AttachmentIDs))
+	for _, id := range payload.AttachmentIDs {
+		attachmentID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Failed to parse attachmentIds"})
+		}
+		attachmentIDs = append(attachmentIDs, attachmentID)
 	}
 
-	// Update the room's LastMessageId after sending a new message
-	if err := initializers.DB.Model(&models.ChatRoom{}).Where("id = ?", message.RoomID).Update("last_message_id", message.ID).Error; err != nil {
-		fmt.Println("Failed to update room's last message: ", err)
+	// The message and its broadcast commit together
+	config, _ := initializers.LoadConfig("./app.env")
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		broadcastPayload, err = sendMessageTx(tx, &config, &message, attachmentIDs)
+		return err
+	})
+	if errors.Is(err, chatfiles.ErrNotAttachable) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
 	}
-
-	serializedMessage := utils.SerializeChatMessage(message)
-	channels, err := GetRoomMemberChannels(message.RoomID)
 	if err != nil {
-		log.Printf("Failed to get room member channels for broadcasting: %s", err)
-	} else {
-		broadcastPayload := CentrifugoBroadcastPayload{
-			Channels: channels,
-			Data: struct {
-				Type string                 `json:"type"`
-				Body map[string]interface{} `json:"body"`
-			}{
-				Type: "new_message",
-				Body: serializedMessage,
-			},
-			IdempotencyKey: fmt.Sprintf("send_message_%d", message.ID),
-		}
+		log.Printf("Failed to send message: %s", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to send message"})
+	}
 
-		if _, err := CentrifugoBroadcastRoom(fmt.Sprint(message.RoomID), broadcastPayload); err != nil {
-			log.Printf("Failed to broadcast new message: %s", err)
-		}
+	if _, err := CentrifugoBroadcastRoomCommitted(message.RoomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast new message: %s", err)
 	}
 
 	roomIDStr := strconv.FormatUint(message.RoomID, 10)
 	pageURL := fmt.Sprintf("https://www.myru.online/chat/%s", roomIDStr)
 
-	// sendPushNotificationToOwner(recipient.UserID, user.Name, message.Content, pageURL)
-	sendNotificationToOwner(recipient.UserID.String(), user.Name, message.Content, pageURL)
+	title := user.Name
+	if room.IsGroup {
+		title = room.Title + ": " + user.Name
+	}
+	for _, recipient := range recipients {
+		// sendPushNotificationToOwner(recipient.UserID, user.Name, message.Content, pageURL)
+		sendNotificationToOwner(recipient.UserID.String(), title, message.Content, pageURL)
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"message": message}})
 }
 
+// sendMessageTx writes a new message, its attachments and its broadcast in
+// the transaction tx.
+func sendMessageTx(tx *gorm.DB, config *initializers.Config, message *models.ChatMessage, attachmentIDs []uint64) (CentrifugoBroadcastPayload, error) {
+	if err := tx.Create(message).Error; err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	attachments, err := chatfiles.Attach(tx, message.UserID, message.RoomID, message.ID, attachmentIDs)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	message.Attachments = attachments
+
+	// Update the room's LastMessageId after sending a new message
+	if err := tx.Model(&models.ChatRoom{}).Where("id = ?", message.RoomID).Update("last_message_id", message.ID).Error; err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+
+	channels, err := roomMemberChannels(tx, message.RoomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels: channels,
+		Data: struct {
+			Type string                 `json:"type"`
+			Body map[string]interface{} `json:"body"`
+		}{
+			Type: "new_message",
+			Body: utils.SerializeChatMessage(*message),
+		},
+		IdempotencyKey: fmt.Sprintf("send_message_%d", message.ID),
+	}
+	return broadcastPayload, centrifugoBroadcastRoomTx(tx, config, message.RoomID, broadcastPayload)
+}
+
 func EditMessageForDM(c *fiber.Ctx) error {
 	userID := c.Locals("user").(models.UserResponse).ID
 	messageIDParam := c.Params("messageId")
@@ -696,7 +724,7 @@ func EditMessageForDM(c *fiber.Ctx) error {
 	}
 
 	var message models.ChatMessage
-	result := initializers.DB.First(&message, "id = ? AND user_id = ?", messageID, userID)
+	result := initializers.DB.Preload("Attachments").First(&message, "id = ? AND user_id = ?", messageID, userID)
 	if result.Error != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"status":  "error",
@@ -706,7 +734,15 @@ func EditMessageForDM(c *fiber.Ctx) error {
 
 	message.Content = payload.Content
 	message.IsEdited = true
-	if err := initializers.DB.Save(&message).Error; err != nil {
+
+	// The edit and its broadcast commit together
+	config, _ := initializers.LoadConfig("./app.env")
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		broadcastPayload, err = editMessageTx(tx, &config, &message)
+		return err
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to update message",
@@ -714,26 +750,8 @@ func EditMessageForDM(c *fiber.Ctx) error {
 		})
 	}
 
-	serializedMessage := utils.SerializeChatMessage(message)
-	channels, err := GetRoomMemberChannels(message.RoomID)
-	if err != nil {
-		log.Printf("Failed to get room member channels for broadcasting: %s", err)
-	} else {
-		broadcastPayload := CentrifugoBroadcastPayload{
-			Channels: channels,
-			Data: struct {
-				Type string                 `json:"type"`
-				Body map[string]interface{} `json:"body"`
-			}{
-				Type: "edit_message",
-				Body: serializedMessage,
-			},
-			IdempotencyKey: fmt.Sprintf("edit_message_%d", message.ID),
-		}
-
-		if _, err := CentrifugoBroadcastRoom(fmt.Sprint(message.RoomID), broadcastPayload); err != nil {
-			log.Printf("Failed to broadcast message update: %s", err)
-		}
+	if _, err := CentrifugoBroadcastRoomCommitted(message.RoomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast message update: %s", err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -745,7 +763,33 @@ func EditMessageForDM(c *fiber.Ctx) error {
 	})
 }
 
+// editMessageTx saves an edited message and its broadcast in the
+// transaction tx.
+func editMessageTx(tx *gorm.DB, config *initializers.Config, message *models.ChatMessage) (CentrifugoBroadcastPayload, error) {
+	if err := tx.Save(message).Error; err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+
+	channels, err := roomMemberChannels(tx, message.RoomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels: channels,
+		Data: struct {
+			Type string                 `json:"type"`
+			Body map[string]interface{} `json:"body"`
+		}{
+			Type: "edit_message",
+			Body: utils.SerializeChatMessage(*message),
+		},
+		IdempotencyKey: fmt.Sprintf("edit_message_%d", message.ID),
+	}
+	return broadcastPayload, centrifugoBroadcastRoomTx(tx, config, message.RoomID, broadcastPayload)
+}
+
 func DeleteMessageForDM(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
 	userID := c.Locals("user").(models.UserResponse).ID
 	messageIDParam := c.Params("messageId")
 	messageID, err := strconv.ParseUint(messageIDParam, 10, 64)
@@ -765,39 +809,28 @@ func DeleteMessageForDM(c *fiber.Ctx) error {
 		})
 	}
 
-	// Perform soft delete by updating IsDeleted to true and setting DeletedAt to the current time
-	now := time.Now()
-	updateResult := initializers.DB.Model(&message).Updates(models.ChatMessage{IsDeleted: true, DeletedAt: &now})
-	if updateResult.Error != nil {
+	// Perform soft delete by updating IsDeleted to true and setting DeletedAt
+	// to the current time, together with its broadcast
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		broadcastPayload, err = deleteMessageTx(tx, &config, &message, time.Now())
+		return err
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to flag message as deleted",
-			"error":   updateResult.Error.Error(),
+			"error":   err.Error(),
 		})
 	}
 
-	tempMessage := message
-	tempMessage.Content = "This message has been deleted."
-	serializedMessage := utils.SerializeChatMessage(tempMessage)
-	channels, err := GetRoomMemberChannels(message.RoomID)
-	if err != nil {
-		log.Printf("Failed to get room member channels for broadcasting: %s", err)
-	} else {
-		broadcastPayload := CentrifugoBroadcastPayload{
-			Channels: channels,
-			Data: struct {
-				Type string                 `json:"type"`
-				Body map[string]interface{} `json:"body"`
-			}{
-				Type: "delete_message",
-				Body: serializedMessage,
-			},
-			IdempotencyKey: fmt.Sprintf("delete_message_%d", message.ID),
-		}
+	if _, err := CentrifugoBroadcastRoomCommitted(message.RoomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast message deletion notice: %s", err)
+	}
 
-		if _, err := CentrifugoBroadcastRoom(fmt.Sprint(message.RoomID), broadcastPayload); err != nil {
-			log.Printf("Failed to broadcast message deletion notice: %s", err)
-		}
+	// Deleted messages keep no files
+	if err := chatfiles.DeleteForMessage(initializers.DB, &config, message.ID); err != nil {
+		log.Printf("Failed to delete attachments of message %d: %s", message.ID, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -806,6 +839,35 @@ func DeleteMessageForDM(c *fiber.Ctx) error {
 	})
 }
 
+// deleteMessageTx flags a message as deleted at now and writes its broadcast
+// in the transaction tx.
+func deleteMessageTx(tx *gorm.DB, config *initializers.Config, message *models.ChatMessage, now time.Time) (CentrifugoBroadcastPayload, error) {
+	if err := tx.Model(message).Updates(models.ChatMessage{IsDeleted: true, DeletedAt: &now}).Error; err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+
+	tempMessage := *message
+	tempMessage.Content = "This message has been deleted."
+	channels, err := roomMemberChannels(tx, message.RoomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels: channels,
+		Data: struct {
+			Type string                 `json:"type"`
+			Body map[string]interface{} `json:"body"`
+		}{
+			Type: "delete_message",
+			Body: utils.SerializeChatMessage(tempMessage),
+		},
+		IdempotencyKey: fmt.Sprintf("delete_message_%d", message.ID),
+	}
+	return broadcastPayload, centrifugoBroadcastRoomTx(tx, config, message.RoomID, broadcastPayload)
+}
+
+// GetChatMessagesForDM pages by offset for older clients, new ones read
+// GetChatHistory and SyncChat.
 func GetChatMessagesForDM(c *fiber.Ctx) error {
 	// Extract the user ID from context and room ID from URL params.
 	userID := c.Locals("user").(models.UserResponse).ID
@@ -832,6 +894,9 @@ func GetChatMessagesForDM(c *fiber.Ctx) error {
 
 	skip := c.QueryInt("skip", 0)    // Starting from the most recent message.
 	limit := c.QueryInt("limit", 10) // Number of messages to fetch.
+	if limit <= 0 || limit > chatsync.MaxPageSize {
+		limit = chatsync.MaxPageSize
+	}
 
 	// Check if end_msg_id is provided in the query string and handle it.
 	endMsgIDParam := c.Query("end_msg_id")
@@ -860,7 +925,7 @@ func GetChatMessagesForDM(c *fiber.Ctx) error {
 
 	// Adjust query based on end_msg_id presence
 	if endMsgIDProvided {
-		query = query.Offset(skip).Where("id >= ?", endMsgID) // Assuming you want messages before and including endMsgID
+		query = query.Offset(skip).Where("id >= ?", endMsgID).Limit(chatsync.MaxChanges) // Assuming you want messages before and including endMsgID
 	} else {
 		// Apply pagination if end_msg_id is not provided
 		query = query.Offset(skip).Limit(limit)
@@ -881,6 +946,7 @@ func GetChatMessagesForDM(c *fiber.Ctx) error {
 				})
 		}).
 		Preload("ParentMessage").
+		Preload("Attachments").
 		Find(&messages).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -900,6 +966,7 @@ func GetChatMessagesForDM(c *fiber.Ctx) error {
 	for i, msg := range messages {
 		if msg.IsDeleted {
 			messages[i].Content = "This message has been deleted."
+			messages[i].Attachments = nil
 		}
 	}
 
@@ -973,7 +1040,14 @@ func MarkMessageAsReadForDM(c *fiber.Ctx) error {
 
 	member.LastReadMessageID = maxUint64Ptr(member.LastReadMessageID, messageIDParsed)
 
-	if err := initializers.DB.Save(&member).Error; err != nil {
+	// The read marker and its broadcast commit together
+	config, _ := initializers.LoadConfig("./app.env")
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		broadcastPayload, err = markReadTx(tx, &config, &member, message)
+		return err
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to update latest read message",
@@ -981,34 +1055,8 @@ func MarkMessageAsReadForDM(c *fiber.Ctx) error {
 		})
 	}
 
-	channels, err := GetRoomMemberChannels(roomIDParsed)
-	if err != nil {
-		log.Printf("Failed to get room member channels: %s", err)
-	} else {
-
-		// Prepare the 'Body' map
-		bodyMap := map[string]interface{}{}
-
-		bodyMap["lastReadMessageId"] = uint64PtrToString(member.LastReadMessageID)
-		bodyMap["ownerId"] = message.UserID.String()
-		bodyMap["readerId"] = userID.String()
-		bodyMap["roomId"] = strconv.FormatUint(message.RoomID, 10)
-
-		broadcastPayload := CentrifugoBroadcastPayload{
-			Channels: channels,
-			Data: struct {
-				Type string                 `json:"type"`
-				Body map[string]interface{} `json:"body"`
-			}{
-				Type: "updated_last_read_msg_id",
-				Body: bodyMap,
-			},
-			IdempotencyKey: fmt.Sprintf("updated_last_read_msg_%s_%s", bodyMap["readerId"], bodyMap["lastReadMessageId"]),
-		}
-
-		if _, err := CentrifugoBroadcastRoom(fmt.Sprint(roomIDParsed), broadcastPayload); err != nil {
-			log.Printf("Failed to broadcast update latest read msg ID: %s", err)
-		}
+	if _, err := CentrifugoBroadcastRoomCommitted(roomIDParsed, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast update latest read msg ID: %s", err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -1020,6 +1068,40 @@ func MarkMessageAsReadForDM(c *fiber.Ctx) error {
 	})
 }
 
+// markReadTx saves the read marker of a member up to message and its
+// broadcast in the transaction tx.
+func markReadTx(tx *gorm.DB, config *initializers.Config, member *models.ChatRoomMember, message models.ChatMessage) (CentrifugoBroadcastPayload, error) {
+	if err := tx.Save(member).Error; err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+
+	channels, err := roomMemberChannels(tx, message.RoomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+
+	// Prepare the 'Body' map
+	bodyMap := map[string]interface{}{}
+
+	bodyMap["lastReadMessageId"] = uint64PtrToString(member.LastReadMessageID)
+	bodyMap["ownerId"] = message.UserID.String()
+	bodyMap["readerId"] = member.UserID.String()
+	bodyMap["roomId"] = strconv.FormatUint(message.RoomID, 10)
+
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels: channels,
+		Data: struct {
+			Type string                 `json:"type"`
+			Body map[string]interface{} `json:"body"`
+		}{
+			Type: "updated_last_read_msg_id",
+			Body: bodyMap,
+		},
+		IdempotencyKey: fmt.Sprintf("updated_last_read_msg_%s_%s", bodyMap["readerId"], bodyMap["lastReadMessageId"]),
+	}
+	return broadcastPayload, centrifugoBroadcastRoomTx(tx, config, message.RoomID, broadcastPayload)
+}
+
 func MarkMessageAsUnReadForDM(c *fiber.Ctx) error {
 	userID := c.Locals("user").(models.UserResponse).ID
 	roomID := c.Params("roomId")
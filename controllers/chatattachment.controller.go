@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"errors"
+	"hyperpage/chatfiles"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// UploadChatAttachment stores a file for a message the user is about to
+// send to a room. The form has the file in "file"; voice notes also send
+// voice=true and their duration in seconds.
+func UploadChatAttachment(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+	roomID, err := strconv.ParseUint(c.Params("roomId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	var member models.ChatRoomMember
+	if err := initializers.DB.First(&member, "room_id = ? AND user_id = ?", roomID, user.ID).Error; err != nil || !member.IsSubscribed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "User is not subscribed to the room"})
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The file is missing"})
+	}
+	voice := c.FormValue("voice") == "true"
+	var duration float64
+	if voice {
+		if duration, err = strconv.ParseFloat(c.FormValue("duration"), 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid duration"})
+		}
+	}
+
+	attachment, err := chatfiles.Store(initializers.DB, &config, user, roomID, file, voice, duration)
+	switch {
+	case errors.Is(err, chatfiles.ErrTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatfiles.ErrQuota):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatfiles.ErrNotAudio), errors.Is(err, chatfiles.ErrInvalidDuration):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case err != nil:
+		log.Printf("Failed to store chat attachment: %s", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to store the file"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"attachment": attachment,
+		},
+	})
+}
+
+func GetChatAttachment(c *fiber.Ctx) error {
+	return sendChatAttachment(c, false)
+}
+
+func GetChatAttachmentThumbnail(c *fiber.Ctx) error {
+	return sendChatAttachment(c, true)
+}
+
+// sendChatAttachment streams an attachment to a member of its room. Only
+// images are shown inline, everything else is a download.
+func sendChatAttachment(c *fiber.Ctx, thumbnail bool) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("attachmentId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid attachment ID"})
+	}
+
+	attachment, err := chatfiles.Find(initializers.DB, id, user.ID)
+	if errors.Is(err, chatfiles.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to load the attachment"})
+	}
+
+	path, mimeType := chatfiles.Path(&config, attachment), attachment.MimeType
+	if thumbnail {
+		if attachment.Thumbnail == "" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "The attachment has no thumbnail"})
+		}
+		path, mimeType = chatfiles.ThumbnailPath(&config, attachment), "image/jpeg"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open chat attachment %d: %s", attachment.ID, err)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "attachment not found"})
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to load the attachment"})
+	}
+
+	if attachment.Kind != chatfiles.KindImage {
+		c.Attachment(attachment.Name)
+	}
+	c.Set(fiber.HeaderContentType, mimeType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendStream(f, int(info.Size()))
+}
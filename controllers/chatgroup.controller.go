@@ -0,0 +1,369 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"hyperpage/chatgroups"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+type CreateChatGroupRequest struct {
+	Title     string   `json:"title"`
+	Avatar    string   `json:"avatar"`
+	MemberIds []string `json:"memberIds"`
+}
+
+type UpdateChatGroupRequest struct {
+	Title      *string `json:"title"`
+	Avatar     *string `json:"avatar"`
+	MaxMembers *int    `json:"maxMembers"`
+}
+
+type InviteChatGroupRequest struct {
+	UserIds []string `json:"userIds"`
+}
+
+type ChatGroupRoleRequest struct {
+	Role string `json:"role"`
+}
+
+func parseUserIDs(ids []string) ([]uuid.UUID, error) {
+	parsed := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		userID, err := uuid.FromString(id)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, userID)
+	}
+	return parsed, nil
+}
+
+// groupAvatarAllowed accepts images the user uploaded to their own storage.
+func groupAvatarAllowed(user models.UserResponse, avatar string) bool {
+	if avatar == "" {
+		return true
+	}
+	return user.Storage != "" && strings.HasPrefix(avatar, user.Storage+"/") && !strings.Contains(avatar, "..")
+}
+
+// broadcastChatGroupTx writes an event with the group as it is in the
+// transaction of the change for its members, and for the removed users, who
+// are not members any more. Send it with sendChatGroupEvent after the commit.
+func broadcastChatGroupTx(tx *gorm.DB, roomID uint64, event string, extra fiber.Map, removed ...uuid.UUID) (CentrifugoBroadcastPayload, error) {
+	body := utils.SerializeChatRoomTx(tx, roomID)
+	if body == nil {
+		body = map[string]interface{}{"id": roomID}
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+
+	channels, err := roomMemberChannels(tx, roomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	for _, id := range removed {
+		channels = append(channels, fmt.Sprintf("personal:%s", id))
+	}
+	if len(channels) == 0 {
+		return CentrifugoBroadcastPayload{}, nil
+	}
+
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels:       channels,
+		IdempotencyKey: fmt.Sprintf("%s_%d_%d", event, roomID, time.Now().UTC().UnixNano()),
+	}
+	broadcastPayload.Data.Type = event
+	broadcastPayload.Data.Body = body
+	return broadcastPayload, CentrifugoBroadcastRoomTx(tx, roomID, broadcastPayload)
+}
+
+// sendChatGroupEvent sends a committed group event written by
+// broadcastChatGroupTx.
+func sendChatGroupEvent(roomID uint64, broadcastPayload CentrifugoBroadcastPayload) {
+	if len(broadcastPayload.Channels) == 0 {
+		return
+	}
+	if _, err := CentrifugoBroadcastRoomCommitted(roomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast %s: %s", broadcastPayload.Data.Type, err)
+	}
+}
+
+func notifyChatGroupInvites(roomID uint64, title, inviter string, userIDs []uuid.UUID) {
+	pageURL := fmt.Sprintf("https://www.myru.online/ru/chat/%d", roomID)
+	for _, id := range userIDs {
+		sendNotificationToOwner(id.String(), inviter, "Invited you to "+title, pageURL)
+	}
+}
+
+func chatGroupRoomID(c *fiber.Ctx) (uint64, bool) {
+	roomID, err := strconv.ParseUint(c.Params("roomId"), 10, 64)
+	return roomID, err == nil
+}
+
+func chatGroupError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, chatgroups.ErrNotFound), errors.Is(err, chatgroups.ErrNotMember):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatgroups.ErrForbidden):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatgroups.ErrFull):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatgroups.ErrUnknownUser), errors.Is(err, chatgroups.ErrUnknownRole),
+		errors.Is(err, chatgroups.ErrInvalidTitle), errors.Is(err, chatgroups.ErrInvalidLimit):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	log.Printf("Chat group error: %s", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to update the group"})
+}
+
+func CreateChatGroup(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+
+	payload := new(CreateChatGroupRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	memberIDs, err := parseUserIDs(payload.MemberIds)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid user ID"})
+	}
+	if !groupAvatarAllowed(user, payload.Avatar) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Upload the avatar first"})
+	}
+
+	// The group and its broadcast commit together
+	var room *models.ChatRoom
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if room, err = chatgroups.Create(tx, &config, user.ID, payload.Title, payload.Avatar, memberIDs); err != nil {
+			return err
+		}
+		broadcastPayload, err = broadcastChatGroupTx(tx, room.ID, "new_room", nil)
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	sendChatGroupEvent(room.ID, broadcastPayload)
+	var invited []uuid.UUID
+	for _, member := range room.Members {
+		if member.UserID != user.ID {
+			invited = append(invited, member.UserID)
+		}
+	}
+	notifyChatGroupInvites(room.ID, room.Title, user.Name, invited)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"room": utils.SerializeChatRoom(room.ID),
+		},
+	})
+}
+
+func UpdateChatGroup(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+	roomID, ok := chatGroupRoomID(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	payload := new(UpdateChatGroupRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	if payload.Avatar != nil && !groupAvatarAllowed(user, *payload.Avatar) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Upload the avatar first"})
+	}
+
+	var room *models.ChatRoom
+	var broadcastPayload CentrifugoBroadcastPayload
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		room, err = chatgroups.Update(tx, &config, roomID, user.ID, chatgroups.Settings{
+			Title:      payload.Title,
+			Avatar:     payload.Avatar,
+			MaxMembers: payload.MaxMembers,
+		})
+		if err != nil {
+			return err
+		}
+		broadcastPayload, err = broadcastChatGroupTx(tx, room.ID, "room_updated", nil)
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	sendChatGroupEvent(room.ID, broadcastPayload)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"room": utils.SerializeChatRoom(room.ID),
+		},
+	})
+}
+
+func InviteChatGroupMembers(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+	roomID, ok := chatGroupRoomID(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	payload := new(InviteChatGroupRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	userIDs, err := parseUserIDs(payload.UserIds)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid user ID"})
+	}
+
+	var room *models.ChatRoom
+	var added []uuid.UUID
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if room, added, err = chatgroups.Invite(tx, &config, roomID, user.ID, userIDs); err != nil || len(added) == 0 {
+			return err
+		}
+		broadcastPayload, err = broadcastChatGroupTx(tx, roomID, "members_added", fiber.Map{"added": added})
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	if len(added) > 0 {
+		sendChatGroupEvent(roomID, broadcastPayload)
+		notifyChatGroupInvites(roomID, room.Title, user.Name, added)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"added": added,
+		},
+	})
+}
+
+func KickChatGroupMember(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	roomID, ok := chatGroupRoomID(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+	userID, err := uuid.FromString(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid user ID"})
+	}
+
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := chatgroups.Kick(tx, roomID, user.ID, userID); err != nil {
+			return err
+		}
+		var err error
+		broadcastPayload, err = broadcastChatGroupTx(tx, roomID, "member_removed", fiber.Map{"removed": userID, "kicked": true}, userID)
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	sendChatGroupEvent(roomID, broadcastPayload)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Member removed from the group",
+	})
+}
+
+func LeaveChatGroup(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	roomID, ok := chatGroupRoomID(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	var broadcastPayload CentrifugoBroadcastPayload
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		owner, err := chatgroups.Leave(tx, roomID, user.ID)
+		if err != nil {
+			return err
+		}
+
+		extra := fiber.Map{"removed": user.ID, "kicked": false}
+		if owner != nil {
+			extra["newOwner"] = *owner
+		}
+		broadcastPayload, err = broadcastChatGroupTx(tx, roomID, "member_removed", extra, user.ID)
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	sendChatGroupEvent(roomID, broadcastPayload)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Left the group",
+	})
+}
+
+func SetChatGroupMemberRole(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	roomID, ok := chatGroupRoomID(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+	userID, err := uuid.FromString(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid user ID"})
+	}
+
+	payload := new(ChatGroupRoleRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := chatgroups.SetRole(tx, roomID, user.ID, userID, payload.Role); err != nil {
+			return err
+		}
+		var err error
+		broadcastPayload, err = broadcastChatGroupTx(tx, roomID, "room_updated", nil)
+		return err
+	})
+	if err != nil {
+		return chatGroupError(c, err)
+	}
+
+	sendChatGroupEvent(roomID, broadcastPayload)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role updated",
+	})
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"hyperpage/chatfiles"
+	"hyperpage/chatmessages"
+	"hyperpage/chatsync"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+type ForwardMessageRequest struct {
+	RoomId string `json:"roomId"`
+}
+
+// messageRecipients returns the subscribed members of a room other than the
+// sender, who get a notification of a new message.
+func messageRecipients(db *gorm.DB, roomID uint64, senderID interface{}) ([]models.ChatRoomMember, error) {
+	var recipients []models.ChatRoomMember
+	err := db.Model(&models.ChatRoomMember{}).
+		Where("room_id = ? AND user_id != ? AND is_subscribed = ?", roomID, senderID, true).
+		Find(&recipients).Error
+	return recipients, err
+}
+
+// broadcastRoomEventTx writes an event for the members of a room in the
+// transaction of the change; send it with CentrifugoBroadcastRoomCommitted
+// after the commit.
+func broadcastRoomEventTx(tx *gorm.DB, roomID uint64, event string, body map[string]interface{}, idempotencyKey string) (CentrifugoBroadcastPayload, error) {
+	channels, err := roomMemberChannels(tx, roomID)
+	if err != nil {
+		return CentrifugoBroadcastPayload{}, err
+	}
+	broadcastPayload := CentrifugoBroadcastPayload{
+		Channels:       channels,
+		IdempotencyKey: idempotencyKey,
+	}
+	broadcastPayload.Data.Type = event
+	broadcastPayload.Data.Body = body
+	return broadcastPayload, CentrifugoBroadcastRoomTx(tx, roomID, broadcastPayload)
+}
+
+func chatMessageError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, chatmessages.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatmessages.ErrForbidden), errors.Is(err, chatmessages.ErrNotSendable):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatmessages.ErrTooManyPins):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	case errors.Is(err, chatmessages.ErrInvalidEmoji), errors.Is(err, chatfiles.ErrQuota):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	log.Printf("Chat message error: %s", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to update message"})
+}
+
+func AddReaction(c *fiber.Ctx) error {
+	payload := new(ReactionRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	return react(c, payload.Emoji, true)
+}
+
+// RemoveReaction takes the emoji from ?emoji=, so it needs no body.
+func RemoveReaction(c *fiber.Ctx) error {
+	return react(c, c.Query("emoji"), false)
+}
+
+func react(c *fiber.Ctx, emoji string, add bool) error {
+	user := c.Locals("user").(models.UserResponse)
+	messageID, err := strconv.ParseUint(c.Params("messageId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid messageId format"})
+	}
+
+	// The reaction and its broadcast commit together
+	var reactions []chatmessages.Reaction
+	var message *models.ChatMessage
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if message, reactions, err = chatmessages.React(tx, user.ID, messageID, emoji, add); err != nil {
+			return err
+		}
+		broadcastPayload, err = broadcastRoomEventTx(tx, message.RoomID, "message_reactions", map[string]interface{}{
+			"messageId": strconv.FormatUint(message.ID, 10),
+			"roomId":    strconv.FormatUint(message.RoomID, 10),
+			"userId":    user.ID.String(),
+			"emoji":     emoji,
+			"added":     add,
+			"reactions": reactions,
+		}, fmt.Sprintf("message_reactions_%d_%s_%d", message.ID, user.ID, time.Now().UTC().UnixNano()))
+		return err
+	})
+	if err != nil {
+		return chatMessageError(c, err)
+	}
+
+	if _, err := CentrifugoBroadcastRoomCommitted(message.RoomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast reactions: %s", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"reactions": reactions,
+		},
+	})
+}
+
+func PinMessage(c *fiber.Ctx) error {
+	return pin(c, true)
+}
+
+func UnpinMessage(c *fiber.Ctx) error {
+	return pin(c, false)
+}
+
+func pin(c *fiber.Ctx, pinned bool) error {
+	user := c.Locals("user").(models.UserResponse)
+	messageID, err := strconv.ParseUint(c.Params("messageId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid messageId format"})
+	}
+
+	event := "message_unpinned"
+	if pinned {
+		event = "message_pinned"
+	}
+
+	// The pin and its broadcast commit together
+	var message *models.ChatMessage
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if message, err = chatmessages.Pin(tx, user.ID, messageID, pinned); err != nil {
+			return err
+		}
+		broadcastPayload, err = broadcastRoomEventTx(tx, message.RoomID, event, map[string]interface{}{
+			"messageId": strconv.FormatUint(message.ID, 10),
+			"roomId":    strconv.FormatUint(message.RoomID, 10),
+			"pinnedAt":  message.PinnedAt,
+			"pinnedBy":  message.PinnedBy,
+		}, fmt.Sprintf("%s_%d_%d", event, message.ID, time.Now().UTC().UnixNano()))
+		return err
+	})
+	if err != nil {
+		return chatMessageError(c, err)
+	}
+
+	if _, err := CentrifugoBroadcastRoomCommitted(message.RoomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast %s: %s", event, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"pinnedAt": message.PinnedAt,
+			"pinnedBy": message.PinnedBy,
+		},
+	})
+}
+
+func GetPinnedMessages(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	roomID, err := strconv.ParseUint(c.Params("roomId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	page, err := chatsync.Pinned(initializers.DB, user.ID, roomID)
+	if errors.Is(err, chatsync.ErrNotMember) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		log.Printf("Failed to read pinned messages: %s", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch messages"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   page,
+	})
+}
+
+// ForwardMessage copies a message the user can read into another room the
+// user sends to. It arrives there as a new message.
+func ForwardMessage(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+	messageID, err := strconv.ParseUint(c.Params("messageId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid messageId format"})
+	}
+	payload := new(ForwardMessageRequest)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	roomID, err := strconv.ParseUint(payload.RoomId, 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+
+	var room models.ChatRoom
+	if err := initializers.DB.First(&room, roomID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "Room not found"})
+	}
+	recipients, err := messageRecipients(initializers.DB, roomID, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to load room members"})
+	}
+	if !room.IsGroup && len(recipients) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The other member is not subscribed or does not exist"})
+	}
+
+	// The forward and its broadcast commit together
+	var message *models.ChatMessage
+	var broadcastPayload CentrifugoBroadcastPayload
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if message, err = chatmessages.Forward(tx, &config, user, messageID, roomID); err != nil {
+			return err
+		}
+		broadcastPayload, err = broadcastRoomEventTx(tx, roomID, "new_message", utils.SerializeChatMessage(*message),
+			fmt.Sprintf("send_message_%d", message.ID))
+		return err
+	})
+	if err != nil {
+		if message != nil {
+			chatfiles.Delete(initializers.DB, &config, message.Attachments)
+		}
+		return chatMessageError(c, err)
+	}
+
+	if _, err := CentrifugoBroadcastRoomCommitted(roomID, broadcastPayload); err != nil {
+		log.Printf("Failed to broadcast forwarded message: %s", err)
+	}
+
+	title := user.Name
+	if room.IsGroup {
+		title = room.Title + ": " + user.Name
+	}
+	pageURL := fmt.Sprintf("https://www.myru.online/chat/%d", roomID)
+	for _, recipient := range recipients {
+		sendNotificationToOwner(recipient.UserID.String(), title, message.Content, pageURL)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"status": "success", "data": fiber.Map{"message": message}})
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"errors"
+	"hyperpage/chatsync"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetChatHistory returns a page of a room, oldest message first. Older
+// pages are read with ?before=<oldest id>, newer ones with ?after=<newest
+// id>; without either the page is the latest.
+func GetChatHistory(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	roomID, err := strconv.ParseUint(c.Params("roomId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid room ID"})
+	}
+	var before, after uint64
+	if v := c.Query("before"); v != "" {
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid before message ID"})
+		}
+	}
+	if v := c.Query("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid after message ID"})
+		}
+	}
+	if before > 0 && after > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Use either before or after"})
+	}
+
+	page, err := chatsync.History(initializers.DB, user.ID, roomID, before, after, c.QueryInt("limit", chatsync.DefaultPageSize))
+	if errors.Is(err, chatsync.ErrNotMember) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if err != nil {
+		log.Printf("Failed to read chat history: %s", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch messages"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   page,
+	})
+}
+
+// SyncChat returns what changed in the rooms of the user since ?version=,
+// the version of the previous sync. Without it the rooms come alone.
+func SyncChat(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	var version uint64
+	if v := c.Query("version"); v != "" {
+		var err error
+		if version, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid version"})
+		}
+	}
+
+	changes, err := chatsync.Since(initializers.DB, user.ID, version)
+	if err != nil {
+		log.Printf("Failed to sync chat: %s", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to sync chat"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   changes,
+	})
+}
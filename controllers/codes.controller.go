@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/promocodes"
+)
+
+func CreateCodeBatch(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload promocodes.BatchRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	batch, codes, err := promocodes.CreateBatch(initializers.DB, user.ID, payload, time.Now())
+	if errors.Is(err, promocodes.ErrInvalidBatch) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Count must be between 1 and " + strconv.Itoa(promocodes.MaxBatchSize) + ", amount must be positive and expiry in the future",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create codes",
+		})
+	}
+
+	values := make([]string, 0, len(codes))
+	for _, code := range codes {
+		values = append(values, code.Code)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"batch": batch,
+			"codes": values,
+		},
+	})
+}
+
+func GetCodeBatches(c *fiber.Ctx) error {
+	var batches []models.CodeBatch
+	if err := initializers.DB.Order("created_at DESC").Find(&batches).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch code batches",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   batches,
+	})
+}
+
+func GetCodeBatch(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid batch ID",
+		})
+	}
+
+	var batch models.CodeBatch
+	if err := initializers.DB.First(&batch, id).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Batch not found",
+		})
+	}
+
+	var codes []models.Codes
+	var redemptions []models.CodeRedemption
+	err = initializers.DB.Where("batch_id = ?", id).Order("id").Find(&codes).Error
+	if err == nil {
+		err = initializers.DB.Where("batch_id = ?", id).Order("created_at DESC").Find(&redemptions).Error
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch code batch",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"batch":       batch,
+			"codes":       codes,
+			"redemptions": redemptions,
+		},
+	})
+}
+
+func UpdateCodeBatch(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid batch ID",
+		})
+	}
+
+	var payload struct {
+		Active *bool `json:"active"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Active == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	batch, err := promocodes.SetBatchActive(initializers.DB, id, *payload.Active)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Batch not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update code batch",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   batch,
+	})
+}
+
+func RedeemCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	redemption, err := promocodes.Redeem(initializers.DB, user.ID, payload.Code, c.IP(), time.Now())
+	if err != nil {
+		return redeemError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   redemption,
+	})
+}
+
+func redeemError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, promocodes.ErrCodeNotFound):
+		message = "Invalid code ID"
+	case errors.Is(err, promocodes.ErrCodeExhausted):
+		message = "Code is already activated"
+	case errors.Is(err, promocodes.ErrAlreadyRedeemed):
+		message = "Code is already redeemed"
+	case errors.Is(err, promocodes.ErrUserLimit):
+		message = "Code limit for this user reached"
+	case errors.Is(err, promocodes.ErrCodeExpired):
+		message = "Code has expired"
+	case errors.Is(err, promocodes.ErrCodeDisabled):
+		message = "Code is disabled"
+	case errors.Is(err, ledger.ErrInvalidAmount):
+		message = "Invalid code balance"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update balance",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
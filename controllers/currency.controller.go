@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/currency"
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+)
+
+func GetExchangeRates(c *fiber.Ctx) error {
+	rates, err := currency.Rates(initializers.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch exchange rates",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   rates,
+		"meta": fiber.Map{
+			"base":       currency.Base,
+			"currencies": currency.Supported(),
+		},
+	})
+}
+
+// SetExchangeRates stores rates sent as {"rates": {"GEL": 33.5}}, each the
+// price of one unit in the base currency.
+func SetExchangeRates(c *fiber.Ctx) error {
+	var payload struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := c.BodyParser(&payload); err != nil || len(payload.Rates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if err := currency.SetRates(initializers.DB, payload.Rates, "admin"); err != nil {
+		return currencyError(c, err)
+	}
+
+	return GetExchangeRates(c)
+}
+
+// ReloadExchangeRates reads the rates file again.
+func ReloadExchangeRates(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	if config.ExchangeRatesFile == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "EXCHANGE_RATES_FILE is not configured",
+		})
+	}
+
+	if err := currency.LoadFile(initializers.DB, config.ExchangeRatesFile); err != nil {
+		return currencyError(c, err)
+	}
+
+	return GetExchangeRates(c)
+}
+
+func GetWallet(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	code, minor, err := ledger.Wallet(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to get balance",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"currency": code,
+			"balance":  ledger.FromMinor(minor),
+		},
+	})
+}
+
+// SetWalletCurrency converts the whole balance into another currency.
+func SetWalletCurrency(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Currency string `json:"currency"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	billing, err := ledger.ChangeCurrency(initializers.DB, user.ID, payload.Currency)
+	if err != nil {
+		return currencyError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"currency": billing.Currency,
+			"balance":  ledger.FromMinor(billing.Balance),
+		},
+	})
+}
+
+func currencyError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, currency.ErrUnsupported):
+		message = "Unsupported currency"
+	case errors.Is(err, currency.ErrNoRate):
+		message = "No exchange rate for this currency yet"
+	case errors.Is(err, currency.ErrInvalidRate):
+		message = "Exchange rates must be positive"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update currency",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
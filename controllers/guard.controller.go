@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/loginguard"
+	"hyperpage/models"
+	"hyperpage/utils"
+)
+
+// throttled answers a request loginguard turned away, with Retry-After in
+// seconds.
+func throttled(c *fiber.Ctx, wait time.Duration, err error) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if errors.Is(err, loginguard.ErrLocked) {
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+			"status":      "fail",
+			"message":     "Too many failed sign in attempts, the account is temporarily locked. Check your email to unlock it",
+			"retry_after": int(math.Ceil(wait.Seconds())),
+		})
+	}
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"status":      "fail",
+		"message":     "Too many attempts, please try again later",
+		"retry_after": int(math.Ceil(wait.Seconds())),
+	})
+}
+
+// guardSignIn checks loginguard before a password is compared. Redis
+// errors let the sign in through rather than lock everybody out.
+func guardSignIn(c *fiber.Ctx, email string) (time.Duration, error) {
+	wait, err := loginguard.Check(c.Context(), c.IP(), email)
+	if errors.Is(err, loginguard.ErrLocked) || errors.Is(err, loginguard.ErrTooManyAttempts) {
+		loginguard.Record(initializers.DB, loginguard.EventRateLimited, email, c.IP(), "login")
+		return wait, err
+	}
+	if err != nil {
+		log.Println("Login guard check failed:", err)
+	}
+	return 0, nil
+}
+
+// guardAttempt counts a rate limited request such as a password reset.
+func guardAttempt(c *fiber.Ctx, action loginguard.Action, email string) (time.Duration, error) {
+	wait, err := loginguard.Attempt(c.Context(), action, c.IP(), email)
+	if errors.Is(err, loginguard.ErrTooManyAttempts) {
+		loginguard.Record(initializers.DB, loginguard.EventRateLimited, email, c.IP(), string(action))
+		return wait, err
+	}
+	if err != nil {
+		log.Println("Login guard check failed:", err)
+	}
+	return 0, nil
+}
+
+// signInFailed counts a wrong email or password. Repeated failures are
+// audited and the failure that locks the account emails its owner an
+// unlock link.
+func signInFailed(c *fiber.Ctx, email string, user *models.User) {
+	failure, err := loginguard.Fail(c.Context(), c.IP(), email)
+	if err != nil {
+		log.Println("Login guard failed to count a failure:", err)
+		return
+	}
+
+	if failure.Failures >= loginguard.RepeatedFailures {
+		loginguard.Record(initializers.DB, loginguard.EventRepeatedFailures, email, c.IP(),
+			strconv.FormatInt(failure.Failures, 10)+" failures")
+	}
+	if !failure.Locked {
+		return
+	}
+
+	loginguard.Record(initializers.DB, loginguard.EventLocked, email, c.IP(), "locked for "+loginguard.LockDuration.String())
+	if user != nil {
+		go sendUnlockEmail(user, failure.UnlockToken, c.Query("language"))
+	}
+}
+
+func sendUnlockEmail(user *models.User, token, language string) {
+	config, _ := initializers.LoadConfig(".")
+
+	firstName := user.Name
+	if strings.Contains(firstName, " ") {
+		firstName = strings.Split(firstName, " ")[1]
+	}
+
+	emailData := utils.EmailData{
+		URL:       "https://www." + config.ClientOrigin + "/auth/unlock/" + token,
+		FirstName: firstName,
+	}
+
+	switch language {
+	case "ru":
+		emailData.Subject = "Вход в аккаунт временно заблокирован"
+	default:
+		language = "en"
+		emailData.Subject = "Sign in to your account is temporarily locked"
+	}
+
+	utils.SendEmail(user, &emailData, "unlockAccount", language)
+}
+
+// UnlockAccount lifts a sign in lock with the token from the unlock email.
+func UnlockAccount(c *fiber.Ctx) error {
+	email, err := loginguard.Unlock(c.Context(), c.Params("unlockToken"))
+	if errors.Is(err, loginguard.ErrInvalidUnlock) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The unlock link is invalid or has expired"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to unlock account"})
+	}
+
+	loginguard.Record(initializers.DB, loginguard.EventUnlocked, email, c.IP(), "unlock link")
+
+	return c.JSON(fiber.Map{"status": "success", "message": "Account unlocked, you can sign in again"})
+}
+
+// GetSecurityEvents lists audit events for admins, newest first, filtered
+// by ?kind, email, ip, user_id, from and to (RFC 3339).
+func GetSecurityEvents(c *fiber.Ctx) error {
+	query := initializers.DB.Model(&models.SecurityEvent{})
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if email := c.Query("email"); email != "" {
+		query = query.Where("email = ?", loginguard.NormalizeEmail(email))
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	for _, bound := range []struct{ param, cond string }{{"from", "created_at >= ?"}, {"to", "created_at < ?"}} {
+		if v := c.Query(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Invalid " + bound.param + " time"})
+			}
+			query = query.Where(bound.cond, t)
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch security events"})
+	}
+
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	var events []models.SecurityEvent
+	if err := query.Order("created_at DESC").Limit(limit).Offset(c.QueryInt("skip", 0)).Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch security events"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   events,
+		"meta":   fiber.Map{"total": total, "limit": limit, "skip": c.QueryInt("skip", 0)},
+	})
+}
+
+// clearSignInLock forgets the failures of an email, such as after its
+// password was reset.
+func clearSignInLock(ctx context.Context, email string) {
+	if err := loginguard.Clear(ctx, email); err != nil {
+		log.Println("Login guard failed to clear a lock:", err)
+	}
+}
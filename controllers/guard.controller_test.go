@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"hyperpage/loginguard"
+	"hyperpage/testdb"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// guardTestApp counts a password reset request and a failed sign in per
+// request, behind the proxy settings of cmd/main.go. app.Test connects
+// from 0.0.0.0.
+func guardTestApp(trustedProxies ...string) *fiber.App {
+	app := fiber.New(fiber.Config{
+		ProxyHeader:             "X-Real-IP",
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          trustedProxies,
+		EnableIPValidation:      true,
+	})
+	app.Post("/attempt", func(c *fiber.Ctx) error {
+		email := c.Query("email")
+		if wait, err := guardAttempt(c, loginguard.Forgot, email); err != nil {
+			return throttled(c, wait, err)
+		}
+		signInFailed(c, email, nil)
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	return app
+}
+
+func attemptFrom(t *testing.T, app *fiber.App, ip, email string) {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodPost, "/attempt?email="+email, nil)
+	req.Header.Set("X-Real-IP", ip)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("attempt from %s = %d", ip, resp.StatusCode)
+	}
+}
+
+func TestGuardKeysOnClientIP(t *testing.T) {
+	server := testdb.Redis(t)
+	app := guardTestApp("0.0.0.0")
+
+	attemptFrom(t, app, "198.51.100.1", "a@example.com")
+	attemptFrom(t, app, "198.51.100.1", "b@example.com")
+	attemptFrom(t, app, "198.51.100.2", "c@example.com")
+
+	for _, bucket := range []struct {
+		key  string
+		want int
+	}{
+		{"guard:forgot:ip:198.51.100.1", 2},
+		{"guard:forgot:ip:198.51.100.2", 1},
+		{"guard:login:ip:198.51.100.1", 2},
+		{"guard:login:ip:198.51.100.2", 1},
+	} {
+		members, _ := server.ZMembers(bucket.key)
+		if len(members) != bucket.want {
+			t.Errorf("%s has %d events, want %d", bucket.key, len(members), bucket.want)
+		}
+	}
+	if server.Exists("guard:forgot:ip:0.0.0.0") || server.Exists("guard:login:ip:0.0.0.0") {
+		t.Error("requests were counted against the proxy address")
+	}
+}
+
+func TestGuardIgnoresUntrustedProxyHeader(t *testing.T) {
+	server := testdb.Redis(t)
+	app := guardTestApp("192.0.2.10")
+
+	// A client that sets the header itself does not get a fresh bucket
+	attemptFrom(t, app, "198.51.100.1", "a@example.com")
+	attemptFrom(t, app, "198.51.100.2", "b@example.com")
+
+	members, _ := server.ZMembers("guard:forgot:ip:0.0.0.0")
+	if len(members) != 2 {
+		t.Fatalf("the connecting address has %d events, want 2", len(members))
+	}
+	if server.Exists("guard:forgot:ip:198.51.100.1") {
+		t.Fatal("an untrusted X-Real-IP was used")
+	}
+}
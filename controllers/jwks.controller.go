@@ -0,0 +1,16 @@
+package controllers
+
+import (
+	"hyperpage/signing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetJWKS publishes the public keys of access tokens, so Centrifugo and other
+// services can verify them. Keys are published before they sign anything;
+// caches should not outlive the wait between generating and activating a
+// key.
+func GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": signing.JWKS()})
+}
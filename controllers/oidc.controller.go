@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/oidc"
+)
+
+// oidcRedirectURL is the client page providers send the browser back to.
+func oidcRedirectURL(config *initializers.Config) string {
+	if config.OIDCRedirectURL != "" {
+		return config.OIDCRedirectURL
+	}
+	return strings.TrimSuffix(config.ClientOrigin, "/") + "/auth/oidc/callback"
+}
+
+// GetOIDCProviders lists the social sign in providers that are configured.
+func GetOIDCProviders(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   oidc.Names(),
+	})
+}
+
+// StartOIDC returns the provider URL to send the browser to. The client
+// page at the redirect URL posts the code and state it gets back to
+// OIDCCallback.
+func StartOIDC(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	provider, err := oidc.Get(c.Context(), c.Params("provider"))
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	url, err := oidc.Begin(c.Context(), provider, oidcRedirectURL(&config), c.Query("session"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to start sign in"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   fiber.Map{"url": url},
+	})
+}
+
+// OIDCCallback completes a browser sign in with the code the provider gave.
+func OIDCCallback(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	state, err := oidc.TakeState(c.Context(), payload.State)
+	if err != nil {
+		return oidcError(c, err)
+	}
+	provider, err := oidc.Get(c.Context(), state.Provider)
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	token, err := provider.Exchange(c.Context(), payload.Code, oidcRedirectURL(&config), state.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange with %s failed: %v", provider.Name, err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Sign in was not accepted by the provider"})
+	}
+	identity, err := provider.Identify(c.Context(), token, state.Nonce)
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	return signInIdentity(c, &config, identity, state.Session)
+}
+
+// OIDCTokenSignIn signs in with an ID token a native app got from the
+// provider SDK, such as Sign in with Apple on iOS. Apple shares the name only
+// on the first authorization, so the app passes it along.
+func OIDCTokenSignIn(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload struct {
+		IDToken string `json:"id_token"`
+		Nonce   string `json:"nonce"`
+		Name    string `json:"name"`
+		Session string `json:"session"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.IDToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	provider, err := oidc.Get(c.Context(), c.Params("provider"))
+	if err != nil {
+		return oidcError(c, err)
+	}
+	identity, err := provider.VerifyIDToken(c.Context(), payload.IDToken, payload.Nonce)
+	if err != nil {
+		return oidcError(c, err)
+	}
+	if identity.Name == "" {
+		identity.Name = payload.Name
+	}
+
+	return signInIdentity(c, &config, identity, payload.Session)
+}
+
+// signInIdentity finds or creates the user of an identity and signs them in
+// like a password sign in, second factor included.
+func signInIdentity(c *fiber.Ctx, config *initializers.Config, identity *oidc.Identity, session string) error {
+	user, created, err := oidc.Resolve(initializers.DB, config, identity)
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	required, err := twoFactorRequired(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+	if required {
+		return beginTwoFactor(c, user, session)
+	}
+
+	return completeSignIn(c, config, user, session, fiber.Map{"created": created})
+}
+
+// GetIdentities lists the providers linked to the current user.
+func GetIdentities(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var identities []models.UserIdentity
+	if err := initializers.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&identities).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch linked accounts"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   identities,
+	})
+}
+
+// UnlinkIdentity removes a linked provider. The password keeps working, a
+// user created by a provider sets one with a password reset.
+func UnlinkIdentity(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	result := initializers.DB.Where("id = ? AND user_id = ?", c.Params("id"), user.ID).Delete(&models.UserIdentity{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to unlink account"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Linked account not found"})
+	}
+
+	return c.JSON(fiber.Map{"status": "success"})
+}
+
+func oidcError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, oidc.ErrUnknownProvider):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "Unknown sign in provider"})
+	case errors.Is(err, oidc.ErrInvalidState):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Sign in expired, please try again"})
+	case errors.Is(err, oidc.ErrInvalidToken):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Invalid identity token"})
+	case errors.Is(err, oidc.ErrNoEmail):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "The provider did not share an email address"})
+	case errors.Is(err, oidc.ErrEmailNotVerified):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "The email address is not verified by the provider"})
+	}
+
+	log.Println("OIDC sign in failed:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to sign in"})
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"hyperpage/initializers"
+	"hyperpage/loginguard"
+	"hyperpage/models"
+	"hyperpage/passwordless"
+	"hyperpage/sessions"
+	"hyperpage/utils"
+)
+
+// RequestMagicLink emails a sign in link. The answer is the same whether
+// the email has an account or not.
+func RequestMagicLink(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	language := c.Query("language")
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Email field cannot be empty"})
+	}
+	email := loginguard.NormalizeEmail(payload.Email)
+
+	if wait, err := guardAttempt(c, loginguard.MagicLink, email); err != nil {
+		return throttled(c, wait, err)
+	}
+
+	sent := fiber.Map{"status": "success", "message": "If the email has an account, a sign in link was sent to it"}
+
+	var user models.User
+	if err := initializers.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(sent)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+
+	token, err := passwordless.NewMagicLink(c.Context(), user.ID.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to create sign in link"})
+	}
+
+	firstName := user.Name
+	if strings.Contains(firstName, " ") {
+		firstName = strings.Split(firstName, " ")[1]
+	}
+	emailData := utils.EmailData{
+		URL:       "https://www." + config.ClientOrigin + "/auth/magic/" + token,
+		FirstName: firstName,
+	}
+	switch language {
+	case "ru":
+		emailData.Subject = "Ссылка для входа (доступна 15 мин)"
+	default:
+		language = "en"
+		emailData.Subject = "Your sign in link (available for 15 minutes)"
+	}
+	go utils.SendEmail(&user, &emailData, "magicLink", language)
+
+	return c.JSON(sent)
+}
+
+// VerifyMagicLink signs in with the token of a sign in link. Following the
+// link proves the email, so an unverified account becomes verified. Whoever
+// registered it never proved to own the address, so its password is
+// replaced and its sessions are revoked; the owner sets a password with a
+// password reset.
+func VerifyMagicLink(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload struct {
+		Token   string `json:"token"`
+		Session string `json:"session"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	userID, err := passwordless.UseMagicLink(c.Context(), payload.Token)
+	if errors.Is(err, passwordless.ErrInvalidLink) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "The sign in link is invalid or has expired"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userID).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "The sign in link is invalid or has expired"})
+	}
+	if !user.Verified {
+		if err := claimUnverified(c, &user); err != nil {
+			log.Println("Failed to verify account with a sign in link:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+		}
+	}
+	clearSignInLock(c.Context(), user.Email)
+
+	return signInPasswordless(c, &config, &user, payload.Session)
+}
+
+// claimUnverified verifies an account for the owner of its email, locking
+// out whoever registered it with the address.
+func claimUnverified(c *fiber.Ctx, user *models.User) error {
+	// Revoked before the account changes, a failure leaves it as it was
+	if err := sessions.RevokeAll(c.Context(), user.ID.String(), ""); err != nil {
+		return err
+	}
+	password, err := utils.RandomPasswordHash()
+	if err != nil {
+		return err
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"verified":          true,
+			"verification_code": "",
+			"password":          password,
+		}).Error; err != nil {
+			return err
+		}
+		user.Verified = true
+		user.VerificationCode = ""
+		user.Password = password
+		return tx.Where(models.Profile{UserID: user.ID}).FirstOrCreate(&models.Profile{UserID: user.ID}).Error
+	})
+}
+
+// TelegramSignIn signs in with the data of the Telegram Login Widget. The
+// account is found by the Telegram ID the bot activation stored; usernames
+// can be given up and taken by somebody else, so they are not trusted.
+func TelegramSignIn(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload map[string]interface{}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	session, _ := payload["session"].(string)
+	delete(payload, "session")
+
+	// The widget sends id and auth_date as numbers, the hash covers them
+	// as text
+	fields := map[string]string{}
+	for k, v := range payload {
+		switch v := v.(type) {
+		case string:
+			fields[k] = v
+		case float64:
+			fields[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+
+	login, err := passwordless.VerifyTelegramLogin(config.TELEGRAM_TOKEN, fields, time.Now())
+	if errors.Is(err, passwordless.ErrTelegramLoginExpired) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Telegram login has expired, please try again"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Invalid Telegram login"})
+	}
+
+	var user models.User
+	err = initializers.DB.Where("tid = ? AND telegram_activated = ?", login.ID, true).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "No account is linked to this Telegram account, activate it with the bot first"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+
+	return signInPasswordless(c, &config, &user, session)
+}
+
+// signInPasswordless finishes a sign in that needed no password, the
+// second factor is still asked for.
+func signInPasswordless(c *fiber.Ctx, config *initializers.Config, user *models.User, session string) error {
+	required, err := twoFactorRequired(user)
+	if err != nil {
+		log.Println("Failed to check two-factor enrollment:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+	if required {
+		return beginTwoFactor(c, user, session)
+	}
+
+	return completeSignIn(c, config, user, session, nil)
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/testdb"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestClaimUnverifiedLocksOutRegistrant(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Profile{})
+	testdb.Use(t, db)
+	testdb.Redis(t)
+	ctx := context.Background()
+
+	// Somebody registered the address first and never verified it
+	password, err := utils.HashPassword("squatter-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{
+		Name:             "squatter",
+		Email:            "alice@example.com",
+		Password:         password,
+		VerificationCode: "code",
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+	access := &utils.TokenDetails{TokenUuid: "access", ExpiresIn: &expires}
+	refresh := &utils.TokenDetails{TokenUuid: "refresh", ExpiresIn: &expires}
+	if _, err := sessions.Create(ctx, user.ID.String(), "browser", "198.51.100.7", access, refresh); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner follows a sign in link
+	app := fiber.New()
+	app.Post("/claim", func(c *fiber.Ctx) error {
+		if err := claimUnverified(c, &user); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/claim", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("claim = %d", resp.StatusCode)
+	}
+
+	var stored models.User
+	if err := db.First(&stored, "id = ?", user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Verified || stored.VerificationCode != "" {
+		t.Fatalf("verified %v, verification code %q", stored.Verified, stored.VerificationCode)
+	}
+	if utils.VerifyPassword(stored.Password, "squatter-password") == nil {
+		t.Fatal("the registrant's password still signs in")
+	}
+	if list, err := sessions.List(ctx, user.ID.String()); err != nil || len(list) != 0 {
+		t.Fatalf("sessions = %v, %v, want none", list, err)
+	}
+	var profiles int64
+	db.Model(&models.Profile{}).Where("user_id = ?", user.ID).Count(&profiles)
+	if profiles != 1 {
+		t.Fatalf("%d profiles, want 1", profiles)
+	}
+}
@@ -1,22 +1,22 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/payments"
 	"hyperpage/utils"
 	"log"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nikita-vanyasin/tinkoff"
-	"gorm.io/gorm"
 )
 
 func handlePanic(c *fiber.Ctx) {
 	if r := recover(); r != nil {
-		fmt.Println("Recovered from panic:", r)
+		log.Println("Recovered from panic:", r)
 		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
 			"message": "An unexpected error occurred",
@@ -25,132 +25,76 @@ func handlePanic(c *fiber.Ctx) {
 }
 
 func Pending(c *fiber.Ctx) error {
+	return processPaymentCallback(c, payments.ProviderTinkoff)
+}
+
+func PaymentCallback(c *fiber.Ctx) error {
+	return processPaymentCallback(c, c.Params("provider"))
+}
+
+func processPaymentCallback(c *fiber.Ctx, providerName string) error {
 
 	defer handlePanic(c)
 
-	var requestBody map[string]interface{}
+	config, _ := initializers.LoadConfig(".")
 
-	if err := c.BodyParser(&requestBody); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+	provider, err := payments.Get(&config, providerName)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"status":  "error",
-			"message": fmt.Sprintf("Failed to parse request body: %v", err),
+			"message": err.Error(),
 		})
 	}
 
-	var response = requestBody
-
-	// Access the value of the PaymentId field
-	// paymentIDFloat := response["PaymentId"].(float64)
-
-	// Convert the PaymentId to an integer
-	var paymentID int64
-
-	switch v := requestBody["PaymentId"].(type) {
-	case float64:
-		paymentID = int64(v)
-	case string:
-		// Преобразование строки в int64
-		id, err := strconv.ParseInt(v, 10, 64)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Invalid PaymentId format",
-			})
-		}
-		paymentID = id
-	default:
+	callback, err := provider.VerifyCallback(c.Body())
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "PaymentId is of an unexpected type",
+			"message": fmt.Sprintf("Invalid notification: %v", err),
 		})
 	}
 
-	if response["Status"] == "CONFIRMED" { // Use == for comparison
-		var payment models.Payments
-		if err := initializers.DB.Where("payment_id = ?  AND status = ?", fmt.Sprintf("%d", paymentID), "NEW").First(&payment).Error; err != nil {
-			// Handle error if the record is not found or other issues
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Payment not found or status is not 'NEW'",
-			})
-		}
-		// Update the status to "applied"
-		payment.Status = "applied"
-		if err := initializers.DB.Save(&payment).Error; err != nil {
-			// Handle error if the update fails
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Failed to update payment status",
-			})
-		}
-
-		decimalAmount := float64(payment.Amount) / 100.0
-
-		// Update the amount field in the balance table
-		updateBalanceErr := initializers.DB.Model(&models.Billing{}).
-			Where("user_id = ?", payment.UserID).
-			Updates(map[string]interface{}{
-				"amount": gorm.Expr("amount + ?", decimalAmount),
-			}).Error
-		if updateBalanceErr != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Failed to update balance",
-			})
-		}
+	result, err := payments.ProcessCallback(initializers.DB, provider.Name(), callback)
+	if errors.Is(err, payments.ErrPaymentNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Payment not found",
+		})
+	}
+	if err != nil {
+		log.Println("Could not process payment notification:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to process payment notification",
+		})
+	}
 
+	if result.BalanceChanged {
 		var user models.User
-		if err := initializers.DB.Model(&models.User{}).Where("id = ?", payment.UserID).First(&user).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Failed to find user",
-			})
-		}
-
-		userSession := user.Session
-
-		transaction := models.Transaction{
-			UserID:      payment.UserID,
-			Total:       `0`,
-			Amount:      decimalAmount,
-			Description: `Пополнение баланса c карты банка`,
-			Module:      `Payment`,
-			Type:        `profit`,
-			Status:      `CLOSED_1`,
+		if err := initializers.DB.Model(&models.User{}).Where("id = ?", result.Payment.UserID).First(&user).Error; err == nil {
+			event := "BalanceAdded"
+			if result.Payment.Status != models.PaymentStatusApplied {
+				event = "BalanceRefunded"
+			}
+			_ = utils.SendPersonalMessageToClient(user.Session, event)
 		}
-
-		createTransactionErr := initializers.DB.Create(&transaction).Error
-		if createTransactionErr != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Failed to create transaction",
-			})
-		}
-
-		var err = utils.SendPersonalMessageToClient(userSession, "BalanceAdded")
-		if err != nil {
-			// handle error
-			_ = err
-		}
-
 	}
 
-	// return the city names as a JSON response
-	return c.JSON(fiber.Map{
-		"status": "success",
-		"data":   "initRes",
-	})
+	// Tinkoff stops retrying the callback only after a plain "OK" body
+	return c.SendString("OK")
 }
 
 func CreateInvoice(c *fiber.Ctx) error {
 
-	// var terminalKey = "1718186727633DEMO"
-	// var terminalPassword = "lkSI$mq4FqxMBrwf"
-
-	var terminalKey = "1669511559870DEMO"
-	var terminalPassword = "3mctl616b7ll8cnh"
+	config, _ := initializers.LoadConfig(".")
 
-	client := tinkoff.NewClient(terminalKey, terminalPassword)
+	provider, err := payments.Get(&config, c.Query("provider"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
 
 	orderID := strconv.FormatInt(time.Now().UnixNano(), 10)
 
@@ -165,62 +109,97 @@ func CreateInvoice(c *fiber.Ctx) error {
 
 	userResp := user.(models.UserResponse)
 
-	initReq := &tinkoff.InitRequest{
+	invoice, err := provider.CreateInvoice(payments.InvoiceRequest{
 		Amount:      amount,
 		OrderID:     orderID,
 		CustomerKey: userResp.Name,
+		Email:       userResp.Email,
 		Description: "Пополнение баланса в профиле " + userResp.Name + " на платформе моя Россия онлайн",
-		// PayType:         tinkoff.PayTypeOneStep,
-		RedirectDueDate: tinkoff.Time(time.Now().Add(4 * time.Hour * 24)), // ссылка истечет через 4 дня
-		Receipt: &tinkoff.Receipt{
-			Email: userResp.Email,
-			Items: []*tinkoff.ReceiptItem{
-				{
-					Price:         amount,
-					Quantity:      "1",
-					Amount:        amount,
-					Name:          "Баланс на сумму " + strconv.FormatUint(amount, 10),
-					Tax:           tinkoff.VATNone,
-					PaymentMethod: tinkoff.PaymentMethodFullPayment,
-					PaymentObject: tinkoff.PaymentObjectIntellectualActivity,
-				},
-			},
-			Taxation: tinkoff.TaxationUSNIncome,
-			Payments: &tinkoff.ReceiptPayments{
-				Electronic: amount,
-			},
-		},
-
-		//custom fields for tinkoff
-		Data: map[string]string{},
-	}
-
-	initRes, err := client.Init(initReq)
+	})
 	if err != nil {
-		// Handle the error here, if needed
-		fmt.Println("Error:", err)
-	} else {
-
-		payments := models.Payments{
-			UserID:    userResp.ID,
-			Amount:    float64(amount),
-			Status:    "NEW",
-			PaymentId: initRes.PaymentID, // Store as a string directly
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-		}
+		log.Println("Could not create invoice:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
 
-		// Create the database record
-		if err := initializers.DB.Create(&payments).Error; err != nil {
-			log.Println("Could not create payment:", err)
-		} else {
-			fmt.Println("Payment record created successfully")
-		}
+	payment := models.Payments{
+		UserID:    userResp.ID,
+		Amount:    float64(amount),
+		Status:    models.PaymentStatusNew,
+		PaymentId: invoice.PaymentID, // Store as a string directly
+		Provider:  provider.Name(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// Without the record the callback could never be matched, so the
+	// invoice is not handed out
+	if err := initializers.DB.Create(&payment).Error; err != nil {
+		log.Println("Could not create payment:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create payment",
+		})
 	}
 
 	// return the city names as a JSON response
 	return c.JSON(fiber.Map{
 		"status": "success",
-		"data":   initRes,
+		"data":   invoice,
+	})
+}
+
+func RefundPayment(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	paymentID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid payment ID",
+		})
+	}
+
+	// Amount is in kopecks, zero refunds the whole remaining amount
+	var payload struct {
+		Amount uint64 `json:"amount"`
+	}
+	if err := c.BodyParser(&payload); err != nil && len(c.Body()) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	payment, err := payments.Refund(initializers.DB, &config, paymentID, payload.Amount)
+	switch {
+	case errors.Is(err, payments.ErrPaymentNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Payment not found",
+		})
+	case errors.Is(err, payments.ErrPaymentNotRefundable), errors.Is(err, payments.ErrRefundTooLarge):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err != nil:
+		log.Println("Could not refund payment:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to refund payment",
+		})
+	}
+
+	var user models.User
+	if err := initializers.DB.Where("id = ?", payment.UserID).First(&user).Error; err == nil {
+		_ = utils.SendPersonalMessageToClient(user.Session, "BalanceRefunded")
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   payment,
 	})
 }
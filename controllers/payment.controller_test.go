@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hyperpage/models"
+	"hyperpage/payments"
+	"hyperpage/testdb"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+// failingProvider is a fake whose acquiring API is down.
+type failingProvider struct {
+	*payments.FakeProvider
+}
+
+func (failingProvider) Name() string {
+	return "failing"
+}
+
+func (failingProvider) CreateInvoice(payments.InvoiceRequest) (*payments.Invoice, error) {
+	return nil, errors.New("acquiring is unavailable")
+}
+
+func paymentsTestApp(user models.UserResponse) *fiber.App {
+	app := fiber.New()
+	app.Post("/invoice", func(c *fiber.Ctx) error {
+		c.Locals("user", user)
+		return c.Next()
+	}, CreateInvoice)
+	app.Post("/callback/:provider", PaymentCallback)
+	return app
+}
+
+func requestInvoice(t *testing.T, app *fiber.App, provider, amount string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodPost, "/invoice?provider="+provider, nil)
+	req.Header.Set("amount", amount)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCreateInvoiceAndCallback(t *testing.T) {
+	db := testdb.Open(t,
+		&models.Payments{},
+		&models.PaymentWebhookEvent{},
+		&models.PaymentRefund{},
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+	testdb.Use(t, db)
+	fake := payments.NewFakeProvider()
+	payments.Register(fake)
+
+	user := models.UserResponse{ID: uuid.NewV4(), Name: "payer", Email: "payer@example.com"}
+	app := paymentsTestApp(user)
+
+	resp := requestInvoice(t, app, payments.ProviderFake, "25000")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("invoice status = %d", resp.StatusCode)
+	}
+	var body struct {
+		Data payments.Invoice `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	var payment models.Payments
+	if err := db.Where("payment_id = ? AND provider = ?", body.Data.PaymentID, payments.ProviderFake).First(&payment).Error; err != nil {
+		t.Fatalf("payment of the invoice: %v", err)
+	}
+	if payment.Status != models.PaymentStatusNew || payment.UserID != user.ID || payment.Amount != 25000 {
+		t.Fatalf("payment = %+v", payment)
+	}
+
+	callback, err := fake.SetStatus(body.Data.PaymentID, payments.StatusConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(fiber.MethodPost, "/callback/"+payments.ProviderFake, strings.NewReader(string(callback)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(text) != "OK" {
+		t.Fatalf("callback = %d %s", resp.StatusCode, text)
+	}
+
+	db.First(&payment, payment.ID)
+	if payment.Status != models.PaymentStatusApplied {
+		t.Fatalf("status after the callback = %s", payment.Status)
+	}
+	var billing models.Billing
+	if err := db.Where("user_id = ?", user.ID).First(&billing).Error; err != nil {
+		t.Fatal(err)
+	}
+	if billing.Balance != 25000 {
+		t.Fatalf("balance = %d, want 25000", billing.Balance)
+	}
+}
+
+func TestCreateInvoiceProviderError(t *testing.T) {
+	payments.Register(failingProvider{payments.NewFakeProvider()})
+	app := paymentsTestApp(models.UserResponse{ID: uuid.NewV4(), Name: "payer"})
+
+	resp := requestInvoice(t, app, "failing", "25000")
+	if resp.StatusCode != fiber.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusBadGateway)
+	}
+}
+
+func TestCreateInvoiceWithoutPaymentRecord(t *testing.T) {
+	// No payments table, the record cannot be written
+	testdb.Use(t, testdb.Open(t))
+	payments.Register(payments.NewFakeProvider())
+	app := paymentsTestApp(models.UserResponse{ID: uuid.NewV4(), Name: "payer"})
+
+	resp := requestInvoice(t, app, payments.ProviderFake, "25000")
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusInternalServerError)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if _, ok := body["data"]; ok {
+		t.Fatal("an invoice without a payment record was handed out")
+	}
+}
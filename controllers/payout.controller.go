@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/payouts"
+)
+
+func GetWithdrawals(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+
+	var withdrawals []models.Withdrawal
+	if err := initializers.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&withdrawals).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch withdrawals",
+		})
+	}
+
+	available, err := payouts.Withdrawable(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch withdrawals",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   withdrawals,
+		"meta": fiber.Map{
+			"withdrawable": available,
+			"settings":     payouts.SettingsFrom(&config),
+		},
+	})
+}
+
+func RequestWithdrawal(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Amount      float64 `json:"amount"`
+		Destination string  `json:"destination"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	settings := payouts.SettingsFrom(&config)
+	w, err := payouts.Request(initializers.DB, settings, user.ID, payload.Amount, payload.Destination)
+	if errors.Is(err, payouts.ErrBelowMinimum) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Minimum withdrawal is " + strconv.FormatFloat(settings.MinAmount, 'f', -1, 64),
+		})
+	}
+	if err != nil {
+		return withdrawalError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   w,
+	})
+}
+
+func CancelWithdrawal(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid withdrawal ID",
+		})
+	}
+
+	w, err := payouts.Cancel(initializers.DB, id, user.ID, time.Now())
+	if err != nil {
+		return withdrawalError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   w,
+	})
+}
+
+func GetAllWithdrawals(c *fiber.Ctx) error {
+	query := initializers.DB.Order("created_at")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var withdrawals []models.Withdrawal
+	if err := query.Find(&withdrawals).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch withdrawals",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   withdrawals,
+	})
+}
+
+func ProcessWithdrawal(c *fiber.Ctx) error {
+	admin := c.Locals("user").(models.UserResponse)
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid withdrawal ID",
+		})
+	}
+
+	var payload struct {
+		Comment   string `json:"comment"`
+		Reference string `json:"reference"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid request body",
+			})
+		}
+	}
+
+	now := time.Now()
+	var w *models.Withdrawal
+	switch c.Params("action") {
+	case "approve":
+		w, err = payouts.Approve(initializers.DB, id, admin.ID, now)
+	case "reject":
+		w, err = payouts.Reject(initializers.DB, id, admin.ID, payload.Comment, now)
+	case "paid":
+		w, err = payouts.MarkPaid(initializers.DB, id, admin.ID, payload.Reference, now)
+	case "fail":
+		w, err = payouts.Fail(initializers.DB, id, admin.ID, payload.Comment, now)
+	default:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown action",
+		})
+	}
+	if err != nil {
+		return withdrawalError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   w,
+	})
+}
+
+func withdrawalError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, payouts.ErrWithdrawalNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Withdrawal not found",
+		})
+	case errors.Is(err, payouts.ErrInvalidTransition):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Withdrawal cannot move to this status",
+		})
+	case errors.Is(err, payouts.ErrNoDestination):
+		message = "Payout destination is required"
+	case errors.Is(err, payouts.ErrExceedsWithdrawable):
+		message = "Amount exceeds the withdrawable balance"
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		message = "Insufficient balance"
+	case errors.Is(err, ledger.ErrAccountInDebt):
+		message = "Account has an outstanding debt"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to process withdrawal",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
@@ -2,9 +2,12 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hyperpage/initializers"
+	"hyperpage/ledger"
 	"hyperpage/models"
+	"hyperpage/signing"
 	"hyperpage/utils"
 	"strconv"
 	"strings"
@@ -349,10 +352,8 @@ func GetProfileGuest(c *fiber.Ctx) error {
 		access_token = c.Cookies("access_token")
 	}
 
-	config, _ := initializers.LoadConfig(".")
-
 	if access_token != "" && access_token != "undefined" {
-		tokenClaims, err := utils.ValidateToken(access_token, config.AccessTokenPublicKey)
+		tokenClaims, err := utils.ValidateToken(access_token, signing.Access)
 		if err != nil {
 			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 		}
@@ -578,6 +579,19 @@ func UpdateBotProfileAdditional(c *fiber.Ctx) error {
 		})
 	}
 
+	if !isBotUser(requestBody.UserId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only bot profiles can be updated with an API key",
+		})
+	}
+	if !apiKeyActsFor(c, requestBody.UserId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "API key cannot act for this user",
+		})
+	}
+
 	profile := models.Profile{}
 	err := initializers.DB.Where("user_id = ?", requestBody.UserId).First(&profile).Error
 	if err != nil {
@@ -861,6 +875,19 @@ func UpdateBotProfile(c *fiber.Ctx) error {
 		})
 	}
 
+	if !isBotUser(requestBody.UserId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only bot profiles can be updated with an API key",
+		})
+	}
+	if !apiKeyActsFor(c, requestBody.UserId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "API key cannot act for this user",
+		})
+	}
+
 	var profile models.Profile
 	if err := initializers.DB.Preload("Guilds").Preload("Hashtags").Preload("City").Preload("Photos").First(&profile, "user_id = ?", requestBody.UserId).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -1465,56 +1492,6 @@ func SendDonat(c *fiber.Ctx) error {
 		})
 	}
 
-	// Получение текущего баланса пользователя
-	var billing models.Billing
-	err = initializers.DB.Where("user_id = ?", userResp.ID).First(&billing).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to fetch balance",
-		})
-	}
-
-	// Проверка достаточности баланса
-	if billing.Amount < priceFloat {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Insufficient balance",
-		})
-	}
-
-	// Обновление баланса пользователя
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", userResp.ID).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount - ?", priceFloat),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to update balance",
-		})
-	}
-
-	// Создание транзакции
-	transaction := models.Transaction{
-		UserID:      userResp.ID,
-		Total:       strconv.FormatFloat(priceFloat, 'f', 2, 64),
-		Amount:      priceFloat,
-		Description: "Донат пользователю " + donatReq.Author,
-		Module:      "donat",
-		Type:        "deduction",
-		Status:      "CLOSED_1",
-	}
-
-	err = initializers.DB.Create(&transaction).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to create transaction",
-		})
-	}
-
 	// Получение ID автора стрима
 	var author models.User
 	err = initializers.DB.Where("name = ?", donatReq.Author).First(&author).Error
@@ -1525,48 +1502,29 @@ func SendDonat(c *fiber.Ctx) error {
 		})
 	}
 
-	// Ensure author.ID is a UUID (string)
-	authorIDStr := author.ID
-
-	// Увеличение баланса автора стрима
-	var authorBilling models.Billing
-	err = initializers.DB.Where("user_id = ?", authorIDStr).First(&authorBilling).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	// Перевод доната с баланса пользователя на баланс автора стрима
+	_, err = ledger.Transfer(initializers.DB, userResp.ID, author.ID, priceFloat, "Получение доната от пользователя "+userResp.Name, ledger.Posting{
+		Module:      "donat",
+		Description: "Донат пользователю " + donatReq.Author,
+		Status:      "CLOSED_1",
+		Total:       strconv.FormatFloat(priceFloat, 'f', 2, 64),
+	})
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to fetch author balance",
+			"message": "Insufficient balance",
 		})
 	}
-
-	// Увеличение баланса автора стрима
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", authorIDStr).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount + ?", priceFloat),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	if errors.Is(err, ledger.ErrAccountInDebt) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to update author balance",
+			"message": "Account has an outstanding debt",
 		})
 	}
-
-	// Создание транзакции для автора стрима
-	transactionReceiver := models.Transaction{
-		UserID:      authorIDStr,
-		Total:       strconv.FormatFloat(priceFloat, 'f', 2, 64),
-		Amount:      priceFloat,
-		Description: "Получение доната от пользователя " + userResp.Name,
-		Module:      "donat",
-		Type:        "addition",
-		Status:      "CLOSED_1",
-	}
-
-	err = initializers.DB.Create(&transactionReceiver).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to create transaction for receiver",
+			"message": "Failed to update balance",
 		})
 	}
 
@@ -1598,6 +1556,13 @@ func UpdateProfileStreaming(c *fiber.Ctx) error {
 		})
 	}
 
+	if !apiKeyActsFor(c, streaming.UserID.String()) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "API key cannot act for this user",
+		})
+	}
+
 	if err := initializers.DB.First(&profile, "user_id = ?", streaming.UserID).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
@@ -1653,6 +1618,12 @@ func DeleteProfileStreaming(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("Failed to parse request body: %v", err),
 		})
 	}
+	if !apiKeyActsFor(c, requestData.UserID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "API key cannot act for this user",
+		})
+	}
 	fmt.Println("---------------------------------------------")
 	fmt.Println(requestData)
 	var profile models.Profile
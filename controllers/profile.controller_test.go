@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestBotProfileUpdateNeedsKeyOfBot(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Profile{}, &models.Langs{})
+	testdb.Use(t, db)
+
+	bots := make([]models.User, 2)
+	for i, name := range []string{"bot-one", "bot-two"} {
+		bots[i] = models.User{Name: name, Email: name + "@example.com", Password: "-", IsBot: true}
+		if err := db.Create(&bots[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&models.Profile{UserID: bots[i].ID}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The key of the first bot, as RequireAPIKey leaves it
+	owner := bots[0].ID
+	key := &models.APIKey{Name: "bot-one", UserID: &owner, CreatedBy: uuid.NewV4()}
+	app := fiber.New()
+	for path, handler := range map[string]fiber.Handler{
+		"/updateprofile":        UpdateBotProfile,
+		"/updateadditionalinfo": UpdateBotProfileAdditional,
+	} {
+		app.Patch(path, func(c *fiber.Ctx) error {
+			c.Locals("api_key", key)
+			return c.Next()
+		}, handler)
+	}
+
+	patch := func(path string, bot models.User) int {
+		t.Helper()
+		body := `{"userid":"` + bot.ID.String() + `","additional":"about"}`
+		req := httptest.NewRequest(fiber.MethodPatch, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/updateprofile", "/updateadditionalinfo"} {
+		if got := patch(path, bots[1]); got != fiber.StatusForbidden {
+			t.Errorf("%s of another bot = %d, want %d", path, got, fiber.StatusForbidden)
+		}
+	}
+	if got := patch("/updateadditionalinfo", bots[0]); got != fiber.StatusOK {
+		t.Errorf("/updateadditionalinfo of the key's bot = %d, want %d", got, fiber.StatusOK)
+	}
+
+	var profile models.Profile
+	db.First(&profile, "user_id = ?", bots[1].ID)
+	if profile.Additional != "" {
+		t.Fatalf("the other bot's profile was changed to %q", profile.Additional)
+	}
+}
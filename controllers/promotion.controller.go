@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/promotions"
+)
+
+func PlacePromotionBid(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload promotions.BidRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	bid, err := promotions.PlaceBid(initializers.DB, user.ID, payload, time.Now())
+	if err != nil {
+		return promotionError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   bid,
+	})
+}
+
+func CancelPromotionBid(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid bid ID",
+		})
+	}
+
+	bid, err := promotions.CancelBid(initializers.DB, user.ID, id, time.Now())
+	if err != nil {
+		return promotionError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   bid,
+	})
+}
+
+func GetMyPromotionBids(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var bids []models.PromotionBid
+	err := initializers.DB.Where("user_id = ?", user.ID).
+		Order("window_start DESC, id DESC").
+		Limit(100).
+		Find(&bids).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch bids",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   bids,
+	})
+}
+
+func promotionError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	case errors.Is(err, promotions.ErrBidNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Bid not found",
+		})
+	case errors.Is(err, promotions.ErrNotBlogOwner):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	case errors.Is(err, promotions.ErrInvalidBid):
+		message = "Invalid feed or window"
+	case errors.Is(err, promotions.ErrBidTooLow):
+		message = "Bid must be at least " + strconv.FormatFloat(promotions.MinBid, 'f', -1, 64)
+	case errors.Is(err, promotions.ErrBiddingClosed):
+		message = "Bidding for this window is closed"
+	case errors.Is(err, promotions.ErrBlogNotActive):
+		message = "Blog is not active"
+	case errors.Is(err, promotions.ErrBlogNotInScope):
+		message = "Blog is not published in this feed"
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		message = "Insufficient balance"
+	case errors.Is(err, ledger.ErrAccountInDebt):
+		message = "Account has an outstanding debt"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to place bid",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
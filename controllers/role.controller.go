@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+
+	"hyperpage/initializers"
+	"hyperpage/permissions"
+)
+
+type rolePayload struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// GetRoles lists the roles with their permissions and every permission
+// that can be granted.
+func GetRoles(c *fiber.Ctx) error {
+	roles, err := permissions.Roles(initializers.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch roles",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   roles,
+		"meta":   fiber.Map{"permissions": permissions.Known},
+	})
+}
+
+func CreateRole(c *fiber.Ctx) error {
+	var payload rolePayload
+	if err := c.BodyParser(&payload); err != nil || len(payload.Name) < 2 || len(payload.Name) > 50 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	role, err := permissions.Create(initializers.DB, payload.Name, payload.Description, payload.Permissions)
+	if err != nil {
+		return roleError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   role,
+	})
+}
+
+// UpdateRole replaces the description and permissions of a role.
+func UpdateRole(c *fiber.Ctx) error {
+	var payload rolePayload
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	role, err := permissions.Update(initializers.DB, c.Params("name"), payload.Description, payload.Permissions)
+	if err != nil {
+		return roleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   role,
+	})
+}
+
+func DeleteRole(c *fiber.Ctx) error {
+	if err := permissions.Delete(initializers.DB, c.Params("name")); err != nil {
+		return roleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// AssignRole gives a user a role, such as making them a moderator.
+func AssignRole(c *fiber.Ctx) error {
+	userID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Role == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if err := permissions.Assign(initializers.DB, userID, payload.Role); err != nil {
+		return roleError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   fiber.Map{"id": userID, "role": payload.Role},
+	})
+}
+
+func roleError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, permissions.ErrRoleNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role not found",
+		})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+		})
+	case errors.Is(err, permissions.ErrRoleExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role already exists",
+		})
+	case errors.Is(err, permissions.ErrUnknownPermission):
+		message = "Unknown permission"
+	case errors.Is(err, permissions.ErrSystemRole):
+		message = "Default roles cannot be deleted"
+	case errors.Is(err, permissions.ErrRoleInUse):
+		message = "Role is assigned to users"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update roles",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
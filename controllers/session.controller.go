@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/signing"
+	"hyperpage/utils"
+)
+
+// startSession issues the first token pair of a new device session and sets
+// the token cookies.
+func startSession(c *fiber.Ctx, config *initializers.Config, user *models.User) (*utils.TokenDetails, *utils.TokenDetails, error) {
+	accessTokenDetails, err := utils.CreateToken(user.ID.String(), config.AccessTokenExpiresIn, signing.Access)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshTokenDetails, err := utils.CreateToken(user.ID.String(), config.RefreshTokenExpiresIn, signing.Refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := sessions.Create(c.Context(), user.ID.String(), c.Get(fiber.HeaderUserAgent), c.IP(), accessTokenDetails, refreshTokenDetails); err != nil {
+		return nil, nil, err
+	}
+
+	setTokenCookies(c, config, accessTokenDetails, refreshTokenDetails)
+	return accessTokenDetails, refreshTokenDetails, nil
+}
+
+func setTokenCookies(c *fiber.Ctx, config *initializers.Config, access, refresh *utils.TokenDetails) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "access_token",
+		Value:    *access.Token,
+		Path:     "/",
+		SameSite: "Lax",
+		MaxAge:   config.AccessTokenMaxAge * 60,
+		Secure:   true,
+		HTTPOnly: false,
+		Domain:   config.ClientOrigin,
+	})
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "refresh_token",
+		Value:    *refresh.Token,
+		Path:     "/",
+		SameSite: "Lax",
+		MaxAge:   config.RefreshTokenMaxAge * 60,
+		Secure:   true,
+		HTTPOnly: true,
+		Domain:   config.ClientOrigin,
+	})
+}
+
+func clearTokenCookies(c *fiber.Ctx, config *initializers.Config) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		c.Cookie(&fiber.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			Secure:   true,
+			HTTPOnly: true,
+			Domain:   config.ClientOrigin,
+		})
+		c.ClearCookie(name)
+	}
+}
+
+func GetSessions(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	current, _ := c.Locals("session_id").(string)
+
+	list, err := sessions.List(c.Context(), user.ID.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch sessions",
+		})
+	}
+	for i := range list {
+		list[i].Current = list[i].ID == current
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   list,
+	})
+}
+
+// RevokeSession signs out one device of the user.
+func RevokeSession(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	err := sessions.Revoke(c.Context(), user.ID.String(), c.Params("id"))
+	if errors.Is(err, sessions.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Session not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to revoke session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// RevokeOtherSessions signs out every device but the current one.
+func RevokeOtherSessions(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	current, _ := c.Locals("session_id").(string)
+
+	if err := sessions.RevokeAll(c.Context(), user.ID.String(), current); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to revoke sessions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/statements"
+)
+
+// GetStatement returns the account statement of a period as JSON, or as a
+// download with ?format=csv, pdf or html.
+func GetStatement(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	from, to, err := statementPeriod(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid period, use month as YYYY-MM or from and to as YYYY-MM-DD",
+		})
+	}
+
+	st, err := ledger.BuildStatement(initializers.DB, user.ID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to build statement",
+		})
+	}
+
+	format := c.Query("format")
+	holder := statements.Holder{Name: user.Name, Email: user.Email}
+	var data []byte
+	switch format {
+	case "", "json":
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"data":   st,
+		})
+	case statements.FormatCSV:
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		data, err = statements.CSV(st)
+	case statements.FormatHTML:
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		data, err = statements.HTML(st, holder, c.Query("language"))
+	case statements.FormatPDF:
+		config, _ := initializers.LoadConfig(".")
+		c.Set(fiber.HeaderContentType, "application/pdf")
+		data, err = statements.PDF(&config, st, holder, c.Query("language"))
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unsupported format",
+		})
+	}
+	if err != nil {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to render statement",
+		})
+	}
+
+	c.Attachment(statements.FileName(st, format))
+	return c.Send(data)
+}
+
+// EmailStatement sends the statement of a period to the user's email.
+func EmailStatement(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	userResp := c.Locals("user").(models.UserResponse)
+
+	from, to, err := statementPeriod(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid period, use month as YYYY-MM or from and to as YYYY-MM-DD",
+		})
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userResp.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+		})
+	}
+
+	st, err := ledger.BuildStatement(initializers.DB, user.ID, from, to)
+	if err == nil {
+		err = statements.Email(&config, &user, st, c.Query("format", statements.FormatPDF), c.Query("language"))
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to send statement",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Statement sent to " + user.Email,
+	})
+}
+
+func GetStatementSchedule(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var schedule models.StatementSchedule
+	if err := initializers.DB.Where("user_id = ?", user.ID).First(&schedule).Error; err != nil {
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"data":   nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   schedule,
+	})
+}
+
+// SetStatementSchedule subscribes the user to monthly statements. The first
+// one is sent for the month that has just ended.
+func SetStatementSchedule(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Format   string `json:"format"`
+		Language string `json:"language"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	if payload.Format == "" {
+		payload.Format = statements.FormatPDF
+	}
+	if payload.Format != statements.FormatPDF && payload.Format != statements.FormatCSV {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unsupported format",
+		})
+	}
+
+	var schedule models.StatementSchedule
+	initializers.DB.Where("user_id = ?", user.ID).First(&schedule)
+	if schedule.ID == 0 {
+		from, _ := statements.MonthOf(time.Now())
+		schedule.UserID = user.ID
+		schedule.LastPeriod = from.Format("2006-01")
+	}
+	schedule.Format = payload.Format
+	schedule.Language = statements.Language(payload.Language)
+
+	if err := initializers.DB.Save(&schedule).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to save schedule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   schedule,
+	})
+}
+
+func DeleteStatementSchedule(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	if err := initializers.DB.Where("user_id = ?", user.ID).Delete(&models.StatementSchedule{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to delete schedule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// statementPeriod reads ?month=YYYY-MM, or ?from=&to= as dates with "to"
+// being inclusive. The current month is used when nothing is given.
+func statementPeriod(c *fiber.Ctx) (time.Time, time.Time, error) {
+	from, to := statements.MonthOf(time.Now())
+
+	if v := c.Query("month"); v != "" {
+		t, err := time.ParseInLocation("2006-01", v, time.Local)
+		if err != nil {
+			return from, to, err
+		}
+		from, to = statements.MonthOf(t)
+		return from, to, nil
+	}
+
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, err
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, err
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("empty period")
+	}
+
+	return from, to, nil
+}
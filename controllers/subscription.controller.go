@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/datatypes"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/subscriptions"
+)
+
+func GetPlans(c *fiber.Ctx) error {
+	plans, err := subscriptions.Plans(initializers.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch plans",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   plans,
+	})
+}
+
+func GetMySubscription(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	sub, err := subscriptions.Current(initializers.DB, user.ID)
+	if errors.Is(err, subscriptions.ErrNoSubscription) {
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"data":   nil,
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch subscription",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   sub,
+	})
+}
+
+func Subscribe(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Plan string `json:"plan"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	return subscribe(c, user, payload.Plan)
+}
+
+func subscribe(c *fiber.Ctx, user models.UserResponse, plan string) error {
+	sub, err := subscriptions.Subscribe(initializers.DB, user.ID, plan, time.Now())
+	switch {
+	case errors.Is(err, subscriptions.ErrPlanNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Plan not found",
+		})
+	case errors.Is(err, subscriptions.ErrAlreadyOnPlan):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Already subscribed to this plan",
+		})
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Insufficient balance",
+		})
+	case errors.Is(err, ledger.ErrAccountInDebt):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Account has an outstanding debt",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update user plan",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   sub,
+	})
+}
+
+func CancelSubscription(c *fiber.Ctx) error {
+	return setAutoRenew(c, false)
+}
+
+func ResumeSubscription(c *fiber.Ctx) error {
+	return setAutoRenew(c, true)
+}
+
+func setAutoRenew(c *fiber.Ctx, autoRenew bool) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	sub, err := subscriptions.SetAutoRenew(initializers.DB, user.ID, autoRenew)
+	if errors.Is(err, subscriptions.ErrNoSubscription) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "No active subscription",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update subscription",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   sub,
+	})
+}
+
+type planInput struct {
+	Name         string          `json:"name"`
+	Price        *float64        `json:"price"`
+	PeriodDays   *int            `json:"periodDays"`
+	LimitStorage *int            `json:"limitStorage"`
+	Features     *datatypes.JSON `json:"features"`
+	Active       *bool           `json:"active"`
+	SortOrder    *int            `json:"sortOrder"`
+}
+
+func (in planInput) apply(plan *models.SubscriptionPlan) {
+	if in.Name != "" {
+		plan.Name = in.Name
+	}
+	if in.Price != nil {
+		plan.Price = *in.Price
+	}
+	if in.PeriodDays != nil {
+		plan.PeriodDays = *in.PeriodDays
+	}
+	if in.LimitStorage != nil {
+		plan.LimitStorage = *in.LimitStorage
+	}
+	if in.Features != nil {
+		plan.Features = *in.Features
+	}
+	if in.Active != nil {
+		plan.Active = *in.Active
+	}
+	if in.SortOrder != nil {
+		plan.SortOrder = *in.SortOrder
+	}
+}
+
+func CreatePlan(c *fiber.Ctx) error {
+	var payload planInput
+	if err := c.BodyParser(&payload); err != nil || payload.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	plan := models.SubscriptionPlan{PeriodDays: 31, LimitStorage: 20, Active: true, Features: datatypes.JSON(`{}`)}
+	payload.apply(&plan)
+
+	if plan.Price < 0 || plan.PeriodDays <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid price or period",
+		})
+	}
+
+	if err := initializers.DB.Create(&plan).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create plan",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   plan,
+	})
+}
+
+func UpdatePlan(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid plan ID",
+		})
+	}
+
+	var plan models.SubscriptionPlan
+	if err := initializers.DB.First(&plan, id).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Plan not found",
+		})
+	}
+
+	var payload planInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	payload.apply(&plan)
+
+	if plan.Price < 0 || plan.PeriodDays <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid price or period",
+		})
+	}
+
+	if err := initializers.DB.Save(&plan).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update plan",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   plan,
+	})
+}
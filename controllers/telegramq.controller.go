@@ -1,16 +1,17 @@
 package controllers
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/permissions"
+	"hyperpage/promocodes"
 	"hyperpage/utils"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"log"
 	"os"
@@ -19,18 +20,6 @@ import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func generateRandomString(length int) (string, error) {
-	randomBytes := make([]byte, length)
-
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", err
-	}
-
-	randomString := base64.URLEncoding.EncodeToString(randomBytes)[:length]
-	return randomString, nil
-}
-
 func ProfileActivity(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
 	//time.Sleep(1 * time.Second)
 	var user models.User
@@ -210,6 +199,11 @@ func MakeCodes(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, afterSpace string) {
 		return
 	}
 
+	// Only those who manage promo codes may mint balance
+	if !permissions.Has(initializers.DB, user.Role, permissions.CodeManage) {
+		return
+	}
+
 	fmt.Println(user.Name)
 
 	// Split the afterSpace string into individual values
@@ -237,32 +231,20 @@ func MakeCodes(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, afterSpace string) {
 		return
 	}
 
-	for i := 0; i < numOfCodes; i++ {
-		// Generate a random unique string for the code
-		randomString, err := generateRandomString(10)
-		if err != nil {
-			fmt.Println("Error generating random string:", err)
-			continue
-		}
-
-		// Create a new code with the specified balance
-		code := models.Codes{
-			Code:      randomString,
-			Balance:   strconv.Itoa(amountPerCode), // Convert amountPerCode to a string
-			Activated: false,
-			UserId:    user.ID,
-			Used:      0,
-		}
-
-		// Save the code to the database
-		err = initializers.DB.Create(&code).Error
-		if err != nil {
-			fmt.Println("Error creating code:", err)
-			continue
-		}
+	batch, codes, err := promocodes.CreateBatch(initializers.DB, user.ID, promocodes.BatchRequest{
+		Name:   "telegram",
+		Count:  numOfCodes,
+		Amount: float64(amountPerCode),
+	}, time.Now())
+	if err != nil {
+		fmt.Println("Error creating codes:", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Ошибка! Не удалось создать коды"))
+		return
+	}
 
-		fmt.Println("Code created:", code.Code)
+	fmt.Println("Code batch created:", batch.ID)
 
+	for _, code := range codes {
 		// Send the code creation status back to the user
 		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, code.Code))
 	}
@@ -1,9 +1,13 @@
 package controllers
 
 import (
+	"errors"
+	"strconv"
+
 	"github.com/gofiber/fiber/v2"
 
 	"hyperpage/initializers"
+	"hyperpage/ledger"
 	"hyperpage/models"
 	"hyperpage/utils"
 )
@@ -28,3 +32,82 @@ func GetTransactions(c *fiber.Ctx) error {
         "data":   transaction,
     })
 }
+
+func ReconcileBalances(c *fiber.Ctx) error {
+	report, err := ledger.Reconcile(initializers.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to reconcile balances",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+// reversibleModules are the posting modules whose system account keeps no
+// state of its own. Withdrawals, promotion bids and currency exchanges are
+// mirrored in the payout hold, the auction escrow and the exchange account,
+// which a bare reversal would leave out of step.
+var reversibleModules = map[string]bool{
+	"donat":        true,
+	"Registration": true,
+	"CodeUsed":     true,
+	"site":         true,
+	"addTimeBlog":  true,
+}
+
+// ReversePosting claws back a posting such as a donation. Card top ups are
+// refunded through RefundPayment so the money also goes back to the card.
+func ReversePosting(c *fiber.Ctx) error {
+	postingID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid posting ID",
+		})
+	}
+
+	var original models.LedgerPosting
+	if err := initializers.DB.First(&original, postingID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Posting not found",
+		})
+	}
+
+	if original.Module == "Payment" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Card payments must be refunded through /payment/refund",
+		})
+	}
+	if !reversibleModules[original.Module] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Postings of module " + original.Module + " cannot be reversed",
+		})
+	}
+
+	posting, err := ledger.Reverse(initializers.DB, postingID, "Возврат: "+original.Description)
+	if errors.Is(err, ledger.ErrAlreadyReversed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Posting is already reversed",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to reverse posting",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   posting,
+	})
+}
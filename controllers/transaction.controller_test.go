@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestReversePostingModules(t *testing.T) {
+	db := testdb.Open(t,
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+	testdb.Use(t, db)
+	app := fiber.New()
+	app.Post("/reverse/:id", ReversePosting)
+
+	reverse := func(posting *models.LedgerPosting) int {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/reverse/"+strconv.FormatUint(posting.ID, 10), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	donor, recipient := uuid.NewV4(), uuid.NewV4()
+	if _, err := ledger.Credit(db, donor, ledger.AccountBonus, 500, ledger.Posting{Module: "Registration"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The system accounts of these keep state a reversal would not update
+	for _, module := range []struct {
+		name    string
+		account string
+	}{
+		{"Withdrawal", ledger.AccountPayoutHold},
+		{"Promotion", ledger.AccountPromotionEscrow},
+		{"Exchange", ledger.AccountExchange},
+		{"Opening", ledger.AccountOpening},
+	} {
+		posting, err := ledger.Debit(db, donor, module.account, 10, ledger.Posting{Module: module.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reverse(posting); got != fiber.StatusBadRequest {
+			t.Errorf("reversing a %s posting = %d, want %d", module.name, got, fiber.StatusBadRequest)
+		}
+	}
+
+	donation, err := ledger.Transfer(db, donor, recipient, 100, "Донат", ledger.Posting{Module: "donat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reverse(donation); got != fiber.StatusOK {
+		t.Fatalf("reversing a donation = %d, want %d", got, fiber.StatusOK)
+	}
+	if balance, _ := ledger.Balance(db, recipient); balance != 0 {
+		t.Fatalf("recipient balance after the reversal = %v, want 0", balance)
+	}
+}
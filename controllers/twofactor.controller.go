@@ -0,0 +1,401 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/twofactor"
+)
+
+// defaultTOTPIssuer names the account in authenticator apps when TOTP_ISSUER
+// is not configured.
+const defaultTOTPIssuer = "myru.online"
+
+const (
+	twoFactorTOTP     = "totp"
+	twoFactorRecovery = "recovery"
+	twoFactorTelegram = "telegram"
+)
+
+// twoFactorRequired reports whether a sign in needs a second factor. It is
+// mandatory for admins even before they enroll.
+func twoFactorRequired(user *models.User) (bool, error) {
+	if user.Role == string(models.RoleAdmin) {
+		return true, nil
+	}
+	return twofactor.Enabled(initializers.DB, user.ID)
+}
+
+func telegramSecondFactor(user *models.User) bool {
+	return user.TelegramActivated && user.Tid != 0
+}
+
+// beginTwoFactor answers a sign in that passed the password check with a
+// challenge token to send back with the second factor.
+func beginTwoFactor(c *fiber.Ctx, user *models.User, session string) error {
+	if pending, err := deletionPending(c, user); pending {
+		return err
+	}
+
+	enrolled, err := twofactor.Enabled(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+
+	challenge, err := twofactor.NewChallenge(c.Context(), user.ID.String(), session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to start two-factor sign in"})
+	}
+
+	methods := []string{twoFactorTOTP}
+	if enrolled {
+		methods = append(methods, twoFactorRecovery)
+	}
+	if enrolled && telegramSecondFactor(user) {
+		methods = append(methods, twoFactorTelegram)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":          "2fa_required",
+		"challenge_token": challenge.Token,
+		"expires_in":      int(twofactor.ChallengeTTL.Seconds()),
+		"methods":         methods,
+		// Admins without an enrollment set it up within the challenge
+		"setup_required": !enrolled,
+	})
+}
+
+// VerifyTwoFactor completes a sign in with a TOTP, recovery or Telegram code.
+// An admin enrolling during the challenge confirms the setup with the first
+// TOTP code and gets the recovery codes with the tokens.
+func VerifyTwoFactor(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload struct {
+		ChallengeToken string `json:"challenge_token"`
+		Method         string `json:"method"`
+		Code           string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.ChallengeToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+	if payload.Method == "" {
+		payload.Method = twoFactorTOTP
+	}
+
+	challenge, user, err := loadChallenge(c, payload.ChallengeToken)
+	if err != nil {
+		return err
+	}
+
+	enrolled, err := twofactor.Enabled(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+	}
+
+	now := time.Now()
+	var extra fiber.Map
+	switch {
+	case payload.Method == twoFactorTOTP && !enrolled:
+		var codes []string
+		codes, err = twofactor.Enable(initializers.DB, user.ID, payload.Code, now)
+		extra = fiber.Map{"recovery_codes": codes}
+	case payload.Method == twoFactorTOTP:
+		err = twofactor.Verify(initializers.DB, user.ID, payload.Code, now)
+	case payload.Method == twoFactorRecovery && enrolled:
+		var ok bool
+		ok, err = twofactor.UseRecoveryCode(initializers.DB, user.ID, payload.Code)
+		if err == nil && !ok {
+			err = twofactor.ErrInvalidCode
+		}
+	case payload.Method == twoFactorTelegram && enrolled && telegramSecondFactor(user):
+		var ok bool
+		ok, err = twofactor.CheckTelegramCode(c.Context(), challenge.Token, payload.Code)
+		if err == nil && !ok {
+			err = twofactor.ErrInvalidCode
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Unsupported two-factor method"})
+	}
+
+	if errors.Is(err, twofactor.ErrInvalidCode) || errors.Is(err, twofactor.ErrNotEnrolled) {
+		err := twofactor.Fail(c.Context(), challenge.Token)
+		if errors.Is(err, twofactor.ErrTooManyAttempts) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"status": "fail", "message": "Too many wrong codes, please log in again"})
+		}
+		if errors.Is(err, twofactor.ErrChallengeExpired) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Sign in challenge expired, please log in again"})
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Invalid two-factor code"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to verify two-factor code"})
+	}
+
+	// The challenge is single use, a second request with it loses the race
+	closed, err := twofactor.Close(c.Context(), challenge.Token)
+	if err != nil || !closed {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Sign in challenge expired, please log in again"})
+	}
+
+	return completeSignIn(c, &config, user, challenge.Session, extra)
+}
+
+// SetupTwoFactorChallenge returns a new TOTP secret to an admin that has to
+// enroll before the sign in can finish.
+func SetupTwoFactorChallenge(c *fiber.Ctx) error {
+	var payload struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.ChallengeToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	_, user, err := loadChallenge(c, payload.ChallengeToken)
+	if err != nil {
+		return err
+	}
+
+	return twoFactorSetup(c, user)
+}
+
+// SendTwoFactorTelegram sends a sign in code to the user's Telegram chat.
+func SendTwoFactorTelegram(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+
+	var payload struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.ChallengeToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Invalid request body"})
+	}
+
+	challenge, user, err := loadChallenge(c, payload.ChallengeToken)
+	if err != nil {
+		return err
+	}
+
+	enrolled, err := twofactor.Enabled(initializers.DB, user.ID)
+	if err != nil || !enrolled || !telegramSecondFactor(user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "message": "Telegram is not available as a second factor"})
+	}
+
+	code, err := twofactor.NewTelegramCode(c.Context(), challenge.Token)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Sign in challenge expired, please log in again"})
+	}
+
+	bot, err := initializers.ConnectTelegram(&initializers.Config{TELEGRAM_TOKEN: config.TELEGRAM_TOKEN})
+	if err == nil {
+		msg := tgbotapi.NewMessage(user.Tid, fmt.Sprintf("Код для входа: %s\nНикому не сообщайте этот код.", code))
+		_, err = bot.Send(msg)
+	}
+	if err != nil {
+		log.Println("Failed to send two-factor code to Telegram:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": "Failed to send the code to Telegram"})
+	}
+
+	return c.JSON(fiber.Map{"status": "success", "message": "Code sent to Telegram"})
+}
+
+func GetTwoFactorStatus(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	enabled, err := twofactor.Enabled(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch two-factor status"})
+	}
+	remaining, err := twofactor.RemainingRecoveryCodes(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to fetch two-factor status"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"enabled":        enabled,
+			"required":       user.Role == string(models.RoleAdmin),
+			"recovery_codes": remaining,
+		},
+	})
+}
+
+// SetupTwoFactor starts an enrollment for the signed in user.
+func SetupTwoFactor(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userResp.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "User not found"})
+	}
+
+	return twoFactorSetup(c, &user)
+}
+
+// EnableTwoFactor confirms the enrollment with a first code.
+func EnableTwoFactor(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Invalid request body"})
+	}
+
+	codes, err := twofactor.Enable(initializers.DB, user.ID, payload.Code, time.Now())
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   fiber.Map{"recovery_codes": codes},
+	})
+}
+
+// DisableTwoFactor turns two-factor off after checking the password and a
+// current code. Admins cannot turn it off.
+func DisableTwoFactor(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+	if userResp.Role == string(models.RoleAdmin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "error", "message": "Two-factor authentication is mandatory for admins"})
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Invalid request body"})
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", userResp.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "User not found"})
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "error", "message": "Invalid password"})
+	}
+	if err := checkSecondFactor(user.ID, payload.Code); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	if err := twofactor.Disable(initializers.DB, user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to disable two-factor authentication"})
+	}
+
+	return c.JSON(fiber.Map{"status": "success"})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a
+// current code.
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Invalid request body"})
+	}
+
+	if err := twofactor.Verify(initializers.DB, user.ID, payload.Code, time.Now()); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	codes, err := twofactor.NewRecoveryCodes(initializers.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to create recovery codes"})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   fiber.Map{"recovery_codes": codes},
+	})
+}
+
+func twoFactorSetup(c *fiber.Ctx, user *models.User) error {
+	config, _ := initializers.LoadConfig(".")
+
+	secret, err := twofactor.Setup(initializers.DB, user.ID)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	issuer := config.TOTPIssuer
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"secret": secret,
+			"uri":    twofactor.ProvisioningURI(issuer, user.Email, secret),
+		},
+	})
+}
+
+// loadChallenge finds an open sign in challenge and its user, answering the
+// request itself when there is none.
+func loadChallenge(c *fiber.Ctx, token string) (*twofactor.Challenge, *models.User, error) {
+	challenge, err := twofactor.GetChallenge(c.Context(), token)
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Sign in challenge expired, please log in again"})
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, "id = ?", challenge.UserID).Error; err != nil {
+		return nil, nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "the user belonging to this challenge no longer exists"})
+	}
+
+	return challenge, &user, nil
+}
+
+// checkSecondFactor accepts a TOTP code or a recovery code.
+func checkSecondFactor(userID uuid.UUID, code string) error {
+	err := twofactor.Verify(initializers.DB, userID, code, time.Now())
+	if !errors.Is(err, twofactor.ErrInvalidCode) {
+		return err
+	}
+	ok, err := twofactor.UseRecoveryCode(initializers.DB, userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return twofactor.ErrInvalidCode
+	}
+	return nil
+}
+
+func twoFactorError(c *fiber.Ctx, err error) error {
+	var message string
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode):
+		message = "Invalid two-factor code"
+	case errors.Is(err, twofactor.ErrNotEnrolled):
+		message = "Two-factor authentication is not set up"
+	case errors.Is(err, twofactor.ErrAlreadyEnabled):
+		message = "Two-factor authentication is already enabled"
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update two-factor authentication",
+		})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"status":  "error",
+		"message": message,
+	})
+}
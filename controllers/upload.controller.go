@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hyperpage/chatfiles"
 	"hyperpage/initializers"
 	"hyperpage/models"
 	"image"
@@ -169,22 +170,6 @@ type UploadedFile struct {
 }
 
 // Function to calculate directory size
-func getDirectorySize(dirname string) (int64, error) {
-	var size int64
-
-	err := filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-
-	return size, err
-}
-
 func compressImage(inputPath, outputPath string, maxWidth, maxHeight int) error {
 	// Open the input image file
 	file, err := os.Open(inputPath)
@@ -278,9 +263,8 @@ func UploadImages(c *fiber.Ctx) error {
 			LimitStorage:      userResp.LimitStorage,
 		}
 
-		// Check the size of the directory
-		dirname := filepath.Join(config.IMGStorePath, userObj.Storage)
-		size, err := getDirectorySize(dirname)
+		// Check the size of the directory, chat attachments count too
+		size, err := chatfiles.Used(initializers.DB, &config, userObj.ID, userObj.Storage)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"status":  "error",
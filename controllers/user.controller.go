@@ -19,7 +19,9 @@ import (
 	"gorm.io/gorm"
 
 	"hyperpage/initializers"
+	"hyperpage/ledger"
 	"hyperpage/models"
+	"hyperpage/promocodes"
 	"hyperpage/utils"
 )
 
@@ -193,11 +195,7 @@ func calculateDirSize(dirPath string) (float64, error) {
 }
 
 func Plan(c *fiber.Ctx) error {
-	userId := c.Locals("user")
-	userResp := userId.(models.UserResponse)
-	userObj := models.User{
-		ID: userResp.ID,
-	}
+	userResp := c.Locals("user").(models.UserResponse)
 
 	user := new(models.User)
 	if err := c.BodyParser(user); err != nil {
@@ -207,100 +205,14 @@ func Plan(c *fiber.Ctx) error {
 		})
 	}
 
-	var amount float64
-	var limitstorage int
-
-	// Add an amount variable to store the amount for the blog post
-	switch user.Name {
-	case "Начальный":
-		amount = 150
-		limitstorage = 300
-	case "Бизнесс":
-		amount = 500
-		limitstorage = 600
-	case "Расширенный":
-		amount = 1000
-		limitstorage = 900
-	}
-
-	// Fetch the current balance
-	var billing models.Billing
-	err := initializers.DB.Where("user_id = ?", userObj.ID).First(&billing).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to fetch balance",
-		})
-	}
-
-	// Check if the balance is sufficient
-	if billing.Amount < amount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Insufficient balance",
-		})
-	}
-	// Update the amount field in the balance table
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", userObj.ID).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount - ?", amount),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to update balance",
-		})
-	}
-
-	transaction := models.Transaction{
-		UserID:      userObj.ID,
-		Total:       "0", // Update with the appropriate value
-		Amount:      amount,
-		Description: "Оплата за тариф на месяц",
-		Module:      "CodeUsed",
-		Type:        "deduction",
-		Status:      "CLOSED_1",
-	}
-
-	err = initializers.DB.Create(&transaction).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to create transaction",
-		})
-	}
-
-	// Update the user's plan, signed, and expired_plan_at columns
-	err = initializers.DB.Model(&models.User{}).
-		Where("id = ?", userObj.ID).
-		Updates(map[string]interface{}{
-			"plan":            user.Name,
-			"signed":          true,
-			"limit_storage":   limitstorage,
-			"expired_plan_at": time.Now().AddDate(0, 0, 31),
-		}).
-		Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to update user plan",
-		})
-	}
-
-	return c.JSON(fiber.Map{
-		"status": "success",
-		"data":   "GOOD",
-	})
+	// The plan name arrives in the name field
+	return subscribe(c, userResp, user.Name)
 }
 
 func AddBalance(c *fiber.Ctx) error {
 
 	userId := c.Locals("user")
 	userResp := userId.(models.UserResponse)
-	userObj := models.User{
-		ID: userResp.ID,
-	}
 
 	code := new(models.Codes)
 	if err := c.BodyParser(code); err != nil {
@@ -311,67 +223,14 @@ func AddBalance(c *fiber.Ctx) error {
 		})
 	}
 
-	//Try find code
-	err := initializers.DB.Table("codes").Where("code = ?", code.Code).First(code).Error
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Invalid code ID",
-		})
-	}
-
-	// Check if code is already activated
-	if code.Activated {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Code is already activated",
-		})
-	}
-
-	// Update the amount field in the balance table
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", userObj.ID).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount + ?", code.Balance),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to update balance",
-		})
-	}
-
-	// Set columns: activated, user, and used
-	code.Activated = true
-	code.UserId = userObj.ID
-	code.Used = uint64(time.Now().Unix())
-
-	// Update the code record in the database
-	err = initializers.DB.Table("codes").Where("code = ?", code.Code).Updates(code).Error
+	redemption, err := promocodes.Redeem(initializers.DB, userResp.ID, code.Code, c.IP(), time.Now())
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to update code",
-		})
-	}
-
-	balanceStr := code.Balance
-	balance, _ := strconv.ParseFloat(balanceStr, 64)
-	transaction := models.Transaction{
-		UserID:      userObj.ID,
-		Total:       `0`,
-		Amount:      balance,
-		Description: `Пополнение баланса`,
-		Module:      `CodeUsed`,
-		Type:        `profit`,
-		Status:      `CLOSED_1`,
+		return redeemError(c, err)
 	}
 
-	initializers.DB.Create(&transaction)
-
 	return c.JSON(fiber.Map{
 		"status": "success",
-		"data":   code.Balance,
+		"data":   strconv.FormatFloat(redemption.Amount, 'f', -1, 64),
 	})
 }
 
@@ -391,7 +250,7 @@ func GetMe(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "failed to get balance"})
 	}
 
-	balance := billing.Amount
+	balance := ledger.FromMinor(billing.Balance)
 
 	dirPath := filepath.Join(config.IMGStorePath, user.Storage)
 	dirSize, err := calculateDirSize(dirPath)
@@ -431,7 +290,7 @@ func GetMe(c *fiber.Ctx) error {
 	// }
 	// fmt.Println(user)
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"user": user, "balance": balance, "storage": roundedSize}})
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"user": user, "balance": balance, "currency": billing.Currency, "storage": roundedSize}})
 
 }
 
@@ -470,104 +329,6 @@ func deleteDirectory(directoryName string) error {
 	return nil
 }
 
-// Define the route for deleting a user and its relations
-func DeleteUserWithRelations(c *fiber.Ctx) error {
-	userId := c.Locals("user").(models.UserResponse)
-
-	// Fetch the user from the database
-	var user models.User
-	if err := initializers.DB.
-		Preload("Billing").
-		Preload("Profile").
-		Preload("Blogs").
-		First(&user, "id = ?", userId.ID).Error; err != nil {
-		// Handle the error (e.g., user not found)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
-	}
-	// Begin a database transaction
-	tx := initializers.DB.Begin()
-
-	var profileID string
-	if err := initializers.DB.Model(&models.Profile{}).Where("user_id = ?", userId.ID).Select("id").Row().Scan(&profileID); err != nil {
-		// Handle the error (e.g., profile not found)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User's profile not found"})
-	}
-
-	// Fetch the paths for profile_photos to be deleted
-	var files []string
-	if err := initializers.DB.Table("profile_photos").Where("profile_id = ?", profileID).Pluck("files", &files).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve profile photo paths"})
-	}
-
-	// Delete the directories on the server
-	for _, path := range files {
-		directoryName := extractDirectoryName(path)
-		if directoryName != "" {
-			err := deleteDirectory(directoryName)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete directories on the server"})
-			}
-		}
-	}
-	// Delete related entities using the profileID and user.ID before deleting the user
-	relatedEntities := []string{
-		"profiles_guilds",
-		"profiles_city",
-		"profiles_hashtags",
-		"profile_photos",
-		"billings",
-		"online_storages",
-		"transactions",
-		"blogs",
-		"user_relation",
-		"votes",
-		"codes",
-		"domains",
-		"payments",
-	}
-	for _, table := range relatedEntities {
-		whereColumn := "user_id"
-		id := user.ID.String()
-		if table == "profiles_guilds" || table == "profiles_city" || table == "profiles_hashtags" || table == "profile_photos" {
-			whereColumn = "profile_id"
-			id = profileID
-		}
-
-		if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-		}
-
-		if table == "user_relation" {
-			whereColumn = "following_id"
-			if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-				tx.Rollback()
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-			}
-		}
-	}
-
-	// Delete the associated profiles records
-	if err := tx.Delete(&user.Profile).Error; err != nil {
-		// Rollback the transaction if an error occurs
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user's profiles"})
-	}
-
-	// Delete the user and its related records
-	if err := tx.Delete(&user).Error; err != nil {
-		// Rollback the transaction if an error occurs
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user"})
-	}
-
-	// Commit the transaction
-	tx.Commit()
-
-	// Return a success response
-	return c.JSON(fiber.Map{"message": "User and related profiles deleted successfully"})
-}
-
 // Function to delete all user accounts where IsBot is true, along with their related records
 func DeleteAllBotUsersWithRelations(c *fiber.Ctx) error {
 	// Find all bot users
@@ -615,12 +376,20 @@ func DeleteAllBotUsersWithRelations(c *fiber.Ctx) error {
 			"billings",
 			"online_storages",
 			"transactions",
+			"promotion_bids",
 			"blogs",
 			"user_relation",
 			"votes",
 			"codes",
+			"code_redemptions",
+			"statement_schedules",
+			"two_factors",
+			"recovery_codes",
+			"user_identities",
+			"api_keys",
 			"domains",
 			"payments",
+			"account_deletions",
 		}
 		for _, table := range relatedEntities {
 			whereColumn := "user_id"
@@ -677,9 +446,9 @@ func GetMeFirst(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "failed to get balance"})
 	}
 
-	balance := billing.Amount
+	balance := ledger.FromMinor(billing.Balance)
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"user": user, "balance": balance}})
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"user": user, "balance": balance, "currency": billing.Currency}})
 
 }
 
@@ -695,51 +464,34 @@ func SetVipUser(c *fiber.Ctx) error {
 		})
 	}
 
-	// Fetch the current balance
-	var billing models.Billing
-	err = initializers.DB.Where("user_id = ?", user.ID).First(&billing).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	// Charge the balance and log the transaction in one posting
+	_, err = ledger.Debit(initializers.DB, user.ID, ledger.AccountRevenue, priceFloat, ledger.Posting{
+		Module:      "site",
+		Description: "Оплата за активацию сайта",
+		Status:      "CLOSED_1",
+	})
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to fetch balance",
+			"message": "Insufficient balance",
 		})
 	}
-
-	// Check if the balance is sufficient
-	if billing.Amount < priceFloat {
+	if errors.Is(err, ledger.ErrAccountInDebt) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Insufficient balance",
+			"message": "Account has an outstanding debt",
 		})
 	}
-	// Update the amount field in the balance table
-	err = initializers.DB.Model(&models.Billing{}).
-		Where("user_id = ?", user.ID).
-		Updates(map[string]interface{}{
-			"amount": gorm.Expr("amount - ?", priceFloat),
-		}).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	if errors.Is(err, ledger.ErrInvalidAmount) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to update balance",
+			"message": "Invalid price value",
 		})
 	}
-
-	transaction := models.Transaction{
-		UserID:      user.ID,
-		Total:       "0", // Update with the appropriate value
-		Amount:      priceFloat,
-		Description: "Оплата за активацию сайта",
-		Module:      "site",
-		Type:        "deduction",
-		Status:      "CLOSED_1",
-	}
-
-	err = initializers.DB.Create(&transaction).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to create transaction",
+			"message": "Failed to update balance",
 		})
 	}
 
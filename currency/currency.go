@@ -0,0 +1,116 @@
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+)
+
+// Base is the currency of system accounts, card payments and every amount
+// the services post. Wallets in another currency are converted at posting
+// time.
+const Base = "RUB"
+
+var (
+	ErrUnsupported = errors.New("unsupported currency")
+	ErrNoRate      = errors.New("no exchange rate for currency")
+	ErrInvalidRate = errors.New("exchange rate must be positive")
+)
+
+// symbols lists the wallet currencies. All of them have two minor digits,
+// so ledger minor units mean the same thing in every currency.
+var symbols = map[string]string{
+	"RUB": "₽",
+	"GEL": "₾",
+	"EUR": "€",
+	"USD": "$",
+}
+
+// languages maps a site language to the currency its users usually pay in.
+var languages = map[string]string{
+	"ru": "RUB",
+	"ka": "GEL",
+	"es": "EUR",
+}
+
+// Supported returns the wallet currency codes.
+func Supported() []string {
+	return []string{"RUB", "GEL", "EUR", "USD"}
+}
+
+// Normalize upper-cases a currency code and checks it is supported. An
+// empty code is the base currency.
+func Normalize(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return Base, nil
+	}
+	if _, ok := symbols[code]; !ok {
+		return "", ErrUnsupported
+	}
+	return code, nil
+}
+
+// ForLanguage returns the default currency of a site language.
+func ForLanguage(language string) string {
+	if code, ok := languages[language]; ok {
+		return code
+	}
+	return Base
+}
+
+// Symbol returns the sign printed after amounts, or the code itself.
+func Symbol(code string) string {
+	if code == "" {
+		code = Base
+	}
+	if s, ok := symbols[code]; ok {
+		return s
+	}
+	return code
+}
+
+// Format prints an amount with its currency sign.
+func Format(amount float64, code string) string {
+	return fmt.Sprintf("%.2f %s", amount, Symbol(code))
+}
+
+// Rate returns the value of one unit of code in the base currency.
+func Rate(db *gorm.DB, code string) (float64, error) {
+	if code == Base || code == "" {
+		return 1, nil
+	}
+	var rate models.ExchangeRate
+	err := db.Where("currency = ?", code).First(&rate).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, ErrNoRate
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rate.Rate, nil
+}
+
+// Convert turns minor units of one currency into another through the base
+// currency rates. It returns the converted amount and the rate applied, the
+// number of to units per from unit.
+func Convert(db *gorm.DB, minor int64, from, to string) (int64, float64, error) {
+	if from == to {
+		return minor, 1, nil
+	}
+	fromRate, err := Rate(db, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	toRate, err := Rate(db, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	rate := fromRate / toRate
+	return int64(math.Round(float64(minor) * rate)), rate, nil
+}
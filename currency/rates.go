@@ -0,0 +1,63 @@
+package currency
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rates returns the stored exchange rates.
+func Rates(db *gorm.DB) ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+	if err := db.Order("currency").Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// SetRates stores rates given as base currency per unit, replacing the
+// previous value of each currency. Either all rates are stored or none.
+func SetRates(db *gorm.DB, rates map[string]float64, source string) error {
+	now := time.Now()
+	rows := make([]models.ExchangeRate, 0, len(rates))
+	for code, rate := range rates {
+		code, err := Normalize(code)
+		if err != nil {
+			return err
+		}
+		if code == Base {
+			continue
+		}
+		if rate <= 0 {
+			return ErrInvalidRate
+		}
+		rows = append(rows, models.ExchangeRate{Currency: code, Rate: rate, Source: source, UpdatedAt: now})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "currency"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "source", "updated_at"}),
+	}).Create(&rows).Error
+}
+
+// LoadFile reads a JSON object of currency codes and rates, such as
+// {"GEL": 33.5, "EUR": 96.1}, and stores it.
+func LoadFile(db *gorm.DB, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rates map[string]float64
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return err
+	}
+	return SetRates(db, rates, "file")
+}
@@ -5,6 +5,7 @@ go 1.21
 toolchain go1.21.4
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.0
 	github.com/bas24/googletranslatefree v0.0.0-20231117033553-f5859fe54d30
 	github.com/disintegration/imaging v1.6.2
 	github.com/go-playground/validator/v10 v10.13.0
@@ -31,7 +32,9 @@ require (
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/go-sql-driver/mysql v1.7.0 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	gorm.io/driver/mysql v1.4.7 // indirect
 )
 
@@ -44,6 +44,42 @@ type Config struct {
 	CentrifugoHttpApiKey       string `mapstructure:"CENTRIFUGO_HTTP_API_KEY"`
 	CentrifugoBroadcastMode    string `mapstructure:"CENTRIFUGO_BROADCAST_MODE"`
 	CentrifugoOutboxPartitions int    `mapstructure:"CENTRIFUGO_OUTBOX_PARTITIONS"`
+
+	ChatGroupMaxMembers   int    `mapstructure:"CHAT_GROUP_MAX_MEMBERS"`
+	ChatAttachmentsPath   string `mapstructure:"CHAT_ATTACHMENTS_PATH"`
+	ChatAttachmentMaxSize int    `mapstructure:"CHAT_ATTACHMENT_MAX_MB"`
+
+	PaymentProvider         string `mapstructure:"PAYMENT_PROVIDER"`
+	TinkoffTerminalKey      string `mapstructure:"TINKOFF_TERMINAL_KEY"`
+	TinkoffTerminalPassword string `mapstructure:"TINKOFF_TERMINAL_PASSWORD"`
+	YooKassaShopID          string `mapstructure:"YOOKASSA_SHOP_ID"`
+	YooKassaSecretKey       string `mapstructure:"YOOKASSA_SECRET_KEY"`
+
+	PayoutMinAmount         float64 `mapstructure:"PAYOUT_MIN_AMOUNT"`
+	PayoutCommissionPercent float64 `mapstructure:"PAYOUT_COMMISSION_PERCENT"`
+
+	PDFRenderer string `mapstructure:"PDF_RENDERER"`
+
+	ExchangeRatesFile string `mapstructure:"EXCHANGE_RATES_FILE"`
+
+	TOTPIssuer string `mapstructure:"TOTP_ISSUER"`
+
+	OIDCRedirectURL    string `mapstructure:"OIDC_REDIRECT_URL"`
+	GoogleClientID     string `mapstructure:"GOOGLE_CLIENT_ID"`
+	GoogleClientSecret string `mapstructure:"GOOGLE_CLIENT_SECRET"`
+	YandexClientID     string `mapstructure:"YANDEX_CLIENT_ID"`
+	YandexClientSecret string `mapstructure:"YANDEX_CLIENT_SECRET"`
+	AppleClientID      string `mapstructure:"APPLE_CLIENT_ID"`
+	AppleBundleID      string `mapstructure:"APPLE_BUNDLE_ID"`
+	AppleTeamID        string `mapstructure:"APPLE_TEAM_ID"`
+	AppleKeyID         string `mapstructure:"APPLE_KEY_ID"`
+	ApplePrivateKey    string `mapstructure:"APPLE_PRIVATE_KEY"`
+	OIDCMockIssuer     string `mapstructure:"OIDC_MOCK_ISSUER"`
+	OIDCMockClientID   string `mapstructure:"OIDC_MOCK_CLIENT_ID"`
+
+	AccountDeletionGraceDays int `mapstructure:"ACCOUNT_DELETION_GRACE_DAYS"`
+
+	TrustedProxies []string `mapstructure:"TRUSTED_PROXIES"`
 }
 
 func LoadConfig(path string) (config Config, err error) {
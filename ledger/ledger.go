@@ -0,0 +1,519 @@
+package ledger
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+
+	"hyperpage/currency"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// System accounts on the other side of user wallet entries.
+const (
+	AccountPaymentGateway = "system:payment_gateway"
+	AccountRevenue        = "system:revenue"
+	AccountBonus          = "system:bonus"
+	AccountPromoCodes     = "system:promo_codes"
+	AccountOpening        = "system:opening_balance"
+	// AccountPromotionEscrow holds promotion bids until their auction runs.
+	AccountPromotionEscrow = "system:promotion_escrow"
+	// AccountPayoutHold holds requested withdrawals until they are paid out
+	// or released, AccountPayouts is money that left the platform.
+	AccountPayoutHold = "system:payout_hold"
+	AccountPayouts    = "system:payouts"
+	// AccountExchange takes the other side of every currency conversion, so
+	// each currency balances on its own.
+	AccountExchange = "system:exchange"
+)
+
+const userAccountPrefix = "user:"
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient balance")
+	ErrAccountInDebt     = errors.New("account has an outstanding debt")
+	ErrAlreadyReversed   = errors.New("ledger posting is already reversed")
+	ErrUnbalanced        = errors.New("ledger posting is not balanced")
+	ErrEmptyPosting      = errors.New("ledger posting has no entries")
+	ErrInvalidAmount     = errors.New("amount must be positive")
+)
+
+// Entry is one leg of a posting. Amount is in minor units of Currency, the
+// base currency when empty, and positive credits the account. A wallet leg
+// in another currency than the wallet is converted when posted. Description
+// and Type override the posting values on the transaction row shown to the
+// user owning the account.
+type Entry struct {
+	Account     string
+	Amount      int64
+	Currency    string
+	Description string
+	Type        string
+}
+
+// Posting describes a single money movement. Every posting is written
+// atomically: entries, wallet balances and the user facing transactions
+// either all land or none do.
+type Posting struct {
+	Module      string
+	ElementId   uint64
+	Description string
+	Status      string
+	Total       string
+	Entries     []Entry
+	// AllowNegative lets the posting take a wallet below zero. Refunds and
+	// chargebacks use it when the user already spent the money, leaving the
+	// wallet in debt until it is topped up again.
+	AllowNegative bool
+	// ReversalOf is the posting this one cancels.
+	ReversalOf *uint64
+	// NoConversion posts wallet legs in their own currency. Only a wallet
+	// changing currency uses it.
+	NoConversion bool
+}
+
+// leg is an entry ready to be written. original and rate are set when the
+// entry was converted into the wallet currency.
+type leg struct {
+	Entry
+	original Entry
+	rate     float64
+}
+
+// UserAccount returns the wallet account name of a user.
+func UserAccount(userID uuid.UUID) string {
+	return userAccountPrefix + userID.String()
+}
+
+func userFromAccount(account string) (uuid.UUID, bool) {
+	if !strings.HasPrefix(account, userAccountPrefix) {
+		return uuid.Nil, false
+	}
+	id, err := uuid.FromString(strings.TrimPrefix(account, userAccountPrefix))
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// ToMinor converts an amount to minor units. Every wallet currency has two
+// minor digits, like kopecks.
+func ToMinor(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// FromMinor converts minor units to an amount.
+func FromMinor(amount int64) float64 {
+	return float64(amount) / 100
+}
+
+// Post validates and writes a posting inside a database transaction. When db
+// is already a transaction the posting joins it.
+func Post(db *gorm.DB, p Posting) (*models.LedgerPosting, error) {
+	if len(p.Entries) == 0 {
+		return nil, ErrEmptyPosting
+	}
+
+	entries := make([]Entry, len(p.Entries))
+	sums := map[string]int64{}
+	for i, e := range p.Entries {
+		code, err := currency.Normalize(e.Currency)
+		if err != nil {
+			return nil, err
+		}
+		e.Currency = code
+		entries[i] = e
+		sums[code] += e.Amount
+	}
+	for _, sum := range sums {
+		if sum != 0 {
+			return nil, ErrUnbalanced
+		}
+	}
+
+	if p.Status == "" {
+		p.Status = "CLOSED_1"
+	}
+	if p.Total == "" {
+		p.Total = "0"
+	}
+
+	var posting *models.LedgerPosting
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock wallets in a stable order so concurrent transfers between the
+		// same users cannot deadlock.
+		wallets := map[uuid.UUID]*models.Billing{}
+		for _, e := range entries {
+			if id, ok := userFromAccount(e.Account); ok {
+				wallets[id] = nil
+			}
+		}
+		ids := make([]uuid.UUID, 0, len(wallets))
+		for id := range wallets {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+		for _, id := range ids {
+			billing, err := lockBilling(tx, id)
+			if err != nil {
+				return err
+			}
+			wallets[id] = billing
+		}
+
+		// Convert wallet legs at the current rate, the exchange account
+		// takes the difference between the currencies
+		legs := make([]leg, 0, len(entries))
+		var exchange []leg
+		deltas := map[uuid.UUID]int64{}
+		for _, e := range entries {
+			l := leg{Entry: e, rate: 1}
+			if id, ok := userFromAccount(e.Account); ok {
+				wallet := wallets[id].Currency
+				if e.Currency != wallet && !p.NoConversion {
+					amount, rate, err := currency.Convert(tx, e.Amount, e.Currency, wallet)
+					if err != nil {
+						return err
+					}
+					l.original, l.rate = e, rate
+					l.Amount, l.Currency = amount, wallet
+					exchange = append(exchange,
+						leg{Entry: Entry{Account: AccountExchange, Amount: -amount, Currency: wallet}, rate: 1},
+						leg{Entry: Entry{Account: AccountExchange, Amount: e.Amount, Currency: e.Currency}, rate: 1},
+					)
+				}
+				deltas[id] += l.Amount
+			}
+			legs = append(legs, l)
+		}
+		legs = append(legs, exchange...)
+
+		for _, id := range ids {
+			if deltas[id] < 0 && !p.AllowNegative {
+				balance, err := accountBalance(tx, UserAccount(id), wallets[id].Currency)
+				if err != nil {
+					return err
+				}
+				if balance < 0 {
+					return ErrAccountInDebt
+				}
+				if balance+deltas[id] < 0 {
+					return ErrInsufficientFunds
+				}
+			}
+		}
+
+		posting = &models.LedgerPosting{
+			Module:      p.Module,
+			ElementId:   p.ElementId,
+			Description: p.Description,
+			ReversalOf:  p.ReversalOf,
+		}
+		if err := tx.Create(posting).Error; err != nil {
+			return err
+		}
+
+		for _, e := range legs {
+			entry := models.LedgerEntry{
+				PostingID: posting.ID,
+				Account:   e.Account,
+				Amount:    e.Amount,
+				Currency:  e.Currency,
+			}
+			if id, ok := userFromAccount(e.Account); ok {
+				entry.UserID = &id
+			}
+			if err := tx.Create(&entry).Error; err != nil {
+				return err
+			}
+			posting.Entries = append(posting.Entries, entry)
+
+			if entry.UserID == nil {
+				continue
+			}
+
+			transaction := models.Transaction{
+				UserID:      *entry.UserID,
+				ElementId:   p.ElementId,
+				Module:      p.Module,
+				Amount:      FromMinor(absMinor(e.Amount)),
+				AmountMinor: absMinor(e.Amount),
+				Description: firstNonEmpty(e.Description, p.Description),
+				Type:        firstNonEmpty(e.Type, defaultType(e.Amount)),
+				Status:      p.Status,
+				Total:       p.Total,
+				PostingID:   &posting.ID,
+				EntryID:     &entry.ID,
+				Currency:    e.Currency,
+				Rate:        e.rate,
+			}
+			if e.original.Currency != "" {
+				transaction.OriginalAmount = FromMinor(absMinor(e.original.Amount))
+				transaction.OriginalAmountMinor = absMinor(e.original.Amount)
+				transaction.OriginalCurrency = e.original.Currency
+			}
+			if err := tx.Create(&transaction).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, id := range ids {
+			if err := syncBilling(tx, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return posting, nil
+}
+
+// Credit moves amount from a system account into the user's wallet.
+func Credit(db *gorm.DB, userID uuid.UUID, from string, amount float64, p Posting) (*models.LedgerPosting, error) {
+	minor := ToMinor(amount)
+	if minor <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	p.Entries = []Entry{
+		{Account: UserAccount(userID), Amount: minor},
+		{Account: from, Amount: -minor},
+	}
+	return Post(db, p)
+}
+
+// Debit moves amount from the user's wallet into a system account.
+func Debit(db *gorm.DB, userID uuid.UUID, to string, amount float64, p Posting) (*models.LedgerPosting, error) {
+	minor := ToMinor(amount)
+	if minor <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	p.Entries = []Entry{
+		{Account: UserAccount(userID), Amount: -minor},
+		{Account: to, Amount: minor},
+	}
+	return Post(db, p)
+}
+
+// Transfer moves amount between two user wallets. receiverDescription is
+// shown on the receiver's transaction row.
+func Transfer(db *gorm.DB, from, to uuid.UUID, amount float64, receiverDescription string, p Posting) (*models.LedgerPosting, error) {
+	minor := ToMinor(amount)
+	if minor <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	p.Entries = []Entry{
+		{Account: UserAccount(from), Amount: -minor, Type: "deduction"},
+		{Account: UserAccount(to), Amount: minor, Type: "addition", Description: receiverDescription},
+	}
+	return Post(db, p)
+}
+
+// Reverse posts the mirror image of an existing posting, returning every
+// amount to where it came from. Wallets are allowed to go negative so a
+// chargeback can claw back money the user already spent.
+func Reverse(db *gorm.DB, postingID uint64, description string) (*models.LedgerPosting, error) {
+	var posting *models.LedgerPosting
+	err := db.Transaction(func(tx *gorm.DB) error {
+		original := new(models.LedgerPosting)
+		if err := tx.Preload("Entries").First(original, postingID).Error; err != nil {
+			return err
+		}
+		if original.ReversalOf != nil {
+			return ErrAlreadyReversed
+		}
+
+		var reversed int64
+		if err := tx.Model(&models.LedgerPosting{}).Where("reversal_of = ?", postingID).Count(&reversed).Error; err != nil {
+			return err
+		}
+		if reversed > 0 {
+			return ErrAlreadyReversed
+		}
+
+		p := Posting{
+			Module:        original.Module,
+			ElementId:     original.ElementId,
+			Description:   description,
+			AllowNegative: true,
+			ReversalOf:    &original.ID,
+		}
+		for _, e := range original.Entries {
+			p.Entries = append(p.Entries, Entry{Account: e.Account, Amount: -e.Amount, Currency: e.Currency})
+		}
+
+		var err error
+		posting, err = Post(tx, p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return posting, nil
+}
+
+// ChangeCurrency moves the whole wallet into another currency at the
+// current rate. A wallet in debt stays in debt in the new currency.
+func ChangeCurrency(db *gorm.DB, userID uuid.UUID, code string) (*models.Billing, error) {
+	code, err := currency.Normalize(code)
+	if err != nil {
+		return nil, err
+	}
+
+	var billing *models.Billing
+	err = db.Transaction(func(tx *gorm.DB) error {
+		billing, err = lockBilling(tx, userID)
+		if err != nil {
+			return err
+		}
+		from := billing.Currency
+		if from == code {
+			return nil
+		}
+
+		minor, err := accountBalance(tx, UserAccount(userID), from)
+		if err != nil {
+			return err
+		}
+		converted, _, err := currency.Convert(tx, minor, from, code)
+		if err != nil {
+			return err
+		}
+
+		billing.Currency = code
+		if err := tx.Model(billing).Update("currency", code).Error; err != nil {
+			return err
+		}
+		if minor == 0 {
+			return syncBilling(tx, userID)
+		}
+
+		_, err = Post(tx, Posting{
+			Module:        "Exchange",
+			Description:   "Обмен валюты " + from + " → " + code,
+			AllowNegative: true,
+			NoConversion:  true,
+			Entries: []Entry{
+				{Account: UserAccount(userID), Amount: -minor, Currency: from},
+				{Account: AccountExchange, Amount: minor, Currency: from},
+				{Account: AccountExchange, Amount: -converted, Currency: code},
+				{Account: UserAccount(userID), Amount: converted, Currency: code},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).First(billing).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return billing, nil
+}
+
+// Wallet returns the currency of a user's wallet and its balance in minor
+// units computed from ledger entries.
+func Wallet(db *gorm.DB, userID uuid.UUID) (string, int64, error) {
+	code := currency.Base
+	var billing models.Billing
+	err := db.Where("user_id = ?", userID).First(&billing).Error
+	if err == nil {
+		code = billing.Currency
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", 0, err
+	}
+
+	minor, err := accountBalance(db, UserAccount(userID), code)
+	if err != nil {
+		return "", 0, err
+	}
+	return code, minor, nil
+}
+
+// InDebt reports whether the user's wallet is below zero.
+func InDebt(db *gorm.DB, userID uuid.UUID) (bool, error) {
+	_, minor, err := Wallet(db, userID)
+	if err != nil {
+		return false, err
+	}
+	return minor < 0, nil
+}
+
+// Balance returns the wallet balance of a user, in the wallet currency,
+// computed from ledger entries.
+func Balance(db *gorm.DB, userID uuid.UUID) (float64, error) {
+	_, minor, err := Wallet(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	return FromMinor(minor), nil
+}
+
+func accountBalance(db *gorm.DB, account, code string) (int64, error) {
+	var sum int64
+	err := db.Model(&models.LedgerEntry{}).
+		Where("account = ? AND currency = ?", account, code).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&sum).Error
+	return sum, err
+}
+
+func lockBilling(tx *gorm.DB, userID uuid.UUID) (*models.Billing, error) {
+	billing := new(models.Billing)
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ?", userID).
+		First(billing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		billing = &models.Billing{UserID: userID, Amount: 0, Currency: currency.Base}
+		err = tx.Create(billing).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return billing, nil
+}
+
+// syncBilling rewrites the cached wallet balance from the ledger entries.
+func syncBilling(tx *gorm.DB, userID uuid.UUID) error {
+	code, minor, err := Wallet(tx, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&models.Billing{}).
+		Where("user_id = ? AND currency = ?", userID, code).
+		Updates(map[string]interface{}{"balance": minor, "amount": FromMinor(minor)}).Error
+}
+
+func absMinor(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func defaultType(amount int64) string {
+	if amount < 0 {
+		return "deduction"
+	}
+	return "profit"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Discrepancy reports a wallet whose cached Billing.Balance does not match
+// the sum of its ledger entries in the wallet currency.
+type Discrepancy struct {
+	UserID   uuid.UUID `json:"userId"`
+	Currency string    `json:"currency"`
+	Billing  float64   `json:"billing"`
+	Ledger   float64   `json:"ledger"`
+}
+
+// Report is the result of a full reconciliation run.
+type Report struct {
+	// TrialBalance is the sum of every entry in the ledger per currency and
+	// every value must be zero.
+	TrialBalance  map[string]int64 `json:"trialBalance"`
+	Discrepancies []Discrepancy    `json:"discrepancies"`
+}
+
+// Reconcile compares every wallet against the ledger.
+func Reconcile(db *gorm.DB) (*Report, error) {
+	report := &Report{TrialBalance: map[string]int64{}, Discrepancies: []Discrepancy{}}
+
+	type total struct {
+		Currency string
+		Sum      int64
+	}
+	var totals []total
+	if err := db.Model(&models.LedgerEntry{}).
+		Select("currency, COALESCE(SUM(amount), 0) AS sum").
+		Group("currency").
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range totals {
+		report.TrialBalance[t.Currency] = t.Sum
+	}
+
+	type row struct {
+		UserID   uuid.UUID
+		Currency string
+		Billing  int64
+		Ledger   int64
+	}
+	var rows []row
+	err := db.Raw(`
+		SELECT b.user_id, b.currency, b.balance AS billing, COALESCE(SUM(e.amount), 0) AS ledger
+		FROM billings b
+		LEFT JOIN ledger_entries e ON e.user_id = b.user_id AND e.currency = b.currency
+		WHERE b.deleted_at IS NULL
+		GROUP BY b.user_id, b.currency, b.balance
+		HAVING b.balance <> COALESCE(SUM(e.amount), 0)
+	`).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			UserID:   r.UserID,
+			Currency: r.Currency,
+			Billing:  FromMinor(r.Billing),
+			Ledger:   FromMinor(r.Ledger),
+		})
+	}
+
+	return report, nil
+}
+
+// OpenBalances posts an opening entry for every wallet that has a balance
+// but no ledger history yet, so balances created before the ledger existed
+// are accounted for.
+func OpenBalances(db *gorm.DB) error {
+	var billings []models.Billing
+	err := db.Where("amount <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.user_id = billings.user_id)").
+		Find(&billings).Error
+	if err != nil {
+		return err
+	}
+
+	for _, b := range billings {
+		minor := ToMinor(b.Amount)
+		_, err := Post(db, Posting{
+			NoConversion:  true,
+			Module:        "Opening",
+			Description:   "Входящий остаток",
+			AllowNegative: true,
+			Entries: []Entry{
+				{Account: UserAccount(b.UserID), Amount: minor, Currency: b.Currency},
+				{Account: AccountOpening, Amount: -minor, Currency: b.Currency},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package ledger
+
+import (
+	"sort"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// StatementLine is one balance movement of a statement. Amount is signed,
+// negative amounts left the balance.
+type StatementLine struct {
+	PostingID   uint64    `json:"postingId"`
+	Date        time.Time `json:"date"`
+	Module      string    `json:"module"`
+	Description string    `json:"description"`
+	Amount      float64   `json:"amount"`
+}
+
+// ModuleTotal sums the movements of one posting module.
+type ModuleTotal struct {
+	Module  string  `json:"module"`
+	Credits float64 `json:"credits"`
+	Debits  float64 `json:"debits"`
+}
+
+// Statement summarises a user's balance over [From, To) in the wallet
+// currency.
+type Statement struct {
+	UserID   uuid.UUID       `json:"userId"`
+	Currency string          `json:"currency"`
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Opening  float64         `json:"opening"`
+	Credits  float64         `json:"credits"`
+	Debits   float64         `json:"debits"`
+	Closing  float64         `json:"closing"`
+	Lines    []StatementLine `json:"lines"`
+	Modules  []ModuleTotal   `json:"modules"`
+}
+
+// BuildStatement collects the wallet movements of a user between from and
+// to. Descriptions come from the transaction row of each entry, so each side
+// of a transfer reads the way it does in the transaction history.
+func BuildStatement(db *gorm.DB, userID uuid.UUID, from, to time.Time) (*Statement, error) {
+	account := UserAccount(userID)
+	code, _, err := Wallet(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	st := &Statement{UserID: userID, Currency: code, From: from, To: to, Lines: []StatementLine{}, Modules: []ModuleTotal{}}
+
+	var opening int64
+	err = db.Raw(`SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE account = ? AND currency = ? AND created_at < ?`, account, code, from).
+		Scan(&opening).Error
+	if err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		PostingID   uint64
+		CreatedAt   time.Time
+		Module      string
+		Description string
+		Amount      int64
+	}
+	var rows []row
+	err = db.Raw(`
+		SELECT e.posting_id, e.created_at, p.module,
+			COALESCE(t.description, p.description) AS description, e.amount
+		FROM ledger_entries e
+		JOIN ledger_postings p ON p.id = e.posting_id
+		LEFT JOIN transactions t ON t.entry_id = e.id
+		WHERE e.account = ? AND e.currency = ? AND e.created_at >= ? AND e.created_at < ?
+		ORDER BY e.created_at, e.id
+	`, account, code, from, to).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var credits, debits int64
+	modules := map[string]*[2]int64{}
+	for _, r := range rows {
+		total, ok := modules[r.Module]
+		if !ok {
+			total = &[2]int64{}
+			modules[r.Module] = total
+		}
+		if r.Amount > 0 {
+			credits += r.Amount
+			total[0] += r.Amount
+		} else {
+			debits -= r.Amount
+			total[1] -= r.Amount
+		}
+		st.Lines = append(st.Lines, StatementLine{
+			PostingID:   r.PostingID,
+			Date:        r.CreatedAt,
+			Module:      r.Module,
+			Description: r.Description,
+			Amount:      FromMinor(r.Amount),
+		})
+	}
+
+	for module, total := range modules {
+		st.Modules = append(st.Modules, ModuleTotal{
+			Module:  module,
+			Credits: FromMinor(total[0]),
+			Debits:  FromMinor(total[1]),
+		})
+	}
+	sort.Slice(st.Modules, func(i, j int) bool { return st.Modules[i].Module < st.Modules[j].Module })
+
+	st.Opening = FromMinor(opening)
+	st.Credits = FromMinor(credits)
+	st.Debits = FromMinor(debits)
+	st.Closing = FromMinor(opening + credits - debits)
+
+	return st, nil
+}
@@ -0,0 +1,62 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestStatementLinesOnePerEntry(t *testing.T) {
+	db := testdb.Open(t,
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+	if err := db.Create(&models.ExchangeRate{Currency: "EUR", Rate: 100}).Error; err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.NewV4()
+	from := time.Now().Add(-time.Hour)
+	if _, err := Credit(db, userID, AccountBonus, 1000, Posting{Module: "Registration"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both legs of a currency change and of a transfer to oneself belong
+	// to the same user and posting
+	if _, err := ChangeCurrency(db, userID, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Transfer(db, userID, userID, 4, "Себе", Posting{Module: "donat", Description: "Донат"}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := BuildStatement(db, userID, from, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Currency != "EUR" || st.Opening != 0 || st.Closing != 10 {
+		t.Fatalf("statement %s opening %v closing %v, want EUR 0 10", st.Currency, st.Opening, st.Closing)
+	}
+	want := []StatementLine{
+		{Module: "Exchange", Description: "Обмен валюты RUB → EUR", Amount: 10},
+		{Module: "donat", Description: "Донат", Amount: -4},
+		{Module: "donat", Description: "Себе", Amount: 4},
+	}
+	if len(st.Lines) != len(want) {
+		t.Fatalf("%d lines, want %d: %+v", len(st.Lines), len(want), st.Lines)
+	}
+	for i, line := range st.Lines {
+		if line.Module != want[i].Module || line.Description != want[i].Description || line.Amount != want[i].Amount {
+			t.Errorf("line %d = %+v, want %+v", i, line, want[i])
+		}
+	}
+	if st.Credits != 14 || st.Debits != 4 {
+		t.Fatalf("credits %v debits %v, want 14 4", st.Credits, st.Debits)
+	}
+}
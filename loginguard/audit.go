@@ -0,0 +1,34 @@
+package loginguard
+
+import (
+	"log"
+
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+)
+
+// Security event kinds.
+const (
+	EventRepeatedFailures = "login_failed_repeated"
+	EventRateLimited      = "rate_limited"
+	EventLocked           = "account_locked"
+	EventUnlocked         = "account_unlocked"
+	EventEmailChanged     = "email_changed"
+)
+
+// Record stores a security event. The user is looked up by email when
+// there is one, failures to record are only logged.
+func Record(db *gorm.DB, kind, email, ip, detail string) {
+	event := models.SecurityEvent{Kind: kind, Email: email, IP: ip, Detail: detail}
+	if email != "" {
+		var user models.User
+		if err := db.Select("id").Where("email = ?", email).First(&user).Error; err == nil {
+			id := user.ID
+			event.UserID = &id
+		}
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Println("Failed to record security event:", err)
+	}
+}
@@ -0,0 +1,278 @@
+// Package loginguard slows down password guessing. Failed sign ins are
+// counted in Redis sliding windows per IP address and per email: past a
+// limit every further failure doubles the wait before the next attempt, and
+// too many failures lock the email until the lock expires or the owner
+// follows the unlock link.
+package loginguard
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Rule allows Limit events per Window.
+type Rule struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// Action is a guarded endpoint.
+type Action string
+
+const (
+	Login     Action = "login"
+	Forgot    Action = "forgot"
+	Reset     Action = "reset"
+	MagicLink Action = "magic_link"
+)
+
+var (
+	// IPRules limit every attempt of an action from one address. Login
+	// counts failures only.
+	IPRules = map[Action]Rule{
+		Login:     {Limit: 30, Window: 15 * time.Minute},
+		Forgot:    {Limit: 5, Window: time.Hour},
+		Reset:     {Limit: 10, Window: 15 * time.Minute},
+		MagicLink: {Limit: 10, Window: time.Hour},
+	}
+	// EmailRules limit the attempts of an action for one email.
+	EmailRules = map[Action]Rule{
+		Login:     {Limit: 5, Window: 15 * time.Minute},
+		Forgot:    {Limit: 3, Window: time.Hour},
+		MagicLink: {Limit: 3, Window: 15 * time.Minute},
+	}
+)
+
+const (
+	// LockThreshold failed sign ins of an email within its window lock it.
+	LockThreshold = 10
+	LockDuration  = 30 * time.Minute
+	// MaxDelay caps the progressive delay between failed sign ins.
+	MaxDelay = 5 * time.Minute
+	// RepeatedFailures is where failures start to be audited.
+	RepeatedFailures = 3
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many attempts")
+	ErrLocked          = errors.New("account is temporarily locked")
+	ErrInvalidUnlock   = errors.New("unlock link is invalid or expired")
+)
+
+// Failure is the state of an email after a failed sign in.
+type Failure struct {
+	Failures    int64
+	Delay       time.Duration
+	Locked      bool
+	UnlockToken string // set when this failure locked the email
+}
+
+func windowKey(action Action, scope, value string) string {
+	return "guard:" + string(action) + ":" + scope + ":" + value
+}
+func delayKey(email string) string  { return "guard:delay:" + email }
+func lockKey(email string) string   { return "guard:lock:" + email }
+func unlockKey(token string) string { return "guard:unlock:" + token }
+
+// hitScript adds an event to a sliding window and returns the events left
+// in it and the time of the oldest, in milliseconds.
+var hitScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1] - ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {redis.call('ZCARD', KEYS[1]), oldest[2] or ARGV[1]}
+`)
+
+// window counts a sliding window, adding an event first when add is set.
+// It returns the count and how long until the oldest event leaves.
+func window(ctx context.Context, key string, rule Rule, add bool) (int64, time.Duration, error) {
+	now := time.Now().UnixMilli()
+	member := ""
+	if add {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return 0, 0, err
+		}
+		member = strconv.FormatInt(now, 10) + "-" + hex.EncodeToString(b)
+	}
+
+	res, err := hitScript.Run(ctx, initializers.RedisClient, []string{key}, now, rule.Window.Milliseconds(), member).Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	count, _ := res[0].(int64)
+	oldest, _ := strconv.ParseInt(toString(res[1]), 10, 64)
+	return count, time.Duration(oldest+rule.Window.Milliseconds()-now) * time.Millisecond, nil
+}
+
+// Check tells whether a sign in may be tried now. The error is
+// ErrLocked or ErrTooManyAttempts together with the time to wait.
+func Check(ctx context.Context, ip, email string) (time.Duration, error) {
+	rdb := initializers.RedisClient
+	if email != "" {
+		if ttl, err := rdb.PTTL(ctx, lockKey(email)).Result(); err != nil {
+			return 0, err
+		} else if ttl > 0 {
+			return ttl, ErrLocked
+		}
+		if ttl, err := rdb.PTTL(ctx, delayKey(email)).Result(); err != nil {
+			return 0, err
+		} else if ttl > 0 {
+			return ttl, ErrTooManyAttempts
+		}
+	}
+
+	rule := IPRules[Login]
+	count, wait, err := window(ctx, windowKey(Login, "ip", ip), rule, false)
+	if err != nil {
+		return 0, err
+	}
+	if count >= rule.Limit {
+		return wait, ErrTooManyAttempts
+	}
+	return 0, nil
+}
+
+// Fail counts a failed sign in of an email from an address.
+func Fail(ctx context.Context, ip, email string) (*Failure, error) {
+	if _, _, err := window(ctx, windowKey(Login, "ip", ip), IPRules[Login], true); err != nil {
+		return nil, err
+	}
+	if email == "" {
+		return &Failure{}, nil
+	}
+
+	rule := EmailRules[Login]
+	count, _, err := window(ctx, windowKey(Login, "email", email), rule, true)
+	if err != nil {
+		return nil, err
+	}
+	failure := &Failure{Failures: count}
+
+	rdb := initializers.RedisClient
+	if count >= LockThreshold {
+		token, err := lock(ctx, email)
+		if err != nil {
+			return nil, err
+		}
+		failure.Locked = token != ""
+		failure.UnlockToken = token
+		failure.Delay = LockDuration
+		return failure, nil
+	}
+	if count >= rule.Limit {
+		failure.Delay = Delay(count - rule.Limit)
+		if err := rdb.Set(ctx, delayKey(email), 1, failure.Delay).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return failure, nil
+}
+
+// Delay is the wait after the n-th failure past the limit: 1s, 2s, 4s and
+// so on up to MaxDelay.
+func Delay(n int64) time.Duration {
+	if n > 16 || time.Second<<n > MaxDelay {
+		return MaxDelay
+	}
+	return time.Second << n
+}
+
+// lock locks an email and returns the unlock token, or "" when it was
+// locked already.
+func lock(ctx context.Context, email string) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	rdb := initializers.RedisClient
+	ok, err := rdb.SetNX(ctx, lockKey(email), token, LockDuration).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+	if err := rdb.Set(ctx, unlockKey(token), email, LockDuration).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Succeed forgets the failures of an email after it signed in.
+func Succeed(ctx context.Context, email string) error {
+	return initializers.RedisClient.Del(ctx, windowKey(Login, "email", email), delayKey(email)).Err()
+}
+
+// Unlock lifts the lock an unlock token was sent for and returns the email.
+func Unlock(ctx context.Context, token string) (string, error) {
+	rdb := initializers.RedisClient
+	email, err := rdb.GetDel(ctx, unlockKey(token)).Result()
+	if err == redis.Nil {
+		return "", ErrInvalidUnlock
+	}
+	if err != nil {
+		return "", err
+	}
+	return email, Clear(ctx, email)
+}
+
+// Clear lifts any lock and delay of an email, such as after a password
+// reset.
+func Clear(ctx context.Context, email string) error {
+	rdb := initializers.RedisClient
+	if token, err := rdb.Get(ctx, lockKey(email)).Result(); err == nil {
+		rdb.Del(ctx, unlockKey(token))
+	}
+	return rdb.Del(ctx, lockKey(email), delayKey(email), windowKey(Login, "email", email)).Err()
+}
+
+// Attempt counts a request of a rate limited action such as a password
+// reset, which are limited whether they succeed or not. email may be empty.
+func Attempt(ctx context.Context, action Action, ip, email string) (time.Duration, error) {
+	if rule, ok := IPRules[action]; ok {
+		count, wait, err := window(ctx, windowKey(action, "ip", ip), rule, true)
+		if err != nil {
+			return 0, err
+		}
+		if count > rule.Limit {
+			return wait, ErrTooManyAttempts
+		}
+	}
+	if rule, ok := EmailRules[action]; ok && email != "" {
+		count, wait, err := window(ctx, windowKey(action, "email", email), rule, true)
+		if err != nil {
+			return 0, err
+		}
+		if count > rule.Limit {
+			return wait, ErrTooManyAttempts
+		}
+	}
+	return 0, nil
+}
+
+// NormalizeEmail is the email as counted, the way users are looked up.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
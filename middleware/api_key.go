@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/apikeys"
+	"hyperpage/initializers"
+)
+
+// RequireAPIKey guards machine routes with an API key that has the scope.
+// The key is stored in Locals "api_key" for ownership checks.
+func RequireAPIKey(scope string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		raw := c.Get(apikeys.Header)
+		if raw == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "API key is required"})
+		}
+
+		now := time.Now()
+		key, err := apikeys.Authenticate(initializers.DB, raw, now)
+		if errors.Is(err, apikeys.ErrInvalidKey) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Invalid API key"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
+		}
+		if !apikeys.HasScope(key, scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "API key is not allowed to access this resource"})
+		}
+
+		allowed, remaining, wait, err := apikeys.Allow(c.Context(), key, now)
+		if err != nil {
+			// Without Redis the limit is not enforced rather than taking bots down
+			log.Println("Failed to count API key request:", err)
+			allowed, remaining = true, key.RateLimit
+		}
+		c.Set("X-RateLimit-Limit", strconv.Itoa(key.RateLimit))
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"status": "fail", "message": "API key rate limit exceeded"})
+		}
+
+		apikeys.Touch(c.Context(), initializers.DB, key, c.IP(), now)
+		c.Locals("api_key", key)
+		return c.Next()
+	}
+}
@@ -1,45 +1,31 @@
 package middleware
 
-// import (
-// 	"fmt"
-// 	"hyperpage/models"
+import (
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/permissions"
 
-// 	"github.com/gofiber/fiber/v2"
-// )
+	"github.com/gofiber/fiber/v2"
+)
 
-// type PermissionMiddleware struct {
-// 	Action     string
-// 	Resource   string
-// 	Permission string
-// }
+// RequirePermission lets the request through when the role of the user
+// grants every one of the permissions. It runs after DeserializeUser.
+func RequirePermission(perms ...string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(models.UserResponse)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"message": "You must be logged in to access this resource",
+			})
+		}
 
-// func CheckPermission(permission PermissionMiddleware) func(c *fiber.Ctx) error {
-// 	return func(c *fiber.Ctx) error {
-// 		user := c.Locals("user")
-// 		if user == nil {
-// 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
-// 		}
-// 		if user != nil {
-//             userResp := user.(models.UserResponse)
-//             userObj := models.User{
-//                 Role:     userResp.Role,
-//             }
-// 			// Extract user's role
-// 			role := userObj.Role
-
-// 			// Check if the role has the required permission
-// 			if hasPermission(role, permission.Action, permission.Resource, permission.Permission) {
-// 				return c.Next()
-// 			}
-// 		}
-
-// 		// If user does not have the required permission, return an error message or redirect to an appropriate page
-// 		return c.SendStatus(fiber.StatusForbidden)
-// 	}
-// }
-
-// func hasPermission(role models.Role, action string, resource string, permission string) bool {
-// 	// Check if role has the required permission for the given action and resource
-// 	// You can implement your own logic here, such as using a database or a map to store permissions
-// 	return true
-// }
\ No newline at end of file
+		for _, perm := range perms {
+			if !permissions.Has(initializers.DB, user.Role, perm) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"message": "You are not authorized to access this resource",
+				})
+			}
+		}
+		return c.Next()
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// CheckRole lets listed roles through.
+//
+// Deprecated: routes check named permissions with RequirePermission.
 func CheckRole(roles []string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		user := c.Locals("user")
@@ -1,12 +1,15 @@
 package middleware
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/signing"
 	"hyperpage/utils"
 
 	"gorm.io/gorm"
@@ -32,13 +35,20 @@ func DeserializeUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "You are not logged in"})
 	}
 
-	config, _ := initializers.LoadConfig(".")
-
-	tokenClaims, err := utils.ValidateToken(access_token, config.AccessTokenPublicKey)
+	tokenClaims, err := utils.ValidateToken(access_token, signing.Access)
 	if err != nil {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
 
+	// A valid signature is not enough, the session must not be revoked
+	sessionID, err := sessions.Check(c.Context(), tokenClaims.TokenUuid)
+	if errors.Is(err, sessions.ErrRevoked) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": "Your session has ended, please log in again"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+
 	var user models.User
 	err = initializers.DB.Preload("Followings").
 		Preload("Followers").
@@ -54,6 +64,7 @@ func DeserializeUser(c *fiber.Ctx) error {
 
 	c.Locals("user", models.FilterUserRecord(&user, language))
 	c.Locals("access_token_uuid", tokenClaims.TokenUuid)
+	c.Locals("session_id", sessionID)
 
 	return c.Next()
 }
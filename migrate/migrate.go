@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"hyperpage/initializers"
+	"hyperpage/ledger"
 	"hyperpage/models"
+	"hyperpage/permissions"
 	"hyperpage/utils"
 	"log"
 	"math/rand"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/jackc/pgtype"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/datatypes"
 )
 
 func init() {
@@ -47,9 +50,60 @@ func main() {
 	if err := initializers.DB.AutoMigrate(&models.Transaction{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.LedgerPosting{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.LedgerEntry{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.Withdrawal{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.StatementSchedule{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.ExchangeRate{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.TwoFactor{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.RecoveryCode{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.UserIdentity{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SecurityEvent{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.AccessRole{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.RolePermission{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.APIKey{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.AccountDeletion{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SigningKey{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SubscriptionPlan{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.Subscription{}); err != nil {
+		panic(err)
+	}
 	if err := initializers.DB.AutoMigrate(&models.Blog{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.PromotionBid{}); err != nil {
+		panic(err)
+	}
 	if err := initializers.DB.AutoMigrate(&models.Favorite{}); err != nil {
 		panic(err)
 	}
@@ -65,6 +119,12 @@ func main() {
 	if err := initializers.DB.AutoMigrate(&models.Payments{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.PaymentWebhookEvent{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.PaymentRefund{}); err != nil {
+		panic(err)
+	}
 	if err := initializers.DB.AutoMigrate(&models.Guilds{}); err != nil {
 		panic(err)
 	}
@@ -77,6 +137,12 @@ func main() {
 	if err := initializers.DB.AutoMigrate(&models.Codes{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.CodeBatch{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.CodeRedemption{}); err != nil {
+		panic(err)
+	}
 	if err := initializers.DB.AutoMigrate(&models.Hashtags{}); err != nil {
 		panic(err)
 	}
@@ -116,6 +182,12 @@ func main() {
 	if err := initializers.DB.AutoMigrate(&models.ChatOutbox{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.ChatAttachment{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.ChatReaction{}); err != nil {
+		panic(err)
+	}
 	if err := initializers.DB.AutoMigrate(&models.Presavedfilters{}); err != nil {
 		panic(err)
 	}
@@ -123,6 +195,11 @@ func main() {
 		panic(err)
 	}
 
+	// Create the default roles and their permissions
+	if err := permissions.Seed(initializers.DB); err != nil {
+		panic(err)
+	}
+
 	// Check if there are any users in the database
 	var userCount int64
 	initializers.DB.Model(&models.User{}).Count(&userCount)
@@ -188,12 +265,11 @@ func main() {
 		}
 		initializers.DB.Create(&domain)
 
-		// Create a billing record for the first user
-		billing := models.Billing{
-			UserID: admin.ID,
-			Amount: 5000,
-		}
-		initializers.DB.Create(&billing)
+		// Credit the starting balance of the first user
+		ledger.Credit(initializers.DB, admin.ID, ledger.AccountBonus, 5000, ledger.Posting{
+			Module:      "Registration",
+			Description: "Стартовый баланс администратора",
+		})
 
 		// Create a profile record for the first user
 		profile := models.Profile{
@@ -236,5 +312,131 @@ func main() {
 		fmt.Println("✅ Admin user created")
 	}
 
+	// Seed the plans that used to be hard-coded in controllers.Plan
+	plans := []models.SubscriptionPlan{
+		{Name: "standart", Price: 0, PeriodDays: 31, LimitStorage: 20, SortOrder: 0},
+		{Name: "Начальный", Price: 150, PeriodDays: 31, LimitStorage: 300, SortOrder: 1},
+		{Name: "Бизнесс", Price: 500, PeriodDays: 31, LimitStorage: 600, SortOrder: 2},
+		{Name: "Расширенный", Price: 1000, PeriodDays: 31, LimitStorage: 900, SortOrder: 3},
+	}
+	for _, plan := range plans {
+		plan.Features = datatypes.JSON(`{}`)
+		if err := initializers.DB.Where("name = ?", plan.Name).FirstOrCreate(&plan).Error; err != nil {
+			panic(err)
+		}
+	}
+
+	// Users who bought a plan before subscriptions existed keep it until it
+	// expires, without being charged again automatically
+	if err := initializers.DB.Exec(`
+		INSERT INTO subscriptions (user_id, plan_id, status, auto_renew, current_period_start, current_period_end)
+		SELECT u.id, p.id, 'canceled', false, u.expired_plan_at - (p.period_days || ' days')::interval, u.expired_plan_at
+		FROM users u
+		JOIN subscription_plans p ON p.name = u.plan
+		WHERE u.expired_plan_at IS NOT NULL AND u.expired_plan_at > now()
+		ON CONFLICT (user_id) DO NOTHING
+	`).Error; err != nil {
+		panic(err)
+	}
+
+	// Bring balances created before the ledger existed into it
+	if err := ledger.OpenBalances(initializers.DB); err != nil {
+		panic(err)
+	}
+
+	// Fill the minor unit balances of wallets from before currencies existed
+	if err := initializers.DB.Exec(`
+		UPDATE billings b SET balance = COALESCE((
+			SELECT SUM(e.amount) FROM ledger_entries e
+			WHERE e.user_id = b.user_id AND e.currency = b.currency
+		), 0)
+	`).Error; err != nil {
+		panic(err)
+	}
+
+	// Fill the minor unit prices and amounts written before they had columns
+	if err := initializers.DB.Exec(`UPDATE blogs SET price = ROUND(total * 100) WHERE price = 0 AND total IS NOT NULL`).Error; err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.Exec(`
+		UPDATE transactions SET amount_minor = ROUND(amount * 100), original_amount_minor = ROUND(original_amount * 100)
+		WHERE amount_minor = 0 AND original_amount_minor = 0
+	`).Error; err != nil {
+		panic(err)
+	}
+
+	// Link older transaction rows to their ledger entry by side and amount
+	if err := initializers.DB.Exec(`
+		UPDATE transactions t SET entry_id = e.id
+		FROM ledger_entries e
+		WHERE t.entry_id IS NULL AND e.posting_id = t.posting_id AND e.user_id = t.user_id
+			AND e.currency = t.currency AND ABS(e.amount) = t.amount_minor
+			AND (e.amount < 0) = (t.type = 'deduction')
+	`).Error; err != nil {
+		panic(err)
+	}
+
+	// Wake the Centrifugo PostgreSQL consumer on new outbox rows instead of
+	// waiting for its next poll, see partition_notification_channel
+	if err := initializers.DB.Exec(`
+		CREATE OR REPLACE FUNCTION centrifugo_notify_partition_change() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('centrifugo_partition_change', NEW.partition::text);
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS centrifugo_notify_partition_trigger ON chat_outboxes;
+		CREATE TRIGGER centrifugo_notify_partition_trigger
+			AFTER INSERT ON chat_outboxes
+			FOR EACH ROW EXECUTE FUNCTION centrifugo_notify_partition_change();
+	`).Error; err != nil {
+		panic(err)
+	}
+
+	// Chat rooms and messages carry the ID of the transaction that changed
+	// them last, so clients sync what changed since a snapshot; member
+	// changes count as changes of their room, reactions as changes of their
+	// message
+	if err := initializers.DB.Exec(`
+		CREATE OR REPLACE FUNCTION chat_set_version() RETURNS trigger AS $$
+		BEGIN
+			NEW.version := pg_current_xact_id()::text::bigint;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS chat_rooms_version_trigger ON chat_rooms;
+		CREATE TRIGGER chat_rooms_version_trigger
+			BEFORE INSERT OR UPDATE ON chat_rooms
+			FOR EACH ROW EXECUTE FUNCTION chat_set_version();
+		DROP TRIGGER IF EXISTS chat_messages_version_trigger ON chat_messages;
+		CREATE TRIGGER chat_messages_version_trigger
+			BEFORE INSERT OR UPDATE ON chat_messages
+			FOR EACH ROW EXECUTE FUNCTION chat_set_version();
+
+		CREATE OR REPLACE FUNCTION chat_member_touch_room() RETURNS trigger AS $$
+		BEGIN
+			UPDATE chat_rooms SET version = 0 WHERE id = COALESCE(NEW.room_id, OLD.room_id);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS chat_room_members_version_trigger ON chat_room_members;
+		CREATE TRIGGER chat_room_members_version_trigger
+			AFTER INSERT OR UPDATE OR DELETE ON chat_room_members
+			FOR EACH ROW EXECUTE FUNCTION chat_member_touch_room();
+
+		CREATE OR REPLACE FUNCTION chat_reaction_touch_message() RETURNS trigger AS $$
+		BEGIN
+			UPDATE chat_messages SET version = 0 WHERE id = COALESCE(NEW.message_id, OLD.message_id);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS chat_reactions_version_trigger ON chat_reactions;
+		CREATE TRIGGER chat_reactions_version_trigger
+			AFTER INSERT OR UPDATE OR DELETE ON chat_reactions
+			FOR EACH ROW EXECUTE FUNCTION chat_reaction_touch_message();
+	`).Error; err != nil {
+		panic(err)
+	}
+
 	fmt.Println("✅ Migration complete")
 }
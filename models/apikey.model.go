@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// APIKey lets a bot or an integration call machine routes. Only the
+// SHA-256 of the key is stored; Prefix finds the row. A key without a user
+// belongs to the system.
+type APIKey struct {
+	ID                uint64     `gorm:"primaryKey" json:"id"`
+	Name              string     `gorm:"not null" json:"name"`
+	UserID            *uuid.UUID `gorm:"type:uuid;index" json:"userId"`
+	Prefix            string     `gorm:"type:varchar(16);not null;uniqueIndex" json:"prefix"`
+	Hash              string     `gorm:"not null" json:"-"`
+	PreviousHash      string     `json:"-"`                 // the key before the last rotation
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt"` // until then the previous key works too
+	Scopes            []string   `gorm:"serializer:json;not null" json:"scopes"`
+	RateLimit         int        `gorm:"not null;default:60" json:"rateLimit"` // requests per minute
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	RevokedAt         *time.Time `json:"revokedAt"`
+	LastUsedAt        *time.Time `json:"lastUsedAt"`
+	LastUsedIP        string     `json:"lastUsedIp"`
+	RotatedAt         *time.Time `json:"rotatedAt"`
+	CreatedBy         uuid.UUID  `gorm:"type:uuid;not null" json:"createdBy"`
+	CreatedAt         time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+}
@@ -9,7 +9,9 @@ import (
 type Billing struct {
     ID        uint64         `gorm:"primaryKey"`
     UserID    uuid.UUID  	 `gorm:"type:uuid;not null"`
-    Amount    float64        `gorm:"not null"`
+    Amount    float64        `gorm:"not null"` // Balance in major units, kept for older readers
+    Balance   int64          `gorm:"not null;default:0"` // minor units of Currency, cached from the ledger
+    Currency  string         `gorm:"size:3;not null;default:RUB"`
     CreatedAt time.Time      `gorm:"autoCreateTime"`
     UpdatedAt time.Time      `gorm:"autoUpdateTime"`
     DeletedAt *time.Time `gorm:"index"`
@@ -26,7 +26,9 @@ type Blog struct {
 	UniqId           string         `gorm:"not null;default:0"`
 	Days             int            `gorm:"not null;default:3"`
 	Views            int            `gorm:"not null;default:0"`
-	Total            float64        `gorm:"null"`
+	Total            float64        `gorm:"null"`               // Price in major units, kept for older readers
+	Price            int64          `gorm:"not null;default:0"` // minor units of Currency
+	Currency         string         `gorm:"size:3;not null;default:RUB"`
 	TmId             float64        `gorm:"not null;default:0"`
 	Photos           []BlogPhoto    `json:"photos"`
 	NotAds           bool           `gorm:"not null;default:true"`
@@ -60,6 +62,7 @@ type BlogResponse struct {
 	City             []string       `json:"city"`
 	Sticker          string         `json:"sticker"`
 	Total            float64        `json:"total"`
+	Currency         string         `json:"currency"`
 	Pined            bool           `json:"pined"`
 	UserID           uuid.UUID      `json:"userId"`
 	TmId             float64        `gorm:"tId"`
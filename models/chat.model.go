@@ -7,6 +7,13 @@ import (
 	"gorm.io/datatypes"
 )
 
+// Roles of chat room members. Members of direct rooms are all members.
+const (
+	ChatRoleOwner  = "owner"
+	ChatRoleAdmin  = "admin"
+	ChatRoleMember = "member"
+)
+
 type ChatRoomMember struct {
 	ID                uint64 `gorm:"primaryKey"`
 	RoomID            uint64
@@ -17,18 +24,25 @@ type ChatRoomMember struct {
 	IsNew             bool      `gorm:"not null;default:false"`
 	JoinedAt          time.Time `gorm:"not null;default:now()"`
 	LastReadMessageID *uint64
-	IsUnread          bool `gorm:"not null;default:false"`
+	IsUnread          bool   `gorm:"not null;default:false"`
+	Role              string `gorm:"size:16;not null;default:'member'"`
 }
 
 type ChatRoom struct {
 	ID            uint64           `gorm:"primaryKey"`
 	Name          string           `gorm:"size:64;unique"`
 	Members       []ChatRoomMember `gorm:"foreignKey:RoomID"`
-	Version       uint64           `gorm:"default:0"`
+	Version       uint64           `gorm:"default:0"` // set by the database, see chatsync
 	CreatedAt     time.Time        `gorm:"not null;default:now()"`
 	BumpedAt      time.Time        `gorm:"not null;default:now()"`
 	LastMessageID *uint64
 	LastMessage   *ChatMessage `gorm:"foreignKey:LastMessageID"`
+	// Group rooms have a title and roles, direct rooms have two members
+	IsGroup    bool   `gorm:"not null;default:false"`
+	Title      string `gorm:"size:128"`
+	Avatar     string
+	OwnerID    *uuid.UUID
+	MaxMembers int `gorm:"not null;default:0"` // 0: the limit of the config
 }
 
 type ChatMessage struct {
@@ -46,7 +60,23 @@ type ChatMessage struct {
 	JsonData  *string    `gorm:"type:jsonb"`
 	// IsRead    bool       `gorm:"not null;default:false"`
 	ParentMessageID *uint64
-	ParentMessage   *ChatMessage `gorm:"foreignKey:ParentMessageID"`
+	ParentMessage   *ChatMessage     `gorm:"foreignKey:ParentMessageID"`
+	Attachments     []ChatAttachment `gorm:"foreignKey:MessageID"`
+	Version         uint64           `gorm:"not null;default:0;index"` // set by the database, see chatsync
+	PinnedAt        *time.Time
+	PinnedBy        *uuid.UUID
+	// A forwarded message points to the message it copies and its author
+	ForwardedFromID     *uint64
+	ForwardedFromUserID *uuid.UUID
+}
+
+// ChatReaction is an emoji a user put on a message, once per emoji.
+type ChatReaction struct {
+	ID        uint64    `gorm:"primaryKey"`
+	MessageID uint64    `gorm:"not null;uniqueIndex:idx_chat_reactions_message_user_emoji"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_chat_reactions_message_user_emoji"`
+	Emoji     string    `gorm:"type:varchar(32);not null;uniqueIndex:idx_chat_reactions_message_user_emoji"`
+	CreatedAt time.Time `gorm:"not null;default:now()"`
 }
 
 type ChatOutbox struct {
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ChatAttachment is a file, image or voice note uploaded to a room. It has
+// no message until the message that carries it is sent. Paths are relative
+// to CHAT_ATTACHMENTS_PATH and never leave the server.
+type ChatAttachment struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	RoomID    uint64    `gorm:"not null;index" json:"roomId"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"userId"`
+	MessageID *uint64   `gorm:"index" json:"messageId"`
+	Kind      string    `gorm:"type:varchar(16);not null" json:"kind"` // image, voice or file
+	Name      string    `gorm:"not null" json:"name"`                  // as uploaded
+	MimeType  string    `gorm:"not null" json:"mimeType"`
+	Size      int64     `gorm:"not null" json:"size"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Duration  float64   `json:"duration,omitempty"` // seconds, as measured by the recording client
+	Path      string    `gorm:"not null" json:"-"`
+	Thumbnail string    `json:"-"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
@@ -8,7 +8,7 @@ import (
 
 type Codes struct {
     ID        uint       `gorm:"primary_key"`
-    Code      string	 `gorm:"not null"`
+    Code      string	 `gorm:"not null;uniqueIndex"`
     Balance   string 	 `gorm:"not null"`
     UserId    uuid.UUID  `gorm:"not null"`
 	Activated bool		 `gorm:"not null"`
@@ -16,4 +16,40 @@ type Codes struct {
     Used 	  uint64  	 `gorm:"null"`
     UpdatedAt time.Time  `gorm:"not null"`
     DeletedAt *time.Time `gorm:"index"`
-}
\ No newline at end of file
+    // BatchID is empty for codes created before batches existed, those are
+    // single use.
+    BatchID     *uint64  `gorm:"index"`
+    Redemptions uint64   `gorm:"not null;default:0"`
+}
+
+// CodeBatch holds the rules shared by a set of generated codes.
+type CodeBatch struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	Name      string     `gorm:"not null;default:''" json:"name"`
+	Amount    float64    `gorm:"not null" json:"amount"`
+	Count     int        `gorm:"not null" json:"count"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	// MaxRedemptions is how many times each code of the batch can be used.
+	MaxRedemptions uint64 `gorm:"not null;default:1" json:"maxRedemptions"`
+	// PerUserLimit is how many codes of the batch one user can redeem, zero
+	// means no limit.
+	PerUserLimit uint64    `gorm:"not null;default:1" json:"perUserLimit"`
+	Active       bool      `gorm:"not null;default:true" json:"active"`
+	CreatedBy    uuid.UUID `gorm:"type:uuid;not null" json:"createdBy"`
+	CreatedAt    time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt    time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// CodeRedemption is the audit record of one code use and the balance
+// transaction it produced.
+type CodeRedemption struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	CodeID        uint      `gorm:"not null;index" json:"codeId"`
+	BatchID       *uint64   `gorm:"index" json:"batchId"`
+	UserID        uuid.UUID `gorm:"type:uuid;not null;index" json:"userId"`
+	Amount        float64   `gorm:"not null" json:"amount"`
+	PostingID     uint64    `gorm:"not null;uniqueIndex" json:"postingId"`
+	TransactionID uint64    `gorm:"not null" json:"transactionId"`
+	IP            string    `gorm:"not null;default:''" json:"ip"`
+	CreatedAt     time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// ExchangeRate is the value of one unit of a currency in the base currency
+// (rubles). The base currency itself has no row.
+type ExchangeRate struct {
+	Currency  string    `gorm:"primaryKey;size:3" json:"currency"`
+	Rate      float64   `gorm:"type:numeric(20,10);not null" json:"rate"`
+	Source    string    `gorm:"not null;default:admin" json:"source"` // file or admin
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// AccountDeletion is a pending request to delete an account. The account is
+// locked until ScheduledFor and then deleted for good, unless the request is
+// cancelled with the token from the email. Only the SHA-256 of the token is
+// stored.
+type AccountDeletion struct {
+	UserID       uuid.UUID `gorm:"type:uuid;primaryKey" json:"userId"`
+	RequestedAt  time.Time `gorm:"not null" json:"requestedAt"`
+	ScheduledFor time.Time `gorm:"not null;index" json:"scheduledFor"`
+	CancelHash   string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// UserIdentity links a user to an account at an OpenID or OAuth2 provider.
+// A user can sign in with several providers besides the password.
+type UserIdentity struct {
+	ID          uint64    `gorm:"primaryKey" json:"id"`
+	UserID      uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	Provider    string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_identity_subject" json:"provider"`
+	Subject     string    `gorm:"not null;uniqueIndex:idx_identity_subject" json:"-"`
+	Email       string    `gorm:"type:varchar(100)" json:"email"`
+	LastLoginAt time.Time `gorm:"not null;default:now()" json:"lastLoginAt"`
+	CreatedAt   time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
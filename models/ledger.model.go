@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// LedgerPosting groups the balanced entries of a single money movement.
+type LedgerPosting struct {
+	ID          uint64        `gorm:"primaryKey" json:"id"`
+	Module      string        `gorm:"not null" json:"module"`
+	ElementId   uint64        `gorm:"not null;default:0" json:"elementId"`
+	Description string        `gorm:"not null" json:"description"`
+	ReversalOf  *uint64       `gorm:"uniqueIndex" json:"reversalOf"` // posting cancelled by this one, at most once
+	Entries     []LedgerEntry `gorm:"foreignKey:PostingID" json:"entries"`
+	CreatedAt   time.Time     `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+// LedgerEntry is one side of a posting. Amount is stored in minor units of
+// Currency: positive values credit the account, negative values debit it.
+// The entries of a posting always sum to zero in each currency.
+type LedgerEntry struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	PostingID uint64     `gorm:"not null;index" json:"postingId"`
+	Account   string     `gorm:"not null;index" json:"account"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"userId"`
+	Amount    int64      `gorm:"not null" json:"amount"`
+	Currency  string     `gorm:"size:3;not null;default:RUB;index" json:"currency"`
+	CreatedAt time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+}
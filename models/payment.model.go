@@ -4,15 +4,61 @@ import (
 	"time"
 
 	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
 )
 
+// Amount and RefundedAmount are stored in kopecks, as sent by the provider.
 type Payments struct {
-	ID        uint64     `gorm:"primaryKey"`
-	UserID    uuid.UUID  `gorm:"type:uuid;not null"`
-	Amount    float64    `gorm:"not null"`
-	PaymentId string     `gorm:"not null"`
-	Status    string     `gorm:"not null"`
-	CreatedAt time.Time  `gorm:"autoCreateTime"`
-	UpdatedAt time.Time  `gorm:"autoUpdateTime"`
-	DeletedAt *time.Time `gorm:"index"`
+	ID             uint64     `gorm:"primaryKey"`
+	UserID         uuid.UUID  `gorm:"type:uuid;not null"`
+	Amount         float64    `gorm:"not null"`
+	RefundedAmount float64    `gorm:"not null;default:0"`
+	PaymentId      string     `gorm:"not null"`
+	Provider       string     `gorm:"not null;default:tinkoff"`
+	Status         string     `gorm:"not null"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime"`
+	DeletedAt      *time.Time `gorm:"index"`
 }
+
+const (
+	PaymentStatusNew             = "NEW"
+	PaymentStatusApplied         = "applied"
+	PaymentStatusRejected        = "rejected"
+	PaymentStatusCanceled        = "canceled"
+	PaymentStatusRefunded        = "refunded"
+	PaymentStatusPartialRefunded = "partial_refunded"
+)
+
+// PaymentWebhookEvent logs every verified provider callback. EventKey is
+// unique so a replayed callback is recognised and skipped.
+type PaymentWebhookEvent struct {
+	ID          uint64         `gorm:"primaryKey"`
+	EventKey    string         `gorm:"not null;uniqueIndex"`
+	Provider    string         `gorm:"not null;default:tinkoff"`
+	PaymentId   string         `gorm:"not null;index"`
+	Status      string         `gorm:"not null"`
+	Amount      uint64         `gorm:"not null;default:0"`
+	Payload     datatypes.JSON `gorm:"not null"`
+	ProcessedAt time.Time      `gorm:"not null;default:now()"`
+	CreatedAt   time.Time      `gorm:"not null;default:now()"`
+}
+
+// PaymentRefund is an admin refund of a payment. It is reserved before the
+// provider is asked to return the money and settled afterwards; a pending
+// refund counts as refunded for further refunds and callbacks.
+type PaymentRefund struct {
+	ID        uint64    `gorm:"primaryKey"`
+	PaymentID uint64    `gorm:"not null;index"`
+	Amount    uint64    `gorm:"not null"`
+	Status    string    `gorm:"not null;index"`
+	Error     string    `gorm:"not null;default:''"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+const (
+	PaymentRefundPending = "pending"
+	PaymentRefundSettled = "settled"
+	PaymentRefundFailed  = "failed"
+)
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Feeds a blog can be promoted in. ScopeID is the city or guild ID and zero
+// for the main feed.
+const (
+	PromotionScopeAll   = "all"
+	PromotionScopeCity  = "city"
+	PromotionScopeGuild = "guild"
+)
+
+const (
+	PromotionBidPending  = "pending"
+	PromotionBidWon      = "won"
+	PromotionBidLost     = "lost"
+	PromotionBidCanceled = "canceled"
+)
+
+// PromotionBid is an offer to pay for a top slot of a feed during one
+// window. While pending the bid amount is held from the owner's balance; the
+// auction releases the hold and charges winners the clearing price.
+type PromotionBid struct {
+	ID          uint64    `gorm:"primaryKey" json:"id"`
+	BlogID      uint64    `gorm:"not null;uniqueIndex:idx_promotion_bid_slot" json:"blogId"`
+	Blog        Blog      `gorm:"foreignKey:BlogID" json:"-"`
+	UserID      uuid.UUID `gorm:"type:uuid;not null;index" json:"userId"`
+	Scope       string    `gorm:"not null;uniqueIndex:idx_promotion_bid_slot;index:idx_promotion_bid_feed" json:"scope"`
+	ScopeID     uint64    `gorm:"not null;default:0;uniqueIndex:idx_promotion_bid_slot;index:idx_promotion_bid_feed" json:"scopeId"`
+	WindowStart time.Time `gorm:"not null;uniqueIndex:idx_promotion_bid_slot;index:idx_promotion_bid_feed" json:"windowStart"`
+	WindowEnd   time.Time `gorm:"not null" json:"windowEnd"`
+	Amount      float64   `gorm:"not null" json:"amount"`
+	// Price is what a winning bid was charged, Position its slot from 1.
+	Price     float64   `gorm:"not null;default:0" json:"price"`
+	Position  int       `gorm:"not null;default:0" json:"position"`
+	Status    string    `gorm:"not null;default:pending;index" json:"status"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// AccessRole is a role users are given through User.Role. What it allows is
+// listed in RolePermission.
+type AccessRole struct {
+	Name        string    `gorm:"type:varchar(50);primaryKey" json:"name"`
+	Description string    `json:"description"`
+	System      bool      `gorm:"not null;default:false" json:"system"` // seeded roles cannot be deleted
+	CreatedAt   time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt   time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+
+	Permissions []RolePermission `gorm:"foreignKey:Role;references:Name;constraint:OnDelete:CASCADE" json:"permissions"`
+}
+
+// RolePermission grants a named permission such as blog.publish to a role.
+type RolePermission struct {
+	Role       string `gorm:"type:varchar(50);primaryKey" json:"-"`
+	Permission string `gorm:"type:varchar(100);primaryKey" json:"permission"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// SecurityEvent is an audit record of sign in abuse, such as repeated
+// failed passwords, rate limited requests and account locks.
+type SecurityEvent struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	Kind      string     `gorm:"type:varchar(50);not null;index" json:"kind"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"userId"`
+	Email     string     `gorm:"type:varchar(100);index" json:"email"`
+	IP        string     `gorm:"type:varchar(64);index" json:"ip"`
+	Detail    string     `json:"detail"`
+	CreatedAt time.Time  `gorm:"not null;default:now();index" json:"createdAt"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SigningKey is an RSA key that signs access or refresh tokens. Tokens name
+// their key in the kid header, which is the RFC 7638 thumbprint of the
+// public key.
+type SigningKey struct {
+	KID         string     `gorm:"type:varchar(64);primaryKey" json:"kid"`
+	Use         string     `gorm:"type:varchar(16);not null;index" json:"use"`
+	Status      string     `gorm:"type:varchar(16);not null;index" json:"status"`
+	PrivateKey  string     `gorm:"type:text" json:"-"`
+	PublicKey   string     `gorm:"type:text;not null" json:"-"`
+	CreatedAt   time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	ActivatedAt *time.Time `json:"activatedAt"`
+	RetiredAt   *time.Time `json:"retiredAt"`
+}
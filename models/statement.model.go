@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// StatementSchedule subscribes a user to a monthly statement by email.
+// LastPeriod is the last month sent, as YYYY-MM.
+type StatementSchedule struct {
+	ID         uint64    `gorm:"primaryKey" json:"id"`
+	UserID     uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"userId"`
+	Format     string    `gorm:"not null;default:pdf" json:"format"`
+	Language   string    `gorm:"not null;default:ru" json:"language"`
+	LastPeriod string    `gorm:"not null;default:''" json:"lastPeriod"`
+	CreatedAt  time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt  time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+)
+
+// SubscriptionPlan is a purchasable plan. Name is what ends up in User.Plan.
+type SubscriptionPlan struct {
+	ID           uint64         `gorm:"primaryKey" json:"id"`
+	Name         string         `gorm:"not null;uniqueIndex" json:"name"`
+	Price        float64        `gorm:"not null;default:0" json:"price"`
+	PeriodDays   int            `gorm:"not null;default:31" json:"periodDays"`
+	LimitStorage int            `gorm:"not null;default:20" json:"limitStorage"`
+	Features     datatypes.JSON `gorm:"type:jsonb;not null;default:'{}'" json:"features"`
+	Active       bool           `gorm:"not null;default:true" json:"active"`
+	SortOrder    int            `gorm:"not null;default:0" json:"sortOrder"`
+	CreatedAt    time.Time      `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt    time.Time      `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+const (
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusGrace    = "grace"
+	SubscriptionStatusExpired  = "expired"
+	SubscriptionStatusCanceled = "canceled"
+)
+
+// Subscription is the current plan of a user. There is at most one per user.
+type Subscription struct {
+	ID                 uint64           `gorm:"primaryKey" json:"id"`
+	UserID             uuid.UUID        `gorm:"type:uuid;not null;uniqueIndex" json:"userId"`
+	PlanID             uint64           `gorm:"not null" json:"planId"`
+	Plan               SubscriptionPlan `gorm:"foreignKey:PlanID" json:"plan"`
+	Status             string           `gorm:"not null;default:active;index" json:"status"`
+	AutoRenew          bool             `gorm:"not null;default:true" json:"autoRenew"`
+	CurrentPeriodStart time.Time        `gorm:"not null" json:"currentPeriodStart"`
+	CurrentPeriodEnd   time.Time        `gorm:"not null;index" json:"currentPeriodEnd"`
+	GraceUntil         *time.Time       `json:"graceUntil"`
+	RenewalAttempts    int              `gorm:"not null;default:0" json:"renewalAttempts"`
+	LastAttemptAt      *time.Time       `json:"lastAttemptAt"`
+	CreatedAt          time.Time        `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt          time.Time        `gorm:"not null;default:now()" json:"updatedAt"`
+}
@@ -11,11 +11,20 @@ type Transaction struct {
 	UserID   	uuid.UUID     `gorm:"type:uuid;not null"`
     ElementId    uint64     `gorm:"not null"`
 	Module		string		`gorm:"not null"`
-	Amount    	float64       `gorm:"not null"`
+	Amount    	float64       `gorm:"not null"` // major units, kept for older readers
+	AmountMinor int64         `gorm:"not null;default:0"` // minor units of Currency
 	Description string        `gorm:"not null"` 
 	Type        string        `gorm:"not null"`    
 	Status       string        `gorm:"null"`    
 	Total       string        `gorm:"null"`    
+	PostingID   *uint64       `gorm:"index"`
+	EntryID     *uint64       `gorm:"index"` // the ledger entry this row describes
+	Currency    string        `gorm:"size:3;not null;default:RUB"`
+	// Set when the posting was in another currency than the wallet
+	OriginalAmount   float64  `gorm:"not null;default:0"`
+	OriginalAmountMinor int64 `gorm:"not null;default:0"`
+	OriginalCurrency string   `gorm:"size:3"`
+	Rate             float64  `gorm:"not null;default:1"`
 
 	CreatedAt time.Time `gorm:"not null;default:now()"`
 	UpdatedAt time.Time `gorm:"not null;default:now()"`
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// TwoFactor is the TOTP enrollment of a user. It exists with Enabled false
+// between setup and the first confirmed code.
+type TwoFactor struct {
+	UserID    uuid.UUID  `gorm:"type:uuid;primaryKey" json:"-"`
+	Secret    string     `gorm:"not null" json:"-"`
+	Enabled   bool       `gorm:"not null;default:false" json:"enabled"`
+	LastStep  int64      `gorm:"not null;default:0" json:"-"` // last accepted time step, codes cannot be replayed
+	EnabledAt *time.Time `json:"enabledAt"`
+	CreatedAt time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// RecoveryCode is a one time code that replaces a TOTP code. Only its
+// SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"-"`
+	Hash      string     `gorm:"not null;uniqueIndex" json:"-"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	WithdrawalRequested = "requested"
+	WithdrawalApproved  = "approved"
+	WithdrawalPaid      = "paid"
+	WithdrawalRejected  = "rejected"
+	WithdrawalFailed    = "failed"
+	WithdrawalCanceled  = "canceled"
+)
+
+// Withdrawal is a request to pay out part of the balance. Amount is held from
+// the balance while the request is open; Payout is what reaches the user
+// after the platform Commission.
+type Withdrawal struct {
+	ID          uint64     `gorm:"primaryKey" json:"id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	Amount      float64    `gorm:"not null" json:"amount"`
+	Commission  float64    `gorm:"not null;default:0" json:"commission"`
+	Payout      float64    `gorm:"not null" json:"payout"`
+	Destination string     `gorm:"not null" json:"destination"`
+	Status      string     `gorm:"not null;default:requested;index" json:"status"`
+	Comment     string     `gorm:"not null;default:''" json:"comment"`
+	Reference   string     `gorm:"not null;default:''" json:"reference"`
+	ProcessedBy *uuid.UUID `gorm:"type:uuid" json:"processedBy"`
+	ApprovedAt  *time.Time `json:"approvedAt"`
+	PaidAt      *time.Time `json:"paidAt"`
+	ClosedAt    *time.Time `json:"closedAt"`
+	CreatedAt   time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt   time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
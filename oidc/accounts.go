@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/utils"
+
+	"github.com/disintegration/imaging"
+	"gorm.io/gorm"
+)
+
+const (
+	avatarName     = "avatar.jpg"
+	maxAvatarBytes = 5 << 20
+)
+
+var (
+	ErrNoEmail          = errors.New("provider did not share an email")
+	ErrEmailNotVerified = errors.New("provider email is not verified")
+)
+
+var nameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Resolve finds the user of an identity. An identity seen before signs in
+// its user; otherwise it is linked to the user with the same email, or a new
+// verified user is created. created tells the two last cases apart.
+func Resolve(db *gorm.DB, config *initializers.Config, identity *Identity) (user *models.User, created bool, err error) {
+	var known models.UserIdentity
+	err = db.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&known).Error
+	if err == nil {
+		user = &models.User{}
+		if err := db.First(user, "id = ?", known.UserID).Error; err != nil {
+			return nil, false, err
+		}
+		db.Model(&known).Updates(map[string]interface{}{"last_login_at": time.Now(), "email": identity.Email})
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	if identity.Email == "" {
+		return nil, false, ErrNoEmail
+	}
+	if !identity.EmailVerified {
+		return nil, false, ErrEmailNotVerified
+	}
+
+	user = &models.User{}
+	err = db.Where("email = ?", identity.Email).First(user).Error
+	switch {
+	case err == nil:
+		return user, false, link(db, config, user, identity)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		user, err = create(db, config, identity)
+		return user, err == nil, err
+	}
+	return nil, false, err
+}
+
+// link attaches an identity to an existing user. The provider vouched for
+// the email, so an unverified account becomes verified. Whoever registered
+// it never proved to own the address, so its password is replaced and its
+// sessions are revoked; the owner sets a password with a password reset.
+func link(db *gorm.DB, config *initializers.Config, user *models.User, identity *Identity) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+		}).Error; err != nil {
+			return err
+		}
+		if user.Verified {
+			return nil
+		}
+
+		// Revoked before the account changes, a failure leaves it as it was
+		if err := sessions.RevokeAll(context.Background(), user.ID.String(), ""); err != nil {
+			return err
+		}
+		password, err := utils.RandomPasswordHash()
+		if err != nil {
+			return err
+		}
+		user.Verified = true
+		user.VerificationCode = ""
+		user.Password = password
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"verified":          true,
+			"verification_code": "",
+			"password":          password,
+		}).Error; err != nil {
+			return err
+		}
+		var profiles int64
+		tx.Model(&models.Profile{}).Where("user_id = ?", user.ID).Count(&profiles)
+		if profiles == 0 {
+			return tx.Create(&models.Profile{UserID: user.ID}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(user.Photo, "/default.jpg") && identity.Picture != "" {
+		if err := importPicture(config, user.Storage, identity.Picture); err == nil {
+			user.Photo = user.Storage + "/" + avatarName
+			db.Model(user).Update("photo", user.Photo)
+		}
+	}
+	return nil
+}
+
+// create registers a user the way SignUpUser does, already verified and
+// with a random password that can be replaced with a password reset.
+func create(db *gorm.DB, config *initializers.Config, identity *Identity) (*models.User, error) {
+	hashedPassword, err := utils.RandomPasswordHash()
+	if err != nil {
+		return nil, err
+	}
+
+	dirName := utils.GenerateUniqueDirName()
+	if err := os.MkdirAll(filepath.Join(config.IMGStorePath, dirName), 0755); err != nil {
+		return nil, err
+	}
+	photo := dirName + "/default.jpg"
+	if identity.Picture != "" && importPicture(config, dirName, identity.Picture) == nil {
+		photo = dirName + "/" + avatarName
+	} else if err := copyDefaultPhoto(config, dirName); err != nil {
+		return nil, err
+	}
+
+	name, err := uniqueName(db, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Name:     name,
+		Email:    identity.Email,
+		Storage:  dirName,
+		Password: hashedPassword,
+		Photo:    photo,
+		Provider: identity.Provider,
+		Verified: true,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.OnlineStorage{
+			UserID: user.ID,
+			Year:   time.Now().Year(),
+			Data:   []byte("[]"),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.Profile{UserID: user.ID}).Error; err != nil {
+			return err
+		}
+		_, err := ledger.Credit(tx, user.ID, ledger.AccountBonus, 100, ledger.Posting{
+			Module:      `Registration`,
+			Description: `Бонус за регистрацию`,
+			Status:      `CLOSED_1`,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// uniqueName makes a user name from the email, names double as subdomains
+// so only lowercase letters, digits and dashes are kept.
+func uniqueName(db *gorm.DB, identity *Identity) (string, error) {
+	base := strings.SplitN(identity.Email, "@", 2)[0]
+	base = strings.Trim(nameChars.ReplaceAllString(strings.ToLower(base), "-"), "-")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if len(base) < 2 {
+		base = "user"
+	}
+
+	name := base
+	for i := 0; i < 5; i++ {
+		var count int64
+		if err := db.Model(&models.User{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return name, nil
+		}
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		name = base + "-" + hex.EncodeToString(suffix)
+	}
+	return "", fmt.Errorf("oidc: no free user name for %q", base)
+}
+
+// importPicture downloads the provider photo into the storage directory,
+// re-encoded so only a real image is kept.
+func importPicture(config *initializers.Config, dirName, pictureURL string) error {
+	if !strings.HasPrefix(pictureURL, "https://") && !strings.HasPrefix(pictureURL, "http://") {
+		return fmt.Errorf("oidc: unsupported picture URL %q", pictureURL)
+	}
+	resp, err := httpClient.Get(pictureURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: picture returned %d", resp.StatusCode)
+	}
+
+	img, err := imaging.Decode(io.LimitReader(resp.Body, maxAvatarBytes))
+	if err != nil {
+		return err
+	}
+	img = imaging.Fit(img, 800, 600, imaging.Lanczos)
+	return imaging.Save(img, filepath.Join(config.IMGStorePath, dirName, avatarName))
+}
+
+func copyDefaultPhoto(config *initializers.Config, dirName string) error {
+	src, err := os.Open(filepath.Join(config.IMGStorePath, "default.jpg"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filepath.Join(config.IMGStorePath, dirName, "default.jpg"))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
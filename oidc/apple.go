@@ -0,0 +1,32 @@
+package oidc
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// appleSecretLifetime is well under the six months Apple allows.
+const appleSecretLifetime = time.Hour
+
+// AppleClientSecret signs the ES256 client secret Apple expects instead of
+// a static one, using the .p8 key of the developer account.
+func AppleClientSecret(teamID, keyID, clientID, privateKeyPEM string) func() (string, error) {
+	return func() (string, error) {
+		key, err := jwt.ParseECPrivateKeyFromPEM([]byte(privateKeyPEM))
+		if err != nil {
+			return "", err
+		}
+
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+			Issuer:    teamID,
+			Subject:   clientID,
+			Audience:  jwt.ClaimStrings{"https://appleid.apple.com"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(appleSecretLifetime)),
+		})
+		token.Header["kid"] = keyID
+		return token.SignedString(key)
+	}
+}
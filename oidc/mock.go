@@ -0,0 +1,216 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// MockClientID is the client the mock issuer expects when none is set.
+const MockClientID = "hyperpage"
+
+const mockKeyID = "mock"
+
+// MockIssuer is a small OpenID provider for local development and tests.
+// It signs in whoever is named by the login_hint of the authorization
+// request without asking, so it must never be reachable in production.
+//
+//	mock, _ := oidc.NewMockIssuer("", oidc.MockClientID)
+//	srv := httptest.NewServer(mock)
+//	mock.Issuer = srv.URL
+type MockIssuer struct {
+	Issuer   string
+	ClientID string
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]mockGrant
+	access map[string]Identity
+}
+
+type mockGrant struct {
+	identity    Identity
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// NewMockIssuer creates an issuer with a fresh signing key.
+func NewMockIssuer(issuer, clientID string) (*MockIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockIssuer{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		ClientID: clientID,
+		key:      key,
+		codes:    map[string]mockGrant{},
+		access:   map[string]Identity{},
+	}, nil
+}
+
+// MockIdentity is the identity the mock issuer gives an email. The subject
+// is stable, so signing in twice finds the same account.
+func MockIdentity(email string) Identity {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		email = "user@example.com"
+	}
+	sum := sha256.Sum256([]byte(email))
+	return Identity{
+		Provider:      Mock,
+		Subject:       hex.EncodeToString(sum[:8]),
+		Email:         email,
+		EmailVerified: true,
+		Name:          strings.SplitN(email, "@", 2)[0],
+	}
+}
+
+// IDToken signs an ID token the way the token endpoint does, for testing
+// the native sign in without a browser.
+func (m *MockIssuer) IDToken(identity Identity, nonce string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.Issuer,
+		"aud":            m.ClientID,
+		"sub":            identity.Subject,
+		"email":          identity.Email,
+		"email_verified": identity.EmailVerified,
+		"name":           identity.Name,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if identity.Picture != "" {
+		claims["picture"] = identity.Picture
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mockKeyID
+	return token.SignedString(m.key)
+}
+
+func (m *MockIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.Issuer,
+			"authorization_endpoint":                m.Issuer + "/authorize",
+			"token_endpoint":                        m.Issuer + "/token",
+			"userinfo_endpoint":                     m.Issuer + "/userinfo",
+			"jwks_uri":                              m.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	case "/jwks":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []JWK{RSAKey(mockKeyID, &m.key.PublicKey)}})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	case "/userinfo":
+		m.userInfo(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" || q.Get("client_id") != m.ClientID {
+		http.Error(w, "invalid client or redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code, err := NewVerifier()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockGrant{
+		identity:    MockIdentity(q.Get("login_hint")),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	m.mu.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", q.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *MockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("client_id") != m.ClientID || r.PostForm.Get("redirect_uri") != grant.redirectURI ||
+		grant.challenge != "" && base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := m.IDToken(grant.identity, grant.nonce)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	accessToken, err := NewVerifier()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	m.mu.Lock()
+	m.access[accessToken] = grant.identity
+	m.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, Token{AccessToken: accessToken, IDToken: idToken, TokenType: "Bearer"})
+}
+
+func (m *MockIssuer) userInfo(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	identity, ok := m.access[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	m.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":            identity.Subject,
+		"email":          identity.Email,
+		"email_verified": identity.EmailVerified,
+		"name":           identity.Name,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,383 @@
+// Package oidc signs users in with OpenID Connect and plain OAuth2 providers
+// such as Google, Yandex and Apple. Providers are registered by name, see
+// FromConfig.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown sign in provider")
+	ErrInvalidToken    = errors.New("invalid identity token")
+	ErrInvalidState    = errors.New("sign in state is invalid or expired")
+)
+
+// Provider is one identity provider. OIDC providers only need Issuer, the
+// endpoints are discovered; OAuth2 providers list them and map their user
+// info with UserInfoMapper.
+type Provider struct {
+	Name     string
+	Issuer   string
+	ClientID string
+	// ClientSecret is static, ClientSecretFunc builds it per request for
+	// providers such as Apple that want a signed secret.
+	ClientSecret     string
+	ClientSecretFunc func() (string, error)
+	// Audiences accepted in ID tokens besides ClientID, such as the iOS
+	// bundle ID of native Apple sign in.
+	Audiences []string
+	Scopes    []string
+	// AuthParams are added to the authorization URL.
+	AuthParams map[string]string
+
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	JWKSURL     string
+	// UserInfoScheme is the Authorization scheme of user info requests,
+	// Bearer when empty.
+	UserInfoScheme string
+	UserInfoMapper func(map[string]interface{}) *Identity
+
+	// mu guards discovery, which fills the endpoints and keys once; they
+	// are read without it after Get returned.
+	mu         sync.Mutex
+	discovered bool
+	keys       *keySet
+}
+
+// Identity is the user as the provider knows them.
+type Identity struct {
+	Provider      string `json:"provider"`
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+}
+
+// Token is the answer of the token endpoint.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]*Provider{}
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Register makes a provider available under its name.
+func Register(p *Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name] = p
+}
+
+// Get returns a registered provider with its endpoints discovered.
+func Get(ctx context.Context, name string) (*Provider, error) {
+	providersMu.RLock()
+	p, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Names lists the registered providers.
+func Names() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// discover reads the OpenID configuration of the issuer once. A failed
+// discovery changes nothing and is retried on the next call.
+func (p *Provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered {
+		return nil
+	}
+
+	if p.Issuer != "" && (p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "") {
+		var doc struct {
+			Issuer                string `json:"issuer"`
+			AuthorizationEndpoint string `json:"authorization_endpoint"`
+			TokenEndpoint         string `json:"token_endpoint"`
+			UserinfoEndpoint      string `json:"userinfo_endpoint"`
+			JWKSURI               string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+			return err
+		}
+		if doc.Issuer != p.Issuer {
+			return fmt.Errorf("oidc: issuer %q does not match %q", doc.Issuer, p.Issuer)
+		}
+		p.AuthURL = firstSet(p.AuthURL, doc.AuthorizationEndpoint)
+		p.TokenURL = firstSet(p.TokenURL, doc.TokenEndpoint)
+		p.UserInfoURL = firstSet(p.UserInfoURL, doc.UserinfoEndpoint)
+		p.JWKSURL = firstSet(p.JWKSURL, doc.JWKSURI)
+	}
+	p.ensureKeys()
+	p.discovered = true
+	return nil
+}
+
+func (p *Provider) ensureKeys() {
+	if p.keys == nil && p.JWKSURL != "" {
+		p.keys = &keySet{url: p.JWKSURL}
+	}
+}
+
+// AuthCodeURL is where the browser is sent to sign in. The PKCE challenge is
+// derived from verifier.
+func (p *Provider) AuthCodeURL(redirectURL, state, nonce, verifier string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("scope", strings.Join(p.Scopes, " "))
+	v.Set("state", state)
+	if p.Issuer != "" {
+		v.Set("nonce", nonce)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	v.Set("code_challenge_method", "S256")
+	for k, value := range p.AuthParams {
+		v.Set(k, value)
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, redirectURL, verifier string) (*Token, error) {
+	secret := p.ClientSecret
+	if p.ClientSecretFunc != nil {
+		var err error
+		if secret, err = p.ClientSecretFunc(); err != nil {
+			return nil, err
+		}
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", secret)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var token Token
+	if err := doJSON(req, &token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" && token.IDToken == "" {
+		return nil, ErrInvalidToken
+	}
+	return &token, nil
+}
+
+// Identify returns the identity behind tokens from Exchange, from the ID
+// token when the provider sent one and from user info otherwise.
+func (p *Provider) Identify(ctx context.Context, token *Token, nonce string) (*Identity, error) {
+	if token.IDToken != "" && p.keys != nil {
+		return p.VerifyIDToken(ctx, token.IDToken, nonce)
+	}
+	return p.UserInfo(ctx, token.AccessToken)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, lifetime and nonce
+// of an ID token. An empty nonce is not checked, native sign in on iOS
+// passes one only when the app asked for it.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Identity, error) {
+	if p.keys == nil {
+		return nil, ErrInvalidToken
+	}
+
+	parsed, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256", "ES256"}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	audienceOK := false
+	for _, aud := range append([]string{p.ClientID}, p.Audiences...) {
+		if aud != "" && claims.VerifyAudience(aud, true) {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+	if nonce != "" && claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidToken)
+	}
+
+	identity := &Identity{
+		Provider:      p.Name,
+		Subject:       claimString(claims, "sub"),
+		Email:         strings.ToLower(claimString(claims, "email")),
+		EmailVerified: claimBool(claims, "email_verified"),
+		Name:          claimString(claims, "name"),
+		Picture:       claimString(claims, "picture"),
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return identity, nil
+}
+
+// UserInfo asks the provider who owns an access token.
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (*Identity, error) {
+	if p.UserInfoURL == "" || accessToken == "" {
+		return nil, ErrInvalidToken
+	}
+
+	scheme := p.UserInfoScheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+	var info map[string]interface{}
+	if err := getJSON(ctx, p.UserInfoURL, scheme+" "+accessToken, &info); err != nil {
+		return nil, err
+	}
+
+	var identity *Identity
+	if p.UserInfoMapper != nil {
+		identity = p.UserInfoMapper(info)
+	} else {
+		identity = &Identity{
+			Subject:       claimString(info, "sub"),
+			Email:         claimString(info, "email"),
+			EmailVerified: claimBool(info, "email_verified"),
+			Name:          claimString(info, "name"),
+			Picture:       claimString(info, "picture"),
+		}
+	}
+	if identity == nil || identity.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	identity.Provider = p.Name
+	identity.Email = strings.ToLower(identity.Email)
+	return identity, nil
+}
+
+// NewVerifier returns a random string for state, nonce and PKCE values.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getJSON(ctx context.Context, u, authorization string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return doJSON(req, out)
+}
+
+func doJSON(req *http.Request, out interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %d: %s", req.URL.Host, resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// claimBool reads a boolean claim. Apple sends booleans as strings.
+func claimBool(claims map[string]interface{}, name string) bool {
+	switch v := claims[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
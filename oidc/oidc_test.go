@@ -0,0 +1,254 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/sessions"
+	"hyperpage/testdb"
+	"hyperpage/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testRedirectURL = "https://app.example.com/oidc/callback"
+
+// newTestIssuer serves a mock issuer and registers a provider that
+// discovers it.
+func newTestIssuer(t *testing.T) *MockIssuer {
+	mock, err := NewMockIssuer("", MockClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	mock.Issuer = srv.URL
+
+	Register(&Provider{
+		Name:     Mock,
+		Issuer:   srv.URL,
+		ClientID: MockClientID,
+		Scopes:   []string{"openid", "email", "profile"},
+	})
+	return mock
+}
+
+// authorize signs email in at the provider the way the browser does and
+// returns the code and state of the redirect back.
+func authorize(t *testing.T, authURL, email string) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL + "&login_hint=" + url.QueryEscape(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize = %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+// begin starts a sign in and returns the provider with the redirect the
+// browser comes back with.
+func begin(t *testing.T, email string) (p *Provider, code, state string) {
+	t.Helper()
+	ctx := context.Background()
+	p, err := Get(ctx, Mock)
+	if err != nil {
+		t.Fatalf("get provider: %v", err)
+	}
+	authURL, err := Begin(ctx, p, testRedirectURL, "ws-session")
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	code, state = authorize(t, authURL, email)
+	return p, code, state
+}
+
+// callback finishes a sign in the way OIDCCallback does.
+func callback(ctx context.Context, code, state string) (*Identity, error) {
+	st, err := TakeState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Get(ctx, st.Provider)
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.Exchange(ctx, code, testRedirectURL, st.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	return p.Identify(ctx, token, st.Nonce)
+}
+
+func TestSignInFlow(t *testing.T) {
+	testdb.Redis(t)
+	newTestIssuer(t)
+	ctx := context.Background()
+
+	_, code, state := begin(t, "Alice@Example.com")
+	identity, err := callback(ctx, code, state)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	want := MockIdentity("alice@example.com")
+	if *identity != want {
+		t.Fatalf("identity = %+v, want %+v", *identity, want)
+	}
+
+	// The state is used up by the first callback
+	if _, err := callback(ctx, code, state); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("replayed state: err = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestSignInStateMismatch(t *testing.T) {
+	testdb.Redis(t)
+	newTestIssuer(t)
+	ctx := context.Background()
+
+	_, code, _ := begin(t, "alice@example.com")
+	if _, err := callback(ctx, code, "forged"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("forged state: err = %v, want ErrInvalidState", err)
+	}
+	if _, err := callback(ctx, code, ""); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("empty state: err = %v, want ErrInvalidState", err)
+	}
+
+	// A state that expired is gone as well
+	server := testdb.Redis(t)
+	_, code, state := begin(t, "alice@example.com")
+	server.FastForward(StateTTL + time.Second)
+	if _, err := callback(ctx, code, state); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expired state: err = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestSignInNonceMismatch(t *testing.T) {
+	testdb.Redis(t)
+	newTestIssuer(t)
+	ctx := context.Background()
+
+	p, code, state := begin(t, "alice@example.com")
+	st, err := TakeState(ctx, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := p.Exchange(ctx, code, testRedirectURL, st.Verifier)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	// An ID token issued for another sign in
+	if _, err := p.Identify(ctx, token, "other-nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("wrong nonce: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := p.Identify(ctx, token, st.Nonce); err != nil {
+		t.Fatalf("right nonce: %v", err)
+	}
+}
+
+func TestSignInPKCEMismatch(t *testing.T) {
+	testdb.Redis(t)
+	newTestIssuer(t)
+	ctx := context.Background()
+
+	p, code, state := begin(t, "alice@example.com")
+	if _, err := TakeState(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	// A stolen code is useless without the verifier of its sign in
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, code, testRedirectURL, verifier); err == nil {
+		t.Fatal("exchange succeeded with the wrong verifier")
+	}
+}
+
+func TestSignInLinksUnverifiedAccount(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.Profile{}, &models.UserIdentity{})
+	testdb.Redis(t)
+	newTestIssuer(t)
+	ctx := context.Background()
+
+	// Somebody registered the address first and never verified it
+	password, err := bcrypt.GenerateFromPassword([]byte("squatter-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	squatted := &models.User{
+		Name:             "squatter",
+		Email:            "alice@example.com",
+		Password:         string(password),
+		VerificationCode: "code",
+		Storage:          "squatter",
+		Photo:            "squatter/default.jpg",
+	}
+	if err := db.Create(squatted).Error; err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+	access := &utils.TokenDetails{TokenUuid: "access", ExpiresIn: &expires}
+	refresh := &utils.TokenDetails{TokenUuid: "refresh", ExpiresIn: &expires}
+	if _, err := sessions.Create(ctx, squatted.ID.String(), "browser", "198.51.100.7", access, refresh); err != nil {
+		t.Fatal(err)
+	}
+
+	_, code, state := begin(t, "alice@example.com")
+	identity, err := callback(ctx, code, state)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	user, created, err := Resolve(db, &initializers.Config{}, identity)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if created || user.ID != squatted.ID {
+		t.Fatalf("resolve created %v user %s, want the existing %s", created, user.ID, squatted.ID)
+	}
+
+	var stored models.User
+	if err := db.First(&stored, "id = ?", squatted.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Verified || stored.VerificationCode != "" {
+		t.Fatalf("verified %v, verification code %q", stored.Verified, stored.VerificationCode)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("squatter-password")) == nil {
+		t.Fatal("the registrant's password still signs in")
+	}
+	if list, err := sessions.List(ctx, squatted.ID.String()); err != nil || len(list) != 0 {
+		t.Fatalf("sessions = %v, %v, want none", list, err)
+	}
+	var linked models.UserIdentity
+	if err := db.Where("provider = ? AND subject = ?", Mock, identity.Subject).First(&linked).Error; err != nil || linked.UserID != squatted.ID {
+		t.Fatalf("identity link = %+v, %v", linked, err)
+	}
+
+	// The next sign in finds the account through the identity
+	_, code, state = begin(t, "alice@example.com")
+	if identity, err = callback(ctx, code, state); err != nil {
+		t.Fatalf("second callback: %v", err)
+	}
+	if user, created, err = Resolve(db, &initializers.Config{}, identity); err != nil || created || user.ID != squatted.ID {
+		t.Fatalf("second resolve = %v, %v, %v", user, created, err)
+	}
+}
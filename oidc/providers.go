@@ -0,0 +1,90 @@
+package oidc
+
+import (
+	"fmt"
+	"strings"
+
+	"hyperpage/initializers"
+)
+
+const (
+	Google = "google"
+	Yandex = "yandex"
+	Apple  = "apple"
+	Mock   = "mock"
+)
+
+// FromConfig registers every provider that has a client ID configured.
+func FromConfig(config *initializers.Config) {
+	if config.GoogleClientID != "" {
+		Register(&Provider{
+			Name:         Google,
+			Issuer:       "https://accounts.google.com",
+			ClientID:     config.GoogleClientID,
+			ClientSecret: config.GoogleClientSecret,
+			Scopes:       []string{"openid", "email", "profile"},
+		})
+	}
+
+	if config.YandexClientID != "" {
+		Register(&Provider{
+			Name:           Yandex,
+			ClientID:       config.YandexClientID,
+			ClientSecret:   config.YandexClientSecret,
+			Scopes:         []string{"login:email", "login:info", "login:avatar"},
+			AuthURL:        "https://oauth.yandex.ru/authorize",
+			TokenURL:       "https://oauth.yandex.ru/token",
+			UserInfoURL:    "https://login.yandex.ru/info?format=json",
+			UserInfoScheme: "OAuth",
+			UserInfoMapper: yandexIdentity,
+		})
+	}
+
+	if config.AppleClientID != "" {
+		var audiences []string
+		if config.AppleBundleID != "" {
+			audiences = append(audiences, config.AppleBundleID)
+		}
+		Register(&Provider{
+			Name:             Apple,
+			Issuer:           "https://appleid.apple.com",
+			ClientID:         config.AppleClientID,
+			ClientSecretFunc: AppleClientSecret(config.AppleTeamID, config.AppleKeyID, config.AppleClientID, config.ApplePrivateKey),
+			Audiences:        audiences,
+			Scopes:           []string{"openid", "email", "name"},
+			// Apple posts the result when name or email are asked for.
+			AuthParams: map[string]string{"response_mode": "form_post"},
+		})
+	}
+
+	if config.OIDCMockIssuer != "" {
+		clientID := config.OIDCMockClientID
+		if clientID == "" {
+			clientID = MockClientID
+		}
+		Register(&Provider{
+			Name:     Mock,
+			Issuer:   config.OIDCMockIssuer,
+			ClientID: clientID,
+			Scopes:   []string{"openid", "email", "profile"},
+		})
+	}
+}
+
+// yandexIdentity maps the Yandex ID user info. Yandex checks the addresses
+// it gives out, so the default email counts as verified.
+func yandexIdentity(info map[string]interface{}) *Identity {
+	identity := &Identity{
+		Subject:       claimString(info, "id"),
+		Email:         claimString(info, "default_email"),
+		EmailVerified: claimString(info, "default_email") != "",
+		Name:          strings.TrimSpace(claimString(info, "real_name")),
+	}
+	if identity.Name == "" {
+		identity.Name = claimString(info, "login")
+	}
+	if avatar := claimString(info, "default_avatar_id"); avatar != "" && !claimBool(info, "is_avatar_empty") {
+		identity.Picture = fmt.Sprintf("https://avatars.yandex.net/get-yapic/%s/islands-200", avatar)
+	}
+	return identity
+}
@@ -0,0 +1,70 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StateTTL is how long the user has to come back from the provider.
+const StateTTL = 10 * time.Minute
+
+// State is a sign in that went to the provider, keyed by the state
+// parameter of the authorization URL.
+type State struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Session  string `json:"session"` // the websocket session given at sign in
+}
+
+func stateKey(state string) string { return "oidc_state:" + state }
+
+// Begin stores a new sign in and returns the URL to send the browser to.
+func Begin(ctx context.Context, p *Provider, redirectURL, session string) (string, error) {
+	state, err := NewVerifier()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := NewVerifier()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := NewVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(State{Provider: p.Name, Nonce: nonce, Verifier: verifier, Session: session})
+	if err != nil {
+		return "", err
+	}
+	if err := initializers.RedisClient.Set(ctx, stateKey(state), data, StateTTL).Err(); err != nil {
+		return "", err
+	}
+	return p.AuthCodeURL(redirectURL, state, nonce, verifier), nil
+}
+
+// TakeState returns a stored sign in once, a replayed state is invalid.
+func TakeState(ctx context.Context, state string) (*State, error) {
+	if state == "" {
+		return nil, ErrInvalidState
+	}
+	data, err := initializers.RedisClient.GetDel(ctx, stateKey(state)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
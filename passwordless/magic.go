@@ -0,0 +1,57 @@
+// Package passwordless signs users in without a password: with a link sent
+// to their email, or with the Telegram Login Widget for accounts activated
+// through the bot.
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MagicLinkTTL is how long a sign in link works.
+const MagicLinkTTL = 15 * time.Minute
+
+var ErrInvalidLink = errors.New("sign in link is invalid or expired")
+
+// Only the hash of a token is stored, a Redis dump does not sign anybody in.
+func magicKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "magic_link:" + hex.EncodeToString(sum[:])
+}
+
+// NewMagicLink returns a single use token that signs the user in.
+func NewMagicLink(ctx context.Context, userID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := initializers.RedisClient.Set(ctx, magicKey(token), userID, MagicLinkTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UseMagicLink returns the user of a token and spends it.
+func UseMagicLink(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidLink
+	}
+	userID, err := initializers.RedisClient.GetDel(ctx, magicKey(token)).Result()
+	if err == redis.Nil {
+		return "", ErrInvalidLink
+	}
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
@@ -0,0 +1,82 @@
+package passwordless
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TelegramLoginMaxAge is how old widget data may be, older data could be
+// replayed.
+const TelegramLoginMaxAge = time.Hour
+
+var (
+	ErrInvalidTelegramLogin = errors.New("telegram login data is invalid")
+	ErrTelegramLoginExpired = errors.New("telegram login data has expired")
+)
+
+// TelegramLogin is what the Telegram Login Widget reports.
+type TelegramLogin struct {
+	ID        int64
+	Username  string
+	FirstName string
+	LastName  string
+	PhotoURL  string
+	AuthDate  time.Time
+}
+
+// VerifyTelegramLogin checks the widget fields against their hash, an
+// HMAC-SHA-256 keyed with the SHA-256 of the bot token over the other fields
+// sorted as key=value lines.
+func VerifyTelegramLogin(botToken string, fields map[string]string, now time.Time) (*TelegramLogin, error) {
+	hash := fields["hash"]
+	if hash == "" || botToken == "" {
+		return nil, ErrInvalidTelegramLogin
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k != "hash" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k + "=" + fields[k]
+	}
+
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(hash))) {
+		return nil, ErrInvalidTelegramLogin
+	}
+
+	id, err := strconv.ParseInt(fields["id"], 10, 64)
+	if err != nil || id == 0 {
+		return nil, ErrInvalidTelegramLogin
+	}
+	authDate, err := strconv.ParseInt(fields["auth_date"], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidTelegramLogin
+	}
+	login := &TelegramLogin{
+		ID:        id,
+		Username:  fields["username"],
+		FirstName: fields["first_name"],
+		LastName:  fields["last_name"],
+		PhotoURL:  fields["photo_url"],
+		AuthDate:  time.Unix(authDate, 0),
+	}
+	if now.Sub(login.AuthDate) > TelegramLoginMaxAge || login.AuthDate.After(now.Add(time.Minute)) {
+		return nil, ErrTelegramLoginExpired
+	}
+	return login, nil
+}
@@ -0,0 +1,128 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// FakeProvider is an in-memory provider for tests and local development. Its
+// callbacks are plain JSON bodies built with Callback.
+type FakeProvider struct {
+	mu       sync.Mutex
+	next     uint64
+	payments map[string]*fakePayment
+}
+
+type fakePayment struct {
+	amount   uint64
+	refunded uint64
+	status   string
+}
+
+type fakeCallback struct {
+	PaymentID string `json:"PaymentId"`
+	Status    string `json:"Status"`
+	Amount    uint64 `json:"Amount"`
+}
+
+var ErrFakePaymentNotFound = errors.New("fake payment not found")
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{payments: map[string]*fakePayment{}}
+}
+
+func (p *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+func (p *FakeProvider) CreateInvoice(req InvoiceRequest) (*Invoice, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	id := strconv.FormatUint(p.next, 10)
+	p.payments[id] = &fakePayment{amount: req.Amount, status: StatusPending}
+
+	return &Invoice{
+		PaymentID:  id,
+		PaymentURL: "https://pay.fake/" + id,
+		Amount:     req.Amount,
+		OrderID:    req.OrderID,
+	}, nil
+}
+
+func (p *FakeProvider) VerifyCallback(body []byte) (*Callback, error) {
+	var cb fakeCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.payments[cb.PaymentID]; !ok {
+		return nil, ErrFakePaymentNotFound
+	}
+
+	return &Callback{
+		PaymentID: cb.PaymentID,
+		Status:    cb.Status,
+		Amount:    cb.Amount,
+		Raw:       body,
+	}, nil
+}
+
+func (p *FakeProvider) GetStatus(paymentID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return "", ErrFakePaymentNotFound
+	}
+	return payment.status, nil
+}
+
+func (p *FakeProvider) Refund(paymentID string, amount uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return ErrFakePaymentNotFound
+	}
+	if payment.status != StatusConfirmed && payment.status != StatusPartialRefunded {
+		return errors.New("fake payment is not confirmed")
+	}
+	if payment.refunded+amount > payment.amount {
+		return errors.New("refund exceeds payment amount")
+	}
+
+	payment.refunded += amount
+	if payment.refunded == payment.amount {
+		payment.status = StatusRefunded
+	} else {
+		payment.status = StatusPartialRefunded
+	}
+	return nil
+}
+
+// SetStatus moves a fake payment to a new status and returns the callback
+// body the provider would send for it.
+func (p *FakeProvider) SetStatus(paymentID, status string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return nil, ErrFakePaymentNotFound
+	}
+	payment.status = status
+
+	return json.Marshal(fakeCallback{
+		PaymentID: paymentID,
+		Status:    status,
+		Amount:    payment.amount - payment.refunded,
+	})
+}
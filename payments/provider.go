@@ -0,0 +1,104 @@
+package payments
+
+import (
+	"errors"
+	"sync"
+
+	"hyperpage/initializers"
+)
+
+// Names of the supported providers, stored in models.Payments.Provider.
+const (
+	ProviderTinkoff  = "tinkoff"
+	ProviderYooKassa = "yookassa"
+	ProviderFake     = "fake"
+)
+
+// Provider independent payment statuses reported by callbacks.
+const (
+	StatusPending         = "PENDING"
+	StatusConfirmed       = "CONFIRMED"
+	StatusRejected        = "REJECTED"
+	StatusCanceled        = "CANCELED"
+	StatusRefunded        = "REFUNDED"
+	StatusPartialRefunded = "PARTIAL_REFUNDED"
+)
+
+var ErrUnknownProvider = errors.New("unknown payment provider")
+
+// InvoiceRequest describes a balance top up. Amount is in kopecks.
+type InvoiceRequest struct {
+	Amount      uint64
+	OrderID     string
+	CustomerKey string
+	Email       string
+	Description string
+}
+
+// Invoice is what the client needs to pay a created payment.
+type Invoice struct {
+	PaymentID  string `json:"PaymentId"`
+	PaymentURL string `json:"PaymentURL"`
+	Amount     uint64 `json:"Amount"`
+	OrderID    string `json:"OrderId"`
+}
+
+// Callback is a verified provider notification. For PARTIAL_REFUNDED the
+// Amount is what is left on the payment after the refund, in kopecks.
+type Callback struct {
+	PaymentID string
+	Status    string
+	Amount    uint64
+	Raw       []byte
+}
+
+// Provider is implemented by every acquiring integration.
+type Provider interface {
+	Name() string
+	CreateInvoice(req InvoiceRequest) (*Invoice, error)
+	// VerifyCallback authenticates a raw callback body and decodes it.
+	VerifyCallback(body []byte) (*Callback, error)
+	GetStatus(paymentID string) (string, error)
+	// Refund returns amount kopecks of a confirmed payment to the payer.
+	Refund(paymentID string, amount uint64) error
+}
+
+var (
+	registeredMu sync.RWMutex
+	registered   = map[string]Provider{}
+)
+
+// Register installs a provider instance under its name, replacing the one
+// built from the configuration. Tests use it to plug in a FakeProvider.
+func Register(p Provider) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered[p.Name()] = p
+}
+
+// Get returns the named provider, or the configured default when name is
+// empty.
+func Get(config *initializers.Config, name string) (Provider, error) {
+	if name == "" {
+		name = config.PaymentProvider
+	}
+	if name == "" {
+		name = ProviderTinkoff
+	}
+
+	registeredMu.RLock()
+	p, ok := registered[name]
+	registeredMu.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	switch name {
+	case ProviderTinkoff:
+		return NewTinkoffProvider(config.TinkoffTerminalKey, config.TinkoffTerminalPassword), nil
+	case ProviderYooKassa:
+		return NewYooKassaProvider(config.YooKassaShopID, config.YooKassaSecretKey, "https://www."+config.ClientOrigin), nil
+	}
+
+	return nil, ErrUnknownProvider
+}
@@ -0,0 +1,154 @@
+package payments
+
+import (
+	"errors"
+	"log"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrPaymentNotRefundable = errors.New("payment is not confirmed or already refunded")
+	ErrRefundTooLarge       = errors.New("refund exceeds the remaining payment amount")
+)
+
+// Refund returns amount kopecks of a payment through its provider and
+// records the reversing transaction. A zero amount refunds everything that
+// is left. The user's balance may go negative when the top up was already
+// spent; further spending is then blocked until the debt is covered.
+//
+// The refund is reserved in one transaction, sent to the provider with no
+// rows locked and settled in a second transaction keyed by the refund ID, so
+// a slow provider never holds the payment or the wallet. The reservation
+// keeps two admins from refunding the same money at once, and the callback
+// the provider sends meanwhile finds nothing left to reverse.
+func Refund(db *gorm.DB, config *initializers.Config, paymentID uint64, amount uint64) (*models.Payments, error) {
+	refund, payment, err := reserveRefund(db, paymentID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := Get(config, payment.Provider)
+	if err == nil {
+		err = provider.Refund(payment.PaymentId, refund.Amount)
+	}
+	if err != nil {
+		// The money stays on the payment, a later refund may try again
+		release := db.Model(refund).Where("status = ?", models.PaymentRefundPending).Updates(map[string]interface{}{
+			"status": models.PaymentRefundFailed,
+			"error":  err.Error(),
+		})
+		if release.Error != nil {
+			log.Printf("Could not release refund %d: %v", refund.ID, release.Error)
+		}
+		return nil, err
+	}
+
+	return SettleRefund(db, refund.ID)
+}
+
+// reserved returns the kopecks of a payment in refunds still pending.
+func reserved(tx *gorm.DB, paymentID uint64) (float64, error) {
+	var sum float64
+	err := tx.Model(&models.PaymentRefund{}).
+		Where("payment_id = ? AND status = ?", paymentID, models.PaymentRefundPending).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&sum).Error
+	return sum, err
+}
+
+// held returns the kopecks of a payment the user still has, neither
+// refunded nor reserved for a refund.
+func held(tx *gorm.DB, payment *models.Payments) (float64, error) {
+	pending, err := reserved(tx, payment.ID)
+	if err != nil {
+		return 0, err
+	}
+	return payment.Amount - payment.RefundedAmount - pending, nil
+}
+
+func reserveRefund(db *gorm.DB, paymentID uint64, amount uint64) (*models.PaymentRefund, *models.Payments, error) {
+	payment := new(models.Payments)
+	refund := new(models.PaymentRefund)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, paymentID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if payment.Status != models.PaymentStatusApplied && payment.Status != models.PaymentStatusPartialRefunded {
+			return ErrPaymentNotRefundable
+		}
+
+		left, err := held(tx, payment)
+		if err != nil {
+			return err
+		}
+		var remaining uint64
+		if left > 0 {
+			remaining = uint64(left)
+		}
+		if amount == 0 {
+			amount = remaining
+		}
+		if amount == 0 || amount > remaining {
+			return ErrRefundTooLarge
+		}
+
+		refund.PaymentID = payment.ID
+		refund.Amount = amount
+		refund.Status = models.PaymentRefundPending
+		return tx.Create(refund).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return refund, payment, nil
+}
+
+// SettleRefund reverses a pending refund the provider has accepted. Settling
+// a refund that is no longer pending changes nothing, so it can be retried.
+func SettleRefund(db *gorm.DB, refundID uint64) (*models.Payments, error) {
+	payment := new(models.Payments)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		refund := new(models.PaymentRefund)
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(refund, refundID).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		if refund.Status != models.PaymentRefundPending {
+			return nil
+		}
+
+		if _, err := reverse(tx, payment, float64(refund.Amount)); err != nil {
+			return err
+		}
+		if payment.RefundedAmount >= payment.Amount {
+			payment.Status = models.PaymentStatusRefunded
+		} else {
+			payment.Status = models.PaymentStatusPartialRefunded
+		}
+		if err := tx.Save(payment).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(refund).Update("status", models.PaymentRefundSettled).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
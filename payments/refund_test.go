@@ -0,0 +1,141 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// confirmedPayment creates a payment through the fake Tinkoff server and
+// confirms it, crediting the user.
+func confirmedPayment(t *testing.T, db *gorm.DB, provider *TinkoffProvider, fake *fakeTinkoff, userID uuid.UUID, amount uint64) *models.Payments {
+	payment := createPayment(t, db, provider, userID, amount)
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "CONFIRMED", 0))
+	return payment
+}
+
+func refundStatuses(t *testing.T, db *gorm.DB, paymentID uint64) []string {
+	t.Helper()
+	var statuses []string
+	if err := db.Model(&models.PaymentRefund{}).Where("payment_id = ?", paymentID).Order("id").Pluck("status", &statuses).Error; err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestRefundSettles(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	Register(provider)
+	userID := uuid.NewV4()
+	payment := confirmedPayment(t, db, provider, fake, userID, 100000)
+
+	refunded, err := Refund(db, &initializers.Config{}, payment.ID, 30000)
+	if err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if refunded.Status != models.PaymentStatusPartialRefunded {
+		t.Fatalf("status = %s", refunded.Status)
+	}
+	if got := balance(t, db, userID); got != 70000 {
+		t.Fatalf("balance = %d, want 70000", got)
+	}
+	if got := refundStatuses(t, db, payment.ID); len(got) != 1 || got[0] != models.PaymentRefundSettled {
+		t.Fatalf("refunds = %v", got)
+	}
+
+	// The provider's callback for the same refund finds nothing to reverse
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "PARTIAL_REFUNDED", 0))
+	if got := balance(t, db, userID); got != 70000 {
+		t.Fatalf("balance after the callback = %d, want 70000", got)
+	}
+
+	// Zero refunds the rest
+	if _, err := Refund(db, &initializers.Config{}, payment.ID, 0); err != nil {
+		t.Fatalf("refund the rest: %v", err)
+	}
+	if got := status(t, db, payment.ID); got != models.PaymentStatusRefunded {
+		t.Fatalf("status = %s", got)
+	}
+	if got := balance(t, db, userID); got != 0 {
+		t.Fatalf("balance = %d, want 0", got)
+	}
+}
+
+func TestRefundCallbackBeforeSettlement(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	userID := uuid.NewV4()
+	payment := confirmedPayment(t, db, provider, fake, userID, 100000)
+
+	refund, _, err := reserveRefund(db, payment.ID, 100000)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	// A reserved amount cannot be refunded again
+	if _, _, err := reserveRefund(db, payment.ID, 1); !errors.Is(err, ErrRefundTooLarge) {
+		t.Fatalf("second reservation: err = %v, want ErrRefundTooLarge", err)
+	}
+	if err := provider.Refund(payment.PaymentId, refund.Amount); err != nil {
+		t.Fatal(err)
+	}
+
+	// The callback arrives while the refund is still pending
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "REFUNDED", 0))
+	if got := balance(t, db, userID); got != 100000 {
+		t.Fatalf("balance after the callback = %d, want 100000", got)
+	}
+
+	if _, err := SettleRefund(db, refund.ID); err != nil {
+		t.Fatalf("settle: %v", err)
+	}
+	// Settling twice reverses once
+	if _, err := SettleRefund(db, refund.ID); err != nil {
+		t.Fatalf("settle again: %v", err)
+	}
+	if got := balance(t, db, userID); got != 0 {
+		t.Fatalf("balance after settlement = %d, want 0", got)
+	}
+	if got := status(t, db, payment.ID); got != models.PaymentStatusRefunded {
+		t.Fatalf("status = %s", got)
+	}
+}
+
+func TestRefundProviderFailureReleases(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	Register(provider)
+	userID := uuid.NewV4()
+	payment := confirmedPayment(t, db, provider, fake, userID, 100000)
+
+	// The fake server refuses refunds above what it holds
+	fake.mu.Lock()
+	fake.payments[payment.PaymentId].refunded = 90000
+	fake.mu.Unlock()
+
+	if _, err := Refund(db, &initializers.Config{}, payment.ID, 50000); err == nil {
+		t.Fatal("refund succeeded although the provider refused it")
+	}
+	if got := refundStatuses(t, db, payment.ID); len(got) != 1 || got[0] != models.PaymentRefundFailed {
+		t.Fatalf("refunds = %v", got)
+	}
+	if got := status(t, db, payment.ID); got != models.PaymentStatusApplied {
+		t.Fatalf("status = %s", got)
+	}
+	if got := balance(t, db, userID); got != 100000 {
+		t.Fatalf("balance = %d, want 100000", got)
+	}
+
+	// The failed refund reserves nothing
+	if _, err := Refund(db, &initializers.Config{}, payment.ID, 10000); err != nil {
+		t.Fatalf("refund after a failure: %v", err)
+	}
+	if got := balance(t, db, userID); got != 90000 {
+		t.Fatalf("balance = %d, want 90000", got)
+	}
+}
@@ -0,0 +1,206 @@
+package payments
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikita-vanyasin/tinkoff"
+)
+
+var (
+	ErrInvalidTerminal  = errors.New("invalid terminal key")
+	ErrInvalidSignature = errors.New("invalid notification token")
+)
+
+// TinkoffProvider talks to the Tinkoff acquiring API of one terminal.
+type TinkoffProvider struct {
+	terminalKey string
+	password    string
+	client      *tinkoff.Client
+}
+
+func NewTinkoffProvider(terminalKey, password string) *TinkoffProvider {
+	return &TinkoffProvider{
+		terminalKey: terminalKey,
+		password:    password,
+		client:      tinkoff.NewClient(terminalKey, password),
+	}
+}
+
+func (p *TinkoffProvider) Name() string {
+	return ProviderTinkoff
+}
+
+func (p *TinkoffProvider) CreateInvoice(req InvoiceRequest) (*Invoice, error) {
+	initReq := &tinkoff.InitRequest{
+		Amount:          req.Amount,
+		OrderID:         req.OrderID,
+		CustomerKey:     req.CustomerKey,
+		Description:     req.Description,
+		RedirectDueDate: tinkoff.Time(time.Now().Add(4 * time.Hour * 24)), // ссылка истечет через 4 дня
+		Receipt: &tinkoff.Receipt{
+			Email: req.Email,
+			Items: []*tinkoff.ReceiptItem{
+				{
+					Price:         req.Amount,
+					Quantity:      "1",
+					Amount:        req.Amount,
+					Name:          "Баланс на сумму " + strconv.FormatUint(req.Amount, 10),
+					Tax:           tinkoff.VATNone,
+					PaymentMethod: tinkoff.PaymentMethodFullPayment,
+					PaymentObject: tinkoff.PaymentObjectIntellectualActivity,
+				},
+			},
+			Taxation: tinkoff.TaxationUSNIncome,
+			Payments: &tinkoff.ReceiptPayments{
+				Electronic: req.Amount,
+			},
+		},
+
+		//custom fields for tinkoff
+		Data: map[string]string{},
+	}
+
+	res, err := p.client.Init(initReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Invoice{
+		PaymentID:  res.PaymentID,
+		PaymentURL: res.PaymentURL,
+		Amount:     res.Amount,
+		OrderID:    res.OrderID,
+	}, nil
+}
+
+func (p *TinkoffProvider) VerifyCallback(body []byte) (*Callback, error) {
+	return ParseTinkoffNotification(body, p.terminalKey, p.password)
+}
+
+func (p *TinkoffProvider) GetStatus(paymentID string) (string, error) {
+	res, err := p.client.GetState(&tinkoff.GetStateRequest{PaymentID: paymentID})
+	if err != nil {
+		return "", err
+	}
+	return tinkoffStatus(res.Status), nil
+}
+
+func (p *TinkoffProvider) Refund(paymentID string, amount uint64) error {
+	_, err := p.client.Cancel(&tinkoff.CancelRequest{
+		PaymentID: paymentID,
+		Amount:    amount,
+	})
+	return err
+}
+
+// tinkoffStatus maps Tinkoff statuses onto provider independent ones.
+func tinkoffStatus(status string) string {
+	switch status {
+	case "CONFIRMED":
+		return StatusConfirmed
+	case "REJECTED", "AUTH_FAIL", "DEADLINE_EXPIRED":
+		return StatusRejected
+	case "CANCELED", "REVERSED":
+		return StatusCanceled
+	case "REFUNDED":
+		return StatusRefunded
+	case "PARTIAL_REFUNDED":
+		return StatusPartialRefunded
+	}
+	return StatusPending
+}
+
+// ParseTinkoffNotification checks the terminal key and the Token signature
+// of a callback body and decodes it.
+//
+// The token is the SHA-256 of the concatenated values of every root level
+// scalar field plus the terminal password, ordered by key name. Nested
+// objects such as Receipt or DATA do not take part in the signature.
+func ParseTinkoffNotification(body []byte, terminalKey, password string) (*Callback, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	token, _ := fields["Token"].(string)
+	if token == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	values := map[string]string{"Password": password}
+	for key, value := range fields {
+		if key == "Token" {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		}
+	}
+
+	expected := tinkoffToken(values)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(token)), []byte(expected)) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	if values["TerminalKey"] != terminalKey {
+		return nil, ErrInvalidTerminal
+	}
+
+	n := &Callback{
+		PaymentID: values["PaymentId"],
+		Status:    tinkoffStatus(values["Status"]),
+		Raw:       body,
+	}
+	if amount, ok := values["Amount"]; ok {
+		parsed, err := strconv.ParseUint(amount, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n.Amount = parsed
+	}
+
+	return n, nil
+}
+
+// SignTinkoffValues returns the Token for a set of root level values. It is
+// used to sign outgoing requests and to build callbacks in a fake server.
+func SignTinkoffValues(values map[string]string, password string) string {
+	withPassword := map[string]string{"Password": password}
+	for k, v := range values {
+		withPassword[k] = v
+	}
+	return tinkoffToken(withPassword)
+}
+
+func tinkoffToken(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(values[k])
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// WebhookResult tells the caller what a processed callback changed.
+type WebhookResult struct {
+	Payment *models.Payments
+	// Replayed is set when the same event was already processed before.
+	Replayed bool
+	// BalanceChanged is set when the callback credited or reversed balance.
+	BalanceChanged bool
+}
+
+// eventKey identifies a callback. A payment can be partially refunded more
+// than once, each time leaving a different remaining amount, so that amount
+// is part of the key for PARTIAL_REFUNDED.
+func eventKey(provider, paymentID, status string, amount uint64) string {
+	if status == StatusPartialRefunded {
+		return fmt.Sprintf("%s:%s:%s:%d", provider, paymentID, status, amount)
+	}
+	return provider + ":" + paymentID + ":" + status
+}
+
+// ProcessCallback applies a verified callback to its payment. The
+// event log row, the payment status and the ledger posting are written in
+// one database transaction, so a callback that fails half way is retried
+// from scratch and a callback that succeeded is never applied twice.
+func ProcessCallback(db *gorm.DB, provider string, n *Callback) (*WebhookResult, error) {
+	result := &WebhookResult{}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		event := models.PaymentWebhookEvent{
+			EventKey:  eventKey(provider, n.PaymentID, n.Status, n.Amount),
+			Provider:  provider,
+			PaymentId: n.PaymentID,
+			Status:    n.Status,
+			Amount:    n.Amount,
+			Payload:   datatypes.JSON(n.Raw),
+		}
+		inserted := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+		if inserted.Error != nil {
+			return inserted.Error
+		}
+		if inserted.RowsAffected == 0 {
+			result.Replayed = true
+			return nil
+		}
+
+		payment := new(models.Payments)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("provider = ? AND payment_id = ?", provider, n.PaymentID).
+			First(payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		result.Payment = payment
+
+		changed, err := applyStatus(tx, payment, n)
+		if err != nil {
+			return err
+		}
+		result.BalanceChanged = changed
+
+		return tx.Save(payment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func applyStatus(tx *gorm.DB, payment *models.Payments, n *Callback) (bool, error) {
+	credited := payment.Status == models.PaymentStatusApplied ||
+		payment.Status == models.PaymentStatusPartialRefunded
+
+	switch n.Status {
+	case StatusConfirmed:
+		if payment.Status != models.PaymentStatusNew {
+			return false, nil
+		}
+		payment.Status = models.PaymentStatusApplied
+		_, err := ledger.Credit(tx, payment.UserID, ledger.AccountPaymentGateway, payment.Amount/100, ledger.Posting{
+			Module:      `Payment`,
+			Description: `Пополнение баланса c карты банка`,
+			Status:      `CLOSED_1`,
+		})
+		return err == nil, err
+
+	case StatusRejected, StatusCanceled:
+		if credited {
+			// A cancel after confirmation returns the whole remaining amount.
+			left, err := held(tx, payment)
+			if err != nil {
+				return false, err
+			}
+			payment.Status = models.PaymentStatusCanceled
+			return reverse(tx, payment, left)
+		}
+		if payment.Status == models.PaymentStatusNew {
+			if n.Status == StatusRejected {
+				payment.Status = models.PaymentStatusRejected
+			} else {
+				payment.Status = models.PaymentStatusCanceled
+			}
+		}
+		return false, nil
+
+	case StatusRefunded:
+		if !credited {
+			return false, nil
+		}
+		left, err := held(tx, payment)
+		if err != nil {
+			return false, err
+		}
+		payment.Status = models.PaymentStatusRefunded
+		return reverse(tx, payment, left)
+
+	case StatusPartialRefunded:
+		if !credited {
+			return false, nil
+		}
+		// Amount in the callback is what is left on the payment after the
+		// refund, the difference to what we still hold is refunded now. An
+		// admin refund being settled is not held any more.
+		left, err := held(tx, payment)
+		if err != nil {
+			return false, err
+		}
+		refund := left - float64(n.Amount)
+		if refund <= 0 {
+			return false, nil
+		}
+		payment.Status = models.PaymentStatusPartialRefunded
+		return reverse(tx, payment, refund)
+	}
+
+	return false, nil
+}
+
+// reverse takes a refunded amount (in kopecks) back from the user's balance.
+// The balance may go negative when the user already spent the money.
+func reverse(tx *gorm.DB, payment *models.Payments, amount float64) (bool, error) {
+	if amount <= 0 {
+		return false, nil
+	}
+	payment.RefundedAmount += amount
+
+	_, err := ledger.Debit(tx, payment.UserID, ledger.AccountPaymentGateway, amount/100, ledger.Posting{
+		Module:        `Payment`,
+		Description:   `Возврат платежа c карты банка`,
+		Status:        `CLOSED_1`,
+		AllowNegative: true,
+	})
+	return err == nil, err
+}
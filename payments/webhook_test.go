@@ -0,0 +1,346 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	testTerminalKey = "TestTerminal"
+	testPassword    = "secret"
+)
+
+// fakeTinkoff serves the acquiring API calls the provider makes and sends
+// signed notifications for the state changes a test drives.
+type fakeTinkoff struct {
+	*httptest.Server
+	mu       sync.Mutex
+	next     int
+	payments map[string]*fakeTinkoffPayment
+}
+
+type fakeTinkoffPayment struct {
+	orderID  string
+	amount   uint64
+	refunded uint64
+	status   string
+}
+
+func newFakeTinkoff(t *testing.T) *fakeTinkoff {
+	f := &fakeTinkoff{payments: map[string]*fakeTinkoffPayment{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Init", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Amount  uint64 `json:"Amount"`
+			OrderID string `json:"OrderId"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.next++
+		id := strconv.Itoa(f.next)
+		f.payments[id] = &fakeTinkoffPayment{orderID: req.OrderID, amount: req.Amount, status: "NEW"}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"TerminalKey": testTerminalKey,
+			"Success":     true,
+			"ErrorCode":   "0",
+			"Status":      "NEW",
+			"PaymentId":   id,
+			"OrderId":     req.OrderID,
+			"Amount":      req.Amount,
+			"PaymentURL":  f.URL + "/pay/" + id,
+		})
+	})
+	mux.HandleFunc("/Cancel", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			PaymentID string `json:"PaymentId"`
+			Amount    uint64 `json:"Amount"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		p, ok := f.payments[req.PaymentID]
+		if !ok || req.Amount > p.amount-p.refunded {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Success": false, "ErrorCode": "7"})
+			return
+		}
+		original := p.amount - p.refunded
+		f.refund(p, req.Amount)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"TerminalKey":    testTerminalKey,
+			"Success":        true,
+			"ErrorCode":      "0",
+			"Status":         p.status,
+			"PaymentId":      req.PaymentID,
+			"OrderId":        p.orderID,
+			"OriginalAmount": original,
+			"NewAmount":      p.amount - p.refunded,
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTinkoff) refund(p *fakeTinkoffPayment, amount uint64) {
+	p.refunded += amount
+	if p.refunded == p.amount {
+		p.status = "REFUNDED"
+	} else {
+		p.status = "PARTIAL_REFUNDED"
+	}
+}
+
+// notify moves a payment to status, refunding amount for refunds, and
+// returns the notification body Tinkoff sends for it.
+func (f *fakeTinkoff) notify(t *testing.T, paymentID, status string, refund uint64) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.payments[paymentID]
+	if !ok {
+		t.Fatalf("unknown fake payment %s", paymentID)
+	}
+	if refund > 0 {
+		f.refund(p, refund)
+	} else {
+		p.status = status
+	}
+
+	values := map[string]string{
+		"TerminalKey": testTerminalKey,
+		"OrderId":     p.orderID,
+		"Success":     "true",
+		"Status":      p.status,
+		"PaymentId":   paymentID,
+		"ErrorCode":   "0",
+		"Amount":      strconv.FormatUint(p.amount-p.refunded, 10),
+	}
+	body := map[string]interface{}{}
+	for k, v := range values {
+		body[k] = v
+	}
+	body["Success"] = true
+	body["Amount"] = p.amount - p.refunded
+	body["Token"] = SignTinkoffValues(values, testPassword)
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestTinkoff(t *testing.T) (*TinkoffProvider, *fakeTinkoff) {
+	f := newFakeTinkoff(t)
+	provider := NewTinkoffProvider(testTerminalKey, testPassword)
+	provider.client.SetBaseURL(f.URL)
+	return provider, f
+}
+
+func openPaymentsDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t,
+		&models.Payments{},
+		&models.PaymentWebhookEvent{},
+		&models.PaymentRefund{},
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+}
+
+// createPayment issues an invoice and stores its payment the way the top up
+// endpoint does.
+func createPayment(t *testing.T, db *gorm.DB, provider Provider, userID uuid.UUID, amount uint64) *models.Payments {
+	invoice, err := provider.CreateInvoice(InvoiceRequest{Amount: amount, OrderID: uuid.NewV4().String()})
+	if err != nil {
+		t.Fatalf("create invoice: %v", err)
+	}
+	payment := &models.Payments{
+		UserID:    userID,
+		Amount:    float64(invoice.Amount),
+		PaymentId: invoice.PaymentID,
+		Provider:  provider.Name(),
+		Status:    models.PaymentStatusNew,
+	}
+	if err := db.Create(payment).Error; err != nil {
+		t.Fatalf("create payment: %v", err)
+	}
+	return payment
+}
+
+func deliver(t *testing.T, db *gorm.DB, provider Provider, body []byte) *WebhookResult {
+	t.Helper()
+	callback, err := provider.VerifyCallback(body)
+	if err != nil {
+		t.Fatalf("verify callback: %v", err)
+	}
+	result, err := ProcessCallback(db, provider.Name(), callback)
+	if err != nil {
+		t.Fatalf("process callback: %v", err)
+	}
+	return result
+}
+
+func balance(t *testing.T, db *gorm.DB, userID uuid.UUID) int64 {
+	t.Helper()
+	var billing models.Billing
+	if err := db.Where("user_id = ?", userID).First(&billing).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0
+		}
+		t.Fatal(err)
+	}
+	return billing.Balance
+}
+
+func status(t *testing.T, db *gorm.DB, id uint64) string {
+	t.Helper()
+	var payment models.Payments
+	if err := db.First(&payment, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return payment.Status
+}
+
+func TestProcessCallbackTransitions(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	userID := uuid.NewV4()
+	payment := createPayment(t, db, provider, userID, 100000)
+
+	confirmed := fake.notify(t, payment.PaymentId, "CONFIRMED", 0)
+	result := deliver(t, db, provider, confirmed)
+	if result.Replayed || !result.BalanceChanged {
+		t.Fatalf("confirmation: replayed %v, balance changed %v", result.Replayed, result.BalanceChanged)
+	}
+	if got := status(t, db, payment.ID); got != models.PaymentStatusApplied {
+		t.Fatalf("status after confirmation = %s", got)
+	}
+	if got := balance(t, db, userID); got != 100000 {
+		t.Fatalf("balance after confirmation = %d", got)
+	}
+
+	// The same notification again changes nothing
+	result = deliver(t, db, provider, confirmed)
+	if !result.Replayed || result.BalanceChanged {
+		t.Fatalf("replay: replayed %v, balance changed %v", result.Replayed, result.BalanceChanged)
+	}
+	if got := balance(t, db, userID); got != 100000 {
+		t.Fatalf("balance after replay = %d", got)
+	}
+	var events int64
+	db.Model(&models.PaymentWebhookEvent{}).Count(&events)
+	if events != 1 {
+		t.Fatalf("event log has %d rows after a replay, want 1", events)
+	}
+
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "PARTIAL_REFUNDED", 40000))
+	if got := status(t, db, payment.ID); got != models.PaymentStatusPartialRefunded {
+		t.Fatalf("status after partial refund = %s", got)
+	}
+	if got := balance(t, db, userID); got != 60000 {
+		t.Fatalf("balance after partial refund = %d", got)
+	}
+
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "REFUNDED", 60000))
+	if got := status(t, db, payment.ID); got != models.PaymentStatusRefunded {
+		t.Fatalf("status after refund = %s", got)
+	}
+	if got := balance(t, db, userID); got != 0 {
+		t.Fatalf("balance after refund = %d", got)
+	}
+}
+
+func TestProcessCallbackRejected(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	userID := uuid.NewV4()
+	payment := createPayment(t, db, provider, userID, 50000)
+
+	result := deliver(t, db, provider, fake.notify(t, payment.PaymentId, "REJECTED", 0))
+	if result.BalanceChanged {
+		t.Fatal("a rejected payment changed the balance")
+	}
+	if got := status(t, db, payment.ID); got != models.PaymentStatusRejected {
+		t.Fatalf("status after rejection = %s", got)
+	}
+
+	// A late confirmation does not credit a rejected payment
+	deliver(t, db, provider, fake.notify(t, payment.PaymentId, "CONFIRMED", 0))
+	if got := balance(t, db, userID); got != 0 {
+		t.Fatalf("balance after a late confirmation = %d", got)
+	}
+}
+
+func TestProcessCallbackUnknownPayment(t *testing.T) {
+	db := openPaymentsDB(t)
+	provider, fake := newTestTinkoff(t)
+	invoice, err := provider.CreateInvoice(InvoiceRequest{Amount: 1000, OrderID: "lost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := provider.VerifyCallback(fake.notify(t, invoice.PaymentID, "CONFIRMED", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessCallback(db, ProviderTinkoff, callback); !errors.Is(err, ErrPaymentNotFound) {
+		t.Fatalf("err = %v, want ErrPaymentNotFound", err)
+	}
+	// The event is not logged, so a retry after the payment exists applies
+	var events int64
+	db.Model(&models.PaymentWebhookEvent{}).Count(&events)
+	if events != 0 {
+		t.Fatalf("event log has %d rows, want 0", events)
+	}
+}
+
+func TestVerifyCallbackRejectsBadToken(t *testing.T) {
+	provider, fake := newTestTinkoff(t)
+	invoice, err := provider.CreateInvoice(InvoiceRequest{Amount: 1000, OrderID: "order"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fake.notify(t, invoice.PaymentID, "CONFIRMED", 0)
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed amount no longer matches the token
+	fields["Amount"] = 999999
+	tampered, _ := json.Marshal(fields)
+	if _, err := provider.VerifyCallback(tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("tampered body: err = %v, want ErrInvalidSignature", err)
+	}
+
+	// So does a token signed with another password
+	other := NewTinkoffProvider(testTerminalKey, "other")
+	if _, err := other.VerifyCallback(body); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("other password: err = %v, want ErrInvalidSignature", err)
+	}
+
+	delete(fields, "Token")
+	unsigned, _ := json.Marshal(fields)
+	if _, err := provider.VerifyCallback(unsigned); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("unsigned body: err = %v, want ErrInvalidSignature", err)
+	}
+
+	if _, err := provider.VerifyCallback(body); err != nil {
+		t.Fatalf("genuine body: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package payments
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const yooKassaBaseURL = "https://api.yookassa.ru/v3"
+
+// YooKassaProvider talks to the YooKassa v3 API of one shop.
+//
+// YooKassa does not sign its notifications, so VerifyCallback only trusts the
+// object ID from the body and reads the actual state back from the API.
+type YooKassaProvider struct {
+	shopID    string
+	secretKey string
+	returnURL string
+	baseURL   string
+	client    *http.Client
+}
+
+func NewYooKassaProvider(shopID, secretKey, returnURL string) *YooKassaProvider {
+	return &YooKassaProvider{
+		shopID:    shopID,
+		secretKey: secretKey,
+		returnURL: returnURL,
+		baseURL:   yooKassaBaseURL,
+		client:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// SetBaseURL points the provider at another API host, e.g. a local fake.
+func (p *YooKassaProvider) SetBaseURL(baseURL string) {
+	p.baseURL = baseURL
+}
+
+func (p *YooKassaProvider) Name() string {
+	return ProviderYooKassa
+}
+
+type yooKassaAmount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type yooKassaPayment struct {
+	ID             string          `json:"id"`
+	Status         string          `json:"status"`
+	Amount         yooKassaAmount  `json:"amount"`
+	RefundedAmount *yooKassaAmount `json:"refunded_amount,omitempty"`
+	Confirmation   struct {
+		ConfirmationURL string `json:"confirmation_url"`
+	} `json:"confirmation"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type yooKassaNotification struct {
+	Type   string `json:"type"`
+	Event  string `json:"event"`
+	Object struct {
+		ID        string `json:"id"`
+		PaymentID string `json:"payment_id"`
+	} `json:"object"`
+}
+
+func (p *YooKassaProvider) CreateInvoice(req InvoiceRequest) (*Invoice, error) {
+	body := map[string]interface{}{
+		"amount":  toYooKassaAmount(req.Amount),
+		"capture": true,
+		"confirmation": map[string]string{
+			"type":       "redirect",
+			"return_url": p.returnURL,
+		},
+		"description": req.Description,
+		"metadata": map[string]string{
+			"order_id":     req.OrderID,
+			"customer_key": req.CustomerKey,
+		},
+		"receipt": map[string]interface{}{
+			"customer": map[string]string{"email": req.Email},
+			"items": []map[string]interface{}{
+				{
+					"description":     "Баланс на сумму " + strconv.FormatUint(req.Amount, 10),
+					"quantity":        "1",
+					"amount":          toYooKassaAmount(req.Amount),
+					"vat_code":        1,
+					"payment_mode":    "full_payment",
+					"payment_subject": "intellectual_activity",
+				},
+			},
+		},
+	}
+
+	var payment yooKassaPayment
+	if err := p.do(http.MethodPost, "/payments", req.OrderID, body, &payment); err != nil {
+		return nil, err
+	}
+
+	return &Invoice{
+		PaymentID:  payment.ID,
+		PaymentURL: payment.Confirmation.ConfirmationURL,
+		Amount:     req.Amount,
+		OrderID:    req.OrderID,
+	}, nil
+}
+
+func (p *YooKassaProvider) VerifyCallback(body []byte) (*Callback, error) {
+	var n yooKassaNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, err
+	}
+
+	paymentID := n.Object.ID
+	if n.Event == "refund.succeeded" {
+		paymentID = n.Object.PaymentID
+	}
+	if paymentID == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	payment, err := p.getPayment(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := fromYooKassaAmount(payment.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	callback := &Callback{
+		PaymentID: payment.ID,
+		Status:    yooKassaStatus(payment.Status),
+		Amount:    amount,
+		Raw:       body,
+	}
+
+	if payment.RefundedAmount != nil {
+		refunded, err := fromYooKassaAmount(*payment.RefundedAmount)
+		if err != nil {
+			return nil, err
+		}
+		if refunded >= amount {
+			callback.Status = StatusRefunded
+			callback.Amount = 0
+		} else if refunded > 0 {
+			callback.Status = StatusPartialRefunded
+			callback.Amount = amount - refunded
+		}
+	}
+
+	return callback, nil
+}
+
+func (p *YooKassaProvider) GetStatus(paymentID string) (string, error) {
+	payment, err := p.getPayment(paymentID)
+	if err != nil {
+		return "", err
+	}
+	return yooKassaStatus(payment.Status), nil
+}
+
+func (p *YooKassaProvider) Refund(paymentID string, amount uint64) error {
+	body := map[string]interface{}{
+		"payment_id": paymentID,
+		"amount":     toYooKassaAmount(amount),
+	}
+	return p.do(http.MethodPost, "/refunds", uuid.NewV4().String(), body, nil)
+}
+
+func (p *YooKassaProvider) getPayment(paymentID string) (*yooKassaPayment, error) {
+	var payment yooKassaPayment
+	if err := p.do(http.MethodGet, "/payments/"+paymentID, "", nil, &payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (p *YooKassaProvider) do(method, path, idempotenceKey string, body interface{}, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.shopID, p.secretKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotenceKey != "" {
+		req.Header.Set("Idempotence-Key", idempotenceKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Code        string `json:"code"`
+			Description string `json:"description"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("yookassa: %s %s: %d %s %s", method, path, resp.StatusCode, apiErr.Code, apiErr.Description)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func yooKassaStatus(status string) string {
+	switch status {
+	case "succeeded":
+		return StatusConfirmed
+	case "canceled":
+		return StatusCanceled
+	}
+	return StatusPending
+}
+
+func toYooKassaAmount(kopecks uint64) yooKassaAmount {
+	return yooKassaAmount{
+		Value:    fmt.Sprintf("%d.%02d", kopecks/100, kopecks%100),
+		Currency: "RUB",
+	}
+}
+
+func fromYooKassaAmount(amount yooKassaAmount) (uint64, error) {
+	value, err := strconv.ParseFloat(amount.Value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, errors.New("yookassa: negative amount")
+	}
+	return uint64(math.Round(value * 100)), nil
+}
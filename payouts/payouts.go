@@ -0,0 +1,307 @@
+package payouts
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"hyperpage/currency"
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultMinAmount applies when PAYOUT_MIN_AMOUNT is not configured.
+const DefaultMinAmount = 500.0
+
+// EarningModules are the posting modules whose credits count as earnings.
+// Only earned money can be withdrawn, a top-up cannot be cashed out again.
+var EarningModules = []string{"donat"}
+
+var (
+	ErrBelowMinimum        = errors.New("amount is below the minimum withdrawal")
+	ErrExceedsWithdrawable = errors.New("amount exceeds the withdrawable balance")
+	ErrNoDestination       = errors.New("payout destination is required")
+	ErrWithdrawalNotFound  = errors.New("withdrawal not found")
+	ErrInvalidTransition   = errors.New("withdrawal cannot move to this status")
+)
+
+// Settings are the payout rules taken from the configuration.
+type Settings struct {
+	MinAmount         float64 `json:"minAmount"`
+	CommissionPercent float64 `json:"commissionPercent"`
+}
+
+func SettingsFrom(config *initializers.Config) Settings {
+	s := Settings{
+		MinAmount:         config.PayoutMinAmount,
+		CommissionPercent: config.PayoutCommissionPercent,
+	}
+	if s.MinAmount <= 0 {
+		s.MinAmount = DefaultMinAmount
+	}
+	s.CommissionPercent = math.Min(math.Max(s.CommissionPercent, 0), 100)
+	return s
+}
+
+// Commission is the platform share of a withdrawal.
+func (s Settings) Commission(amount float64) float64 {
+	return round2(amount * s.CommissionPercent / 100)
+}
+
+// Withdrawable is how much of the balance the user can request now: the
+// earnings not yet withdrawn or requested, capped by the balance. Payouts
+// are in the base currency, other currencies count at the current rate.
+// A reversed earning counts for nobody: neither the original, whose credit
+// went back, nor the reversal, which credits the payer again.
+func Withdrawable(db *gorm.DB, userID uuid.UUID) (float64, error) {
+	type total struct {
+		Currency string
+		Sum      int64
+	}
+	var totals []total
+	err := db.Raw(`
+		SELECT e.currency, COALESCE(SUM(e.amount), 0) AS sum
+		FROM ledger_entries e
+		JOIN ledger_postings p ON p.id = e.posting_id
+		WHERE e.account = ? AND e.amount > 0 AND p.module IN ?
+			AND p.reversal_of IS NULL
+			AND NOT EXISTS (SELECT 1 FROM ledger_postings r WHERE r.reversal_of = p.id)
+		GROUP BY e.currency
+	`, ledger.UserAccount(userID), EarningModules).Scan(&totals).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var earned int64
+	for _, t := range totals {
+		minor, _, err := currency.Convert(db, t.Sum, t.Currency, currency.Base)
+		if err != nil {
+			return 0, err
+		}
+		earned += minor
+	}
+
+	var withdrawn float64
+	err = db.Model(&models.Withdrawal{}).
+		Where("user_id = ? AND status IN ?", userID, []string{models.WithdrawalRequested, models.WithdrawalApproved, models.WithdrawalPaid}).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&withdrawn).Error
+	if err != nil {
+		return 0, err
+	}
+
+	code, minor, err := ledger.Wallet(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	balance, _, err := currency.Convert(db, minor, code, currency.Base)
+	if err != nil {
+		return 0, err
+	}
+
+	available := math.Min(ledger.FromMinor(earned)-withdrawn, ledger.FromMinor(balance))
+	return math.Max(round2(available), 0), nil
+}
+
+// Request opens a withdrawal and holds the amount from the balance.
+func Request(db *gorm.DB, settings Settings, userID uuid.UUID, amount float64, destination string) (*models.Withdrawal, error) {
+	amount = round2(amount)
+	destination = strings.TrimSpace(destination)
+	if destination == "" {
+		return nil, ErrNoDestination
+	}
+	if amount < settings.MinAmount {
+		return nil, ErrBelowMinimum
+	}
+
+	commission := settings.Commission(amount)
+	w := &models.Withdrawal{
+		UserID:      userID,
+		Amount:      amount,
+		Commission:  commission,
+		Payout:      round2(amount - commission),
+		Destination: destination,
+		Status:      models.WithdrawalRequested,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Requests of one user are serialised on the wallet row, so two of
+		// them cannot both pass the withdrawable check.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).
+			Find(&[]models.Billing{}).Error; err != nil {
+			return err
+		}
+
+		available, err := Withdrawable(tx, userID)
+		if err != nil {
+			return err
+		}
+		if amount > available {
+			return ErrExceedsWithdrawable
+		}
+
+		if err := tx.Create(w).Error; err != nil {
+			return err
+		}
+
+		_, err = ledger.Debit(tx, userID, ledger.AccountPayoutHold, amount, ledger.Posting{
+			Module:      "Withdrawal",
+			ElementId:   w.ID,
+			Description: "Заявка на вывод средств",
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Approve accepts a request for payment.
+func Approve(db *gorm.DB, id uint64, adminID uuid.UUID, now time.Time) (*models.Withdrawal, error) {
+	return transition(db, id, nil, models.WithdrawalRequested, func(tx *gorm.DB, w *models.Withdrawal) error {
+		w.Status = models.WithdrawalApproved
+		w.ProcessedBy = &adminID
+		w.ApprovedAt = &now
+		return nil
+	})
+}
+
+// Reject declines a request and releases the held amount.
+func Reject(db *gorm.DB, id uint64, adminID uuid.UUID, comment string, now time.Time) (*models.Withdrawal, error) {
+	return transition(db, id, nil, models.WithdrawalRequested, func(tx *gorm.DB, w *models.Withdrawal) error {
+		w.Status = models.WithdrawalRejected
+		w.ProcessedBy = &adminID
+		w.Comment = comment
+		w.ClosedAt = &now
+		return release(tx, w, "Отклонение заявки на вывод средств")
+	})
+}
+
+// Cancel lets the user withdraw a request nobody has processed yet.
+func Cancel(db *gorm.DB, id uint64, userID uuid.UUID, now time.Time) (*models.Withdrawal, error) {
+	return transition(db, id, &userID, models.WithdrawalRequested, func(tx *gorm.DB, w *models.Withdrawal) error {
+		w.Status = models.WithdrawalCanceled
+		w.ClosedAt = &now
+		return release(tx, w, "Отмена заявки на вывод средств")
+	})
+}
+
+// MarkPaid records that the money was sent. The hold is split into the
+// payout that left the platform and the commission kept as revenue.
+func MarkPaid(db *gorm.DB, id uint64, adminID uuid.UUID, reference string, now time.Time) (*models.Withdrawal, error) {
+	return transition(db, id, nil, models.WithdrawalApproved, func(tx *gorm.DB, w *models.Withdrawal) error {
+		w.Status = models.WithdrawalPaid
+		w.ProcessedBy = &adminID
+		w.Reference = reference
+		w.PaidAt = &now
+		w.ClosedAt = &now
+
+		entries := []ledger.Entry{
+			{Account: ledger.AccountPayoutHold, Amount: -ledger.ToMinor(w.Amount)},
+			{Account: ledger.AccountPayouts, Amount: ledger.ToMinor(w.Payout)},
+		}
+		if commission := ledger.ToMinor(w.Amount) - ledger.ToMinor(w.Payout); commission > 0 {
+			entries = append(entries, ledger.Entry{Account: ledger.AccountRevenue, Amount: commission})
+		}
+		_, err := ledger.Post(tx, ledger.Posting{
+			Module:      "Withdrawal",
+			ElementId:   w.ID,
+			Description: "Выплата по заявке на вывод средств",
+			Entries:     entries,
+		})
+		return err
+	})
+}
+
+// Fail records that an approved payout did not go through and gives the
+// held amount back.
+func Fail(db *gorm.DB, id uint64, adminID uuid.UUID, comment string, now time.Time) (*models.Withdrawal, error) {
+	return transition(db, id, nil, models.WithdrawalApproved, func(tx *gorm.DB, w *models.Withdrawal) error {
+		w.Status = models.WithdrawalFailed
+		w.ProcessedBy = &adminID
+		w.Comment = comment
+		w.ClosedAt = &now
+		return release(tx, w, "Возврат средств по неудачной выплате")
+	})
+}
+
+// transition locks a withdrawal, checks its current status and applies fn.
+// owner restricts the lookup to one user's withdrawals.
+func transition(db *gorm.DB, id uint64, owner *uuid.UUID, from string, fn func(tx *gorm.DB, w *models.Withdrawal) error) (*models.Withdrawal, error) {
+	w := new(models.Withdrawal)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id)
+		if owner != nil {
+			query = query.Where("user_id = ?", *owner)
+		}
+		err := query.First(w).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWithdrawalNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if w.Status != from {
+			return ErrInvalidTransition
+		}
+
+		if err := fn(tx, w); err != nil {
+			return err
+		}
+		return tx.Save(w).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	notify(db, w)
+	return w, nil
+}
+
+func release(tx *gorm.DB, w *models.Withdrawal, description string) error {
+	_, err := ledger.Credit(tx, w.UserID, ledger.AccountPayoutHold, w.Amount, ledger.Posting{
+		Module:      "Withdrawal",
+		ElementId:   w.ID,
+		Description: description,
+	})
+	return err
+}
+
+func notify(db *gorm.DB, w *models.Withdrawal) {
+	var message string
+	switch w.Status {
+	case models.WithdrawalApproved:
+		message = "Заявка на вывод средств одобрена и передана на выплату."
+	case models.WithdrawalPaid:
+		message = "Выплата по заявке на вывод средств отправлена."
+	case models.WithdrawalRejected:
+		message = "Заявка на вывод средств отклонена, средства возвращены на баланс."
+	case models.WithdrawalFailed:
+		message = "Выплата не прошла, средства возвращены на баланс."
+	default:
+		return
+	}
+	if w.Comment != "" {
+		message += " " + w.Comment
+	}
+
+	db.Create(&models.Notification{
+		Title:     "Вывод средств",
+		Message:   message,
+		UserID:    w.UserID,
+		CreatedAt: time.Now(),
+	})
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,61 @@
+package payouts
+
+import (
+	"testing"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/testdb"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestWithdrawableAfterReversedDonation(t *testing.T) {
+	db := testdb.Open(t,
+		&models.Withdrawal{},
+		&models.Billing{},
+		&models.Transaction{},
+		&models.LedgerPosting{},
+		&models.LedgerEntry{},
+		&models.ExchangeRate{},
+	)
+	donor, recipient := uuid.NewV4(), uuid.NewV4()
+	if _, err := ledger.Credit(db, donor, ledger.AccountBonus, 500, ledger.Posting{Module: "Registration"}); err != nil {
+		t.Fatal(err)
+	}
+	donation, err := ledger.Transfer(db, donor, recipient, 300, "Донат", ledger.Posting{Module: EarningModules[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withdrawable := func(userID uuid.UUID) float64 {
+		t.Helper()
+		amount, err := Withdrawable(db, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amount
+	}
+	if got := withdrawable(recipient); got != 300 {
+		t.Fatalf("recipient can withdraw %v before the reversal, want 300", got)
+	}
+
+	if _, err := ledger.Reverse(db, donation.ID, "Возврат доната"); err != nil {
+		t.Fatal(err)
+	}
+	// The donor got the money back, it was never earned
+	if got := withdrawable(donor); got != 0 {
+		t.Fatalf("donor can withdraw %v after the reversal, want 0", got)
+	}
+	if got := withdrawable(recipient); got != 0 {
+		t.Fatalf("recipient can withdraw %v after the reversal, want 0", got)
+	}
+
+	// Later donations still count
+	if _, err := ledger.Transfer(db, donor, recipient, 50, "Донат", ledger.Posting{Module: EarningModules[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := withdrawable(recipient); got != 50 {
+		t.Fatalf("recipient can withdraw %v, want 50", got)
+	}
+}
@@ -0,0 +1,316 @@
+// Package permissions maps roles to named permissions. Roles and their
+// grants live in the database so admins can change them without a deploy;
+// lookups go through a short lived in-memory cache.
+package permissions
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+
+	"hyperpage/models"
+)
+
+// Permissions checked by the API.
+const (
+	// All is granted to admins and allows everything.
+	All = "*"
+
+	ProfileEdit   = "profile.edit"
+	BlogPublish   = "blog.publish"
+	BlogModerate  = "blog.moderate" // edit and delete any blog
+	ChatUse       = "chat.use"
+	LangManage    = "lang.manage"
+	CityManage    = "city.manage"
+	GuildManage   = "guild.manage"
+	PlanManage    = "plan.manage"
+	CodeManage    = "code.manage"
+	PayoutManage  = "payout.manage"
+	BillingManage = "billing.manage"
+	BillingRefund = "billing.refund"
+	SecurityAudit = "security.audit"
+	RoleManage    = "role.manage"
+	APIKeyManage  = "apikey.manage"
+)
+
+// Known lists every permission with what it allows.
+var Known = map[string]string{
+	All:           "Everything",
+	ProfileEdit:   "Edit the own profile and account",
+	BlogPublish:   "Create and edit own blogs",
+	BlogModerate:  "Edit, archive and delete any blog",
+	ChatUse:       "Use direct messages",
+	LangManage:    "Manage languages",
+	CityManage:    "Manage cities and their translations",
+	GuildManage:   "Manage guilds and their translations",
+	PlanManage:    "Manage subscription plans",
+	CodeManage:    "Manage promo code batches",
+	PayoutManage:  "Review and process withdrawals",
+	BillingManage: "Manage exchange rates, reconcile and reverse postings",
+	BillingRefund: "Refund payments",
+	SecurityAudit: "Read security events",
+	RoleManage:    "Manage roles and assign them to users",
+	APIKeyManage:  "Issue, rotate and revoke API keys",
+}
+
+// Seeded roles.
+const (
+	Admin     = "admin"
+	Moderator = "moderator"
+	User      = "user"
+	Vip       = "vip"
+)
+
+var member = []string{ProfileEdit, BlogPublish, ChatUse}
+
+// Defaults are the roles created on the first start and their grants.
+var Defaults = map[string][]string{
+	Admin:     {All},
+	Moderator: append([]string{BlogModerate, CityManage, GuildManage, SecurityAudit}, member...),
+	User:      member,
+	Vip:       member,
+}
+
+var (
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrRoleExists        = errors.New("role already exists")
+	ErrSystemRole        = errors.New("system roles cannot be deleted")
+	ErrRoleInUse         = errors.New("role is assigned to users")
+)
+
+// cacheTTL bounds how long other instances keep stale grants after a change.
+const cacheTTL = time.Minute
+
+var cache = struct {
+	sync.RWMutex
+	grants map[string]map[string]bool
+	loaded time.Time
+}{}
+
+// Seed creates the default roles that do not exist yet. Grants of existing
+// roles are left as admins set them.
+func Seed(db *gorm.DB) error {
+	for name, perms := range Defaults {
+		var count int64
+		if err := db.Model(&models.AccessRole{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := db.Create(&models.AccessRole{Name: name, System: true, Permissions: grants(name, perms)}).Error; err != nil {
+			return err
+		}
+	}
+	Invalidate()
+	return nil
+}
+
+// Has reports whether a role grants a permission.
+func Has(db *gorm.DB, role, permission string) bool {
+	cache.RLock()
+	fresh := cache.grants != nil && time.Since(cache.loaded) < cacheTTL
+	perms := cache.grants[role]
+	cache.RUnlock()
+
+	if !fresh {
+		loaded, err := load(db)
+		if err != nil {
+			// Without the table only the defaults are known
+			perms = set(Defaults[role])
+		} else {
+			perms = loaded[role]
+		}
+	}
+	return perms[All] || perms[permission]
+}
+
+// OwnerOr reports whether a user may change a resource: owners always may,
+// others need the permission, such as a moderator editing any blog.
+func OwnerOr(db *gorm.DB, role string, userID, ownerID uuid.UUID, permission string) bool {
+	return userID == ownerID || Has(db, role, permission)
+}
+
+// Invalidate drops the cache after grants changed.
+func Invalidate() {
+	cache.Lock()
+	cache.grants = nil
+	cache.Unlock()
+}
+
+func load(db *gorm.DB) (map[string]map[string]bool, error) {
+	var rows []models.RolePermission
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	grants := map[string]map[string]bool{}
+	for _, r := range rows {
+		if grants[r.Role] == nil {
+			grants[r.Role] = map[string]bool{}
+		}
+		grants[r.Role][r.Permission] = true
+	}
+
+	cache.Lock()
+	cache.grants = grants
+	cache.loaded = time.Now()
+	cache.Unlock()
+	return grants, nil
+}
+
+// Roles lists the roles with their permissions.
+func Roles(db *gorm.DB) ([]models.AccessRole, error) {
+	var roles []models.AccessRole
+	err := db.Preload("Permissions").Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// Create adds a role.
+func Create(db *gorm.DB, name, description string, perms []string) (*models.AccessRole, error) {
+	if err := validate(perms); err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := db.Model(&models.AccessRole{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrRoleExists
+	}
+
+	role := &models.AccessRole{Name: name, Description: description, Permissions: grants(name, perms)}
+	if err := db.Create(role).Error; err != nil {
+		return nil, err
+	}
+	Invalidate()
+	return role, nil
+}
+
+// Update replaces the description and permissions of a role.
+func Update(db *gorm.DB, name, description string, perms []string) (*models.AccessRole, error) {
+	if err := validate(perms); err != nil {
+		return nil, err
+	}
+
+	role := &models.AccessRole{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(role, "name = ?", name).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRoleNotFound
+			}
+			return err
+		}
+		if err := tx.Model(role).Updates(map[string]interface{}{"description": description, "updated_at": time.Now()}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role = ?", name).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		role.Permissions = grants(name, perms)
+		if len(role.Permissions) == 0 {
+			return nil
+		}
+		return tx.Create(&role.Permissions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	Invalidate()
+	return role, nil
+}
+
+// Delete removes a role nobody has.
+func Delete(db *gorm.DB, name string) error {
+	var role models.AccessRole
+	if err := db.First(&role, "name = ?", name).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+	if role.System {
+		return ErrSystemRole
+	}
+	var users int64
+	if err := db.Model(&models.User{}).Where("role = ?", name).Count(&users).Error; err != nil {
+		return err
+	}
+	if users > 0 {
+		return ErrRoleInUse
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role = ?", name).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		return err
+	}
+	Invalidate()
+	return nil
+}
+
+// Assign gives a user a role.
+func Assign(db *gorm.DB, userID uuid.UUID, name string) error {
+	var count int64
+	if err := db.Model(&models.AccessRole{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRoleNotFound
+	}
+	result := db.Model(&models.User{}).Where("id = ?", userID).Update("role", name)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Names lists the known permissions.
+func Names() []string {
+	names := make([]string, 0, len(Known))
+	for name := range Known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validate(perms []string) error {
+	for _, p := range perms {
+		if _, ok := Known[p]; !ok {
+			return ErrUnknownPermission
+		}
+	}
+	return nil
+}
+
+func grants(role string, perms []string) []models.RolePermission {
+	seen := map[string]bool{}
+	out := []models.RolePermission{}
+	for _, p := range perms {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, models.RolePermission{Role: role, Permission: p})
+		}
+	}
+	return out
+}
+
+func set(perms []string) map[string]bool {
+	out := map[string]bool{}
+	for _, p := range perms {
+		out[p] = true
+	}
+	return out
+}
@@ -0,0 +1,255 @@
+package promocodes
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxBatchSize caps how many codes one request can generate.
+	MaxBatchSize = 1000
+	codeLength   = 10
+	// Letters and digits that are hard to confuse when typed by hand.
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var (
+	ErrInvalidBatch    = errors.New("invalid code batch")
+	ErrCodeNotFound    = errors.New("code not found")
+	ErrCodeExpired     = errors.New("code has expired")
+	ErrCodeDisabled    = errors.New("code is disabled")
+	ErrCodeExhausted   = errors.New("code is already activated")
+	ErrAlreadyRedeemed = errors.New("code is already redeemed by this user")
+	ErrUserLimit       = errors.New("redemption limit for this user reached")
+)
+
+// BatchRequest describes a batch of codes to generate.
+type BatchRequest struct {
+	Name           string     `json:"name"`
+	Count          int        `json:"count"`
+	Amount         float64    `json:"amount"`
+	ExpiresAt      *time.Time `json:"expiresAt"`
+	MaxRedemptions uint64     `json:"maxRedemptions"`
+	PerUserLimit   *uint64    `json:"perUserLimit"`
+}
+
+// CreateBatch generates a batch of codes sharing the same amount and limits.
+// A code is single use unless MaxRedemptions says otherwise, and a user can
+// redeem one code of the batch unless PerUserLimit says otherwise.
+func CreateBatch(db *gorm.DB, createdBy uuid.UUID, req BatchRequest, now time.Time) (*models.CodeBatch, []models.Codes, error) {
+	if req.Count <= 0 || req.Count > MaxBatchSize || ledger.ToMinor(req.Amount) <= 0 {
+		return nil, nil, ErrInvalidBatch
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return nil, nil, ErrInvalidBatch
+	}
+	if req.MaxRedemptions == 0 {
+		req.MaxRedemptions = 1
+	}
+	perUserLimit := uint64(1)
+	if req.PerUserLimit != nil {
+		perUserLimit = *req.PerUserLimit
+	}
+
+	batch := &models.CodeBatch{
+		Name:           req.Name,
+		Amount:         req.Amount,
+		Count:          req.Count,
+		ExpiresAt:      req.ExpiresAt,
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   perUserLimit,
+		Active:         true,
+		CreatedBy:      createdBy,
+	}
+	codes := make([]models.Codes, 0, req.Count)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(batch).Error; err != nil {
+			return err
+		}
+
+		balance := strconv.FormatFloat(req.Amount, 'f', -1, 64)
+		for len(codes) < req.Count {
+			value, err := generateCode()
+			if err != nil {
+				return err
+			}
+
+			code := models.Codes{
+				Code:      value,
+				Balance:   balance,
+				UserId:    createdBy,
+				Activated: false,
+				BatchID:   &batch.ID,
+			}
+			// A collision with an existing code is skipped and a new value
+			// drawn instead.
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "code"}},
+				DoNothing: true,
+			}).Create(&code)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				codes = append(codes, code)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return batch, codes, nil
+}
+
+// Redeem credits the value of a code to the user's balance. The code row and
+// its batch are locked for the whole redemption, so concurrent requests for
+// the same code or batch are applied one after another and the limits are
+// checked against committed redemptions only.
+func Redeem(db *gorm.DB, userID uuid.UUID, value string, ip string, now time.Time) (*models.CodeRedemption, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, ErrCodeNotFound
+	}
+
+	var redemption *models.CodeRedemption
+	err := db.Transaction(func(tx *gorm.DB) error {
+		code := new(models.Codes)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ? AND deleted_at IS NULL", value).
+			First(code).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCodeNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		limit := uint64(1)
+		var batch *models.CodeBatch
+		if code.BatchID != nil {
+			batch = new(models.CodeBatch)
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(batch, *code.BatchID).Error
+			if err != nil {
+				return err
+			}
+			if !batch.Active {
+				return ErrCodeDisabled
+			}
+			if batch.ExpiresAt != nil && !now.Before(*batch.ExpiresAt) {
+				return ErrCodeExpired
+			}
+			limit = batch.MaxRedemptions
+		}
+		if code.Activated || code.Redemptions >= limit {
+			return ErrCodeExhausted
+		}
+
+		var used int64
+		err = tx.Model(&models.CodeRedemption{}).
+			Where("code_id = ? AND user_id = ?", code.ID, userID).
+			Count(&used).Error
+		if err != nil {
+			return err
+		}
+		if used > 0 {
+			return ErrAlreadyRedeemed
+		}
+
+		if batch != nil && batch.PerUserLimit > 0 {
+			var usedInBatch int64
+			err := tx.Model(&models.CodeRedemption{}).
+				Where("batch_id = ? AND user_id = ?", batch.ID, userID).
+				Count(&usedInBatch).Error
+			if err != nil {
+				return err
+			}
+			if uint64(usedInBatch) >= batch.PerUserLimit {
+				return ErrUserLimit
+			}
+		}
+
+		amount, err := strconv.ParseFloat(code.Balance, 64)
+		if err != nil {
+			return err
+		}
+
+		posting, err := ledger.Credit(tx, userID, ledger.AccountPromoCodes, amount, ledger.Posting{
+			Module:      `CodeUsed`,
+			ElementId:   uint64(code.ID),
+			Description: `Пополнение баланса`,
+			Status:      `CLOSED_1`,
+		})
+		if err != nil {
+			return err
+		}
+
+		transaction := new(models.Transaction)
+		err = tx.Where("posting_id = ? AND user_id = ?", posting.ID, userID).First(transaction).Error
+		if err != nil {
+			return err
+		}
+
+		redemption = &models.CodeRedemption{
+			CodeID:        code.ID,
+			BatchID:       code.BatchID,
+			UserID:        userID,
+			Amount:        amount,
+			PostingID:     posting.ID,
+			TransactionID: transaction.ID,
+			IP:            ip,
+		}
+		if err := tx.Create(redemption).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(code).Updates(map[string]interface{}{
+			"redemptions": code.Redemptions + 1,
+			"activated":   code.Redemptions+1 >= limit,
+			"used":        uint64(now.Unix()),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return redemption, nil
+}
+
+// SetBatchActive enables or disables every code of a batch.
+func SetBatchActive(db *gorm.DB, batchID uint64, active bool) (*models.CodeBatch, error) {
+	batch := new(models.CodeBatch)
+	if err := db.First(batch, batchID).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(batch).Update("active", active).Error; err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func generateCode() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := 0; i < codeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
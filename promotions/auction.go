@@ -0,0 +1,128 @@
+package promotions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type feedWindow struct {
+	Scope       string
+	ScopeID     uint64
+	WindowStart time.Time
+}
+
+// RunAuctions settles every feed window whose bidding has closed. Bids are
+// ranked by amount, earlier bids win ties. Every hold is released first,
+// then the top Slots bids are charged the next bid below them (or MinBid),
+// so a winner never pays more than it offered. A winner that can no longer
+// be charged loses its slot to the next bid.
+func RunAuctions(db *gorm.DB, now time.Time) {
+	var windows []feedWindow
+	err := db.Model(&models.PromotionBid{}).
+		Select("DISTINCT scope, scope_id, window_start").
+		Where("status = ? AND window_start <= ?", models.PromotionBidPending, now.Add(AuctionLead)).
+		Scan(&windows).Error
+	if err != nil {
+		log.Println("Failed to load promotion windows:", err)
+		return
+	}
+
+	for _, w := range windows {
+		if err := settle(db, w, now); err != nil {
+			log.Printf("Failed to settle promotion %s/%d at %s: %v", w.Scope, w.ScopeID, w.WindowStart, err)
+		}
+	}
+}
+
+func settle(db *gorm.DB, w feedWindow, now time.Time) error {
+	var notices []models.Notification
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var bids []models.PromotionBid
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Preload("Blog").
+			Where("scope = ? AND scope_id = ? AND window_start = ? AND status = ?", w.Scope, w.ScopeID, w.WindowStart, models.PromotionBidPending).
+			Order("amount DESC, created_at, id").
+			Find(&bids).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range bids {
+			if err := release(tx, &bids[i]); err != nil {
+				return err
+			}
+		}
+
+		position := 0
+		for i := range bids {
+			bid := &bids[i]
+			bid.Status = models.PromotionBidLost
+
+			if position < Slots && bid.Blog.Status == "ACTIVE" {
+				price := MinBid
+				if i+1 < len(bids) {
+					price = math.Max(price, bids[i+1].Amount)
+				}
+				price = math.Min(price, bid.Amount)
+
+				// The charge runs in a savepoint, a failed one leaves the
+				// transaction usable for the next bidder.
+				err := utils.DeductAmountFromUserBalanceTx(tx, bid.UserID, price, price, "Promotion", bid.ID, "Оплата продвижения объявления")
+				switch {
+				case err == nil:
+					position++
+					bid.Status = models.PromotionBidWon
+					bid.Position = position
+					bid.Price = price
+				case errors.Is(err, ledger.ErrInsufficientFunds), errors.Is(err, ledger.ErrAccountInDebt):
+				default:
+					return err
+				}
+			}
+
+			if err := tx.Omit("Blog").Save(bid).Error; err != nil {
+				return err
+			}
+			notices = append(notices, notice(bid, now))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range notices {
+		db.Create(&notices[i])
+	}
+	return nil
+}
+
+func notice(bid *models.PromotionBid, now time.Time) models.Notification {
+	day := bid.WindowStart.Format("02.01.2006")
+	if bid.Status == models.PromotionBidWon {
+		return models.Notification{
+			Title:     "Продвижение объявления",
+			Message:   fmt.Sprintf("Объявление «%s» займёт место %d в ленте %s. Списано %.2f ₽.", bid.Blog.Title, bid.Position, day, bid.Price),
+			UserID:    bid.UserID,
+			CreatedAt: now,
+		}
+	}
+	return models.Notification{
+		Title:     "Продвижение объявления",
+		Message:   fmt.Sprintf("Ставка на продвижение объявления «%s» на %s не выиграла, средства возвращены на баланс.", bid.Blog.Title, day),
+		UserID:    bid.UserID,
+		CreatedAt: now,
+	}
+}
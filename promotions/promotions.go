@@ -0,0 +1,253 @@
+package promotions
+
+import (
+	"errors"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Slots is how many promoted blogs a feed shows at the top.
+	Slots = 3
+	// MinBid is the reserve price of a slot for one window.
+	MinBid = 10.0
+	// WindowLength is the time a won slot is shown. Windows start at
+	// midnight server time.
+	WindowLength = 24 * time.Hour
+	// AuctionLead is how long before a window starts bidding closes and the
+	// auction for it runs.
+	AuctionLead = time.Hour
+	// MaxAdvance limits how far ahead a window can be bid on.
+	MaxAdvance = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidBid     = errors.New("invalid promotion bid")
+	ErrBidTooLow      = errors.New("bid is below the minimum")
+	ErrBiddingClosed  = errors.New("bidding for this window is closed")
+	ErrNotBlogOwner   = errors.New("blog belongs to another user")
+	ErrBlogNotActive  = errors.New("blog is not active")
+	ErrBlogNotInScope = errors.New("blog is not published in this feed")
+	ErrBidNotFound    = errors.New("promotion bid not found")
+)
+
+// BidRequest is an offer for one window of a feed. WindowStart may be any
+// time within the wanted window.
+type BidRequest struct {
+	BlogID      uint64    `json:"blogId"`
+	Scope       string    `json:"scope"`
+	ScopeID     uint64    `json:"scopeId"`
+	WindowStart time.Time `json:"windowStart"`
+	Amount      float64   `json:"amount"`
+}
+
+// WindowStart returns the start of the window t falls into.
+func WindowStart(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// PlaceBid creates a bid or changes the amount of the blog's pending bid for
+// the same feed and window. The balance hold is adjusted by the difference.
+func PlaceBid(db *gorm.DB, userID uuid.UUID, req BidRequest, now time.Time) (*models.PromotionBid, error) {
+	switch req.Scope {
+	case models.PromotionScopeAll:
+		req.ScopeID = 0
+	case models.PromotionScopeCity, models.PromotionScopeGuild:
+		if req.ScopeID == 0 {
+			return nil, ErrInvalidBid
+		}
+	default:
+		return nil, ErrInvalidBid
+	}
+	if req.Amount < MinBid {
+		return nil, ErrBidTooLow
+	}
+
+	start := WindowStart(req.WindowStart)
+	if !biddingOpen(start, now) {
+		return nil, ErrBiddingClosed
+	}
+	if start.Sub(now) > MaxAdvance {
+		return nil, ErrInvalidBid
+	}
+
+	var result *models.PromotionBid
+	err := db.Transaction(func(tx *gorm.DB) error {
+		blog := new(models.Blog)
+		if err := tx.First(blog, req.BlogID).Error; err != nil {
+			return err
+		}
+		if blog.UserID != userID {
+			return ErrNotBlogOwner
+		}
+		if blog.Status != "ACTIVE" {
+			return ErrBlogNotActive
+		}
+		if err := checkScope(tx, blog.ID, req.Scope, req.ScopeID); err != nil {
+			return err
+		}
+
+		bid := new(models.PromotionBid)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("blog_id = ? AND scope = ? AND scope_id = ? AND window_start = ?", blog.ID, req.Scope, req.ScopeID, start).
+			First(bid).Error
+		held := 0.0
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			bid = &models.PromotionBid{
+				BlogID:      blog.ID,
+				UserID:      userID,
+				Scope:       req.Scope,
+				ScopeID:     req.ScopeID,
+				WindowStart: start,
+				WindowEnd:   start.Add(WindowLength),
+				Status:      models.PromotionBidPending,
+			}
+			if err := tx.Create(bid).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case bid.Status == models.PromotionBidPending:
+			held = bid.Amount
+		case bid.Status == models.PromotionBidCanceled:
+			bid.Status = models.PromotionBidPending
+		default:
+			return ErrBiddingClosed
+		}
+
+		if err := hold(tx, bid, req.Amount-held); err != nil {
+			return err
+		}
+
+		bid.Amount = req.Amount
+		result = bid
+		return tx.Omit("Blog").Save(bid).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// CancelBid withdraws a pending bid and releases its hold.
+func CancelBid(db *gorm.DB, userID uuid.UUID, bidID uint64, now time.Time) (*models.PromotionBid, error) {
+	bid := new(models.PromotionBid)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", bidID, userID).
+			First(bid).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrBidNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if bid.Status != models.PromotionBidPending || !biddingOpen(bid.WindowStart, now) {
+			return ErrBiddingClosed
+		}
+
+		if err := release(tx, bid); err != nil {
+			return err
+		}
+		bid.Status = models.PromotionBidCanceled
+		return tx.Omit("Blog").Save(bid).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bid, nil
+}
+
+// RemoveBlog releases the pending bids of a blog that is about to be deleted
+// and drops all of its bids.
+func RemoveBlog(db *gorm.DB, blogID uint64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var bids []models.PromotionBid
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("blog_id = ? AND status = ?", blogID, models.PromotionBidPending).
+			Find(&bids).Error
+		if err != nil {
+			return err
+		}
+		for i := range bids {
+			if err := release(tx, &bids[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Where("blog_id = ?", blogID).Delete(&models.PromotionBid{}).Error
+	})
+}
+
+// Promoted returns the blogs holding the slots of a feed right now, in slot
+// order.
+func Promoted(db *gorm.DB, scope string, scopeID uint64, now time.Time) ([]uint64, error) {
+	var ids []uint64
+	err := db.Model(&models.PromotionBid{}).
+		Joins("JOIN blogs ON blogs.id = promotion_bids.blog_id").
+		Where("promotion_bids.scope = ? AND promotion_bids.scope_id = ?", scope, scopeID).
+		Where("promotion_bids.status = ?", models.PromotionBidWon).
+		Where("promotion_bids.window_start <= ? AND promotion_bids.window_end > ?", now, now).
+		Where("blogs.status = ? AND blogs.deleted_at IS NULL", "ACTIVE").
+		Order("promotion_bids.position").
+		Pluck("promotion_bids.blog_id", &ids).Error
+	return ids, err
+}
+
+func biddingOpen(windowStart, now time.Time) bool {
+	return now.Add(AuctionLead).Before(windowStart)
+}
+
+func checkScope(tx *gorm.DB, blogID uint64, scope string, scopeID uint64) error {
+	var count int64
+	var err error
+	switch scope {
+	case models.PromotionScopeCity:
+		err = tx.Table("blog_city").Where("blog_id = ? AND city_id = ?", blogID, scopeID).Count(&count).Error
+	case models.PromotionScopeGuild:
+		err = tx.Table("blog_guilds").Where("blog_id = ? AND guilds_id = ?", blogID, scopeID).Count(&count).Error
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrBlogNotInScope
+	}
+	return nil
+}
+
+// hold moves diff between the owner's balance and the escrow account; a
+// negative diff gives money back.
+func hold(tx *gorm.DB, bid *models.PromotionBid, diff float64) error {
+	var err error
+	switch {
+	case diff > 0:
+		_, err = ledger.Debit(tx, bid.UserID, ledger.AccountPromotionEscrow, diff, ledger.Posting{
+			Module:      "Promotion",
+			ElementId:   bid.ID,
+			Description: "Ставка на продвижение объявления",
+		})
+	case diff < 0:
+		_, err = ledger.Credit(tx, bid.UserID, ledger.AccountPromotionEscrow, -diff, ledger.Posting{
+			Module:      "Promotion",
+			ElementId:   bid.ID,
+			Description: "Возврат ставки на продвижение объявления",
+		})
+	}
+	return err
+}
+
+func release(tx *gorm.DB, bid *models.PromotionBid) error {
+	return hold(tx, bid, -bid.Amount)
+}
@@ -7,18 +7,20 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
 
+	"hyperpage/apikeys"
 	"hyperpage/controllers"
 	"hyperpage/initializers"
 	"hyperpage/middleware"
+	"hyperpage/permissions"
 )
 
 func Register(micro *fiber.App) {
 	micro.Route("/settings", func(router fiber.Router) {
 		router.Get("/base", controllers.GetBaseSystemData)
 		router.Get("/langs", controllers.Langs)
-		router.Post("/addlang", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.AddLang)
-		router.Delete("/deletelang/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteLang)
-		router.Patch("/updatelang/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateLang)
+		router.Post("/addlang", middleware.DeserializeUser, middleware.RequirePermission(permissions.LangManage), controllers.AddLang)
+		router.Delete("/deletelang/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.LangManage), controllers.DeleteLang)
+		router.Patch("/updatelang/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.LangManage), controllers.UpdateLang)
 	})
 
 	micro.Route("/presavedfilter", func(router fiber.Router) {
@@ -49,12 +51,50 @@ func Register(micro *fiber.App) {
 		router.Post("/forgotpassword", controllers.ForgotPassword)
 		router.Patch("/resetpassword/:resetToken", controllers.ResetPassword)
 		router.Get("/verifyemail/:verificationCode", controllers.VerifyEmail)
+		router.Post("/change-email/:changeToken", controllers.ConfirmEmailChange)
+		router.Get("/unlock/:unlockToken", controllers.UnlockAccount)
+		router.Get("/security-events", middleware.DeserializeUser, middleware.RequirePermission(permissions.SecurityAudit), controllers.GetSecurityEvents)
 		router.Get("/logout", middleware.DeserializeUser, controllers.LogoutUser)
-		router.Get("/refresh/:refreshToken", controllers.RefreshAccessToken)
+		router.Post("/refresh", controllers.RefreshAccessToken)
+		router.Get("/sessions", middleware.DeserializeUser, controllers.GetSessions)
+		router.Delete("/sessions", middleware.DeserializeUser, controllers.RevokeOtherSessions)
+		router.Delete("/sessions/:id", middleware.DeserializeUser, controllers.RevokeSession)
+		router.Post("/2fa/verify", controllers.VerifyTwoFactor)
+		router.Post("/2fa/challenge/setup", controllers.SetupTwoFactorChallenge)
+		router.Post("/2fa/telegram", controllers.SendTwoFactorTelegram)
+		router.Get("/2fa", middleware.DeserializeUser, controllers.GetTwoFactorStatus)
+		router.Post("/2fa/setup", middleware.DeserializeUser, controllers.SetupTwoFactor)
+		router.Post("/2fa/enable", middleware.DeserializeUser, controllers.EnableTwoFactor)
+		router.Post("/2fa/disable", middleware.DeserializeUser, controllers.DisableTwoFactor)
+		router.Post("/2fa/recovery-codes", middleware.DeserializeUser, controllers.RegenerateRecoveryCodes)
+		router.Post("/magic-link", controllers.RequestMagicLink)
+		router.Post("/magic-link/verify", controllers.VerifyMagicLink)
+		router.Post("/telegram", controllers.TelegramSignIn)
+		router.Get("/oidc", controllers.GetOIDCProviders)
+		router.Post("/oidc/callback", controllers.OIDCCallback)
+		router.Get("/oidc/:provider", controllers.StartOIDC)
+		router.Post("/oidc/:provider/token", controllers.OIDCTokenSignIn)
+		router.Get("/identities", middleware.DeserializeUser, controllers.GetIdentities)
+		router.Delete("/identities/:id", middleware.DeserializeUser, controllers.UnlinkIdentity)
 		router.Post("/checkTokenExp", controllers.CheckTokenExp)
 		router.Get("/check", middleware.DeserializeUser, controllers.GetUserDetails)
 	})
 
+	micro.Route("/roles", func(router fiber.Router) {
+		router.Get("/", middleware.DeserializeUser, middleware.RequirePermission(permissions.RoleManage), controllers.GetRoles)
+		router.Post("/", middleware.DeserializeUser, middleware.RequirePermission(permissions.RoleManage), controllers.CreateRole)
+		router.Put("/:name", middleware.DeserializeUser, middleware.RequirePermission(permissions.RoleManage), controllers.UpdateRole)
+		router.Delete("/:name", middleware.DeserializeUser, middleware.RequirePermission(permissions.RoleManage), controllers.DeleteRole)
+		router.Put("/users/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.RoleManage), controllers.AssignRole)
+	})
+
+	micro.Route("/apikeys", func(router fiber.Router) {
+		router.Get("/", middleware.DeserializeUser, middleware.RequirePermission(permissions.APIKeyManage), controllers.GetAPIKeys)
+		router.Post("/", middleware.DeserializeUser, middleware.RequirePermission(permissions.APIKeyManage), controllers.CreateAPIKey)
+		router.Post("/:id/rotate", middleware.DeserializeUser, middleware.RequirePermission(permissions.APIKeyManage), controllers.RotateAPIKey)
+		router.Delete("/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.APIKeyManage), controllers.RevokeAPIKey)
+	})
+
 	micro.Route("/followers", func(router fiber.Router) {
 		router.Post("/scribe", middleware.DeserializeUser, controllers.Scribe)
 		router.Post("/unscribe", middleware.DeserializeUser, controllers.Unscribe)
@@ -72,10 +112,15 @@ func Register(micro *fiber.App) {
 
 	micro.Route("/users", func(router fiber.Router) {
 		router.Get("/myTime", controllers.MyTime)
-		router.Post("/deletme", middleware.DeserializeUser, controllers.DeleteUserWithRelations)
+		router.Post("/deletme", middleware.DeserializeUser, controllers.RequestAccountDeletion)
+		router.Post("/deletion/cancel/:cancelToken", controllers.CancelAccountDeletion)
+		router.Get("/export", middleware.DeserializeUser, controllers.ExportMyData)
+		router.Get("/email", middleware.DeserializeUser, controllers.GetEmailChange)
+		router.Post("/email", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.RequestEmailChange)
+		router.Delete("/email", middleware.DeserializeUser, controllers.CancelEmailChange)
 		router.Post("/setvip", middleware.DeserializeUser, controllers.SetVipUser)
-		router.Patch("/changeName", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.ChangeNickName)
-		router.Patch("/setTokenDeivce", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.SetTokenIOSdevice)
+		router.Patch("/changeName", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.ChangeNickName)
+		router.Patch("/setTokenDeivce", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.SetTokenIOSdevice)
 		router.Get("/notifications", middleware.DeserializeUser, controllers.GetNotifications)
 		router.Patch("/notifications/:id/read", middleware.DeserializeUser, controllers.MarkNotificationAsRead)
 		router.Delete("/notifications/:id", middleware.DeserializeUser, controllers.DeleteNotification)
@@ -99,8 +144,53 @@ func Register(micro *fiber.App) {
 		router.Post("/plan", middleware.DeserializeUser, controllers.Plan)
 	})
 
+	micro.Route("/subscriptions", func(router fiber.Router) {
+		router.Get("/plans", controllers.GetPlans)
+		router.Get("/me", middleware.DeserializeUser, controllers.GetMySubscription)
+		router.Post("/subscribe", middleware.DeserializeUser, controllers.Subscribe)
+		router.Post("/cancel", middleware.DeserializeUser, controllers.CancelSubscription)
+		router.Post("/resume", middleware.DeserializeUser, controllers.ResumeSubscription)
+		router.Post("/plans", middleware.DeserializeUser, middleware.RequirePermission(permissions.PlanManage), controllers.CreatePlan)
+		router.Patch("/plans/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.PlanManage), controllers.UpdatePlan)
+	})
+
+	micro.Route("/codes", func(router fiber.Router) {
+		router.Post("/redeem", middleware.DeserializeUser, controllers.RedeemCode)
+		router.Get("/batches", middleware.DeserializeUser, middleware.RequirePermission(permissions.CodeManage), controllers.GetCodeBatches)
+		router.Post("/batches", middleware.DeserializeUser, middleware.RequirePermission(permissions.CodeManage), controllers.CreateCodeBatch)
+		router.Get("/batches/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.CodeManage), controllers.GetCodeBatch)
+		router.Patch("/batches/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.CodeManage), controllers.UpdateCodeBatch)
+	})
+
+	micro.Route("/promotions", func(router fiber.Router) {
+		router.Get("/bids", middleware.DeserializeUser, controllers.GetMyPromotionBids)
+		router.Post("/bids", middleware.DeserializeUser, controllers.PlacePromotionBid)
+		router.Delete("/bids/:id", middleware.DeserializeUser, controllers.CancelPromotionBid)
+	})
+
+	micro.Route("/payouts", func(router fiber.Router) {
+		router.Get("/", middleware.DeserializeUser, controllers.GetWithdrawals)
+		router.Post("/", middleware.DeserializeUser, controllers.RequestWithdrawal)
+		router.Post("/:id/cancel", middleware.DeserializeUser, controllers.CancelWithdrawal)
+		router.Get("/statement", middleware.DeserializeUser, controllers.GetStatement)
+		router.Get("/all", middleware.DeserializeUser, middleware.RequirePermission(permissions.PayoutManage), controllers.GetAllWithdrawals)
+		router.Post("/:id/:action", middleware.DeserializeUser, middleware.RequirePermission(permissions.PayoutManage), controllers.ProcessWithdrawal)
+	})
+
 	micro.Route("/billing", func(router fiber.Router) {
 		router.Get("/transactions", middleware.DeserializeUser, controllers.GetTransactions)
+		router.Get("/statement", middleware.DeserializeUser, controllers.GetStatement)
+		router.Post("/statement/email", middleware.DeserializeUser, controllers.EmailStatement)
+		router.Get("/statement/schedule", middleware.DeserializeUser, controllers.GetStatementSchedule)
+		router.Put("/statement/schedule", middleware.DeserializeUser, controllers.SetStatementSchedule)
+		router.Delete("/statement/schedule", middleware.DeserializeUser, controllers.DeleteStatementSchedule)
+		router.Get("/wallet", middleware.DeserializeUser, controllers.GetWallet)
+		router.Put("/wallet/currency", middleware.DeserializeUser, controllers.SetWalletCurrency)
+		router.Get("/rates", controllers.GetExchangeRates)
+		router.Put("/rates", middleware.DeserializeUser, middleware.RequirePermission(permissions.BillingManage), controllers.SetExchangeRates)
+		router.Post("/rates/reload", middleware.DeserializeUser, middleware.RequirePermission(permissions.BillingManage), controllers.ReloadExchangeRates)
+		router.Get("/reconcile", middleware.DeserializeUser, middleware.RequirePermission(permissions.BillingManage), controllers.ReconcileBalances)
+		router.Post("/reverse/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BillingManage), controllers.ReversePosting)
 	})
 
 	micro.Route("/calls", func(router fiber.Router) {
@@ -111,48 +201,48 @@ func Register(micro *fiber.App) {
 	micro.Route("/cities", func(router fiber.Router) {
 		router.Get("/all", controllers.GetCities)
 		router.Get("/query", controllers.GetName)
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCity)
-		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCity)
-		router.Patch("/update/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCity)
-		router.Get("/get", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetCityTranslation)
+		router.Post("/create", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.CreateCity)
+		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.DeleteCity)
+		router.Patch("/update/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.UpdateCity)
+		router.Get("/get", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.GetCityTranslation)
 	})
 
 	micro.Route("/citiestranslator", func(router fiber.Router) {
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCityTranslation)
-		router.Delete("/remove", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCityTranslation)
-		router.Patch("/update", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCityTranslation)
+		router.Post("/create", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.CreateCityTranslation)
+		router.Delete("/remove", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.DeleteCityTranslation)
+		router.Patch("/update", middleware.DeserializeUser, middleware.RequirePermission(permissions.CityManage), controllers.UpdateCityTranslation)
 	})
 
 	micro.Route("/guilds", func(router fiber.Router) {
 		router.Get("/all", controllers.GetGuilds)
 		router.Get("/getAll", controllers.GetGuildsAll)
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuild)
-		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuild)
-		router.Patch("/update/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuild)
+		router.Post("/create", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.CreateGuild)
+		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.DeleteGuild)
+		router.Patch("/update/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.UpdateGuild)
 
 		router.Get("/name", controllers.GetGuildName)
 		router.Get("/namecustom", controllers.GetGuildNameA)
 	})
 
 	micro.Route("/guildstranslator", func(router fiber.Router) {
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuildTranslation)
-		router.Delete("/remove", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuildTranslation)
-		router.Patch("/update", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuildTranslation)
+		router.Post("/create", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.CreateGuildTranslation)
+		router.Delete("/remove", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.DeleteGuildTranslation)
+		router.Patch("/update", middleware.DeserializeUser, middleware.RequirePermission(permissions.GuildManage), controllers.UpdateGuildTranslation)
 	})
 
 	micro.Route("/profile", func(router fiber.Router) {
-		router.Get("/get", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetProfile)
-		router.Patch("/save", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateProfile)
-		router.Patch("/saveAdditional", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateProfileAdditional)
-		router.Patch("/photos", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateProfilePhotos)
-		router.Post("/documents", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.NewProfileDocuments)
-		router.Patch("/documents", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateProfileDocuments)
-		router.Delete("/documents/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DeleteProfileDocuments)
-		router.Post("/streaming/", controllers.UpdateProfileStreaming)
-		router.Delete("/streaming/:id", controllers.DeleteProfileStreaming)
+		router.Get("/get", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.GetProfile)
+		router.Patch("/save", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.UpdateProfile)
+		router.Patch("/saveAdditional", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.UpdateProfileAdditional)
+		router.Patch("/photos", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.UpdateProfilePhotos)
+		router.Post("/documents", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.NewProfileDocuments)
+		router.Patch("/documents", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.UpdateProfileDocuments)
+		router.Delete("/documents/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.DeleteProfileDocuments)
+		router.Post("/streaming/", middleware.RequireAPIKey(apikeys.ScopeStreaming), controllers.UpdateProfileStreaming)
+		router.Delete("/streaming/:id", middleware.RequireAPIKey(apikeys.ScopeStreaming), controllers.DeleteProfileStreaming)
 		router.Post("/streaming/donat", middleware.DeserializeUser, controllers.SendDonat)
 
-		router.Get("/getdocuments", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetDocuments)
+		router.Get("/getdocuments", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.GetDocuments)
 	})
 
 	micro.Route("/profiles", func(router fiber.Router) {
@@ -164,18 +254,20 @@ func Register(micro *fiber.App) {
 	micro.Route("/payment", func(router fiber.Router) {
 		router.Post("/invoice", middleware.DeserializeUser, controllers.CreateInvoice)
 		router.Post("/pending", controllers.Pending)
+		router.Post("/callback/:provider", controllers.PaymentCallback)
+		router.Post("/refund/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BillingRefund), controllers.RefundPayment)
 	})
 
 	micro.Route("/profilehashtags", func(router fiber.Router) {
-		router.Post("/addhashtag", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.AddHashTagProfile)
+		router.Post("/addhashtag", middleware.DeserializeUser, middleware.RequirePermission(permissions.ProfileEdit), controllers.AddHashTagProfile)
 		router.Get("/findTag", controllers.SearchHashTagProfile)
 		router.Get("/get", controllers.Get10RandomTags)
 
 	})
 
 	micro.Route("/blog", func(router fiber.Router) {
-		router.Get("/list", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetAllBlogs)
-		router.Post("/makearchive/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.SendToArchive)
+		router.Get("/list", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), controllers.GetAllBlogs)
+		router.Post("/makearchive/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), controllers.SendToArchive)
 		router.Post("/search", middleware.DeserializeUser, controllers.SearchBlogByTitle)
 		router.Post("/addblogtime", middleware.DeserializeUser, controllers.AddBlogTime)
 		router.Post("/addhashtag", middleware.DeserializeUser, controllers.AddHashTag)
@@ -197,34 +289,52 @@ func Register(micro *fiber.App) {
 		router.Get("/random", controllers.GetRandom)
 
 		router.Get("/:id", controllers.GetBlogById)
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), middleware.CheckProfileFilled(), controllers.CreateBlog)
+		router.Post("/create", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), middleware.CheckProfileFilled(), controllers.CreateBlog)
 		router.Post("/create/photos", middleware.DeserializeUser, controllers.CreateBlogPhoto)
-		router.Get("/edit/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.EditBlogGetId)
-		router.Patch("/patch/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateBlog)
-		router.Delete("/delete/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DeleteBlog)
+		router.Get("/edit/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), controllers.EditBlogGetId)
+		router.Patch("/patch/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), controllers.UpdateBlog)
+		router.Delete("/delete/:id", middleware.DeserializeUser, middleware.RequirePermission(permissions.BlogPublish), controllers.DeleteBlog)
 	})
 
 	micro.Route("/chat", func(router fiber.Router) {
-		router.Get("/room/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetRoomDetailsForDM)
-		router.Get("/rooms", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetSubscribedRoomsForDM)
-		router.Get("/newRooms", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetNewUnsubscribedRoomsForDM)
-		router.Get("/archivedRooms", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetUnsubscribedNotNewRoomsForDM)
-		router.Post("/createRoom", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.CreateChatRoomForDM)
-		router.Patch("/subscribe/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.SubscribeNewRoomForDM)
-		router.Patch("/unsubscribe/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UnsubscribeRoomForDM)
-
-		router.Get("/message/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetChatMessagesForDM)
-		router.Post("/message/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.SendMessageForDM)
-		router.Patch("/message/:messageId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.EditMessageForDM)
-		router.Delete("/message/:messageId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DeleteMessageForDM)
+		router.Get("/room/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetRoomDetailsForDM)
+		router.Get("/rooms", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetSubscribedRoomsForDM)
+		router.Get("/newRooms", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetNewUnsubscribedRoomsForDM)
+		router.Get("/archivedRooms", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetUnsubscribedNotNewRoomsForDM)
+		router.Post("/createRoom", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.CreateChatRoomForDM)
+		router.Patch("/subscribe/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.SubscribeNewRoomForDM)
+		router.Patch("/unsubscribe/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.UnsubscribeRoomForDM)
+
+		router.Post("/groups", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.CreateChatGroup)
+		router.Patch("/groups/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.UpdateChatGroup)
+		router.Post("/groups/:roomId/members", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.InviteChatGroupMembers)
+		router.Delete("/groups/:roomId/members/:userId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.KickChatGroupMember)
+		router.Patch("/groups/:roomId/members/:userId/role", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.SetChatGroupMemberRole)
+		router.Post("/groups/:roomId/leave", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.LeaveChatGroup)
+
+		router.Get("/message/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetChatMessagesForDM)
+		router.Get("/history/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetChatHistory)
+		router.Get("/sync", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.SyncChat)
+		router.Post("/message/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.SendMessageForDM)
+		router.Patch("/message/:messageId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.EditMessageForDM)
+		router.Delete("/message/:messageId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.DeleteMessageForDM)
+		router.Post("/message/:messageId/reactions", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.AddReaction)
+		router.Delete("/message/:messageId/reactions", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.RemoveReaction)
+		router.Put("/message/:messageId/pin", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.PinMessage)
+		router.Delete("/message/:messageId/pin", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.UnpinMessage)
+		router.Post("/message/:messageId/forward", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.ForwardMessage)
+		router.Get("/pins/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetPinnedMessages)
+		router.Post("/attachments/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.UploadChatAttachment)
+		router.Get("/attachment/:attachmentId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetChatAttachment)
+		router.Get("/attachment/:attachmentId/thumbnail", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetChatAttachmentThumbnail)
 		// Marks a message as read by the recipient
-		router.Patch("/read/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.MarkMessageAsReadForDM)
-		router.Patch("/unread/:roomId/:status", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.MarkMessageAsUnReadForDM)
+		router.Patch("/read/:roomId", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.MarkMessageAsReadForDM)
+		router.Patch("/unread/:roomId/:status", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.MarkMessageAsUnReadForDM)
 	})
 
 	micro.Route("/contrifugoToken", func(router fiber.Router) {
-		router.Get("/connection", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetCentrifugoConnectionToken)
-		router.Get("/subscription", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetCentrifugoSubscriptionToken)
+		router.Get("/connection", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetCentrifugoConnectionToken)
+		router.Get("/subscription", middleware.DeserializeUser, middleware.RequirePermission(permissions.ChatUse), controllers.GetCentrifugoSubscriptionToken)
 	})
 
 	micro.Route("/files", func(router fiber.Router) {
@@ -252,10 +362,10 @@ func Register(micro *fiber.App) {
 	})
 
 	micro.Route("/managebot", func(router fiber.Router) {
-		router.Post("/registerbot", controllers.SignUpBot)
-		router.Post("/deletebots", controllers.DeleteAllBotUsersWithRelations)
-		router.Patch("/updateprofile", controllers.UpdateBotProfile)
-		router.Patch("/updateadditionalinfo", controllers.UpdateBotProfileAdditional)
+		router.Post("/registerbot", middleware.RequireAPIKey(apikeys.ScopeBots), controllers.SignUpBot)
+		router.Post("/deletebots", middleware.RequireAPIKey(apikeys.ScopeBotsDelete), controllers.DeleteAllBotUsersWithRelations)
+		router.Patch("/updateprofile", middleware.RequireAPIKey(apikeys.ScopeBots), controllers.UpdateBotProfile)
+		router.Patch("/updateadditionalinfo", middleware.RequireAPIKey(apikeys.ScopeBots), controllers.UpdateBotProfileAdditional)
 	})
 
 	micro.All("*", func(c *fiber.Ctx) error {
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"hyperpage/controllers"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WellKnownRoute serves the documents other services discover us by, such
+// as the keys that verify our access tokens.
+func WellKnownRoute(a *fiber.App) {
+	route := a.Group("/.well-known")
+	route.Get("/jwks.json", controllers.GetJWKS)
+}
@@ -0,0 +1,252 @@
+// Package sessions keeps a registry of signed in devices in Redis. Every sign
+// in starts a session, the family of all tokens issued from it: access and
+// refresh tokens point at their session by token UUID, and a token is only
+// accepted while its session exists.
+package sessions
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/utils"
+
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	ErrRevoked  = errors.New("session is revoked or expired")
+	ErrReused   = errors.New("refresh token was already used")
+	ErrNotFound = errors.New("session not found")
+)
+
+// Session is one signed in device.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// rotate swaps the current refresh token of a session when the presented
+// one is still current. It returns 0 when the session is gone and -1 when
+// the presented token was already rotated.
+var rotate = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'refresh')
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'refresh', ARGV[2], 'last_seen_at', ARGV[3], 'expires_at', ARGV[4])
+redis.call('EXPIREAT', KEYS[1], ARGV[4])
+return 1
+`)
+
+// touch records the use of a session that still exists.
+var touch = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_seen_at', ARGV[1])
+return 1
+`)
+
+func sessionKey(id string) string      { return "session:" + id }
+func tokenKey(tokenUUID string) string { return "session_token:" + tokenUUID }
+func userKey(userID string) string     { return "user_sessions:" + userID }
+
+// Create registers a new session for a sign in and its first pair of
+// tokens.
+func Create(ctx context.Context, userID, device, ip string, access, refresh *utils.TokenDetails) (*Session, error) {
+	now := time.Now()
+	s := &Session{
+		ID:         uuid.NewV4().String(),
+		UserID:     userID,
+		Device:     device,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  time.Unix(*refresh.ExpiresIn, 0),
+	}
+
+	rdb := initializers.RedisClient
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(s.ID),
+			"user_id", s.UserID,
+			"device", s.Device,
+			"ip", s.IP,
+			"created_at", s.CreatedAt.Unix(),
+			"last_seen_at", s.LastSeenAt.Unix(),
+			"expires_at", s.ExpiresAt.Unix(),
+			"refresh", refresh.TokenUuid,
+		)
+		pipe.ExpireAt(ctx, sessionKey(s.ID), s.ExpiresAt)
+		pipe.SAdd(ctx, userKey(userID), s.ID)
+		addToken(ctx, pipe, s.ID, access)
+		addToken(ctx, pipe, s.ID, refresh)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rotate exchanges a refresh token for a new pair. Presenting a refresh
+// token that was already exchanged means it leaked, so the whole session is
+// revoked and ErrReused returned.
+func Rotate(ctx context.Context, refreshUUID string, access, refresh *utils.TokenDetails) (string, error) {
+	rdb := initializers.RedisClient
+	id, err := rdb.Get(ctx, tokenKey(refreshUUID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrRevoked
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	res, err := rotate.Run(ctx, rdb, []string{sessionKey(id)},
+		refreshUUID, refresh.TokenUuid, now.Unix(), *refresh.ExpiresIn).Int()
+	if err != nil {
+		return "", err
+	}
+	switch res {
+	case 0:
+		return "", ErrRevoked
+	case -1:
+		userID, _ := rdb.HGet(ctx, sessionKey(id), "user_id").Result()
+		log.Printf("Refresh token reuse in session %s of user %s, revoking it", id, userID)
+		if err := revoke(ctx, userID, id); err != nil {
+			return "", err
+		}
+		return "", ErrReused
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		addToken(ctx, pipe, id, access)
+		addToken(ctx, pipe, id, refresh)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Check returns the session of a token, or ErrRevoked when the session was
+// revoked, expired or the token was never registered.
+func Check(ctx context.Context, tokenUUID string) (string, error) {
+	rdb := initializers.RedisClient
+	id, err := rdb.Get(ctx, tokenKey(tokenUUID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrRevoked
+	}
+	if err != nil {
+		return "", err
+	}
+
+	alive, err := touch.Run(ctx, rdb, []string{sessionKey(id)}, time.Now().Unix()).Int()
+	if err != nil {
+		return "", err
+	}
+	if alive == 0 {
+		return "", ErrRevoked
+	}
+	return id, nil
+}
+
+// List returns the active sessions of a user, the most recently used first.
+func List(ctx context.Context, userID string) ([]Session, error) {
+	rdb := initializers.RedisClient
+	ids, err := rdb.SMembers(ctx, userKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		fields, err := rdb.HGetAll(ctx, sessionKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			// Expired, forget it
+			rdb.SRem(ctx, userKey(userID), id)
+			continue
+		}
+		list = append(list, Session{
+			ID:         id,
+			UserID:     fields["user_id"],
+			Device:     fields["device"],
+			IP:         fields["ip"],
+			CreatedAt:  unix(fields["created_at"]),
+			LastSeenAt: unix(fields["last_seen_at"]),
+			ExpiresAt:  unix(fields["expires_at"]),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeenAt.After(list[j].LastSeenAt) })
+	return list, nil
+}
+
+// Revoke signs a device out. Its tokens stop working at once.
+func Revoke(ctx context.Context, userID, id string) error {
+	owner, err := initializers.RedisClient.HGet(ctx, sessionKey(id), "user_id").Result()
+	if errors.Is(err, redis.Nil) || owner != userID {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return revoke(ctx, userID, id)
+}
+
+// RevokeAll signs out every device of a user except the session keep, which
+// may be empty.
+func RevokeAll(ctx context.Context, userID, keep string) error {
+	ids, err := initializers.RedisClient.SMembers(ctx, userKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == keep {
+			continue
+		}
+		if err := revoke(ctx, userID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revoke(ctx context.Context, userID, id string) error {
+	_, err := initializers.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userKey(userID), id)
+		return nil
+	})
+	return err
+}
+
+// addToken points a token at its session until the token expires.
+func addToken(ctx context.Context, pipe redis.Pipeliner, id string, token *utils.TokenDetails) {
+	pipe.Set(ctx, tokenKey(token.TokenUuid), id, 0)
+	pipe.ExpireAt(ctx, tokenKey(token.TokenUuid), time.Unix(*token.ExpiresIn, 0))
+}
+
+func unix(v string) time.Time {
+	sec, _ := strconv.ParseInt(v, 10, 64)
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,305 @@
+// Package signing keeps the RSA keys that sign access and refresh tokens.
+//
+// Keys live in the signing_keys table and move through a rotation: a next
+// key is published in the JWKS but signs nothing yet, the active key signs
+// new tokens, a retiring key only verifies tokens it signed before, and a
+// retired key is gone. The keys of ACCESS_TOKEN_PRIVATE_KEY and
+// REFRESH_TOKEN_PRIVATE_KEY keep signing while the table has no active key
+// for their use, and keep verifying until they are retired or unset. Lookups
+// go through a short lived in-memory cache.
+package signing
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Key uses.
+const (
+	Access  = "access"
+	Refresh = "refresh"
+)
+
+// Key statuses, in the order of a rotation.
+const (
+	StatusNext     = "next"
+	StatusActive   = "active"
+	StatusRetiring = "retiring"
+	StatusRetired  = "retired"
+	// StatusLegacy marks the key of the environment while the table does
+	// not know it.
+	StatusLegacy = "legacy"
+)
+
+var (
+	ErrNoKey      = errors.New("no signing key")
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// cacheTTL bounds how long other instances use a key ring after a rotation.
+const cacheTTL = time.Minute
+
+// Key is a usable key of the ring. Private is nil for keys that only verify.
+type Key struct {
+	KID     string
+	Use     string
+	Status  string
+	Private *rsa.PrivateKey
+	Public  *rsa.PublicKey
+	since   time.Time
+}
+
+var ring = struct {
+	sync.RWMutex
+	legacy map[string]*Key
+	keys   map[string][]*Key
+	loaded time.Time
+}{}
+
+// Configure loads the keys of the environment. They are base64 encoded PEM,
+// like the rest of the token settings.
+func Configure(config *initializers.Config) error {
+	legacy := map[string]*Key{}
+	for _, k := range []struct{ use, private, public string }{
+		{Access, config.AccessTokenPrivateKey, config.AccessTokenPublicKey},
+		{Refresh, config.RefreshTokenPrivateKey, config.RefreshTokenPublicKey},
+	} {
+		key, err := legacyKey(k.use, k.private, k.public)
+		if err != nil {
+			return fmt.Errorf("%s token key: %w", k.use, err)
+		}
+		if key != nil {
+			legacy[k.use] = key
+		}
+	}
+
+	ring.Lock()
+	ring.legacy = legacy
+	ring.keys = nil
+	ring.Unlock()
+	return nil
+}
+
+func legacyKey(use, private, public string) (*Key, error) {
+	key := &Key{Use: use, Status: StatusLegacy}
+	if private != "" {
+		pem, err := base64.StdEncoding.DecodeString(private)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode private key: %w", err)
+		}
+		if key.Private, err = jwt.ParseRSAPrivateKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("parse private key: %w", err)
+		}
+		key.Public = &key.Private.PublicKey
+	} else if public != "" {
+		pem, err := base64.StdEncoding.DecodeString(public)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode public key: %w", err)
+		}
+		if key.Public, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+	} else {
+		return nil, nil
+	}
+	key.KID = Thumbprint(key.Public)
+	return key, nil
+}
+
+// Invalidate drops the cache after the ring changed.
+func Invalidate() {
+	ring.Lock()
+	ring.keys = nil
+	ring.Unlock()
+}
+
+// keysOf returns the keys of a use that still verify, the signing key
+// first.
+func keysOf(use string) []*Key {
+	ring.RLock()
+	fresh := ring.keys != nil && time.Since(ring.loaded) < cacheTTL
+	keys := ring.keys[use]
+	ring.RUnlock()
+	if fresh {
+		return keys
+	}
+
+	loaded, err := load(initializers.DB)
+	if err != nil {
+		// Without the table only the environment is known
+		ring.RLock()
+		defer ring.RUnlock()
+		if key := ring.legacy[use]; key != nil {
+			return []*Key{key}
+		}
+		return nil
+	}
+	return loaded[use]
+}
+
+func load(db *gorm.DB) (map[string][]*Key, error) {
+	var rows []models.SigningKey
+	if err := db.Where("status <> ?", StatusRetired).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// The table knows about environment keys that were imported or retired
+	var retired []string
+	if err := db.Model(&models.SigningKey{}).Where("status = ?", StatusRetired).Pluck("kid", &retired).Error; err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, kid := range retired {
+		known[kid] = true
+	}
+
+	keys := map[string][]*Key{}
+	for _, row := range rows {
+		key, err := parse(row)
+		if err != nil {
+			continue
+		}
+		known[key.KID] = true
+		keys[key.Use] = append(keys[key.Use], key)
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+	for use, key := range ring.legacy {
+		if !known[key.KID] {
+			keys[use] = append(keys[use], key)
+		}
+	}
+	for _, list := range keys {
+		sort.SliceStable(list, func(i, j int) bool { return rank(list[i]) < rank(list[j]) })
+	}
+	ring.keys = keys
+	ring.loaded = time.Now()
+	return keys, nil
+}
+
+// rank orders the keys of a use: the newest active key signs, the
+// environment key signs when the table has none.
+func rank(k *Key) int64 {
+	switch k.Status {
+	case StatusActive:
+		return -k.since.Unix()
+	case StatusLegacy:
+		return 1 << 40
+	case StatusRetiring:
+		return 1 << 41
+	default:
+		return 1 << 42
+	}
+}
+
+func parse(row models.SigningKey) (*Key, error) {
+	key := &Key{KID: row.KID, Use: row.Use, Status: row.Status, since: row.CreatedAt}
+	if row.ActivatedAt != nil {
+		key.since = *row.ActivatedAt
+	}
+	var err error
+	if row.PrivateKey != "" {
+		if key.Private, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(row.PrivateKey)); err != nil {
+			return nil, err
+		}
+	}
+	if key.Public, err = jwt.ParseRSAPublicKeyFromPEM([]byte(row.PublicKey)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Signer returns the key that signs new tokens of a use.
+func Signer(use string) (*Key, error) {
+	for _, key := range keysOf(use) {
+		if key.Private == nil {
+			continue
+		}
+		if key.Status == StatusActive || key.Status == StatusLegacy {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %s tokens", ErrNoKey, use)
+}
+
+// Verifier returns the public key of a kid for tokens of a use.
+func Verifier(use, kid string) (*rsa.PublicKey, error) {
+	for _, key := range keysOf(use) {
+		if key.KID == kid && key.Status != StatusNext {
+			return key.Public, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+// Verifiers returns every public key that verifies tokens of a use, for
+// tokens signed before keys had IDs.
+func Verifiers(use string) []*rsa.PublicKey {
+	var keys []*rsa.PublicKey
+	for _, key := range keysOf(use) {
+		if key.Status != StatusNext {
+			keys = append(keys, key.Public)
+		}
+	}
+	return keys
+}
+
+// JWK is one public key of a JSON Web Key Set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func jwk(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// JWKS returns the public keys of access tokens, including the next key,
+// so other services know it before it signs anything.
+func JWKS() []JWK {
+	keys := []JWK{}
+	for _, key := range keysOf(Access) {
+		keys = append(keys, jwk(key.KID, key.Public))
+	}
+	return keys
+}
+
+// Thumbprint is the RFC 7638 SHA-256 thumbprint of a public key, used as
+// its kid.
+func Thumbprint(key *rsa.PublicKey) string {
+	k := jwk("", key)
+	// Members in lexicographic order, no whitespace
+	data, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{k.E, k.Kty, k.N})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
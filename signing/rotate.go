@@ -0,0 +1,215 @@
+package signing
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+)
+
+// KeyBits is the size of generated keys.
+const KeyBits = 2048
+
+var (
+	ErrUnknownUse   = errors.New("use must be access or refresh")
+	ErrKeyNotFound  = errors.New("signing key not found")
+	ErrKeyActive    = errors.New("the active key cannot be retired, activate another key first")
+	ErrKeyRetired   = errors.New("signing key is retired")
+	ErrNoPrivateKey = errors.New("signing key has no private key")
+)
+
+func checkUse(use string) error {
+	if use != Access && use != Refresh {
+		return ErrUnknownUse
+	}
+	return nil
+}
+
+// List returns the keys of the table, newest first.
+func List(db *gorm.DB) ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	err := db.Order("use, created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// Generate creates a next key for a use. It is published at once and signs
+// nothing until it is activated.
+func Generate(db *gorm.DB, use string) (*models.SigningKey, error) {
+	if err := checkUse(use); err != nil {
+		return nil, err
+	}
+	private, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return store(db, use, StatusNext, private, nil)
+}
+
+// Import copies the keys of the environment into the table as active keys
+// of their use, unless the table already has one. Their tokens keep
+// validating after the environment variables are removed.
+func Import(db *gorm.DB) ([]models.SigningKey, error) {
+	ring.RLock()
+	legacy := ring.legacy
+	ring.RUnlock()
+
+	var imported []models.SigningKey
+	for _, use := range []string{Access, Refresh} {
+		key := legacy[use]
+		if key == nil || key.Private == nil {
+			continue
+		}
+		var count int64
+		if err := db.Model(&models.SigningKey{}).Where("kid = ? OR (use = ? AND status = ?)", key.KID, use, StatusActive).Count(&count).Error; err != nil {
+			return imported, err
+		}
+		if count > 0 {
+			continue
+		}
+		now := time.Now()
+		row, err := store(db, use, StatusActive, key.Private, &now)
+		if err != nil {
+			return imported, err
+		}
+		imported = append(imported, *row)
+	}
+	return imported, nil
+}
+
+func store(db *gorm.DB, use, status string, private *rsa.PrivateKey, activatedAt *time.Time) (*models.SigningKey, error) {
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	row := &models.SigningKey{
+		KID:         Thumbprint(&private.PublicKey),
+		Use:         use,
+		Status:      status,
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})),
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+		ActivatedAt: activatedAt,
+	}
+	if err := db.Create(row).Error; err != nil {
+		return nil, err
+	}
+	Invalidate()
+	return row, nil
+}
+
+func find(db *gorm.DB, kid string) (*models.SigningKey, error) {
+	var key models.SigningKey
+	err := db.First(&key, "kid = ?", kid).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	return &key, err
+}
+
+// Activate makes a key sign new tokens of its use. The key that signed
+// before becomes retiring and keeps verifying its tokens.
+func Activate(db *gorm.DB, kid string) (*models.SigningKey, error) {
+	key, err := find(db, kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.Status == StatusRetired {
+		return nil, ErrKeyRetired
+	}
+	if key.PrivateKey == "" {
+		return nil, ErrNoPrivateKey
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SigningKey{}).
+			Where("use = ? AND status = ? AND kid <> ?", key.Use, StatusActive, key.KID).
+			Update("status", StatusRetiring).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		key.Status = StatusActive
+		key.ActivatedAt = &now
+		return tx.Save(key).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The environment key of the use stops signing too
+	if err := retireLegacy(db, key.Use, StatusRetiring); err != nil {
+		return nil, err
+	}
+	Invalidate()
+	return key, nil
+}
+
+// retireLegacy records the environment key of a use with a status, so the
+// table decides about it from now on.
+func retireLegacy(db *gorm.DB, use, status string) error {
+	ring.RLock()
+	key := ring.legacy[use]
+	ring.RUnlock()
+	if key == nil {
+		return nil
+	}
+
+	var count int64
+	if err := db.Model(&models.SigningKey{}).Where("kid = ?", key.KID).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		return err
+	}
+	return db.Create(&models.SigningKey{
+		KID:       key.KID,
+		Use:       use,
+		Status:    status,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+	}).Error
+}
+
+// Retire stops a key from verifying. Tokens it signed are rejected from now
+// on, so wait for them to expire first. The private key is wiped.
+func Retire(db *gorm.DB, kid string) (*models.SigningKey, error) {
+	key, err := find(db, kid)
+	if errors.Is(err, ErrKeyNotFound) {
+		// An environment key the table never saw
+		for _, use := range []string{Access, Refresh} {
+			ring.RLock()
+			legacy := ring.legacy[use]
+			ring.RUnlock()
+			if legacy != nil && legacy.KID == kid {
+				if signer, err := Signer(use); err == nil && signer.KID == kid {
+					return nil, ErrKeyActive
+				}
+				if err := retireLegacy(db, use, StatusRetired); err != nil {
+					return nil, err
+				}
+				Invalidate()
+				return find(db, kid)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Status == StatusActive {
+		return nil, ErrKeyActive
+	}
+
+	now := time.Now()
+	key.Status = StatusRetired
+	key.PrivateKey = ""
+	key.RetiredAt = &now
+	if err := db.Save(key).Error; err != nil {
+		return nil, err
+	}
+	Invalidate()
+	return key, nil
+}
@@ -0,0 +1,91 @@
+package statements
+
+import (
+	"log"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"gorm.io/gorm"
+)
+
+// MonthOf returns the calendar month containing t as [from, to).
+func MonthOf(t time.Time) (time.Time, time.Time) {
+	from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return from, from.AddDate(0, 1, 0)
+}
+
+// Email sends a statement to the user. The CSV is always attached, the PDF
+// too when asked for; a PDF that fails to render is logged and left out.
+func Email(config *initializers.Config, user *models.User, st *ledger.Statement, format, language string) error {
+	csvData, err := CSV(st)
+	if err != nil {
+		return err
+	}
+	attachments := []utils.Attachment{{Name: FileName(st, FormatCSV), Data: csvData}}
+
+	if format == FormatPDF {
+		pdf, err := PDF(config, st, Holder{Name: user.Name, Email: user.Email}, language)
+		if err != nil {
+			log.Printf("Could not render statement PDF for %s: %v", user.ID, err)
+		} else {
+			attachments = append(attachments, utils.Attachment{Name: FileName(st, FormatPDF), Data: pdf})
+		}
+	}
+
+	language = Language(language)
+	subject := "Account statement " + Period(st)
+	if language == "ru" {
+		subject = "Выписка по счёту " + Period(st)
+	}
+
+	utils.SendEmail(user, &utils.StatementEmail{
+		Subject:     subject,
+		Name:        user.Name,
+		Period:      Period(st),
+		Opening:     money(st.Opening, st.Currency),
+		Credits:     money(st.Credits, st.Currency),
+		Debits:      money(st.Debits, st.Currency),
+		Closing:     money(st.Closing, st.Currency),
+		Attachments: attachments,
+	}, "Statement", language)
+
+	return nil
+}
+
+// SendScheduled emails last month's statement to every subscribed user that
+// has not received it yet. It is safe to run daily.
+func SendScheduled(db *gorm.DB, config *initializers.Config, now time.Time) {
+	from, to := MonthOf(now.AddDate(0, -1, 0))
+	period := from.Format("2006-01")
+
+	var schedules []models.StatementSchedule
+	if err := db.Where("last_period <> ?", period).Find(&schedules).Error; err != nil {
+		log.Println("Failed to load statement schedules:", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		var user models.User
+		if err := db.First(&user, "id = ?", schedule.UserID).Error; err != nil {
+			log.Printf("Failed to load user %s for statement: %v", schedule.UserID, err)
+			continue
+		}
+
+		st, err := ledger.BuildStatement(db, user.ID, from, to)
+		if err != nil {
+			log.Printf("Failed to build statement for %s: %v", user.ID, err)
+			continue
+		}
+
+		if err := Email(config, &user, st, schedule.Format, schedule.Language); err != nil {
+			log.Printf("Failed to send statement to %s: %v", user.ID, err)
+			continue
+		}
+
+		db.Model(&schedule).Update("last_period", period)
+	}
+}
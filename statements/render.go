@@ -0,0 +1,219 @@
+package statements
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/currency"
+	"hyperpage/initializers"
+	"hyperpage/ledger"
+	"hyperpage/utils"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatPDF  = "pdf"
+	FormatHTML = "html"
+
+	// DefaultPDFRenderer is used when PDF_RENDERER is not configured.
+	DefaultPDFRenderer = "wkhtmltopdf"
+	renderTimeout      = time.Minute
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported statement format")
+
+// Holder is the account owner printed on a statement.
+type Holder struct {
+	Name  string
+	Email string
+}
+
+type documentLine struct {
+	Date        string
+	Module      string
+	Description string
+	Amount      string
+}
+
+type documentModule struct {
+	Module  string
+	Credits string
+	Debits  string
+}
+
+type document struct {
+	Name        string
+	Email       string
+	Period      string
+	Opening     string
+	Credits     string
+	Debits      string
+	Closing     string
+	Lines       []documentLine
+	Modules     []documentModule
+	GeneratedAt string
+}
+
+// Period formats the statement dates, the end date being inclusive.
+func Period(st *ledger.Statement) string {
+	return st.From.Format("02.01.2006") + " – " + st.To.AddDate(0, 0, -1).Format("02.01.2006")
+}
+
+// Language returns the template language for a requested one. Statements
+// are translated to English and Russian only.
+func Language(language string) string {
+	if language == "ru" {
+		return "ru"
+	}
+	return "en"
+}
+
+// FileName is the download name of a statement.
+func FileName(st *ledger.Statement, format string) string {
+	return "statement_" + st.From.Format("2006-01-02") + "_" + st.To.AddDate(0, 0, -1).Format("2006-01-02") + "." + format
+}
+
+// CSV writes the statement as a spreadsheet friendly table: a summary, the
+// totals by module and every movement.
+func CSV(st *ledger.Statement) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	records := [][]string{
+		{"period_from", st.From.Format("2006-01-02")},
+		{"period_to", st.To.AddDate(0, 0, -1).Format("2006-01-02")},
+		{"currency", st.Currency},
+		{"opening_balance", amount(st.Opening)},
+		{"credits", amount(st.Credits)},
+		{"debits", amount(st.Debits)},
+		{"closing_balance", amount(st.Closing)},
+		{},
+		{"module", "credits", "debits"},
+	}
+	for _, m := range st.Modules {
+		records = append(records, []string{m.Module, amount(m.Credits), amount(m.Debits)})
+	}
+	records = append(records, []string{}, []string{"date", "posting_id", "module", "description", "amount"})
+	for _, l := range st.Lines {
+		records = append(records, []string{
+			l.Date.Format(time.RFC3339),
+			strconv.FormatUint(l.PostingID, 10),
+			l.Module,
+			l.Description,
+			amount(l.Amount),
+		})
+	}
+
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HTML renders the StatementDocument template of the language.
+func HTML(st *ledger.Statement, holder Holder, language string) ([]byte, error) {
+	doc := document{
+		Name:        holder.Name,
+		Email:       holder.Email,
+		Period:      Period(st),
+		Opening:     money(st.Opening, st.Currency),
+		Credits:     money(st.Credits, st.Currency),
+		Debits:      money(st.Debits, st.Currency),
+		Closing:     money(st.Closing, st.Currency),
+		GeneratedAt: time.Now().Format("02.01.2006 15:04"),
+	}
+	for _, m := range st.Modules {
+		doc.Modules = append(doc.Modules, documentModule{Module: m.Module, Credits: money(m.Credits, st.Currency), Debits: money(m.Debits, st.Currency)})
+	}
+	for _, l := range st.Lines {
+		doc.Lines = append(doc.Lines, documentLine{
+			Date:        l.Date.Format("02.01.2006 15:04"),
+			Module:      l.Module,
+			Description: l.Description,
+			Amount:      money(l.Amount, st.Currency),
+		})
+	}
+
+	tmpl, err := utils.ParseTemplateDir("templates")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "StatementDocument_"+Language(language)+".html", doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PDF prints the HTML statement with the configured renderer. wkhtmltopdf
+// reads and writes through pipes, chromium needs files.
+func PDF(config *initializers.Config, st *ledger.Statement, holder Holder, language string) ([]byte, error) {
+	html, err := HTML(st, holder, language)
+	if err != nil {
+		return nil, err
+	}
+
+	renderer := config.PDFRenderer
+	if renderer == "" {
+		renderer = DefaultPDFRenderer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+
+	if strings.Contains(filepath.Base(renderer), "chrom") {
+		return chromiumPDF(ctx, renderer, html)
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, renderer, "--quiet", "--encoding", "utf-8", "-", "-")
+	cmd.Stdin = bytes.NewReader(html)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", renderer, err, stderr.String())
+	}
+	return out.Bytes(), nil
+}
+
+func chromiumPDF(ctx context.Context, renderer string, html []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "statement")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "statement.html")
+	output := filepath.Join(dir, "statement.pdf")
+	if err := os.WriteFile(input, html, 0o600); err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, renderer,
+		"--headless", "--disable-gpu", "--no-sandbox", "--no-pdf-header-footer",
+		"--print-to-pdf="+output, "file://"+input)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", renderer, err, stderr.String())
+	}
+	return os.ReadFile(output)
+}
+
+func amount(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func money(v float64, code string) string {
+	return currency.Format(v, code)
+}
@@ -0,0 +1,176 @@
+package subscriptions
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ProcessRenewals runs the daily subscription lifecycle:
+//
+//   - subscriptions close to the end of their period are renewed from the
+//     balance; a failed attempt is retried and the user is notified,
+//   - a subscription whose period ended without renewal enters a grace period
+//     in which it keeps the plan while renewal is retried,
+//   - subscriptions past their grace period, or cancelled ones past their
+//     period, expire and the user goes back to the free plan.
+func ProcessRenewals(db *gorm.DB, now time.Time) {
+	var subs []models.Subscription
+	err := db.Where("status IN ?", []string{
+		models.SubscriptionStatusActive,
+		models.SubscriptionStatusGrace,
+		models.SubscriptionStatusCanceled,
+	}).Where("current_period_end <= ?", now.Add(RenewalWindow)).Find(&subs).Error
+	if err != nil {
+		log.Println("Failed to load subscriptions for renewal:", err)
+		return
+	}
+
+	for _, sub := range subs {
+		if err := processOne(db, sub.ID, now); err != nil {
+			log.Printf("Failed to process subscription %d: %v", sub.ID, err)
+		}
+	}
+
+	expireLegacyPlans(db, now)
+}
+
+func processOne(db *gorm.DB, id uint64, now time.Time) error {
+	var notice *models.Notification
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		sub := new(models.Subscription)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Preload("Plan").
+			First(sub, id).Error
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case sub.Status == models.SubscriptionStatusCanceled:
+			if now.Before(sub.CurrentPeriodEnd) {
+				return nil
+			}
+			notice = notification(sub, "Подписка завершена", "Срок действия тарифа "+sub.Plan.Name+" истёк.")
+			return expire(tx, sub, now)
+
+		case sub.Status == models.SubscriptionStatusGrace && sub.GraceUntil != nil && !now.Before(*sub.GraceUntil):
+			notice = notification(sub, "Подписка завершена", "Не удалось продлить тариф "+sub.Plan.Name+", он отключён. Пополните баланс и оформите тариф заново.")
+			return expire(tx, sub, now)
+
+		case !sub.Plan.Active:
+			// Retired plans are not renewed, they run out like a cancellation.
+			sub.Status = models.SubscriptionStatusCanceled
+			sub.AutoRenew = false
+			return tx.Omit("Plan").Save(sub).Error
+		}
+
+		if sub.LastAttemptAt != nil && now.Sub(*sub.LastAttemptAt) < RetryInterval {
+			return nil
+		}
+
+		renewErr := renew(tx, sub, now)
+		if renewErr == nil {
+			return syncUser(tx, sub.UserID, &sub.Plan, &sub.CurrentPeriodEnd)
+		}
+		if !errors.Is(renewErr, ledger.ErrInsufficientFunds) && !errors.Is(renewErr, ledger.ErrAccountInDebt) {
+			return renewErr
+		}
+
+		sub.RenewalAttempts++
+		sub.LastAttemptAt = &now
+		if sub.Status == models.SubscriptionStatusActive && !now.Before(sub.CurrentPeriodEnd) {
+			graceUntil := sub.CurrentPeriodEnd.Add(GracePeriod)
+			sub.Status = models.SubscriptionStatusGrace
+			sub.GraceUntil = &graceUntil
+		}
+		notice = notification(sub, "Не удалось продлить подписку", "На балансе недостаточно средств для продления тарифа "+sub.Plan.Name+". Пополните баланс, чтобы сохранить тариф.")
+
+		return tx.Omit("Plan").Save(sub).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if notice != nil {
+		return db.Create(notice).Error
+	}
+	return nil
+}
+
+// renew charges one more period. The new period continues from the old end,
+// so days spent in grace are paid for.
+func renew(tx *gorm.DB, sub *models.Subscription, now time.Time) error {
+	// The posting runs in a savepoint, so a failed charge leaves the outer
+	// transaction usable for recording the attempt. A plan made free since
+	// renews without one.
+	if sub.Plan.Price > 0 {
+		_, err := ledger.Debit(tx, sub.UserID, ledger.AccountRevenue, sub.Plan.Price, ledger.Posting{
+			Module:      "Subscription",
+			ElementId:   sub.PlanID,
+			Description: "Продление тарифа " + sub.Plan.Name,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	sub.Status = models.SubscriptionStatusActive
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = sub.CurrentPeriodEnd.AddDate(0, 0, sub.Plan.PeriodDays)
+	sub.GraceUntil = nil
+	sub.RenewalAttempts = 0
+	sub.LastAttemptAt = &now
+
+	return tx.Omit("Plan").Save(sub).Error
+}
+
+// expireLegacyPlans downgrades users whose plan was bought before
+// subscriptions existed and has no subscription record.
+func expireLegacyPlans(db *gorm.DB, now time.Time) {
+	var users []models.User
+	err := db.Where("expired_plan_at < ?", now).
+		Where("NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = users.id)").
+		Find(&users).Error
+	if err != nil {
+		log.Println("Failed to load expired plans:", err)
+		return
+	}
+
+	for _, user := range users {
+		err := db.Model(&models.User{}).
+			Where("id = ?", user.ID).
+			Updates(map[string]interface{}{
+				"plan":            FreePlan,
+				"signed":          false,
+				"expired_plan_at": nil,
+				"limit_storage":   FreePlanLimitStorage,
+			}).Error
+		if err != nil {
+			log.Printf("Failed to downgrade user %s: %v", user.ID, err)
+			continue
+		}
+		db.Create(&models.Notification{
+			Title:     "Подписка завершена",
+			Message:   "Срок действия тарифа " + user.Plan + " истёк.",
+			UserID:    user.ID,
+			CreatedAt: now,
+		})
+	}
+}
+
+func notification(sub *models.Subscription, title, message string) *models.Notification {
+	return &models.Notification{
+		Title:     title,
+		Message:   message,
+		UserID:    sub.UserID,
+		CreatedAt: time.Now(),
+	}
+}
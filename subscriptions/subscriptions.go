@@ -0,0 +1,248 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"hyperpage/ledger"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// FreePlan is the plan users fall back to when a subscription ends.
+	FreePlan             = "standart"
+	FreePlanLimitStorage = 20
+
+	// RenewalWindow is how long before the period end renewal is attempted.
+	RenewalWindow = 24 * time.Hour
+	// RetryInterval separates two renewal attempts of one subscription.
+	RetryInterval = 20 * time.Hour
+	// GracePeriod keeps the plan after a failed renewal while retries go on.
+	GracePeriod = 3 * 24 * time.Hour
+)
+
+var (
+	ErrPlanNotFound   = errors.New("plan not found")
+	ErrAlreadyOnPlan  = errors.New("already subscribed to this plan")
+	ErrNoSubscription = errors.New("no active subscription")
+)
+
+// Plans returns the active plans in display order.
+func Plans(db *gorm.DB) ([]models.SubscriptionPlan, error) {
+	var plans []models.SubscriptionPlan
+	err := db.Where("active = ?", true).Order("sort_order, price").Find(&plans).Error
+	return plans, err
+}
+
+// Current returns the subscription of a user with its plan.
+func Current(db *gorm.DB, userID uuid.UUID) (*models.Subscription, error) {
+	sub := new(models.Subscription)
+	err := db.Preload("Plan").Where("user_id = ?", userID).First(sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNoSubscription
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// HasFeature reports whether the user's current plan enables a feature flag.
+func HasFeature(db *gorm.DB, userID uuid.UUID, feature string) bool {
+	sub, err := Current(db, userID)
+	if err != nil || !isLive(sub) {
+		return false
+	}
+
+	var features map[string]bool
+	if err := json.Unmarshal(sub.Plan.Features, &features); err != nil {
+		return false
+	}
+	return features[feature]
+}
+
+// Subscribe moves a user onto a plan and charges the balance. When the user
+// switches from another paid plan, the unused part of the current period is
+// credited against the new price; a downgrade that costs less than the
+// credit pays the difference back to the balance. The new plan always starts
+// a full period from now.
+func Subscribe(db *gorm.DB, userID uuid.UUID, planName string, now time.Time) (*models.Subscription, error) {
+	var result *models.Subscription
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		plan := new(models.SubscriptionPlan)
+		err := tx.Where("name = ? AND active = ?", planName, true).First(plan).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPlanNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		sub := new(models.Subscription)
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Preload("Plan").
+			Where("user_id = ?", userID).
+			First(sub).Error
+		exists := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var credit float64
+		if exists && isLive(sub) {
+			if sub.PlanID == plan.ID && sub.Status != models.SubscriptionStatusGrace {
+				return ErrAlreadyOnPlan
+			}
+			credit = unusedValue(sub, now)
+		}
+
+		charge := round2(plan.Price - credit)
+		switch {
+		case charge > 0:
+			_, err = ledger.Debit(tx, userID, ledger.AccountRevenue, charge, ledger.Posting{
+				Module:      "Subscription",
+				ElementId:   plan.ID,
+				Description: "Оплата за тариф " + plan.Name,
+			})
+		case charge < 0:
+			_, err = ledger.Credit(tx, userID, ledger.AccountRevenue, -charge, ledger.Posting{
+				Module:      "Subscription",
+				ElementId:   plan.ID,
+				Description: "Возврат за неиспользованный период тарифа",
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		if plan.Price == 0 {
+			// Switching to a free plan ends the paid subscription right away.
+			if exists {
+				if err := expire(tx, sub, now); err != nil {
+					return err
+				}
+			}
+			result = sub
+			return nil
+		}
+
+		sub.UserID = userID
+		sub.PlanID = plan.ID
+		sub.Plan = *plan
+		sub.Status = models.SubscriptionStatusActive
+		sub.AutoRenew = true
+		sub.CurrentPeriodStart = now
+		sub.CurrentPeriodEnd = now.AddDate(0, 0, plan.PeriodDays)
+		sub.GraceUntil = nil
+		sub.RenewalAttempts = 0
+		sub.LastAttemptAt = nil
+		if err := tx.Omit("Plan").Save(sub).Error; err != nil {
+			return err
+		}
+
+		result = sub
+		return syncUser(tx, userID, plan, &sub.CurrentPeriodEnd)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SetAutoRenew turns automatic renewal on or off. A subscription without
+// auto renewal simply ends with its current period.
+func SetAutoRenew(db *gorm.DB, userID uuid.UUID, autoRenew bool) (*models.Subscription, error) {
+	sub, err := Current(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isLive(sub) {
+		return nil, ErrNoSubscription
+	}
+
+	status := models.SubscriptionStatusActive
+	if !autoRenew {
+		status = models.SubscriptionStatusCanceled
+	}
+	if sub.Status == models.SubscriptionStatusGrace && autoRenew {
+		status = models.SubscriptionStatusGrace
+	}
+
+	err = db.Model(sub).Updates(map[string]interface{}{
+		"auto_renew": autoRenew,
+		"status":     status,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	sub.AutoRenew = autoRenew
+	sub.Status = status
+
+	return sub, nil
+}
+
+// isLive reports whether the subscription still grants its plan.
+func isLive(sub *models.Subscription) bool {
+	switch sub.Status {
+	case models.SubscriptionStatusActive, models.SubscriptionStatusGrace, models.SubscriptionStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// unusedValue is the share of the paid price not yet consumed.
+func unusedValue(sub *models.Subscription, now time.Time) float64 {
+	if sub.Status == models.SubscriptionStatusGrace || !now.Before(sub.CurrentPeriodEnd) {
+		return 0
+	}
+	total := sub.CurrentPeriodEnd.Sub(sub.CurrentPeriodStart)
+	if total <= 0 {
+		return 0
+	}
+	left := sub.CurrentPeriodEnd.Sub(now)
+	return round2(sub.Plan.Price * float64(left) / float64(total))
+}
+
+// syncUser mirrors the plan onto the user columns the rest of the code reads.
+func syncUser(tx *gorm.DB, userID uuid.UUID, plan *models.SubscriptionPlan, expiresAt *time.Time) error {
+	return tx.Model(&models.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"plan":            plan.Name,
+			"signed":          true,
+			"limit_storage":   plan.LimitStorage,
+			"expired_plan_at": expiresAt,
+		}).Error
+}
+
+// expire ends a subscription and puts the user back on the free plan.
+func expire(tx *gorm.DB, sub *models.Subscription, now time.Time) error {
+	sub.Status = models.SubscriptionStatusExpired
+	sub.AutoRenew = false
+	sub.GraceUntil = nil
+	sub.CurrentPeriodEnd = now
+	if err := tx.Omit("Plan").Save(sub).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&models.User{}).
+		Where("id = ?", sub.UserID).
+		Updates(map[string]interface{}{
+			"plan":            FreePlan,
+			"signed":          false,
+			"limit_storage":   FreePlanLimitStorage,
+			"expired_plan_at": nil,
+		}).Error
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,27 @@
+package testdb
+
+import (
+	"testing"
+
+	"hyperpage/initializers"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis starts an in-memory Redis server, installs a client of it as
+// initializers.RedisClient and puts the previous client back when the test
+// ends. The server is returned for tests that move its clock.
+func Redis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	previous := initializers.RedisClient
+	initializers.RedisClient = client
+	t.Cleanup(func() {
+		initializers.RedisClient = previous
+		client.Close()
+	})
+	return server
+}
@@ -0,0 +1,155 @@
+package twofactor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// ChallengeTTL is how long a sign in waits for the second factor.
+	ChallengeTTL = 5 * time.Minute
+	// MaxAttempts is how many wrong codes end a challenge.
+	MaxAttempts = 5
+)
+
+var (
+	ErrChallengeExpired = errors.New("sign in challenge expired")
+	ErrTooManyAttempts  = errors.New("too many wrong codes")
+)
+
+// Challenge is a sign in that passed the password check and waits for the
+// second factor.
+type Challenge struct {
+	Token   string
+	UserID  string
+	Session string // the websocket session given at sign in
+}
+
+func challengeKey(token string) string { return "2fa_challenge:" + token }
+
+// NewChallenge opens a challenge for a user that signed in with a password.
+func NewChallenge(ctx context.Context, userID, session string) (*Challenge, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	ch := &Challenge{Token: hex.EncodeToString(b), UserID: userID, Session: session}
+
+	rdb := initializers.RedisClient
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, challengeKey(ch.Token), "user_id", ch.UserID, "session", ch.Session, "attempts", 0)
+		pipe.Expire(ctx, challengeKey(ch.Token), ChallengeTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// GetChallenge loads an open challenge.
+func GetChallenge(ctx context.Context, token string) (*Challenge, error) {
+	fields, err := initializers.RedisClient.HGetAll(ctx, challengeKey(token)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || fields["user_id"] == "" {
+		return nil, ErrChallengeExpired
+	}
+	return &Challenge{Token: token, UserID: fields["user_id"], Session: fields["session"]}, nil
+}
+
+// failScript counts a wrong code of a challenge that still exists, so an
+// expired one is not brought back without a TTL. It returns -1 when the
+// challenge is gone.
+var failScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+return redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+`)
+
+// setScript sets a field of a challenge that still exists and returns 0
+// when the challenge is gone.
+var setScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// Fail counts a wrong code and closes the challenge after MaxAttempts.
+func Fail(ctx context.Context, token string) error {
+	rdb := initializers.RedisClient
+	attempts, err := failScript.Run(ctx, rdb, []string{challengeKey(token)}).Int64()
+	if err != nil {
+		return err
+	}
+	if attempts < 0 {
+		return ErrChallengeExpired
+	}
+	if attempts >= MaxAttempts {
+		rdb.Del(ctx, challengeKey(token))
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// Close ends a challenge once the second factor was accepted, so its token
+// cannot be used again.
+func Close(ctx context.Context, token string) (bool, error) {
+	n, err := initializers.RedisClient.Del(ctx, challengeKey(token)).Result()
+	return n == 1, err
+}
+
+// NewTelegramCode creates a one time code for a challenge, to be sent by the
+// Telegram bot. A new code replaces the previous one.
+func NewTelegramCode(ctx context.Context, token string) (string, error) {
+	if _, err := GetChallenge(ctx, token); err != nil {
+		return "", err
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	set, err := setScript.Run(ctx, initializers.RedisClient, []string{challengeKey(token)}, "telegram", hashTelegramCode(token, code)).Int64()
+	if err != nil {
+		return "", err
+	}
+	if set == 0 {
+		return "", ErrChallengeExpired
+	}
+	return code, nil
+}
+
+// CheckTelegramCode compares a code with the one sent for the challenge.
+func CheckTelegramCode(ctx context.Context, token, code string) (bool, error) {
+	hash, err := initializers.RedisClient.HGet(ctx, challengeKey(token), "telegram").Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashTelegramCode(token, code))) == 1, nil
+}
+
+func hashTelegramCode(token, code string) string {
+	sum := sha256.Sum256([]byte(token + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
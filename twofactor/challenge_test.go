@@ -0,0 +1,57 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"hyperpage/testdb"
+)
+
+func TestExpiredChallengeStaysGone(t *testing.T) {
+	server := testdb.Redis(t)
+	ctx := context.Background()
+
+	ch, err := NewChallenge(ctx, "user", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Fail(ctx, ch.Token); err != nil {
+		t.Fatalf("first wrong code: %v", err)
+	}
+	if ttl := server.TTL(challengeKey(ch.Token)); ttl <= 0 || ttl > ChallengeTTL {
+		t.Fatalf("challenge TTL = %v after a wrong code", ttl)
+	}
+
+	server.FastForward(ChallengeTTL)
+	if err := Fail(ctx, ch.Token); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("wrong code after expiry = %v, want ErrChallengeExpired", err)
+	}
+	if _, err := NewTelegramCode(ctx, ch.Token); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("telegram code after expiry = %v, want ErrChallengeExpired", err)
+	}
+	if server.Exists(challengeKey(ch.Token)) {
+		t.Fatal("the expired challenge was written again")
+	}
+}
+
+func TestFailClosesChallengeAfterMaxAttempts(t *testing.T) {
+	testdb.Redis(t)
+	ctx := context.Background()
+
+	ch, err := NewChallenge(ctx, "user", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < MaxAttempts; i++ {
+		if err := Fail(ctx, ch.Token); err != nil {
+			t.Fatalf("wrong code %d: %v", i, err)
+		}
+	}
+	if err := Fail(ctx, ch.Token); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("wrong code %d = %v, want ErrTooManyAttempts", MaxAttempts, err)
+	}
+	if _, err := GetChallenge(ctx, ch.Token); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("challenge after too many codes: %v", err)
+	}
+}
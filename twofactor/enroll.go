@@ -0,0 +1,127 @@
+package twofactor
+
+import (
+	"errors"
+	"time"
+
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotEnrolled    = errors.New("two-factor authentication is not set up")
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrInvalidCode    = errors.New("invalid two-factor code")
+)
+
+// Enabled reports whether the user confirmed a TOTP enrollment.
+func Enabled(db *gorm.DB, userID uuid.UUID) (bool, error) {
+	var n int64
+	err := db.Model(&models.TwoFactor{}).Where("user_id = ? AND enabled", userID).Count(&n).Error
+	return n > 0, err
+}
+
+// Setup starts an enrollment with a new secret, replacing an unconfirmed
+// one. The secret is only used once Enable confirms a code from it.
+func Setup(db *gorm.DB, userID uuid.UUID) (string, error) {
+	secret, err := NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var tf models.TwoFactor
+		err := tx.Where("user_id = ?", userID).First(&tf).Error
+		if err == nil && tf.Enabled {
+			return ErrAlreadyEnabled
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Save(&models.TwoFactor{UserID: userID, Secret: secret, CreatedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Enable confirms an enrollment with a first code and returns the recovery
+// codes of the user.
+func Enable(db *gorm.DB, userID uuid.UUID, code string, now time.Time) ([]string, error) {
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var tf models.TwoFactor
+		err := tx.Where("user_id = ?", userID).First(&tf).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if tf.Enabled {
+			return ErrAlreadyEnabled
+		}
+
+		step, ok := Validate(tf.Secret, code, now, 0)
+		if !ok {
+			return ErrInvalidCode
+		}
+		err = tx.Model(&tf).Updates(map[string]interface{}{
+			"enabled":    true,
+			"last_step":  step,
+			"enabled_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		codes, err = NewRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP code of an enabled user. A code is accepted once.
+func Verify(db *gorm.DB, userID uuid.UUID, code string, now time.Time) error {
+	var tf models.TwoFactor
+	err := db.Where("user_id = ? AND enabled", userID).First(&tf).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+
+	step, ok := Validate(tf.Secret, code, now, tf.LastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// Two requests racing with the same code: only one moves the step
+	res := db.Model(&models.TwoFactor{}).
+		Where("user_id = ? AND last_step < ?", userID, step).
+		Update("last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable removes the enrollment and the recovery codes.
+func Disable(db *gorm.DB, userID uuid.UUID) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.TwoFactor{}).Error
+	})
+}
@@ -11,7 +11,6 @@ import (
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	uuid "github.com/satori/go.uuid"
 )
 
 func MoveToArch(bot *tgbotapi.BotAPI) {
@@ -144,38 +143,6 @@ func CheckExpiration(bot *tgbotapi.BotAPI) {
 	}
 }
 
-func CheckPlan(bot *tgbotapi.BotAPI) {
-	var users []models.User
-
-	// Retrieve all users
-	initializers.DB.Find(&users)
-
-	var userIds []uuid.UUID
-	for _, user := range users {
-		// Check if expired_plan_at is not null and less than the current time
-		if user.ExpiredPlanAt != nil && user.ExpiredPlanAt.Before(time.Now()) {
-			userIds = append(userIds, user.ID)
-
-			// Update plan, signed, expired_plan_at, and limit_storage columns
-			err := initializers.DB.Model(&models.User{}).
-				Where("id = ?", user.ID).
-				Updates(map[string]interface{}{
-					"plan":            "standart",
-					"signed":          false,
-					"expired_plan_at": nil,
-					"limit_storage":   20,
-				}).Error
-			if err != nil {
-				// Handle error if necessary
-				// ...
-			}
-		}
-	}
-
-	// Further processing or notifications
-	// ...
-}
-
 func CheckSite(bot *tgbotapi.BotAPI) {
 	configPath := "./app.env"
 	config, _ := initializers.LoadConfig(configPath)
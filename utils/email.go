@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -21,6 +22,7 @@ type EmailData struct {
 	URL       string
 	FirstName string
 	Subject   string
+	Email     string // an address the message is about, not the recipient
 }
 
 type ReqCat struct {
@@ -49,6 +51,23 @@ type ComplainPost struct {
 	Subject string
 }
 
+// Attachment is a file sent along with an email.
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+type StatementEmail struct {
+	Subject     string
+	Name        string
+	Period      string
+	Opening     string
+	Credits     string
+	Debits      string
+	Closing     string
+	Attachments []Attachment
+}
+
 type ContactUs struct {
 	Subject    string
 	Name       string
@@ -110,6 +129,8 @@ func SendEmail(user *models.User, data interface{}, emailTemplatePrefix string,
 		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
 	case *ContactUs:
 		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *StatementEmail:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
 	default:
 		log.Fatal("Unsupported email data type")
 	}
@@ -138,6 +159,15 @@ func SendEmail(user *models.User, data interface{}, emailTemplatePrefix string,
 		m.SetHeader("Subject", data.Subject)
 	case *ContactUs:
 		m.SetHeader("Subject", data.Subject)
+	case *StatementEmail:
+		m.SetHeader("Subject", data.Subject)
+		for _, a := range data.Attachments {
+			content := a.Data
+			m.Attach(a.Name, gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(content)
+				return err
+			}))
+		}
 	default:
 		log.Println("Unsupported email data type")
 	}
@@ -151,7 +181,7 @@ func SendEmail(user *models.User, data interface{}, emailTemplatePrefix string,
 
 	// Send Email
 	if err := d.DialAndSend(m); err != nil {
-		log.Fatal("Could not send email: ", err)
+		log.Println("Could not send email: ", err)
 	}
 
 }
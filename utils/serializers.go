@@ -49,12 +49,20 @@ func SerializeChatRoomMember(member models.ChatRoomMember) map[string]interface{
 		"is_subscribed": member.IsSubscribed,
 		"is_new":        member.IsNew,
 		"joined_at":     member.JoinedAt,
+		"role":          member.Role,
+		"last_read_id":  member.LastReadMessageID,
 	}
 }
 
 func SerializeChatRoom(roomID uint64) map[string]interface{} {
+	return SerializeChatRoomTx(initializers.DB, roomID)
+}
+
+// SerializeChatRoomTx is SerializeChatRoom reading the room in the caller's
+// database transaction, so a change not yet committed is seen.
+func SerializeChatRoomTx(tx *gorm.DB, roomID uint64) map[string]interface{} {
 	var room models.ChatRoom
-	err := initializers.DB.Preload("Members.User").Preload("LastMessage").First(&room, roomID).Error
+	err := tx.Preload("Members.User").Preload("LastMessage").First(&room, roomID).Error
 	if err != nil {
 		return nil
 	}
@@ -66,6 +74,11 @@ func SerializeChatRoom(roomID uint64) map[string]interface{} {
 		"created_at":   room.CreatedAt,
 		"bumped_at":    room.BumpedAt,
 		"member_count": len(room.Members),
+		"is_group":     room.IsGroup,
+		"title":        room.Title,
+		"avatar":       room.Avatar,
+		"owner_id":     room.OwnerID,
+		"max_members":  room.MaxMembers,
 	}
 
 	if room.LastMessage != nil {
@@ -111,6 +124,21 @@ func SerializeChatMessage(message models.ChatMessage) map[string]interface{} {
 		"jsonData":      message.JsonData,
 		"msgType":       message.MsgType,
 		"parentMsg":     SerializeParentMessage(parentMessage),
+		"attachments":   SerializeChatAttachments(message),
+		"forwardedFrom": serializeForward(message),
+		"pinnedAt":      message.PinnedAt,
+		"pinnedBy":      message.PinnedBy,
+	}
+}
+
+// serializeForward points a forwarded message to the original and its author.
+func serializeForward(message models.ChatMessage) map[string]interface{} {
+	if message.ForwardedFromID == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":      *message.ForwardedFromID,
+		"user_id": message.ForwardedFromUserID,
 	}
 }
 
@@ -136,6 +164,29 @@ func SerializeParentMessage(message models.ChatMessage) map[string]interface{} {
 	}
 }
 
+// SerializeChatAttachments lists the attachments loaded with a message;
+// deleted messages have none. Files are fetched by ID.
+func SerializeChatAttachments(message models.ChatMessage) []map[string]interface{} {
+	attachments := make([]map[string]interface{}, 0, len(message.Attachments))
+	if message.IsDeleted {
+		return attachments
+	}
+	for _, attachment := range message.Attachments {
+		attachments = append(attachments, map[string]interface{}{
+			"id":            attachment.ID,
+			"kind":          attachment.Kind,
+			"name":          attachment.Name,
+			"mime_type":     attachment.MimeType,
+			"size":          attachment.Size,
+			"width":         attachment.Width,
+			"height":        attachment.Height,
+			"duration":      attachment.Duration,
+			"has_thumbnail": attachment.Thumbnail != "",
+		})
+	}
+	return attachments
+}
+
 func SerializeCity(city models.City) map[string]interface{} {
 	var translations []map[string]interface{}
 	for _, t := range city.Translations {
@@ -1,10 +1,12 @@
 package utils
 
 import (
-	"encoding/base64"
+	"crypto/rsa"
 	"fmt"
 	"time"
 
+	"hyperpage/signing"
+
 	"github.com/golang-jwt/jwt/v4"
 	uuid "github.com/satori/go.uuid"
 )
@@ -16,7 +18,9 @@ type TokenDetails struct {
 	ExpiresIn *int64
 }
 
-func CreateToken(userid string, ttl time.Duration, privateKey string) (*TokenDetails, error) {
+// CreateToken signs a token with the active key of a use, named in the kid
+// header.
+func CreateToken(userid string, ttl time.Duration, use string) (*TokenDetails, error) {
 	now := time.Now().UTC()
 	td := &TokenDetails{
 		ExpiresIn: new(int64),
@@ -26,14 +30,9 @@ func CreateToken(userid string, ttl time.Duration, privateKey string) (*TokenDet
 	td.TokenUuid = uuid.NewV4().String()
 	td.UserID = userid
 
-	decodedPrivateKey, err := base64.StdEncoding.DecodeString(privateKey)
+	key, err := signing.Signer(use)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode token private key: %w", err)
-	}
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(decodedPrivateKey)
-
-	if err != nil {
-		return nil, fmt.Errorf("create: parse token private key: %w", err)
+		return nil, fmt.Errorf("create: %w", err)
 	}
 
 	atClaims := make(jwt.MapClaims)
@@ -43,7 +42,9 @@ func CreateToken(userid string, ttl time.Duration, privateKey string) (*TokenDet
 	atClaims["iat"] = now.Unix()
 	atClaims["nbf"] = now.Unix()
 
-	*td.Token, err = jwt.NewWithClaims(jwt.SigningMethodRS256, atClaims).SignedString(key)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, atClaims)
+	token.Header["kid"] = key.KID
+	*td.Token, err = token.SignedString(key.Private)
 	if err != nil {
 		return nil, fmt.Errorf("create: sign token: %w", err)
 	}
@@ -51,24 +52,37 @@ func CreateToken(userid string, ttl time.Duration, privateKey string) (*TokenDet
 	return td, nil
 }
 
-func ValidateToken(token string, publicKey string) (*TokenDetails, error) {
-	decodedPublicKey, err := base64.StdEncoding.DecodeString(publicKey)
-	if err != nil {
-		return nil, fmt.Errorf("could not decode: %w", err)
+// ValidateToken checks a token of a use with the key its kid names. Tokens
+// from before key IDs are tried with every key of the use.
+func ValidateToken(token string, use string) (*TokenDetails, error) {
+	var keys []*rsa.PublicKey
+	kid := ""
+	if unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{}); err == nil {
+		kid, _ = unverified.Header["kid"].(string)
 	}
-
-	key, err := jwt.ParseRSAPublicKeyFromPEM(decodedPublicKey)
-
-	if err != nil {
-		return nil, fmt.Errorf("validate: parse key: %w", err)
+	if kid != "" {
+		key, err := signing.Verifier(use, kid)
+		if err != nil {
+			return nil, fmt.Errorf("validate: %w", err)
+		}
+		keys = append(keys, key)
+	} else {
+		keys = signing.Verifiers(use)
 	}
 
-	parsedToken, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected method: %s", t.Header["alg"])
+	var parsedToken *jwt.Token
+	err := signing.ErrNoKey
+	for _, key := range keys {
+		parsedToken, err = jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected method: %s", t.Header["alg"])
+			}
+			return key, nil
+		})
+		if err == nil {
+			break
 		}
-		return key, nil
-	})
+	}
 
 	if err != nil {
 		return nil, fmt.Errorf("validate: %w", err)